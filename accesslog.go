@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessLogSample logs 1 in N successful requests, errors and retried
+// requests are always logged
+var accessLogSample = envInt("ACCESS_LOG_SAMPLE", 1)
+
+// accessLogRate caps the successful requests logged per second, 0 disables it
+var accessLogRate = envInt("ACCESS_LOG_RATE", 0)
+
+// logSampler picks the successful requests making it to the access log
+type logSampler struct {
+	mux    sync.Mutex
+	every  int
+	rate   int
+	seen   int
+	second time.Time
+	logged int
+}
+
+var accessSampler = &logSampler{every: accessLogSample, rate: accessLogRate}
+
+// Sample returns true when the next successful request should be logged
+func (s *logSampler) Sample(now time.Time) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.seen++
+	if s.every > 1 && s.seen%s.every != 0 {
+		return false
+	}
+	if s.rate <= 0 {
+		return true
+	}
+	if second := now.Truncate(time.Second); !second.Equal(s.second) {
+		s.second, s.logged = second, 0
+	}
+	if s.logged >= s.rate {
+		return false
+	}
+	s.logged++
+	return true
+}
+
+// accessWriter remembers what was answered to a request for the access log
+type accessWriter struct {
+	http.ResponseWriter
+	status  int
+	retried bool
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *accessWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to websockets, which answer on their own
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+// noteRetry flags the request behind w as retried, so it's always logged
+func noteRetry(w http.ResponseWriter) {
+	if aw, ok := w.(*accessWriter); ok {
+		aw.retried = true
+	}
+}
+
+// logAccess writes the access log line of a finished request
+func logAccess(w *accessWriter, r *http.Request, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < http.StatusBadRequest && !w.retried && !accessSampler.Sample(time.Now()) {
+		return
+	}
+	log.Printf("%s %s %s %d %s\n", r.RemoteAddr, r.Method, r.URL.RequestURI(), status, time.Since(start))
+}
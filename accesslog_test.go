@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSampler(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		every    int
+		rate     int
+		requests int
+		spacing  time.Duration // between requests
+		logged   int
+	}{
+		{"everything", 1, 0, 100, 0, 100},
+		{"unset", 0, 0, 100, 0, 100},
+		{"1 in 10", 10, 0, 100, 0, 10},
+		{"1 in 10 of a few", 10, 0, 9, 0, 0},
+		{"5 a second within a second", 1, 5, 100, time.Millisecond, 5},
+		{"5 a second over 10 seconds", 1, 5, 100, 100 * time.Millisecond, 50},
+		{"1 in 2 capped at 5 a second", 2, 5, 100, time.Millisecond, 5},
+		{"1 in 2 under the cap", 2, 5, 100, time.Second, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &logSampler{every: tt.every, rate: tt.rate}
+			logged := 0
+			for i := 0; i < tt.requests; i++ {
+				if s.Sample(start.Add(time.Duration(i) * tt.spacing)) {
+					logged++
+				}
+			}
+			if logged != tt.logged {
+				t.Fatalf("logged %d of %d, want %d", logged, tt.requests, tt.logged)
+			}
+		})
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer func(s *logSampler) { accessSampler = s }(accessSampler)
+	accessSampler = &logSampler{every: 10}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	const requests = 1000
+	for i := 0; i < requests; i++ {
+		lb(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/room", nil))
+		lb(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+	}
+	ok := strings.Count(out.String(), "POST /room 200 ")
+	if ok < requests/10-requests/50 || ok > requests/10+requests/50 {
+		t.Errorf("logged %d of %d successful requests, want about a tenth", ok, requests)
+	}
+	if failed := strings.Count(out.String(), "GET /nowhere 404 "); failed != requests {
+		t.Errorf("logged %d of %d failed requests, want all", failed, requests)
+	}
+}
+
+func TestAccessLogKeepsRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = server.Serve(&resettingListener{Listener: l, resets: 1}) }()
+	defer server.Close()
+	defer setPool(t, l.Addr().String())()
+	defer func(s *logSampler) { accessSampler = s }(accessSampler)
+	// nothing successful would be logged without the retry
+	accessSampler = &logSampler{every: 1 << 30}
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	w := httptest.NewRecorder()
+	lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	if n := strings.Count(out.String(), "POST /room 200 "); n != 1 {
+		t.Fatalf("retried request logged %d times, want once:\n%s", n, out.String())
+	}
+	lb(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/room", nil))
+	if n := strings.Count(out.String(), "POST /room 200 "); n != 1 {
+		t.Fatalf("request without retries logged, want it sampled out:\n%s", out.String())
+	}
+}
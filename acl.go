@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// ipAllowlistFile lists the only networks allowed in, one per line, when set
+var ipAllowlistFile = os.Getenv("IP_ALLOWLIST_FILE")
+
+// ipBlocklistFile lists networks that are always turned away, one per line
+var ipBlocklistFile = os.Getenv("IP_BLOCKLIST_FILE")
+
+// accessList holds the client networks let in and turned away
+type accessList struct {
+	mux   sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+var acl accessList
+
+// Permits returns true when ip may use the balancer
+func (a *accessList) Permits(ip net.IP) bool {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if inNetworks(ip, a.deny) {
+		return false
+	}
+	return len(a.allow) == 0 || inNetworks(ip, a.allow)
+}
+
+// loadNetworksFile parses a file of networks, an empty name yields none
+func loadNetworksFile(name string) ([]*net.IPNet, error) {
+	if name == "" {
+		return nil, nil
+	}
+	items, err := readListFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseNetworks(items)
+}
+
+// loadACL (re)reads the allow and block lists, keeping the current ones on error
+func loadACL() error {
+	allow, err := loadNetworksFile(ipAllowlistFile)
+	if err != nil {
+		return err
+	}
+	deny, err := loadNetworksFile(ipBlocklistFile)
+	if err != nil {
+		return err
+	}
+	acl.mux.Lock()
+	acl.allow, acl.deny = allow, deny
+	acl.mux.Unlock()
+	log.Printf("Loaded access lists, %d allowed and %d blocked networks\n", len(allow), len(deny))
+	return nil
+}
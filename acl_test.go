@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setACL loads the access lists from files holding allow and deny, an empty
+// list leaves its file unset, returning how to put the previous lists back
+func setACL(t *testing.T, allow, deny string) (restore func()) {
+	t.Helper()
+	oldAllowFile, oldDenyFile := ipAllowlistFile, ipBlocklistFile
+	acl.mux.RLock()
+	oldAllow, oldDeny := acl.allow, acl.deny
+	acl.mux.RUnlock()
+	removeAllow, removeDeny := func() {}, func() {}
+	ipAllowlistFile, ipBlocklistFile = "", ""
+	if allow != "" {
+		ipAllowlistFile, removeAllow = writeTempFile(t, allow)
+	}
+	if deny != "" {
+		ipBlocklistFile, removeDeny = writeTempFile(t, deny)
+	}
+	if err := loadACL(); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		removeAllow()
+		removeDeny()
+		ipAllowlistFile, ipBlocklistFile = oldAllowFile, oldDenyFile
+		acl.mux.Lock()
+		acl.allow, acl.deny = oldAllow, oldDeny
+		acl.mux.Unlock()
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer func(trusted []*net.IPNet) { trustedProxies = trusted }(trustedProxies)
+	proxies, err := parseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	tests := []struct {
+		name   string
+		allow  string
+		deny   string
+		remote string
+		xff    string
+		code   int
+	}{
+		{"no lists", "", "", "203.0.113.5:1234", "", http.StatusOK},
+		{"blocked", "", "203.0.113.0/24\n", "203.0.113.5:1234", "", http.StatusForbidden},
+		{"not blocked", "", "203.0.113.0/24\n", "198.51.100.7:1234", "", http.StatusOK},
+		{"blocked single address", "", "# attacker\n198.51.100.7\n", "198.51.100.7:1234", "", http.StatusForbidden},
+		{"allowed", "198.51.100.0/24\n", "", "198.51.100.7:1234", "", http.StatusOK},
+		{"not allowed", "198.51.100.0/24\n", "", "203.0.113.5:1234", "", http.StatusForbidden},
+		{"allowed but blocked", "198.51.100.0/24\n", "198.51.100.7/32\n", "198.51.100.7:1234", "", http.StatusForbidden},
+		{"ipv6 blocked", "", "2001:db8::/32\n", "[2001:db8::1]:1234", "", http.StatusForbidden},
+		{"blocked behind a trusted proxy", "", "203.0.113.0/24\n", "10.0.0.2:1234", "203.0.113.5", http.StatusForbidden},
+		{"allowed behind a trusted proxy", "198.51.100.0/24\n", "", "10.0.0.2:1234", "198.51.100.7", http.StatusOK},
+		// only trusted proxies get to say who the client is
+		{"forged forwarding", "", "203.0.113.0/24\n", "203.0.113.5:1234", "198.51.100.7", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setACL(t, tt.allow, tt.deny)()
+			req := httptest.NewRequest(http.MethodPost, "/room", nil)
+			req.RemoteAddr = tt.remote
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			w := httptest.NewRecorder()
+			lb(w, req)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestReloadAccessLists(t *testing.T) {
+	defer setACL(t, "", "198.51.100.0/24\n")()
+	attacker := net.ParseIP("203.0.113.5")
+	if !acl.Permits(attacker) {
+		t.Fatal("blocked before being listed")
+	}
+	if err := ioutil.WriteFile(ipBlocklistFile, []byte("198.51.100.0/24\n203.0.113.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadACL(); err != nil {
+		t.Fatal(err)
+	}
+	if acl.Permits(attacker) {
+		t.Fatal("still let in after the reload")
+	}
+	// a broken list keeps the current ones
+	if err := ioutil.WriteFile(ipBlocklistFile, []byte("not-a-network\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadACL(); err == nil {
+		t.Fatal("loaded an invalid list")
+	}
+	if acl.Permits(attacker) {
+		t.Fatal("a failed reload dropped the block list")
+	}
+}
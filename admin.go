@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// backendStatus is the status endpoint view of a backend
+type backendStatus struct {
+	ID          string       `json:"id"`
+	Pool        string       `json:"pool,omitempty"`
+	Zone        string       `json:"zone,omitempty"`
+	Weight      int          `json:"weight"`
+	URL         string       `json:"url"`
+	Alive       bool         `json:"alive"`
+	WSAlive     bool         `json:"ws_alive"`
+	Ready       bool         `json:"ready"`
+	Cordoned    bool         `json:"cordoned"`
+	Draining    bool         `json:"draining"`
+	Quarantined bool         `json:"quarantined"`
+	Degraded    bool         `json:"degraded"`
+	Inflight    int64        `json:"inflight"`
+	Connections int64        `json:"connections"`
+	RoomLoad    int64        `json:"room_load"`
+	Capacity    int64        `json:"capacity,omitempty"`
+	Usage       backendUsage `json:"usage"`
+}
+
+// newBackendStatus snapshots the state of b
+func newBackendStatus(b *Backend) backendStatus {
+	return backendStatus{
+		ID:          b.ID,
+		Pool:        b.Pool,
+		Zone:        b.GetZone(),
+		Weight:      b.GetWeight(),
+		URL:         b.URL.String(),
+		Alive:       b.IsAlive(),
+		WSAlive:     b.IsWSAlive(),
+		Ready:       b.IsReady(),
+		Cordoned:    b.IsCordoned(),
+		Draining:    b.IsDraining(),
+		Quarantined: b.IsQuarantined(),
+		Degraded:    b.IsDegraded(),
+		Inflight:    b.Inflight(),
+		Connections: b.ActiveConns(),
+		RoomLoad:    b.roomLoad.Sum(),
+		Capacity:    b.Capacity(),
+		Usage:       b.usage.snapshot(),
+	}
+}
+
+// adminAddr is where the admin listener binds, keep it off public interfaces
+var adminAddr = envString("ADMIN_ADDR", "localhost:3031")
+
+// adminMux routes the endpoints served on the admin listener
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/", adminHandler)
+	mux.HandleFunc("/ready", readyHandler)
+	if metricsEnabled {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
+	return mux
+}
+
+// readyHandler reports ready while at least one backend is alive
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	for _, b := range serverPool.Backends() {
+		if b.IsAlive() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	http.Error(w, "No backend available", http.StatusServiceUnavailable)
+}
+
+// adminHandler serves the operator endpoints under /admin/
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/admin")
+	switch {
+	case path == "/status":
+		statusHandler(w, r)
+	case path == "/health/summary":
+		healthSummaryHandler(w, r)
+	case path == "/drain":
+		drainBackendsHandler(w, r)
+	case path == "/drain/stream":
+		drainStreamHandler(w, r)
+	case path == "/split":
+		splitHandler(w, r)
+	case path == "/chaos" || strings.HasPrefix(path, "/chaos/"):
+		chaosHandler(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "/chaos"), "/"))
+	case path == "/pins" || strings.HasPrefix(path, "/pins/"):
+		pinsHandler(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "/pins"), "/"))
+	case path == "/scale-in" || strings.HasPrefix(path, "/scale-in/"):
+		scaleInHandler(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "/scale-in"), "/"))
+	case path == "/failures":
+		failuresHandler(w, r)
+	case path == "/route":
+		routeHandler(w, r)
+	case path == "/simulate":
+		simulateHandler(w, r)
+	case path == "/rebalance/plan":
+		rebalancePlanHandler(w, r)
+	case strings.HasPrefix(path, "/backends/"):
+		backendHandler(w, r, strings.TrimPrefix(path, "/backends/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// statusHandler reports the state of every backend in the pool
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, poolStatus(serverPool.Backends()))
+}
+
+// poolStatus snapshots every backend and the requests in flight
+func poolStatus(backends []*Backend) map[string]interface{} {
+	return map[string]interface{}{
+		"backends": backendStatuses(backends),
+		"inflight": atomic.LoadInt64(&inflight),
+	}
+}
+
+// backendStatuses snapshots every backend of a pool
+func backendStatuses(backends []*Backend) []backendStatus {
+	statuses := make([]backendStatus, 0, len(backends))
+	for _, b := range backends {
+		statuses = append(statuses, newBackendStatus(b))
+	}
+	return statuses
+}
+
+// healthSummary aggregates the state of the pool for monitors
+type healthSummary struct {
+	Backends    int   `json:"backends"`
+	Alive       int   `json:"alive"`
+	Draining    int   `json:"draining"`
+	Quarantined int   `json:"quarantined"`
+	Degraded    int   `json:"degraded"`
+	Inflight    int64 `json:"inflight"`
+	Connections int64 `json:"connections"`
+	// share of the in-flight capacity in use, only known when it's capped
+	Utilization *float64 `json:"utilization_percent"`
+}
+
+// newHealthSummary counts the backends by state and what they're serving
+func newHealthSummary(backends []*Backend) healthSummary {
+	summary := healthSummary{Backends: len(backends), Inflight: atomic.LoadInt64(&inflight)}
+	for _, b := range backends {
+		if b.IsAlive() {
+			summary.Alive++
+		}
+		if b.IsDraining() {
+			summary.Draining++
+		}
+		if b.IsQuarantined() {
+			summary.Quarantined++
+		}
+		if b.IsDegraded() {
+			summary.Degraded++
+		}
+		summary.Connections += b.ActiveConns()
+	}
+	capacity := int64(maxInflight)
+	if capacity <= 0 {
+		capacity = int64(maxInflightPerBackend) * int64(summary.Alive)
+	}
+	if capacity > 0 {
+		utilization := float64(summary.Inflight) * 100 / float64(capacity)
+		summary.Utilization = &utilization
+	} else if maxInflightPerBackend > 0 {
+		// every backend is down, nothing can be served
+		utilization := 100.0
+		summary.Utilization = &utilization
+	}
+	return summary
+}
+
+// healthSummaryHandler reports aggregate numbers about the pool, cheap
+// enough to be polled by monitors
+func healthSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, newHealthSummary(serverPool.Backends()))
+}
+
+// routeHandler reports where a room id or path would be routed, e.g.
+// /admin/route?roomId=12345, without registering the room or proxying anything
+func routeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if roomId := r.URL.Query().Get("roomId"); roomId != "" {
+		var err error
+		if path, err = roomPath("room", roomId); err != nil {
+			http.Error(w, err.Error()+", pass the path instead", http.StatusBadRequest)
+			return
+		}
+	}
+	if path == "" {
+		http.Error(w, "roomId or path is required", http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// headers such as the shard key or websocket upgrade steer routing too
+	req.Header = r.Header.Clone()
+	req = withDryRun(req)
+	decision, routeErr := route(req)
+	result := map[string]interface{}{
+		"path":   req.URL.RequestURI(),
+		"class":  decision.Class,
+		"branch": decision.Branch,
+	}
+	if b := decision.Backend; b != nil {
+		result["backend"] = newBackendStatus(b)
+	}
+	if routeErr != nil {
+		result["error"] = routeErr.Error()
+		result["code"] = routeErr.Code
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// withDryRun marks req so routing it has no side effects
+func withDryRun(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), DryRun, true))
+}
+
+// rebalancePlanHandler suggests room moves that would even out the pool, without moving anything
+func rebalancePlanHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, planRebalance(serverPool.Backends(), serverPool.rooms.Rooms()))
+}
+
+// backendHandler applies an action to a single backend, e.g. {id}/cordon
+func backendHandler(w http.ResponseWriter, r *http.Request, rest string) {
+	parts := strings.Split(rest, "/")
+	if len(parts) == 1 {
+		updateBackendHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b := serverPool.GetBackend(parts[0])
+	if b == nil {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+	switch parts[1] {
+	case "cordon":
+		b.SetCordoned(true)
+	case "uncordon":
+		b.SetCordoned(false)
+	case "drain":
+		// removal waits for the backend, so it goes on in the background
+		// once the backends queued before it are done
+		drains.Queue(b)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("%s [%s]\n", b.URL, parts[1])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateBackendHandler changes the weight and zone of a backend on PATCH
+// /admin/backends/{id}, e.g. {"weight":3,"zone":"eu-west-1b"}, taking effect
+// on the next selection
+func updateBackendHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var update struct {
+		Weight *int    `json:"weight"`
+		Zone   *string `json:"zone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Weight != nil && *update.Weight < 1 {
+		http.Error(w, "weight must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	b := serverPool.UpdateBackend(id, update.Weight, update.Zone)
+	if b == nil {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("[%s] updated, weight %d, zone %q\n", b.ID, b.GetWeight(), b.GetZone())
+	writeJSON(w, http.StatusOK, newBackendStatus(b))
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to encode response: ", err)
+	}
+}
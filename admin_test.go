@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// setPool fills serverPool with backends built from specs and an empty room
+// registry, returning how to put the previous ones back
+func setPool(t testing.TB, specs ...string) (restore func()) {
+	t.Helper()
+	backends := make([]*Backend, 0, len(specs))
+	for _, spec := range specs {
+		b, err := buildBackend(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, b)
+	}
+	serverPool.mux.Lock()
+	old := serverPool.backends
+	serverPool.setBackends(backends)
+	serverPool.mux.Unlock()
+	serverPool.rooms.mux.Lock()
+	oldRooms := serverPool.rooms.rooms
+	serverPool.rooms.rooms = nil
+	serverPool.rooms.mux.Unlock()
+	return func() {
+		serverPool.mux.Lock()
+		serverPool.setBackends(old)
+		serverPool.mux.Unlock()
+		serverPool.rooms.mux.Lock()
+		serverPool.rooms.rooms = oldRooms
+		serverPool.rooms.mux.Unlock()
+	}
+}
+
+func TestRouteHandlerMatchesRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		source string
+		roomId string
+	}{
+		{"room", "", defaultRoomIdSource, "42"},
+		{"room under prefix", "/api", defaultRoomIdSource, "42"},
+		{"deeper segment", "/api/v1", "segment:3", "7"},
+		{"query", "/api", "query:room", "1234"},
+	}
+	defer setPool(t, "localhost:9101", "localhost:9102", "localhost:9103")()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoomRoutes(t, tt.prefix, RoomIdInt, tt.source)()
+			w := httptest.NewRecorder()
+			routeHandler(w, httptest.NewRequest(http.MethodGet, "/admin/route?roomId="+url.QueryEscape(tt.roomId), nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body.String())
+			}
+			var got struct {
+				Path    string `json:"path"`
+				Class   string `json:"class"`
+				Branch  string `json:"branch"`
+				Backend struct {
+					ID string `json:"id"`
+				} `json:"backend"`
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Error != "" {
+				t.Fatalf("routing %s failed: %s", got.Path, got.Error)
+			}
+			req := httptest.NewRequest(http.MethodGet, got.Path, nil)
+			if id := extractRoomId(req); id != tt.roomId {
+				t.Fatalf("room id of %s = %q, want %q", got.Path, id, tt.roomId)
+			}
+			want, err := route(withDryRun(req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Class != want.Class || got.Branch != want.Branch || got.Backend.ID != want.Backend.ID {
+				t.Fatalf("endpoint routed %s to %s/%s/%s, route() to %s/%s/%s", got.Path,
+					got.Class, got.Branch, got.Backend.ID, want.Class, want.Branch, want.Backend.ID)
+			}
+			if got.Class != RouteAction {
+				t.Fatalf("class of %s = %q, want %q", got.Path, got.Class, RouteAction)
+			}
+		})
+	}
+}
+
+func TestRouteHandlerRejectsRegexSource(t *testing.T) {
+	defer setRoomRoutes(t, "", RoomIdInt, `regex:^/room/game-(\d+)`)()
+	w := httptest.NewRecorder()
+	routeHandler(w, httptest.NewRequest(http.MethodGet, "/admin/route?roomId=12", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCordonBackend(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		before   bool // whether a starts cordoned
+		code     int
+		cordoned bool // whether a ends up cordoned
+	}{
+		{"cordon", http.MethodPost, "/admin/backends/a/cordon", false, http.StatusNoContent, true},
+		{"uncordon", http.MethodPost, "/admin/backends/a/uncordon", true, http.StatusNoContent, false},
+		{"unknown backend", http.MethodPost, "/admin/backends/z/cordon", false, http.StatusNotFound, false},
+		{"unknown action", http.MethodPost, "/admin/backends/a/restart", true, http.StatusNotFound, true},
+		{"not a POST", http.MethodGet, "/admin/backends/a/cordon", false, http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b")()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			a := serverPool.GetBackend("a")
+			a.SetCordoned(tt.before)
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if a.IsCordoned() != tt.cordoned {
+				t.Fatalf("cordoned = %v, want %v", a.IsCordoned(), tt.cordoned)
+			}
+			for i := 0; i < 4; i++ {
+				if peer := serverPool.GetNextPeer(); tt.cordoned && peer == a {
+					t.Fatal("a new room landed on the cordoned backend")
+				}
+			}
+			// the rooms it already serves stay with it
+			d, err := route(withDryRun(httptest.NewRequest(http.MethodGet, "/room/1/state", nil)))
+			if err != nil || d.Backend != a {
+				t.Fatalf("room 1 routed to %q (%v), want a", idOf(d.Backend), err)
+			}
+		})
+	}
+}
+
+func TestAdminOnlyOnAdminListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer func(enabled bool, policy string) { metricsEnabled, unmatchedPolicy = enabled, policy }(metricsEnabled, unmatchedPolicy)
+	metricsEnabled = true
+	admin := httptest.NewServer(adminMux())
+	defer admin.Close()
+	public := httptest.NewServer(http.HandlerFunc(lb))
+	defer public.Close()
+	get := func(base, path string) (int, string) {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for _, path := range []string{"/admin/status", "/admin/health/summary", "/admin/failures", "/ready", "/metrics"} {
+		for _, policy := range []string{UnmatchedStrict, UnmatchedPassThrough} {
+			t.Run(path+" "+policy, func(t *testing.T) {
+				unmatchedPolicy = policy
+				if code, body := get(admin.URL, path); code != http.StatusOK {
+					t.Fatalf("admin listener answered %s with %d: %s", path, code, body)
+				}
+				// the public listener only proxies, at most to a backend
+				code, body := get(public.URL, path)
+				if code == http.StatusOK && body != "backend "+path {
+					t.Fatalf("public listener served %s itself: %s", path, body)
+				}
+			})
+		}
+	}
+}
+
+func TestHealthSummary(t *testing.T) {
+	defer func(max, perBackend int) { maxInflight, maxInflightPerBackend = max, perBackend }(maxInflight, maxInflightPerBackend)
+	defer func(n int64) { atomic.StoreInt64(&inflight, n) }(atomic.LoadInt64(&inflight))
+	percent := func(p float64) *float64 { return &p }
+	tests := []struct {
+		name        string
+		down        []string
+		draining    []string
+		quarantined []string
+		degraded    []string
+		conns       int64 // on each backend
+		inflight    int64
+		max         int
+		perBackend  int
+		want        healthSummary
+	}{
+		{"all up", nil, nil, nil, nil, 0, 0, 0, 0,
+			healthSummary{Backends: 4, Alive: 4}},
+		{"a mix", []string{"c", "d"}, []string{"b"}, []string{"d"}, []string{"a"}, 3, 5, 0, 0,
+			healthSummary{Backends: 4, Alive: 2, Draining: 1, Quarantined: 1, Degraded: 1, Inflight: 5, Connections: 12}},
+		{"capped overall", []string{"d"}, nil, nil, nil, 0, 25, 100, 10,
+			healthSummary{Backends: 4, Alive: 3, Inflight: 25, Utilization: percent(25)}},
+		{"capped by backend", []string{"d"}, nil, nil, nil, 0, 15, 0, 10,
+			healthSummary{Backends: 4, Alive: 3, Inflight: 15, Utilization: percent(50)}},
+		{"capped by backend all down", []string{"a", "b", "c", "d"}, nil, nil, nil, 0, 0, 0, 10,
+			healthSummary{Backends: 4, Utilization: percent(100)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c", "localhost:9104?name=d")()
+			for _, id := range tt.down {
+				serverPool.GetBackend(id).SetAlive(false)
+			}
+			for _, id := range tt.draining {
+				serverPool.GetBackend(id).startDraining()
+			}
+			for _, id := range tt.quarantined {
+				b := serverPool.GetBackend(id)
+				b.mux.Lock()
+				b.quarantined = true
+				b.mux.Unlock()
+			}
+			for _, id := range tt.degraded {
+				b := serverPool.GetBackend(id)
+				b.mux.Lock()
+				b.degraded = true
+				b.mux.Unlock()
+			}
+			for _, b := range serverPool.Backends() {
+				atomic.AddInt64(&b.activeConns, tt.conns)
+			}
+			atomic.StoreInt64(&inflight, tt.inflight)
+			maxInflight, maxInflightPerBackend = tt.max, tt.perBackend
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(http.MethodGet, "/admin/health/summary", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			var got healthSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("summary %s, want %+v", w.Body.String(), tt.want)
+			}
+		})
+	}
+	w := httptest.NewRecorder()
+	adminHandler(w, httptest.NewRequest(http.MethodPost, "/admin/health/summary", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUpdateBackendHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		code   int
+		weight int    // weight of a afterwards
+		zone   string // zone of a afterwards
+		share  int    // picks out of 100 landing on a afterwards
+	}{
+		{"raise the weight", "/admin/backends/a", `{"weight":3}`, http.StatusOK, 3, "eu-1", 50},
+		{"lower the weight", "/admin/backends/b", `{"weight":1}`, http.StatusOK, 1, "eu-1", 50},
+		{"move zone", "/admin/backends/a", `{"zone":"eu-2"}`, http.StatusOK, 1, "eu-2", 25},
+		{"both", "/admin/backends/a", `{"weight":9,"zone":"eu-2"}`, http.StatusOK, 9, "eu-2", 75},
+		{"zero weight", "/admin/backends/a", `{"weight":0}`, http.StatusBadRequest, 1, "eu-1", 25},
+		{"negative weight", "/admin/backends/a", `{"weight":-2}`, http.StatusBadRequest, 1, "eu-1", 25},
+		{"not json", "/admin/backends/a", `weight=3`, http.StatusBadRequest, 1, "eu-1", 25},
+		{"unknown backend", "/admin/backends/z", `{"weight":3}`, http.StatusNotFound, 1, "eu-1", 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a&zone=eu-1", "localhost:9102?name=b&zone=eu-1&weight=3")()
+			// warm the rotation up so the change lands mid-cycle
+			for i := 0; i < 5; i++ {
+				serverPool.GetWeightedPeer()
+			}
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			a := serverPool.GetBackend("a")
+			if a.GetWeight() != tt.weight || a.GetZone() != tt.zone {
+				t.Fatalf("a has weight %d zone %q, want %d %q", a.GetWeight(), a.GetZone(), tt.weight, tt.zone)
+			}
+			// the next selections follow the new weights
+			picks := 0
+			for i := 0; i < 400; i++ {
+				if serverPool.GetWeightedPeer() == a {
+					picks++
+				}
+			}
+			if share := picks / 4; share < tt.share-1 || share > tt.share+1 {
+				t.Fatalf("a got %d of 100 picks, want %d", share, tt.share)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clientAffinityTTL keeps sending a client's new rooms to the backend of its
+// first one for that long, then the strategy picks again so load rebalances.
+// 0 disables it, ip-hash is sticky on its own.
+var clientAffinityTTL = envDuration("CLIENT_AFFINITY_TTL", 0)
+
+// ClientAffinity remembers the backend new rooms of each client address went
+// to, until the affinity expires
+type ClientAffinity struct {
+	mux     sync.RWMutex
+	clients map[string]*affinityEntry
+}
+
+type affinityEntry struct {
+	backend *Backend
+	expires time.Time
+}
+
+var clientAffinity ClientAffinity
+
+// Lookup returns the backend a client is sticky to, nil when it isn't or the
+// affinity expired
+func (a *ClientAffinity) Lookup(client string) *Backend {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	entry, ok := a.clients[client]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.backend
+}
+
+// Record makes a client sticky to a backend for clientAffinityTTL. The
+// expiry isn't pushed back by later rooms, so busy clients rebalance too.
+func (a *ClientAffinity) Record(client string, b *Backend) {
+	a.mux.Lock()
+	if a.clients == nil {
+		a.clients = make(map[string]*affinityEntry)
+	}
+	a.clients[client] = &affinityEntry{backend: b, expires: time.Now().Add(clientAffinityTTL)}
+	a.mux.Unlock()
+}
+
+// Forget drops every client sticky to b
+func (a *ClientAffinity) Forget(b *Backend) {
+	a.mux.Lock()
+	for client, entry := range a.clients {
+		if entry.backend == b {
+			delete(a.clients, client)
+		}
+	}
+	a.mux.Unlock()
+}
+
+// Expire drops the expired affinities
+func (a *ClientAffinity) Expire() {
+	now := time.Now()
+	a.mux.Lock()
+	for client, entry := range a.clients {
+		if now.After(entry.expires) {
+			delete(a.clients, client)
+		}
+	}
+	a.mux.Unlock()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetAffinity forgets every client affinity
+func resetAffinity() {
+	clientAffinity.mux.Lock()
+	clientAffinity.clients = nil
+	clientAffinity.mux.Unlock()
+}
+
+func TestClientAffinity(t *testing.T) {
+	defer func(ttl time.Duration) { clientAffinityTTL = ttl }(clientAffinityTTL)
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		clients string // of each new room
+		wait    int    // new rooms before waiting for the affinity to expire, 0 never waits
+		down    int    // new rooms before a goes down, 0 never
+		peers   string // the new rooms go to
+	}{
+		{"disabled", 0, "1111", 0, 0, "abab"},
+		{"within the ttl", time.Minute, "1111", 0, 0, "aaaa"},
+		{"rebalanced after expiry", 30 * time.Millisecond, "1111", 2, 0, "aabb"},
+		{"clients apart", time.Minute, "1212", 0, 0, "abab"},
+		{"sticky backend down", time.Minute, "1111", 0, 2, "aabb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientAffinityTTL = tt.ttl
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b")()
+			resetAffinity()
+			defer resetAffinity()
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			var peers []string
+			for i, client := range tt.clients {
+				if tt.wait > 0 && i == tt.wait {
+					time.Sleep(2 * tt.ttl)
+				}
+				if tt.down > 0 && i == tt.down {
+					serverPool.GetBackend("a").SetAlive(false)
+				}
+				r := httptest.NewRequest(http.MethodPost, "/room", nil)
+				r.RemoteAddr = "203.0.113." + string(client) + ":1234"
+				peers = append(peers, idOf(newRoomPeer(r)))
+			}
+			if got := strings.Join(peers, ""); got != tt.peers {
+				t.Fatalf("new rooms went to %s, want %s", got, tt.peers)
+			}
+		})
+	}
+}
+
+func TestClientAffinityExpire(t *testing.T) {
+	defer func(ttl time.Duration) { clientAffinityTTL = ttl }(clientAffinityTTL)
+	b, err := buildBackend("localhost:9101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var affinity ClientAffinity
+	clientAffinityTTL = time.Minute
+	affinity.Record("203.0.113.1", b)
+	clientAffinityTTL = time.Millisecond
+	affinity.Record("203.0.113.2", b)
+	time.Sleep(5 * time.Millisecond)
+	affinity.Expire()
+	if affinity.Lookup("203.0.113.1") != b {
+		t.Fatal("affinity within its ttl dropped")
+	}
+	if _, ok := affinity.clients["203.0.113.2"]; ok {
+		t.Fatal("expired affinity kept")
+	}
+	affinity.Forget(b)
+	if len(affinity.clients) != 0 {
+		t.Fatalf("%d affinities kept for a forgotten backend", len(affinity.clients))
+	}
+}
@@ -1,21 +1,208 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Backend holds the data about a server
 type Backend struct {
+	ID           string // stable identity, the configured name or host:port
+	Pool         string // named group for traffic splits, e.g. blue or green
+	Zone         string // availability zone, preferred when it's the balancer's
+	Weight       int    // share of new rooms with weighted-round-robin
 	URL          *url.URL
+	spec         string // as configured, host:port and options
 	Alive        bool
+	Cordoned     bool
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
+	CheckType    string
+	httpProbe    *httpProbe
+	transport    http.RoundTripper
+	warmConns    int
+	maxConns     int // see backendMaxConns
+	maxStreams   int // see backendMaxStreams
+	warming      bool
+	draining     bool
+	drainStarted chan struct{} // closed when the backend starts draining
+	readyPath    string        // polled while draining, see terminationReadyPath
+	inflight     int64
+	activeConns  int64
+	successes    int       // consecutive successful health probes
+	failures     int       // consecutive failed health probes
+	failureRate  float64   // moving average of failed proxied requests
+	quarantined  bool      // kept failing, re-checked with a back-off
+	degraded     bool      // health checks slower than healthLatencySLO
+	nextProbe    time.Time // when a quarantined backend is re-checked
+	// time between re-checks while quarantined, doubling on every failure
+	quarantineInterval time.Duration
+	added              time.Time // when the backend joined the pool
+	roomLoad           roomLoad  // cost of the rooms recently created on it
+	usage              backendUsage
+	pathRewrites       []pathRewrite
+	maintenance        *maintenanceSchedule
+	proxy              *url.URL // egress proxy the backend is reached through
+	tlsConfig          *tls.Config
+	healthClient       *http.Client
+	wsProbePath        string // upgraded by the websocket check, empty disables it
+	wsDown             bool   // failed its last websocket check
+	readinessPath      string // tells whether the backend takes new matches, see readinessCheckPath
+	notReady           bool   // said it takes no new matches on its last readiness check
+	preserveHost       bool   // forwards the client's Host, see preserveHost
+	capacity           int64  // room load it can take, 0 for unlimited, see capacityHeader
+	capacityPath       string // reports the capacity, see capacityPath
+	// cordoned by a maintenance window rather than an operator
+	maintenanceCordon bool
+	inMaintenance     bool // within one of its maintenance windows
+}
+
+// buildBackend creates a backend out of a `host:port[?option=value&...]` spec
+func buildBackend(spec string) (*Backend, error) {
+	serverUrl, err := url.Parse("http" + getSecure() + "://" + spec)
+	if err != nil {
+		return nil, err
+	}
+	options := serverUrl.Query()
+	serverUrl.RawQuery = ""
+	if err := checkBackendHost(serverUrl); err != nil {
+		return nil, err
+	}
+
+	checkType := optionOr(options, "check", healthCheckType)
+	if !isValidCheckType(checkType) {
+		return nil, fmt.Errorf("unknown health check type %q for %s", checkType, serverUrl.Host)
+	}
+	probe, err := newHTTPProbe(options)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", serverUrl.Host, err)
+	}
+	warm, err := strconv.Atoi(optionOr(options, "warm", strconv.Itoa(warmConns)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid warm: %v", serverUrl.Host, err)
+	}
+	maxConns, err := strconv.Atoi(optionOr(options, "max_conns", strconv.Itoa(backendMaxConns)))
+	if err != nil || maxConns < 0 {
+		return nil, fmt.Errorf("%s: invalid max_conns %q, expected a connection count", serverUrl.Host, options.Get("max_conns"))
+	}
+	maxStreams, err := strconv.Atoi(optionOr(options, "max_streams", strconv.Itoa(backendMaxStreams)))
+	if err != nil || maxStreams < 0 {
+		return nil, fmt.Errorf("%s: invalid max_streams %q, expected a stream count", serverUrl.Host, options.Get("max_streams"))
+	}
+	// the stream cap is enforced over all connections, it needs a count of them
+	if maxStreams > 0 && maxConns == 0 {
+		return nil, fmt.Errorf("%s: max_streams needs max_conns, the streams are capped per connection", serverUrl.Host)
+	}
+	keepHost, err := strconv.ParseBool(optionOr(options, "preserve_host", strconv.FormatBool(preserveHost)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid preserve_host: %v", serverUrl.Host, err)
+	}
+	weight, err := strconv.Atoi(optionOr(options, "weight", "1"))
+	if err != nil || weight < 1 {
+		return nil, fmt.Errorf("%s: invalid weight %q, expected a positive integer", serverUrl.Host, options.Get("weight"))
+	}
+	capacity, err := strconv.ParseInt(optionOr(options, "capacity", "0"), 10, 64)
+	if err != nil || capacity < 0 {
+		return nil, fmt.Errorf("%s: invalid capacity %q, expected a room load", serverUrl.Host, options.Get("capacity"))
+	}
+	rewrites, err := parsePathRewrites(options.Get("path_rewrite"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", serverUrl.Host, err)
+	}
+	maintenance, err := newMaintenanceSchedule(options)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", serverUrl.Host, err)
+	}
+	proxy, err := parseProxy(optionOr(options, "proxy", backendProxy))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", serverUrl.Host, err)
+	}
+	tlsConfig, err := newBackendTLSConfig(optionOr(options, "tls_ca", backendTLSCA))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", serverUrl.Host, err)
+	}
+
+	b := &Backend{
+		ID:            optionOr(options, "name", serverUrl.Host),
+		Pool:          options.Get("pool"),
+		Zone:          options.Get("zone"),
+		Weight:        weight,
+		URL:           serverUrl,
+		spec:          spec,
+		Alive:         true,
+		CheckType:     checkType,
+		httpProbe:     probe,
+		warmConns:     warm,
+		maxConns:      maxConns,
+		maxStreams:    maxStreams,
+		added:         time.Now(),
+		pathRewrites:  rewrites,
+		maintenance:   maintenance,
+		proxy:         proxy,
+		tlsConfig:     tlsConfig,
+		healthClient:  healthClient,
+		readyPath:     optionOr(options, "ready_path", terminationReadyPath),
+		drainStarted:  make(chan struct{}),
+		wsProbePath:   optionOr(options, "ws_probe_path", wsHealthCheckPath),
+		readinessPath: optionOr(options, "readiness_path", readinessCheckPath),
+		preserveHost:  keepHost,
+		capacity:      capacity,
+		capacityPath:  optionOr(options, "capacity_path", capacityPath),
+	}
+	// the checks go the way the traffic does
+	if proxy != nil {
+		b.healthClient = newHealthClient(tlsConfig, b.healthDial)
+	} else if tlsConfig != nil {
+		b.healthClient = newHealthClient(tlsConfig, nil)
+	}
+	b.transport = newTransport(b)
+	b.ReverseProxy = createProxy(b)
+	return b, nil
+}
+
+// checkBackendHost rejects hosts that can't be dialed as they are, IPv6
+// literals must be bracketed like [::1]:3030
+func checkBackendHost(u *url.URL) error {
+	if !strings.HasPrefix(u.Host, "[") {
+		if strings.Count(u.Host, ":") > 1 {
+			return fmt.Errorf("IPv6 backend %s must be bracketed, e.g. [::1]:3030", u.Host)
+		}
+		return nil
+	}
+	// the zone of link-local addresses isn't part of the IP
+	ip := u.Hostname()
+	if i := strings.Index(ip, "%"); i >= 0 {
+		ip = ip[:i]
+	}
+	if net.ParseIP(ip) == nil || !strings.Contains(ip, ":") {
+		return fmt.Errorf("invalid IPv6 backend %s", u.Host)
+	}
+	return nil
 }
 
 func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&b.usage.Requests, 1)
+	// once the body and the websocket, if any, went through
+	defer b.publishUsage()
+	// HTTP/1.0 clients may not send a Host, the backend gets its own then
+	if r.Host == "" {
+		r = r.WithContext(r.Context())
+		r.Host = b.URL.Host
+	}
+	if isWebSocket(r) {
+		b.ServeWS(w, r)
+		return
+	}
+	r.Body = countBytes(r.Body, &b.usage.BytesIn)
 	b.ReverseProxy.ServeHTTP(w, r)
 }
 
@@ -33,3 +220,91 @@ func (b *Backend) IsAlive() (alive bool) {
 	b.mux.RUnlock()
 	return
 }
+
+// SetCordoned marks this backend as unschedulable for new rooms on an
+// operator's request, the end of a maintenance window leaves it as it is
+func (b *Backend) SetCordoned(cordoned bool) {
+	b.mux.Lock()
+	b.Cordoned, b.maintenanceCordon = cordoned, false
+	b.mux.Unlock()
+}
+
+// GetWeight returns the share of new rooms the backend takes with weighted round robin
+func (b *Backend) GetWeight() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Weight
+}
+
+// GetZone returns the availability zone of the backend
+func (b *Backend) GetZone() string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.Zone
+}
+
+// IsCordoned returns true when backend should not receive new rooms
+func (b *Backend) IsCordoned() (cordoned bool) {
+	b.mux.RLock()
+	cordoned = b.Cordoned
+	b.mux.RUnlock()
+	return
+}
+
+// Inflight returns the number of requests currently proxied to this backend
+func (b *Backend) Inflight() int64 {
+	return atomic.LoadInt64(&b.inflight)
+}
+
+// Load returns the requests and websockets the backend is serving, upgrades
+// aren't counted in flight so each connection counts once
+func (b *Backend) Load() int64 {
+	return b.Inflight() + b.ActiveConns()
+}
+
+// takesNewRooms returns true when new rooms can be placed on the backend
+func (b *Backend) takesNewRooms() bool {
+	// cordoned and draining backends keep their rooms but take no new ones
+	return b.IsAlive() && !b.IsCordoned() && !b.IsDraining() && !b.IsSaturated() && !b.IsFull() &&
+		// clients connect to the rooms they create, over websockets
+		(!createRequiresWS || b.IsWSAlive()) && b.IsReady()
+}
+
+// IsSaturated returns true when backend reached its in-flight cap
+func (b *Backend) IsSaturated() bool {
+	return maxInflightPerBackend > 0 && b.Inflight() >= int64(maxInflightPerBackend)
+}
+
+// seedProbe takes a first probe result as it is, as if its threshold was reached
+func (b *Backend) seedProbe(ok bool) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if ok {
+		b.successes, b.failures = healthyThreshold, 0
+	} else {
+		b.successes, b.failures = 0, unhealthyThreshold
+	}
+	b.Alive = ok
+	return b.Alive
+}
+
+// recordProbe tracks consecutive health probe results and flips the backend
+// state once a threshold is reached, returning whether it's alive
+func (b *Backend) recordProbe(ok bool) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if ok {
+		b.failures = 0
+		b.successes++
+		if b.successes >= healthyThreshold {
+			b.Alive = true
+		}
+	} else {
+		b.successes = 0
+		b.failures++
+		if b.failures >= unhealthyThreshold {
+			b.Alive = false
+		}
+	}
+	return b.Alive
+}
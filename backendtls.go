@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// backendTLSCert and backendTLSKey are the client certificate presented to
+// backends requiring mutual TLS
+var (
+	backendTLSCert = os.Getenv("BACKEND_TLS_CERT")
+	backendTLSKey  = os.Getenv("BACKEND_TLS_KEY")
+)
+
+// backendTLSCA is the CA bundle backend certificates are verified against,
+// the system roots when empty
+var backendTLSCA = os.Getenv("BACKEND_TLS_CA")
+
+// backendClientCert is loaded at startup out of backendTLSCert and backendTLSKey
+var backendClientCert *tls.Certificate
+
+// loadBackendClientCert reads the client certificate, if one is configured
+func loadBackendClientCert() error {
+	if backendTLSCert == "" && backendTLSKey == "" {
+		return nil
+	}
+	if backendTLSCert == "" || backendTLSKey == "" {
+		return fmt.Errorf("BACKEND_TLS_CERT and BACKEND_TLS_KEY go together")
+	}
+	cert, err := tls.LoadX509KeyPair(backendTLSCert, backendTLSKey)
+	if err != nil {
+		return fmt.Errorf("invalid backend client certificate: %v", err)
+	}
+	backendClientCert = &cert
+	return nil
+}
+
+// newBackendTLSConfig returns the TLS config of a backend verified against
+// the CA bundle at caPath, nil when the defaults do
+func newBackendTLSConfig(caPath string) (*tls.Config, error) {
+	if backendClientCert == nil && caPath == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if backendClientCert != nil {
+		config.Certificates = []tls.Certificate{*backendClientCert}
+	}
+	if caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", caPath)
+		}
+	}
+	return config, nil
+}
+
+// clientTLSConfig returns the TLS config dialing the backend, with its host
+// name to verify
+func (b *Backend) clientTLSConfig() *tls.Config {
+	config := &tls.Config{}
+	if b.tlsConfig != nil {
+		config = b.tlsConfig.Clone()
+	}
+	config.ServerName = b.URL.Hostname()
+	return config
+}
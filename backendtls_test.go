@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate along with its key, PEM encoded
+type testCert struct {
+	cert, key []byte
+	parsed    *x509.Certificate
+	signer    *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate from template, signed by ca or by itself
+// when ca is nil
+func newTestCert(t *testing.T, template *x509.Certificate, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.parsed, ca.signer
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		parsed: parsed,
+		signer: key,
+	}
+}
+
+// testPKI is a CA with a server certificate for 127.0.0.1 and a client
+// certificate, written to dir
+type testPKI struct {
+	dir                               string
+	ca, server, client                *testCert
+	caFile, clientCertFile, clientKey string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "balancer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: dir}
+	p.ca = newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	p.server = newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "backend"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, p.ca)
+	p.client = newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "balancer"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, p.ca)
+	p.caFile = p.write(t, "ca.pem", p.ca.cert)
+	p.clientCertFile = p.write(t, "client.pem", p.client.cert)
+	p.clientKey = p.write(t, "client.key", p.client.key)
+	return p
+}
+
+func (p *testPKI) write(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(p.dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// setBackendTLS sets the backend TLS settings and loads the client
+// certificate, returning their restore
+func setBackendTLS(t *testing.T, cert, key, ca string) (restore func()) {
+	t.Helper()
+	oldCert, oldKey, oldCA, oldClientCert := backendTLSCert, backendTLSKey, backendTLSCA, backendClientCert
+	backendTLSCert, backendTLSKey, backendTLSCA, backendClientCert = cert, key, ca, nil
+	restore = func() {
+		backendTLSCert, backendTLSKey, backendTLSCA, backendClientCert = oldCert, oldKey, oldCA, oldClientCert
+	}
+	if err := loadBackendClientCert(); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return restore
+}
+
+func TestLoadBackendClientCert(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	missing := filepath.Join(p.dir, "missing.pem")
+	tests := []struct {
+		name   string
+		cert   string
+		key    string
+		loaded bool
+		err    bool
+	}{
+		{"none", "", "", false, false},
+		{"both", p.clientCertFile, p.clientKey, true, false},
+		{"cert only", p.clientCertFile, "", false, true},
+		{"key only", "", p.clientKey, false, true},
+		{"unreadable cert", missing, p.clientKey, false, true},
+		{"unreadable key", p.clientCertFile, missing, false, true},
+		{"key of another cert", p.write(t, "ca-as-client.pem", p.ca.cert), p.clientKey, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(cert, key string, loaded *tls.Certificate) {
+				backendTLSCert, backendTLSKey, backendClientCert = cert, key, loaded
+			}(backendTLSCert, backendTLSKey, backendClientCert)
+			backendTLSCert, backendTLSKey, backendClientCert = tt.cert, tt.key, nil
+			err := loadBackendClientCert()
+			if (err != nil) != tt.err || (backendClientCert != nil) != tt.loaded {
+				t.Fatalf("loadBackendClientCert() = %v, loaded %v, want error %v, loaded %v", err, backendClientCert != nil, tt.err, tt.loaded)
+			}
+		})
+	}
+}
+
+func TestNewBackendTLSConfig(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	tests := []struct {
+		name string
+		ca   string
+		err  bool
+	}{
+		{"bundle", p.caFile, false},
+		{"missing bundle", filepath.Join(p.dir, "missing.pem"), true},
+		{"bundle without certificates", p.write(t, "empty.pem", []byte("not a certificate\n")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := newBackendTLSConfig(tt.ca)
+			if (err != nil) != tt.err || (err == nil && config.RootCAs == nil) {
+				t.Fatalf("newBackendTLSConfig() = %v, %v, want error %v", config, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMutualTLSToBackends(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+	serverCert, err := tls.X509KeyPair(p.server.cert, p.server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(p.ca.parsed)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocket(r) {
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	// the test server logs every refused handshake
+	backend.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	backend.StartTLS()
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "https://")
+	defer setEnv("SECURE_LAYER", "1")()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		ca       string // for every backend
+		spec     string
+		accepted bool
+	}{
+		{"mutual tls", p.clientCertFile, p.clientKey, p.caFile, host, true},
+		{"ca of the backend only", p.clientCertFile, p.clientKey, "", host + "?tls_ca=" + p.caFile, true},
+		{"without a client certificate", "", "", p.caFile, host, false},
+		{"without the ca", p.clientCertFile, p.clientKey, "", host, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setBackendTLS(t, tt.cert, tt.key, tt.ca)()
+			defer setPool(t, tt.spec)()
+			resp, err := http.Post(front.URL+"/room", "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if accepted := resp.StatusCode == http.StatusOK; accepted != tt.accepted {
+				t.Fatalf("http: status %d, want accepted %v", resp.StatusCode, tt.accepted)
+			}
+			conn, _, wsResp := openWS(t, front.URL, "/ws/1", "")
+			conn.Close()
+			if accepted := wsResp.StatusCode == http.StatusSwitchingProtocols; accepted != tt.accepted {
+				t.Fatalf("websocket: status %d, want accepted %v", wsResp.StatusCode, tt.accepted)
+			}
+		})
+	}
+}
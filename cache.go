@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachePaths are the path prefixes whose GET responses may be cached, e.g. /lobby
+var cachePaths = envList("CACHE_PATHS")
+
+// cacheMaxBytes caps the size of the cached bodies, least recently used go first
+var cacheMaxBytes = envInt("CACHE_MAX_BYTES", 10<<20)
+
+// cachedResponse is a response kept until it expires
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// ResponseCache is an in-memory LRU cache of backend responses
+type ResponseCache struct {
+	mux     sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // front is the most recently used
+	size    int
+	max     int
+}
+
+var responseCache = &ResponseCache{max: cacheMaxBytes}
+
+// Get returns the fresh response stored under key, if any
+func (c *ResponseCache) Get(key string) *cachedResponse {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return entry
+}
+
+// Put stores a response, evicting the least recently used ones to fit it
+func (c *ResponseCache) Put(entry *cachedResponse) {
+	if len(entry.body) > c.max {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if e, ok := c.entries[entry.key]; ok {
+		c.remove(e)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += len(entry.body)
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *ResponseCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+
+// cacheKey returns the key r is cached under, empty when r can't be cached
+func cacheKey(r *http.Request) string {
+	if len(cachePaths) == 0 || r.Method != http.MethodGet || isWebSocket(r) || r.Header.Get("Authorization") != "" {
+		return ""
+	}
+	if _, ok := cacheControl(r.Header)["no-store"]; ok {
+		return ""
+	}
+	for _, prefix := range cachePaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return r.URL.RequestURI()
+		}
+	}
+	return ""
+}
+
+// GetCacheKeyFromContext returns the key the response to r is cached under
+func GetCacheKeyFromContext(r *http.Request) string {
+	key, _ := r.Context().Value(CacheKey).(string)
+	return key
+}
+
+// serveCached answers r from the cache, false on a miss or when the client
+// asks for a fresh response
+func serveCached(w http.ResponseWriter, r *http.Request, key string) bool {
+	if _, ok := cacheControl(r.Header)["no-cache"]; ok {
+		return false
+	}
+	entry := responseCache.Get(key)
+	if entry == nil {
+		return false
+	}
+	writeCached(w, r, entry)
+	return true
+}
+
+// writeCached answers r with a cached response, or a 304 when the client
+// already has it
+func writeCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.Header().Set("X-Cache", "HIT")
+	if etag := entry.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	_, _ = w.Write(entry.body)
+}
+
+// storeCached keeps resp when its request was flagged and the backend allows
+// shared caching, the body is read and put back for the client
+func storeCached(resp *http.Response) error {
+	key := GetCacheKeyFromContext(resp.Request)
+	if key == "" || resp.StatusCode != http.StatusOK || len(resp.Header["Set-Cookie"]) > 0 || resp.Header.Get("Vary") != "" {
+		return nil
+	}
+	ttl := cacheTTL(resp.Header)
+	if ttl <= 0 {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(cacheMaxBytes)+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return err
+	}
+	if len(body) > cacheMaxBytes {
+		// too big to keep, hand it over as it comes
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	_ = resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	header := resp.Header.Clone()
+	// hits aren't proxied, the attempts that got this response aren't theirs
+	header.Del("X-LB-Attempts")
+	header.Del("X-LB-Retries")
+	now := time.Now()
+	responseCache.Put(&cachedResponse{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  header,
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+	return nil
+}
+
+// cacheTTL returns how long a response may be kept by a shared cache
+func cacheTTL(header http.Header) time.Duration {
+	directives := cacheControl(header)
+	for _, forbidden := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[forbidden]; ok {
+			return 0
+		}
+	}
+	age, ok := directives["s-maxage"]
+	if !ok {
+		age = directives["max-age"]
+	}
+	seconds, err := strconv.Atoi(age)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// cacheControl parses the Cache-Control directives of header
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name := strings.ToLower(parts[0])
+			if len(parts) == 2 {
+				directives[name] = strings.Trim(parts[1], `"`)
+			} else {
+				directives[name] = ""
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		ttl          time.Duration
+	}{
+		{"max-age=60", time.Minute},
+		{"public, s-maxage=10, max-age=60", 10 * time.Second},
+		{`max-age="30"`, 30 * time.Second},
+		{"private, max-age=60", 0},
+		{"no-store", 0},
+		{"No-Cache, max-age=60", 0},
+		{"", 0},
+		{"max-age=soon", 0},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.cacheControl != "" {
+			header.Set("Cache-Control", tt.cacheControl)
+		}
+		if ttl := cacheTTL(header); ttl != tt.ttl {
+			t.Errorf("cacheTTL(%q) = %s, want %s", tt.cacheControl, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	defer func(paths []string) { cachePaths = paths }(cachePaths)
+	cachePaths = []string{"/lobby"}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header map[string]string
+		key    string
+	}{
+		{"cached path", http.MethodGet, "/lobby/list?page=2", nil, "/lobby/list?page=2"},
+		{"other path", http.MethodGet, "/room/1", nil, ""},
+		{"not a GET", http.MethodPost, "/lobby", nil, ""},
+		{"authorized", http.MethodGet, "/lobby", map[string]string{"Authorization": "Bearer x"}, ""},
+		{"no-store", http.MethodGet, "/lobby", map[string]string{"Cache-Control": "no-store"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if key := cacheKey(r); key != tt.key {
+				t.Fatalf("cacheKey = %q, want %q", key, tt.key)
+			}
+		})
+	}
+}
+
+func TestCacheLeavesRetryHeadersOut(t *testing.T) {
+	defer func(cache *ResponseCache) { responseCache = cache }(responseCache)
+	responseCache = &ResponseCache{max: cacheMaxBytes}
+	req := httptest.NewRequest(http.MethodGet, "/lobby", nil)
+	req = req.WithContext(context.WithValue(req.Context(), CacheKey, "/lobby"))
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Cache-Control": {"max-age=60"},
+			"X-Lb-Attempts": {"2"},
+			"X-Lb-Retries":  {"1"},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader("lobbies")),
+		Request: req,
+	}
+	if err := storeCached(resp); err != nil {
+		t.Fatal(err)
+	}
+	// the proxied response keeps them
+	if resp.Header.Get("X-LB-Attempts") != "2" {
+		t.Fatal("storing dropped X-LB-Attempts from the proxied response")
+	}
+	w := httptest.NewRecorder()
+	if !serveCached(w, httptest.NewRequest(http.MethodGet, "/lobby", nil), "/lobby") {
+		t.Fatal("response wasn't cached")
+	}
+	for _, name := range []string{"X-LB-Attempts", "X-LB-Retries"} {
+		if value := w.Header().Get(name); value != "" {
+			t.Errorf("cache hit answered %s: %s", name, value)
+		}
+	}
+	if body := w.Body.String(); body != "lobbies" || w.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("cache hit answered %q, X-Cache %q", body, w.Header().Get("X-Cache"))
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &ResponseCache{max: 10}
+	expires := time.Now().Add(time.Minute)
+	c.Put(&cachedResponse{key: "a", body: []byte("12345"), expires: expires})
+	c.Put(&cachedResponse{key: "b", body: []byte("12345"), expires: expires})
+	c.Get("a")
+	c.Put(&cachedResponse{key: "c", body: []byte("12345"), expires: expires})
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true} {
+		if (c.Get(key) != nil) != kept {
+			t.Errorf("%s kept = %v, want %v", key, !kept, kept)
+		}
+	}
+	c.Put(&cachedResponse{key: "d", body: []byte("too large to fit"), expires: expires})
+	if c.Get("d") != nil {
+		t.Error("kept a body larger than the cache")
+	}
+}
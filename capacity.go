@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// capacityHeader carries the room load a backend can currently take on its
+// responses, e.g. as it scales up or down, empty disables it
+var capacityHeader = envString("CAPACITY_HEADER", "")
+
+// capacityPath is requested along the health check for the room load the
+// backend can currently take, empty disables it
+var capacityPath = envString("CAPACITY_PATH", "")
+
+// capacityField is the numeric field of the capacity JSON answer, dots go
+// into nested objects
+var capacityField = envString("CAPACITY_FIELD", "capacity")
+
+// Capacity returns the room load the backend can take, 0 when it's unknown
+// or unlimited
+func (b *Backend) Capacity() int64 {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.capacity
+}
+
+// IsFull returns true when the backend's room load reached its capacity
+func (b *Backend) IsFull() bool {
+	capacity := b.Capacity()
+	return capacity > 0 && b.roomLoad.Sum() >= capacity
+}
+
+// setCapacity records a capacity report
+func (b *Backend) setCapacity(capacity int64) {
+	b.mux.Lock()
+	previous := b.capacity
+	b.capacity = capacity
+	b.mux.Unlock()
+	if previous != capacity {
+		log.Printf("[%s] capacity changed from %d to %d\n", b.ID, previous, capacity)
+	}
+}
+
+// recordCapacityHeader records the capacity a backend reported on a response
+func (b *Backend) recordCapacityHeader(header http.Header) {
+	if capacityHeader == "" {
+		return
+	}
+	value := header.Get(capacityHeader)
+	if value == "" {
+		return
+	}
+	capacity, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || capacity < 0 {
+		log.Printf("[%s] invalid capacity %q\n", b.ID, value)
+		return
+	}
+	b.setCapacity(capacity)
+}
+
+// probeCapacity requests the capacity of the backend, if it reports it, and
+// records it. Failures keep the last known capacity.
+func (b *Backend) probeCapacity() {
+	if b.capacityPath == "" {
+		return
+	}
+	capacity, err := b.fetchCapacity()
+	if err != nil {
+		log.Printf("[%s] capacity check failed, %s\n", b.ID, err.Error())
+		return
+	}
+	b.setCapacity(capacity)
+}
+
+// fetchCapacity requests the capacity path and reads capacityField out of
+// the answer
+func (b *Backend) fetchCapacity() (int64, error) {
+	value, err := b.fetchField(b.capacityPath, capacityField)
+	if err != nil {
+		return 0, err
+	}
+	capacity, ok := value.(float64)
+	if !ok || capacity < 0 {
+		return 0, fmt.Errorf("%s is not a valid capacity", capacityField)
+	}
+	return int64(capacity), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCapacityHeader(t *testing.T) {
+	defer func(header string) { capacityHeader = header }(capacityHeader)
+	capacityHeader = "X-Capacity"
+	var reported string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reported != "" {
+			w.Header().Set("X-Capacity", reported)
+		}
+	}))
+	defer backend.Close()
+	tests := []struct {
+		name     string
+		reported string // empty for no header
+		capacity int64
+	}{
+		{"reduced", "3", 3},
+		{"raised", "40", 40},
+		{"unlimited", "0", 0},
+		{"not reported", "", 5},
+		{"negative", "-1", 5},
+		{"not a number", "many", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reported = tt.reported
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?capacity=5")()
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := serverPool.Backends()[0].Capacity(); got != tt.capacity {
+				t.Fatalf("capacity %d, want %d", got, tt.capacity)
+			}
+		})
+	}
+}
+
+func TestReportedCapacityLimitsRooms(t *testing.T) {
+	defer func(field string) { capacityField = field }(capacityField)
+	capacityField = "rooms.free"
+	capacities := make(map[string]string)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/capacity" {
+				_, _ = io.WriteString(w, capacities[name])
+			}
+		}))
+	}
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+	tests := []struct {
+		name   string
+		a, b   string // capacity answers
+		rooms  int
+		placed string // new rooms on a, b and refused
+	}{
+		{"unlimited", `{"rooms":{"free":0}}`, `{"rooms":{"free":0}}`, 10, "5 5 0"},
+		{"a reduced", `{"rooms":{"free":2}}`, `{"rooms":{"free":0}}`, 10, "2 8 0"},
+		{"both reduced", `{"rooms":{"free":2}}`, `{"rooms":{"free":3}}`, 10, "2 3 5"},
+		// a failed report keeps the capacity the spec started with
+		{"invalid report", `{"rooms":{"free":"lots"}}`, `{"rooms":{"free":0}}`, 10, "4 6 0"},
+		{"no report", `{}`, `{"rooms":{"free":0}}`, 10, "4 6 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacities["a"], capacities["b"] = tt.a, tt.b
+			defer setPool(t, strings.TrimPrefix(a.URL, "http://")+"?name=a&capacity=4&capacity_path=/capacity",
+				strings.TrimPrefix(b.URL, "http://")+"?name=b&capacity_path=/capacity")()
+			serverPool.InitialHealthCheck()
+			placed := make(map[string]int)
+			for i := 0; i < tt.rooms; i++ {
+				d, err := route(httptest.NewRequest(http.MethodPost, "/room", nil))
+				if err != nil {
+					placed["refused"]++
+					continue
+				}
+				placed[d.Backend.ID]++
+			}
+			if got := fmt.Sprintf("%d %d %d", placed["a"], placed["b"], placed["refused"]); got != tt.placed {
+				t.Fatalf("placed %s, want %s", got, tt.placed)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosEnabled turns on fault injection, never set it in production
+var chaosEnabled = envBool("CHAOS_ENABLED", false)
+
+// Faults chaos mode can inject into a backend's requests
+const (
+	FaultError   = "error"   // answer 503 instead of the backend
+	FaultLatency = "latency" // wait before reaching the backend
+	FaultDrop    = "drop"    // fail as if the backend dropped the connection
+)
+
+// errChaosDrop is the transport error of an injected dropped connection
+var errChaosDrop = errors.New("chaos: connection dropped")
+
+// chaosRule is the faults injected into a share of a backend's requests
+type chaosRule struct {
+	Rate     float64          `json:"rate"`
+	Faults   []string         `json:"faults"`
+	Latency  string           `json:"latency,omitempty"`
+	Injected map[string]int64 `json:"injected"`
+	latency  time.Duration
+}
+
+// chaosMonkey holds the rules of chaos mode by backend id
+type chaosMonkey struct {
+	mux   sync.Mutex
+	rules map[string]*chaosRule
+}
+
+var chaos chaosMonkey
+
+// Set validates a rule and applies it to a backend's requests
+func (c *chaosMonkey) Set(id string, rule *chaosRule) error {
+	if rule.Rate < 0 || rule.Rate > 1 {
+		return fmt.Errorf("rate must be between 0 and 1, got %v", rule.Rate)
+	}
+	if len(rule.Faults) == 0 {
+		return errors.New("at least one fault is required")
+	}
+	for _, fault := range rule.Faults {
+		if fault != FaultError && fault != FaultLatency && fault != FaultDrop {
+			return fmt.Errorf("unknown fault %q", fault)
+		}
+	}
+	rule.latency = time.Second
+	if rule.Latency != "" {
+		latency, err := time.ParseDuration(rule.Latency)
+		if err != nil {
+			return fmt.Errorf("invalid latency: %v", err)
+		}
+		rule.latency = latency
+	}
+	rule.Latency = rule.latency.String()
+	rule.Injected = make(map[string]int64)
+	c.mux.Lock()
+	if c.rules == nil {
+		c.rules = make(map[string]*chaosRule)
+	}
+	c.rules[id] = rule
+	c.mux.Unlock()
+	return nil
+}
+
+// Clear stops injecting faults into a backend's requests
+func (c *chaosMonkey) Clear(id string) {
+	c.mux.Lock()
+	delete(c.rules, id)
+	c.mux.Unlock()
+}
+
+// Rules returns a copy of the rules by backend id
+func (c *chaosMonkey) Rules() map[string]chaosRule {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	rules := make(map[string]chaosRule, len(c.rules))
+	for id, rule := range c.rules {
+		copied := *rule
+		copied.Injected = make(map[string]int64, len(rule.Injected))
+		for fault, count := range rule.Injected {
+			copied.Injected[fault] = count
+		}
+		rules[id] = copied
+	}
+	return rules
+}
+
+// Pick returns the fault to inject into the next request of a backend, and
+// the latency to add, empty when it goes through untouched
+func (c *chaosMonkey) Pick(id string) (string, time.Duration) {
+	if !chaosEnabled {
+		return "", 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	rule := c.rules[id]
+	if rule == nil || rand.Float64() >= rule.Rate {
+		return "", 0
+	}
+	fault := rule.Faults[rand.Intn(len(rule.Faults))]
+	rule.Injected[fault]++
+	return fault, rule.latency
+}
+
+// chaosTransport injects the backend's faults before its requests go out
+type chaosTransport struct {
+	backend *Backend
+	next    http.RoundTripper
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fault, latency := chaos.Pick(t.backend.ID)
+	switch fault {
+	case FaultError:
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"X-Chaos": {FaultError}},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	case FaultDrop:
+		return nil, errChaosDrop
+	case FaultLatency:
+		if err := chaosSleep(req, latency); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// injectDialFault applies the backend's faults to a websocket dial
+func (b *Backend) injectDialFault(r *http.Request) error {
+	fault, latency := chaos.Pick(b.ID)
+	switch fault {
+	case FaultError, FaultDrop:
+		return errChaosDrop
+	case FaultLatency:
+		return chaosSleep(r, latency)
+	}
+	return nil
+}
+
+// chaosSleep waits for latency unless the request is given up on first
+func chaosSleep(r *http.Request, latency time.Duration) error {
+	select {
+	case <-time.After(latency):
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// chaosHandler shows the chaos rules on GET /admin/chaos, and sets a
+// backend's rule on PUT /admin/chaos/{id} or clears it on DELETE, e.g.
+// {"rate":0.1,"faults":["error","drop"],"latency":"500ms"}
+func chaosHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if !chaosEnabled {
+		http.Error(w, "Chaos mode is disabled, set CHAOS_ENABLED", http.StatusNotFound)
+		return
+	}
+	if id == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, chaos.Rules())
+		return
+	}
+	if serverPool.GetBackend(id) == nil {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var rule chaosRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid rule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := chaos.Set(id, &rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[%s] Chaos injecting %s into %v%% of requests\n", id, strings.Join(rule.Faults, ","), rule.Rate*100)
+	case http.MethodDelete:
+		chaos.Clear(id)
+		log.Printf("[%s] Chaos stopped\n", id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setChaos enables chaos mode without any rule, returning its restore
+func setChaos(enabled bool) (restore func()) {
+	oldEnabled := chaosEnabled
+	chaos.mux.Lock()
+	oldRules := chaos.rules
+	chaos.rules = nil
+	chaos.mux.Unlock()
+	chaosEnabled = enabled
+	return func() {
+		chaosEnabled = oldEnabled
+		chaos.mux.Lock()
+		chaos.rules = oldRules
+		chaos.mux.Unlock()
+	}
+}
+
+func TestChaosRule(t *testing.T) {
+	defer setChaos(true)()
+	tests := []struct {
+		name    string
+		rule    chaosRule
+		latency time.Duration
+		err     bool
+	}{
+		{"error", chaosRule{Rate: 0.1, Faults: []string{FaultError}}, time.Second, false},
+		{"all faults", chaosRule{Rate: 1, Faults: []string{FaultError, FaultLatency, FaultDrop}, Latency: "250ms"}, 250 * time.Millisecond, false},
+		{"never", chaosRule{Rate: 0, Faults: []string{FaultDrop}}, time.Second, false},
+		{"negative rate", chaosRule{Rate: -0.1, Faults: []string{FaultError}}, 0, true},
+		{"rate over 1", chaosRule{Rate: 10, Faults: []string{FaultError}}, 0, true},
+		{"no fault", chaosRule{Rate: 0.1}, 0, true},
+		{"unknown fault", chaosRule{Rate: 0.1, Faults: []string{"fire"}}, 0, true},
+		{"invalid latency", chaosRule{Rate: 0.1, Faults: []string{FaultLatency}, Latency: "slow"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			err := chaos.Set("a", &rule)
+			if (err != nil) != tt.err {
+				t.Fatalf("Set() = %v, want error %v", err, tt.err)
+			}
+			if err == nil && rule.latency != tt.latency {
+				t.Fatalf("latency %s, want %s", rule.latency, tt.latency)
+			}
+		})
+	}
+}
+
+func TestChaosRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		rate    float64
+		faults  []string
+	}{
+		{"a tenth", true, 0.1, []string{FaultError}},
+		{"a third of mixed faults", true, 0.3, []string{FaultError, FaultLatency, FaultDrop}},
+		{"all", true, 1, []string{FaultDrop}},
+		{"none", true, 0, []string{FaultDrop}},
+		// rules left behind never fire once chaos mode is off
+		{"disabled", false, 0.5, []string{FaultError}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setChaos(true)()
+			if err := chaos.Set("a", &chaosRule{Rate: tt.rate, Faults: tt.faults}); err != nil {
+				t.Fatal(err)
+			}
+			chaosEnabled = tt.enabled
+			const requests = 10000
+			injected := make(map[string]int)
+			for i := 0; i < requests; i++ {
+				if fault, _ := chaos.Pick("a"); fault != "" {
+					injected[fault]++
+				}
+				if fault, _ := chaos.Pick("b"); fault != "" {
+					t.Fatalf("injected %s into a backend without a rule", fault)
+				}
+			}
+			want := tt.rate
+			if !tt.enabled {
+				want = 0
+			}
+			total := 0
+			for _, fault := range tt.faults {
+				share := float64(injected[fault]) / requests
+				if each := want / float64(len(tt.faults)); share < each-0.02 || share > each+0.02 {
+					t.Errorf("injected %s into %.3f of requests, want %.3f", fault, share, each)
+				}
+				total += injected[fault]
+			}
+			if counted := chaos.Rules()["a"].Injected; tt.enabled && int64(total) != totalInjected(counted) {
+				t.Errorf("rule counted %v injections, want %d", counted, total)
+			}
+		})
+	}
+}
+
+// totalInjected adds up the injections counted by fault
+func totalInjected(counts map[string]int64) (total int64) {
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+func TestChaosFaults(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?name=a")()
+	defer setChaos(true)()
+	tests := []struct {
+		fault string
+		code  int
+		chaos string // the X-Chaos header
+		slow  bool
+		err   bool
+	}{
+		{FaultError, http.StatusServiceUnavailable, FaultError, false, false},
+		{FaultLatency, http.StatusOK, "", true, false},
+		{FaultDrop, 0, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fault, func(t *testing.T) {
+			if err := chaos.Set("a", &chaosRule{Rate: 1, Faults: []string{tt.fault}, Latency: "50ms"}); err != nil {
+				t.Fatal(err)
+			}
+			transport := &chaosTransport{backend: serverPool.GetBackend("a"), next: http.DefaultTransport}
+			req := httptest.NewRequest(http.MethodPost, backend.URL+"/room", nil)
+			req.RequestURI = ""
+			started := time.Now()
+			resp, err := transport.RoundTrip(req)
+			if (err != nil) != tt.err {
+				t.Fatalf("RoundTrip() error %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code || resp.Header.Get("X-Chaos") != tt.chaos {
+				t.Fatalf("status %d with X-Chaos %q, want %d with %q", resp.StatusCode, resp.Header.Get("X-Chaos"), tt.code, tt.chaos)
+			}
+			if slow := time.Since(started) >= 50*time.Millisecond; slow != tt.slow {
+				t.Fatalf("took %s, want slow %v", time.Since(started), tt.slow)
+			}
+		})
+	}
+}
+
+func TestChaosHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		method  string
+		path    string
+		body    string
+		code    int
+		rules   int // afterwards
+	}{
+		{"disabled", false, http.MethodPut, "/admin/chaos/a", `{"rate":0.5,"faults":["error"]}`, http.StatusNotFound, 1},
+		{"list", true, http.MethodGet, "/admin/chaos", ``, http.StatusOK, 1},
+		{"set", true, http.MethodPut, "/admin/chaos/b", `{"rate":0.5,"faults":["drop"]}`, http.StatusNoContent, 2},
+		{"replace", true, http.MethodPut, "/admin/chaos/a", `{"rate":0.1,"faults":["latency"],"latency":"10ms"}`, http.StatusNoContent, 1},
+		{"invalid rule", true, http.MethodPut, "/admin/chaos/b", `{"rate":2,"faults":["error"]}`, http.StatusBadRequest, 1},
+		{"not json", true, http.MethodPut, "/admin/chaos/b", `rate=1`, http.StatusBadRequest, 1},
+		{"unknown backend", true, http.MethodPut, "/admin/chaos/z", `{"rate":0.5,"faults":["error"]}`, http.StatusNotFound, 1},
+		{"clear", true, http.MethodDelete, "/admin/chaos/a", ``, http.StatusNoContent, 0},
+		{"list can't be set", true, http.MethodPut, "/admin/chaos", ``, http.StatusMethodNotAllowed, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b")()
+			defer setChaos(true)()
+			if err := chaos.Set("a", &chaosRule{Rate: 0.5, Faults: []string{FaultError}}); err != nil {
+				t.Fatal(err)
+			}
+			chaosEnabled = tt.enabled
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if rules := chaos.Rules(); len(rules) != tt.rules {
+				t.Fatalf("%d rules, want %d", len(rules), tt.rules)
+			}
+			if tt.method == http.MethodGet {
+				var rules map[string]chaosRule
+				if err := json.Unmarshal(w.Body.Bytes(), &rules); err != nil {
+					t.Fatal(err)
+				}
+				if rule := rules["a"]; rule.Rate != 0.5 || rule.Latency != "1s" {
+					t.Fatalf("listed %+v, want the rule of a", rules)
+				}
+			}
+		})
+	}
+}
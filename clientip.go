@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For header is believed
+var trustedProxies []*net.IPNet
+
+// parseNetworks parses CIDRs, bare addresses are taken as single hosts
+func parseNetworks(items []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", item, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// inNetworks returns true when ip belongs to any of the networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client behind r, following
+// X-Forwarded-For back through the trusted proxies
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !inNetworks(ip, trustedProxies) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNetworks(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
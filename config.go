@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envList splits a comma separated environment variable, dropping empty items
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envInt reads an integer environment variable, falling back to def when unset
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return i
+}
+
+// envString reads an environment variable, falling back to def when unset
+func envString(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envDuration reads a duration environment variable like "30s", falling back to def when unset
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// envBool reads a boolean environment variable, falling back to def when unset
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
+
+// envFloat reads a float environment variable, falling back to def when unset
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return f
+}
+
+// loadServerList returns the backend specs from SERVER_LIST or from the file named by SERVER_LIST_FILE
+func loadServerList() ([]string, error) {
+	file := os.Getenv("SERVER_LIST_FILE")
+	if file == "" {
+		return envList("SERVER_LIST"), nil
+	}
+	if os.Getenv("SERVER_LIST") != "" {
+		return nil, errors.New("set either SERVER_LIST or SERVER_LIST_FILE, not both")
+	}
+	return readListFile(file)
+}
+
+// readListFile reads one item per line, skipping blank lines and # comments
+func readListFile(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items, nil
+}
+
+// optionOr returns a backend option, falling back to def when unset
+func optionOr(options url.Values, name, def string) string {
+	if value := options.Get(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// writeFileAtomic replaces the file name with data, readers never see a
+// partly written file
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		_ = tmp.Close()
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
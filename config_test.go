@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setEnv sets the environment variable name, unsetting it when value is
+// empty, returning how to put it back
+func setEnv(name, value string) (restore func()) {
+	old, ok := os.LookupEnv(name)
+	if value == "" {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, value)
+	}
+	return func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// writeTempFile writes data to a new file, returning its name and how to remove it
+func writeTempFile(t *testing.T, data string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "balancer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func TestReadListFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		items []string
+	}{
+		{"one per line", "a:3030\nb:3030\n", []string{"a:3030", "b:3030"}},
+		{"comments and blank lines", "# backends\n\na:3030 # first\n   \n#b:3030\nc:3030", []string{"a:3030", "c:3030"}},
+		{"windows line endings", "a:3030\r\nb:3030\r\n", []string{"a:3030", "b:3030"}},
+		{"spaces around", "  a:3030?weight=2  \n", []string{"a:3030?weight=2"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, remove := writeTempFile(t, tt.data)
+			defer remove()
+			items, err := readListFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%q", items) != fmt.Sprintf("%q", tt.items) {
+				t.Fatalf("readListFile = %q, want %q", items, tt.items)
+			}
+		})
+	}
+	if _, err := readListFile(filepath.Join(os.TempDir(), "no-such-list")); err == nil {
+		t.Fatal("read a missing file")
+	}
+}
+
+func TestLoadServerList(t *testing.T) {
+	file, remove := writeTempFile(t, "# pool\nc:3030\nd:3030\n")
+	defer remove()
+	tests := []struct {
+		name  string
+		list  string
+		file  string
+		specs []string
+		err   bool
+	}{
+		{"env list", "a:3030,b:3030", "", []string{"a:3030", "b:3030"}, false},
+		{"file", "", file, []string{"c:3030", "d:3030"}, false},
+		{"both", "a:3030", file, nil, true},
+		{"missing file", "", file + ".missing", nil, true},
+		{"neither", "", "", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setEnv("SERVER_LIST", tt.list)()
+			defer setEnv("SERVER_LIST_FILE", tt.file)()
+			specs, err := loadServerList()
+			if (err != nil) != tt.err {
+				t.Fatalf("loadServerList error = %v, want error %v", err, tt.err)
+			}
+			if fmt.Sprintf("%q", specs) != fmt.Sprintf("%q", tt.specs) {
+				t.Fatalf("loadServerList = %q, want %q", specs, tt.specs)
+			}
+		})
+	}
+}
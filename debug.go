@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofEnabled serves the pprof endpoints on debugAddr
+var pprofEnabled = envBool("PPROF_ENABLED", false)
+
+// debugAddr is where the debug listener binds, keep it off public interfaces
+var debugAddr = envString("DEBUG_ADDR", "localhost:6060")
+
+// logLevel is info, or debug to also log how each new room was placed
+var logLevel = envString("LOG_LEVEL", "info")
+
+// debugf logs at the debug level
+func debugf(format string, v ...interface{}) {
+	if logLevel == "debug" {
+		log.Printf(format, v...)
+	}
+}
+
+// logPlacement logs the strategy a new room went through, how many backends
+// were alive and could take it, and the one it got
+func logPlacement(r *http.Request, peer *Backend) {
+	if logLevel != "debug" {
+		return
+	}
+	backends := serverPool.Backends()
+	alive, eligible := 0, 0
+	for _, b := range backends {
+		if b.IsAlive() {
+			alive++
+		}
+		if b.takesNewRooms() {
+			eligible++
+		}
+	}
+	chosen := "none"
+	if peer != nil {
+		chosen = peer.ID
+	}
+	debugf("%s(%s) New room with %s, %d backends, %d alive, %d eligible, chose %s\n",
+		r.RemoteAddr, r.URL.Path, lbStrategy, len(backends), alive, eligible, chosen)
+}
+
+// debugMux routes the pprof endpoints
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serveDebug runs the debug listener when pprof is enabled
+func serveDebug() {
+	if !pprofEnabled {
+		return
+	}
+	log.Printf("Debug server started at %s\n", debugAddr)
+	if err := http.ListenAndServe(debugAddr, debugMux()); err != nil {
+		log.Println("Debug server stopped: ", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPprofOnlyOnDebugListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.Handler
+		pprof   bool
+	}{
+		{"debug listener", debugMux(), true},
+		{"public listener", http.HandlerFunc(lb), false},
+		{"admin listener", adminMux(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+			served := w.Code == http.StatusOK && strings.Contains(w.Body.String(), "goroutine")
+			if served != tt.pprof {
+				t.Fatalf("pprof served = %v, want %v (status %d)", served, tt.pprof, w.Code)
+			}
+		})
+	}
+}
+
+func TestDebugListenerDisabled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	defer func(enabled bool, addr string) { pprofEnabled, debugAddr = enabled, addr }(pprofEnabled, debugAddr)
+	pprofEnabled, debugAddr = false, addr
+	// returns right away without binding
+	serveDebug()
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Fatalf("the disabled debug listener holds %s: %v", addr, err)
+	}
+	l.Close()
+}
+
+func TestLogPlacement(t *testing.T) {
+	defer func(level, strategy string) { logLevel, lbStrategy = level, strategy }(logLevel, lbStrategy)
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		name     string
+		level    string
+		strategy string
+		down     []string // backends marked down
+		dryRun   bool
+		line     string // logged, empty for nothing
+	}{
+		{"info", "info", StrategyRoundRobin, nil, false, ""},
+		{"round-robin", "debug", StrategyRoundRobin, nil, false, "New room with round-robin, 3 backends, 3 alive, 2 eligible, chose a"},
+		{"least-load", "debug", StrategyLeastLoad, nil, false, "New room with least-load, 3 backends, 3 alive, 2 eligible, chose a"},
+		{"one down", "debug", StrategyRoundRobin, []string{"a"}, false, "New room with round-robin, 3 backends, 2 alive, 1 eligible, chose b"},
+		{"none left", "debug", StrategyRoundRobin, []string{"a", "b"}, false, "New room with round-robin, 3 backends, 1 alive, 0 eligible, chose none"},
+		{"dry run", "debug", StrategyRoundRobin, nil, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logLevel, lbStrategy = tt.level, tt.strategy
+			// c is alive but cordoned, so it's never eligible
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c")()
+			serverPool.GetBackend("c").SetCordoned(true)
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			for _, id := range tt.down {
+				serverPool.GetBackend(id).SetAlive(false)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/room", nil)
+			if tt.dryRun {
+				r = withDryRun(r)
+			}
+			out.Reset()
+			_, _ = route(r)
+			logged := strings.TrimSpace(out.String())
+			if tt.line == "" {
+				if logged != "" {
+					t.Fatalf("logged %q, want nothing", logged)
+				}
+				return
+			}
+			if !strings.HasSuffix(logged, "192.0.2.1:1234(/room) "+tt.line) {
+				t.Fatalf("logged %q, want %q", logged, tt.line)
+			}
+		})
+	}
+}
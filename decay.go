@@ -0,0 +1,33 @@
+package main
+
+// decayAlpha is how much each proxied outcome moves a backend's failure rate, 0 disables decay
+var decayAlpha = envFloat("DECAY_ALPHA", 0.1)
+
+// decayMinWeight is the lowest share a flaky backend decays to
+var decayMinWeight = envFloat("DECAY_MIN_WEIGHT", 0.1)
+
+// recordOutcome folds a proxied request outcome into the backend's recent failure rate
+func (b *Backend) recordOutcome(ok bool) {
+	if decayAlpha <= 0 {
+		return
+	}
+	sample := 0.0
+	if !ok {
+		sample = 1
+	}
+	b.mux.Lock()
+	b.failureRate += decayAlpha * (sample - b.failureRate)
+	b.mux.Unlock()
+}
+
+// EffectiveWeight returns the share of its turns a backend takes, decayed
+// by its recent failure rate and recovering as it stabilizes
+func (b *Backend) EffectiveWeight() float64 {
+	b.mux.RLock()
+	weight := 1 - b.failureRate
+	b.mux.RUnlock()
+	if weight < decayMinWeight {
+		return decayMinWeight
+	}
+	return weight
+}
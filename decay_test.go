@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEffectiveWeight(t *testing.T) {
+	defer func(alpha, min float64) { decayAlpha, decayMinWeight = alpha, min }(decayAlpha, decayMinWeight)
+	tests := []struct {
+		name     string
+		alpha    float64
+		min      float64
+		outcomes string // + for a success, - for a failure
+		weight   float64
+	}{
+		{"no failures", 0.1, 0.1, "+++", 1},
+		{"one failure", 0.5, 0.1, "-", 0.5},
+		{"recovering", 0.5, 0.1, "-+", 0.75},
+		{"floored", 0.5, 0.2, "----", 0.2},
+		{"disabled", 0, 0.1, "----", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decayAlpha, decayMinWeight = tt.alpha, tt.min
+			b, err := buildBackend("localhost:9101")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, outcome := range tt.outcomes {
+				b.recordOutcome(outcome == '+')
+			}
+			if weight := b.EffectiveWeight(); math.Abs(weight-tt.weight) > 1e-9 {
+				t.Fatalf("EffectiveWeight = %g, want %g", weight, tt.weight)
+			}
+		})
+	}
+}
+
+func TestFlakyBackendShareShrinksAndRecovers(t *testing.T) {
+	defer func(alpha, min float64) { decayAlpha, decayMinWeight = alpha, min }(decayAlpha, decayMinWeight)
+	decayAlpha, decayMinWeight = 0.1, 0.1
+	tests := []struct {
+		name string
+		pick func(*ServerPool) *Backend
+	}{
+		{"round robin", (*ServerPool).GetNextPeer},
+		{"weighted", (*ServerPool).GetWeightedPeer},
+	}
+	// share returns the share of 2000 picks landing on b
+	share := func(pick func(*ServerPool) *Backend, b *Backend) float64 {
+		n := 0
+		for i := 0; i < 2000; i++ {
+			if pick(&serverPool) == b {
+				n++
+			}
+		}
+		return float64(n) / 2000
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101", "localhost:9102")()
+			flaky := serverPool.Backends()[1]
+			if s := share(tt.pick, flaky); math.Abs(s-0.5) > 0.05 {
+				t.Fatalf("healthy share %.2f, want about 0.5", s)
+			}
+			for i := 0; i < 20; i++ {
+				flaky.recordOutcome(false)
+			}
+			shrunk := share(tt.pick, flaky)
+			if shrunk > 0.25 || shrunk == 0 {
+				t.Fatalf("flaky share %.2f, want it shrunk but not ejected", shrunk)
+			}
+			for i := 0; i < 60; i++ {
+				flaky.recordOutcome(true)
+			}
+			if s := share(tt.pick, flaky); s < 0.45 {
+				t.Fatalf("recovered share %.2f, want about 0.5", s)
+			}
+		})
+	}
+}
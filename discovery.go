@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// dnsDiscovery is a `host:port[?option=value&...]` spec whose host resolves
+// to the addresses of the backends, the options apply to each of them
+var dnsDiscovery = os.Getenv("DNS_DISCOVERY")
+
+// dnsRefreshInterval is how often the discovery name is resolved
+var dnsRefreshInterval = envDuration("DNS_REFRESH_INTERVAL", 30*time.Second)
+
+// dnsRetryBackoff is the wait before retrying a failed resolution, doubled
+// on each failure up to dnsRefreshInterval
+var dnsRetryBackoff = envDuration("DNS_RETRY_BACKOFF", time.Second)
+
+// dnsMaxFailures is how many resolutions in a row may fail before the
+// discovered backends are dropped
+var dnsMaxFailures = envInt("DNS_MAX_FAILURES", 5)
+
+// dnsBackendTTL is how long a discovered backend stays after it was last
+// resolved, so a flaky answer doesn't drop it right away
+var dnsBackendTTL = envDuration("DNS_BACKEND_TTL", 5*time.Minute)
+
+// discoverer keeps the pool in sync with the addresses a name resolves to,
+// holding on to the last known good set while resolution fails
+type discoverer struct {
+	host     string
+	port     string
+	options  string
+	resolve  func(host string) ([]string, error)
+	lastSeen map[string]time.Time // discovered backend id to when it was last resolved
+	failures int
+}
+
+// newDiscoverer parses a DNS_DISCOVERY spec
+func newDiscoverer(spec string) (*discoverer, error) {
+	u, err := url.Parse("dns://" + spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("DNS_DISCOVERY %q is missing a port", spec)
+	}
+	// every discovered backend is named after its address
+	if u.Query().Get("name") != "" {
+		return nil, fmt.Errorf("DNS_DISCOVERY %q can't set a name", spec)
+	}
+	return &discoverer{
+		host:     u.Hostname(),
+		port:     u.Port(),
+		options:  u.RawQuery,
+		resolve:  net.LookupHost,
+		lastSeen: make(map[string]time.Time),
+	}, nil
+}
+
+// refresh resolves the name once and updates the pool, returning how long
+// to wait before the next refresh
+func (d *discoverer) refresh() time.Duration {
+	addrs, err := d.resolve(d.host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: d.host}
+	}
+	if err != nil {
+		d.failures++
+		log.Printf("Resolving %s failed %d times in a row: %s\n", d.host, d.failures, err.Error())
+		if d.failures >= dnsMaxFailures {
+			d.expire(time.Now())
+		} else {
+			d.expire(time.Now().Add(-dnsBackendTTL))
+		}
+		backoff := dnsRetryBackoff
+		for i := 1; i < d.failures && backoff < dnsRefreshInterval; i++ {
+			backoff *= 2
+		}
+		if backoff > dnsRefreshInterval {
+			backoff = dnsRefreshInterval
+		}
+		return backoff
+	}
+	d.failures = 0
+	now := time.Now()
+	for _, addr := range addrs {
+		id := net.JoinHostPort(addr, d.port)
+		if _, ok := d.lastSeen[id]; !ok {
+			if !d.add(id) {
+				continue
+			}
+		}
+		d.lastSeen[id] = now
+	}
+	d.expire(now.Add(-dnsBackendTTL))
+	return dnsRefreshInterval
+}
+
+// add builds a discovered backend and puts it in the pool
+func (d *discoverer) add(id string) bool {
+	spec := id
+	if d.options != "" {
+		spec += "?" + d.options
+	}
+	b, err := buildBackend(spec)
+	if err != nil {
+		log.Printf("Can't add discovered backend %s: %s\n", id, err.Error())
+		return false
+	}
+	if serverPool.GetBackend(b.ID) != nil {
+		log.Printf("Discovered backend %s is already in the pool\n", b.ID)
+		return false
+	}
+	serverPool.AddBackend(b)
+	log.Printf("Discovered backend %s\n", b.ID)
+	go b.warm()
+	return true
+}
+
+// expire removes the discovered backends last resolved before deadline
+func (d *discoverer) expire(deadline time.Time) {
+	for id, seen := range d.lastSeen {
+		if seen.Before(deadline) {
+			serverPool.RemoveBackend(id)
+			delete(d.lastSeen, id)
+			log.Printf("Removed discovered backend %s\n", id)
+		}
+	}
+}
+
+// discover runs a routine keeping the pool in sync with DNS, starting after wait
+func (d *discoverer) discover(wait time.Duration) {
+	for {
+		time.Sleep(wait)
+		wait = d.refresh()
+	}
+}
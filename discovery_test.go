@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNewDiscoverer(t *testing.T) {
+	for _, spec := range []string{"game.internal", "game.internal:3030?name=a"} {
+		if _, err := newDiscoverer(spec); err == nil {
+			t.Errorf("newDiscoverer(%q) accepted an invalid spec", spec)
+		}
+	}
+	d, err := newDiscoverer("game.internal:3030?weight=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.host != "game.internal" || d.port != "3030" || d.options != "weight=2" {
+		t.Fatalf("parsed %+v", d)
+	}
+}
+
+func TestDiscoveryKeepsBackendsThroughFailures(t *testing.T) {
+	defer func(interval, backoff, ttl time.Duration, failures int) {
+		dnsRefreshInterval, dnsRetryBackoff, dnsBackendTTL, dnsMaxFailures = interval, backoff, ttl, failures
+	}(dnsRefreshInterval, dnsRetryBackoff, dnsBackendTTL, dnsMaxFailures)
+	dnsRefreshInterval, dnsRetryBackoff, dnsBackendTTL, dnsMaxFailures = 30*time.Second, time.Second, 5*time.Minute, 4
+	errTemporary := errors.New("temporary failure in name resolution")
+	// a step resolves once, stale ages the last resolution of 10.0.0.2 first
+	type step struct {
+		addrs []string
+		err   error
+		stale bool
+		pool  []string
+		wait  time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"hiccup", []step{
+			{addrs: []string{"10.0.0.1", "10.0.0.2"}, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 30 * time.Second},
+			{err: errTemporary, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: time.Second},
+			{err: errTemporary, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 2 * time.Second},
+			{addrs: []string{"10.0.0.1", "10.0.0.2"}, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 30 * time.Second},
+		}},
+		{"empty answers count as failures", []step{
+			{addrs: []string{"10.0.0.1"}, pool: []string{"10.0.0.1:3030"}, wait: 30 * time.Second},
+			{addrs: []string{}, pool: []string{"10.0.0.1:3030"}, wait: time.Second},
+		}},
+		{"outage", []step{
+			{addrs: []string{"10.0.0.1", "10.0.0.2"}, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 30 * time.Second},
+			{err: errTemporary, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: time.Second},
+			{err: errTemporary, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 2 * time.Second},
+			{err: errTemporary, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 4 * time.Second},
+			{err: errTemporary, pool: nil, wait: 8 * time.Second},
+			{err: errTemporary, pool: nil, wait: 16 * time.Second},
+			{err: errTemporary, pool: nil, wait: 30 * time.Second},
+			{addrs: []string{"10.0.0.2"}, pool: []string{"10.0.0.2:3030"}, wait: 30 * time.Second},
+		}},
+		{"address gone from the answers", []step{
+			{addrs: []string{"10.0.0.1", "10.0.0.2"}, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 30 * time.Second},
+			{addrs: []string{"10.0.0.1"}, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 30 * time.Second},
+			{addrs: []string{"10.0.0.1"}, stale: true, pool: []string{"10.0.0.1:3030"}, wait: 30 * time.Second},
+		}},
+		{"ttl expires while failing", []step{
+			{addrs: []string{"10.0.0.1", "10.0.0.2"}, pool: []string{"10.0.0.1:3030", "10.0.0.2:3030"}, wait: 30 * time.Second},
+			{err: errTemporary, stale: true, pool: []string{"10.0.0.1:3030"}, wait: time.Second},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t)()
+			d, err := newDiscoverer("game.internal:3030")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				d.resolve = func(host string) ([]string, error) { return s.addrs, s.err }
+				if s.stale {
+					if _, ok := d.lastSeen["10.0.0.2:3030"]; ok {
+						d.lastSeen["10.0.0.2:3030"] = time.Now().Add(-dnsBackendTTL - time.Second)
+					}
+				}
+				wait := d.refresh()
+				var pool []string
+				for _, b := range serverPool.Backends() {
+					pool = append(pool, b.ID)
+				}
+				sort.Strings(pool)
+				if fmt.Sprint(pool) != fmt.Sprint(s.pool) || wait != s.wait {
+					t.Fatalf("step %d: pool %v waiting %s, want %v waiting %s", i, pool, wait, s.pool, s.wait)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once the balancer stops taking new requests
+var draining int32
+
+// drainProgress is a snapshot of what is left to drain
+type drainProgress struct {
+	Draining bool            `json:"draining"`
+	Backends []backendStatus `json:"backends"`
+	Inflight int64           `json:"inflight"`
+}
+
+// currentDrainProgress counts the requests and websockets still open per backend
+func currentDrainProgress() drainProgress {
+	progress := drainProgress{Draining: atomic.LoadInt32(&draining) == 1}
+	for _, b := range serverPool.Backends() {
+		progress.Inflight += b.Load()
+		progress.Backends = append(progress.Backends, newBackendStatus(b))
+	}
+	return progress
+}
+
+// waitForDrain blocks until nothing is proxied to any backend or ctx is done
+func waitForDrain(ctx context.Context) {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for currentDrainProgress().Inflight > 0 {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drainStreamHandler pushes what is left to drain every second as server
+// sent events, until everything drained or the client goes away
+func drainStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		progress := currentDrainProgress()
+		data, err := json.Marshal(progress)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if progress.Inflight == 0 {
+			fmt.Fprint(w, "event: done\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// terminationReadyPath is polled while a backend drains, the backend answers
+// 200 once it has no match left and can go. Empty waits for its requests and
+// websockets to close instead.
+var terminationReadyPath = envString("TERMINATION_READY_PATH", "")
+
+// terminationReadyInterval is how often a draining backend is checked
+var terminationReadyInterval = envDuration("TERMINATION_READY_INTERVAL", 5*time.Second)
+
+// backendDrainTimeout is when a draining backend is removed even if it's not done
+var backendDrainTimeout = envDuration("BACKEND_DRAIN_TIMEOUT", 30*time.Minute)
+
+// wsDrainCloseAfter is how long websockets of a draining backend are left
+// open before their clients are told to reconnect, landing on another
+// backend. 0 leaves them open until they close on their own.
+var wsDrainCloseAfter = envDuration("WS_DRAIN_CLOSE_AFTER", 0)
+
+// wsDrainCloseCode is the close code sent to those clients, 1012 is service restart
+var wsDrainCloseCode = envInt("WS_DRAIN_CLOSE_CODE", 1012)
+
+// closeOnDrain tells the client to reconnect wsDrainCloseAfter after the
+// backend started draining, or after connecting to an already draining one,
+// and calls closed once it did. It gives up when stop is closed.
+func (b *Backend) closeOnDrain(client *wsPeer, stop <-chan struct{}, closed func()) {
+	select {
+	case <-b.drainStarted:
+	case <-stop:
+		return
+	}
+	select {
+	case <-time.After(wsDrainCloseAfter):
+	case <-stop:
+		return
+	}
+	if err := client.close(wsDrainCloseCode, "backend draining"); err != nil {
+		log.Printf("[%s] Failed to ask client to reconnect: %s\n", b.ID, err.Error())
+	}
+	closed()
+}
+
+// drainBackend stops sending new rooms to b, waits until it's done with the
+// ones it has and removes it from the pool
+func drainBackend(b *Backend) {
+	if !b.startDraining() {
+		return
+	}
+	log.Printf("%s [draining]\n", b.URL)
+	deadline := time.Now().Add(backendDrainTimeout)
+	t := time.NewTicker(terminationReadyInterval)
+	defer t.Stop()
+	busy := false
+	for !b.drained() {
+		if time.Now().After(deadline) {
+			log.Printf("%s still busy after %s, removing it anyway\n", b.URL, backendDrainTimeout)
+			busy = true
+			break
+		}
+		<-t.C
+	}
+	// a reload may have replaced it by a backend of the same id meanwhile
+	if serverPool.GetBackend(b.ID) == b {
+		serverPool.RemoveBackend(b.ID)
+	}
+	log.Printf("%s [drained]\n", b.URL)
+	retire(b, busy)
+}
+
+// drained returns true once the backend says it's ready to terminate, or
+// without a ready path once nothing is proxied to it anymore
+func (b *Backend) drained() bool {
+	if b.readyPath == "" {
+		return b.Inflight() == 0 && b.ActiveConns() == 0
+	}
+	resp, err := b.healthClient.Get(b.URL.String() + b.readyPath)
+	if err != nil {
+		log.Printf("[%s] Termination ready check failed: %s\n", b.ID, err.Error())
+		return false
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// startDraining flags the backend as draining, false when it already was
+func (b *Backend) startDraining() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.draining {
+		return false
+	}
+	b.draining = true
+	close(b.drainStarted)
+	return true
+}
+
+// IsDraining returns true while the backend is on its way out of the pool
+func (b *Backend) IsDraining() (draining bool) {
+	b.mux.RLock()
+	draining = b.draining
+	b.mux.RUnlock()
+	return
+}
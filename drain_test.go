@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainStream(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String())()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	admin := httptest.NewServer(adminMux())
+	defer admin.Close()
+
+	conn, _, resp := openWS(t, front.URL, "/ws/1", "")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	stream, err := http.Get(admin.URL + "/admin/drain/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	if ct := stream.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q, want text/event-stream", ct)
+	}
+	events := bufio.NewScanner(stream.Body)
+	next := func() (string, string) {
+		var event, data string
+		for events.Scan() {
+			line := events.Text()
+			switch {
+			case line == "":
+				return event, data
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		t.Fatalf("stream ended: %v", events.Err())
+		return "", ""
+	}
+
+	// the first update comes right away, not after a tick
+	_, data := next()
+	var progress drainProgress
+	if err := json.Unmarshal([]byte(data), &progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Inflight != 1 || len(progress.Backends) != 1 {
+		t.Fatalf("progress %s, want the websocket in flight", data)
+	}
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		event, data := next()
+		if event == "done" {
+			break
+		}
+		if err := json.Unmarshal([]byte(data), &progress); err != nil {
+			t.Fatal(err)
+		}
+		if progress.Inflight == 0 {
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still draining %s", data)
+		}
+	}
+	// and the stream ends with it
+	if events.Scan() {
+		t.Fatalf("more after done: %q", events.Text())
+	}
+}
+
+func TestDrainStreamClientGone(t *testing.T) {
+	// a request that never finishes keeps the drain going
+	defer setPool(t, "localhost:9101")()
+	b := serverPool.Backends()[0]
+	atomic.AddInt64(&b.inflight, 1)
+	defer atomic.AddInt64(&b.inflight, -1)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/admin/drain/stream", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		drainStreamHandler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stream kept going after its client left")
+	}
+}
+
+func TestDrainUntilTerminationReady(t *testing.T) {
+	var ready, checks int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/termination-ready" {
+			return
+		}
+		atomic.AddInt64(&checks, 1)
+		if atomic.LoadInt64(&ready) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	defer func(interval, timeout time.Duration) {
+		terminationReadyInterval, backendDrainTimeout = interval, timeout
+	}(terminationReadyInterval, backendDrainTimeout)
+	terminationReadyInterval = 10 * time.Millisecond
+	tests := []struct {
+		name      string
+		spec      string
+		timeout   time.Duration
+		inflight  int64         // requests in flight while draining
+		readyIn   time.Duration // until the backend says it can go, 0 from the start, negative never
+		removedIn time.Duration // roughly, 0 before it's ready
+		checked   bool          // whether the ready path is polled
+	}{
+		// idle but open connections don't keep a backend that says it's done
+		{"ready path", host + "?name=a&ready_path=/termination-ready", time.Minute, 1, 100 * time.Millisecond, 100 * time.Millisecond, true},
+		{"ready at once", host + "?name=a&ready_path=/termination-ready", time.Minute, 1, 0, 0, true},
+		{"never ready", host + "?name=a&ready_path=/termination-ready", 100 * time.Millisecond, 0, -1, 100 * time.Millisecond, true},
+		{"without a ready path", host + "?name=a", time.Minute, 0, -1, 0, false},
+		{"without a ready path while busy", host + "?name=a", 100 * time.Millisecond, 1, 0, 100 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backendDrainTimeout = tt.timeout
+			atomic.StoreInt64(&ready, 0)
+			if tt.readyIn == 0 {
+				atomic.StoreInt64(&ready, 1)
+			}
+			atomic.StoreInt64(&checks, 0)
+			defer setPool(t, tt.spec, "localhost:9102?name=b")()
+			b := serverPool.GetBackend("a")
+			atomic.AddInt64(&b.inflight, tt.inflight)
+			started := time.Now()
+			done := make(chan struct{})
+			go func() {
+				drainBackend(b)
+				close(done)
+			}()
+			if tt.readyIn > 0 {
+				time.AfterFunc(tt.readyIn, func() { atomic.StoreInt64(&ready, 1) })
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("backend never left the pool")
+			}
+			took := time.Since(started)
+			if took < tt.removedIn || took > tt.removedIn+500*time.Millisecond {
+				t.Fatalf("removed after %s, want about %s", took, tt.removedIn)
+			}
+			if serverPool.GetBackend("a") != nil {
+				t.Fatal("drained backend still in the pool")
+			}
+			if !b.IsDraining() || b.takesNewRooms() {
+				t.Fatal("drained backend would take new rooms")
+			}
+			if checked := atomic.LoadInt64(&checks) > 0; checked != tt.checked {
+				t.Fatalf("ready path polled %v, want %v", checked, tt.checked)
+			}
+		})
+	}
+}
+
+func TestDrainClosesWebsockets(t *testing.T) {
+	defer func(after time.Duration, code int) {
+		wsDrainCloseAfter, wsDrainCloseCode = after, code
+	}(wsDrainCloseAfter, wsDrainCloseCode)
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name   string
+		after  time.Duration
+		code   int
+		before bool // whether the backend drains before the client connects
+		drain  bool
+		closed bool // whether the client is told to reconnect
+	}{
+		{"off", 0, 1012, false, true, false},
+		{"not draining", 30 * time.Millisecond, 1012, false, false, false},
+		{"draining", 30 * time.Millisecond, 1012, false, true, true},
+		{"custom code", 30 * time.Millisecond, 4000, false, true, true},
+		{"draining before connecting", 30 * time.Millisecond, 1012, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsDrainCloseAfter, wsDrainCloseCode = tt.after, tt.code
+			backend := wsBackend(t, nil)
+			defer backend.Close()
+			defer setPool(t, backend.Addr().String())()
+			b := serverPool.Backends()[0]
+			if tt.before {
+				b.startDraining()
+			}
+			conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+			// the next case changes the settings the handler reads
+			defer waitWebsockets(t, 0)
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			if opcode, _, payload, err := readWSFrame(br); err != nil || opcode != 0x1 || string(payload) != "hello" {
+				t.Fatalf("got opcode %x %q (%v), want the backend's hello", opcode, payload, err)
+			}
+			started := time.Now()
+			if tt.drain && !tt.before {
+				b.startDraining()
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			opcode, masked, payload, err := readWSFrame(br)
+			if !tt.closed {
+				if err, ok := err.(net.Error); !ok || !err.Timeout() {
+					t.Fatalf("got opcode %x %q (%v), want the websocket left open", opcode, payload, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if waited := time.Since(started); !tt.before && waited < tt.after {
+				t.Fatalf("told to reconnect after %s, want the %s grace", waited, tt.after)
+			}
+			if opcode != wsOpClose || masked || len(payload) < 2 {
+				t.Fatalf("got opcode %x masked %v %q, want an unmasked close frame", opcode, masked, payload)
+			}
+			if code, reason := int(binary.BigEndian.Uint16(payload)), string(payload[2:]); code != tt.code || reason != "backend draining" {
+				t.Fatalf("close code %d %q, want %d", code, reason, tt.code)
+			}
+			// nothing follows the close frame
+			if _, _, _, err := readWSFrame(br); err == nil {
+				t.Fatal("websocket still open after the close frame")
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Orders in which queued backends start draining
+const (
+	DrainOrderWeight = "weight"
+	DrainOrderFIFO   = "fifo"
+)
+
+// drainOrder picks the next backend to drain when several are queued: weight
+// starts with the down ones, then the lowest weight and capacity, so the
+// backends carrying most of the pool serve longest, fifo goes by queue order
+var drainOrder = envString("DRAIN_ORDER", DrainOrderWeight)
+
+// drainConcurrency is how many queued backends drain at once
+var drainConcurrency = envInt("DRAIN_CONCURRENCY", 1)
+
+// drainRemovedBackends drains the backends dropped from the server list on
+// reload instead of removing them right away
+var drainRemovedBackends = envBool("DRAIN_REMOVED_BACKENDS", false)
+
+// isValidDrainOrder returns true for the supported DRAIN_ORDER values
+func isValidDrainOrder(order string) bool {
+	return order == DrainOrderWeight || order == DrainOrderFIFO
+}
+
+// drainsBefore returns true when a is to start draining before b
+func drainsBefore(a, b *Backend) bool {
+	if drainOrder == DrainOrderFIFO {
+		return false
+	}
+	// a down backend takes nothing away from the pool
+	if aliveA, aliveB := a.IsAlive(), b.IsAlive(); aliveA != aliveB {
+		return !aliveA
+	}
+	if weightA, weightB := a.GetWeight(), b.GetWeight(); weightA != weightB {
+		return weightA < weightB
+	}
+	// an unknown capacity is taken as the largest
+	capacityA, capacityB := a.Capacity(), b.Capacity()
+	if capacityA != capacityB {
+		return capacityB == 0 || (capacityA != 0 && capacityA < capacityB)
+	}
+	return false
+}
+
+// drainQueue holds the backends waiting for their turn to drain, they keep
+// serving until then
+type drainQueue struct {
+	mux     sync.Mutex
+	pending []*Backend
+	running int
+}
+
+var drains drainQueue
+
+// Queue adds backends to drain and starts as many as drainConcurrency allows,
+// returning the ones queued
+func (q *drainQueue) Queue(backends ...*Backend) []*Backend {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	var queued []*Backend
+	for _, b := range backends {
+		if b.IsDraining() || q.isPending(b) {
+			continue
+		}
+		q.pending = append(q.pending, b)
+		queued = append(queued, b)
+	}
+	q.dispatch()
+	return queued
+}
+
+// Pending returns the backends waiting to drain, in the order they would start
+func (q *drainQueue) Pending() []*Backend {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	pending := make([]*Backend, len(q.pending))
+	copy(pending, q.pending)
+	// insertion sort keeps the queue order among equals
+	for i := 1; i < len(pending); i++ {
+		for j := i; j > 0 && drainsBefore(pending[j], pending[j-1]); j-- {
+			pending[j], pending[j-1] = pending[j-1], pending[j]
+		}
+	}
+	return pending
+}
+
+// IsQueued returns true while b waits for its turn to drain
+func (q *drainQueue) IsQueued(b *Backend) bool {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.isPending(b)
+}
+
+func (q *drainQueue) isPending(b *Backend) bool {
+	for _, p := range q.pending {
+		if p == b {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch starts draining the next backends while there's room, mux held.
+// The order is decided at each start so late arrivals and health changes count.
+func (q *drainQueue) dispatch() {
+	for q.running < drainConcurrency && len(q.pending) > 0 {
+		next := 0
+		for i, b := range q.pending {
+			if drainsBefore(b, q.pending[next]) {
+				next = i
+			}
+		}
+		b := q.pending[next]
+		q.pending = append(q.pending[:next], q.pending[next+1:]...)
+		q.running++
+		go func() {
+			drainBackend(b)
+			q.mux.Lock()
+			q.running--
+			q.dispatch()
+			q.mux.Unlock()
+		}()
+	}
+}
+
+// drainBackendsHandler queues several backends to drain on POST /admin/drain,
+// e.g. {"backends":["a","b"]}, answering with the order they'll drain in
+func drainBackendsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Backends []string `json:"backends"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Backends) == 0 {
+			http.Error(w, "Expected a list of backends", http.StatusBadRequest)
+			return
+		}
+		backends := make([]*Backend, 0, len(body.Backends))
+		for _, id := range body.Backends {
+			b := serverPool.GetBackend(id)
+			if b == nil {
+				http.Error(w, "Backend "+id+" not found", http.StatusNotFound)
+				return
+			}
+			backends = append(backends, b)
+		}
+		for _, b := range drains.Queue(backends...) {
+			log.Printf("%s [queued for draining]\n", b.URL)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pending := drains.Pending()
+	ids := make([]string, 0, len(pending))
+	for _, b := range pending {
+		ids = append(ids, b.ID)
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, status, map[string]interface{}{"order": drainOrder, "pending": ids})
+}
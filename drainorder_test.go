@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// holdDrains keeps queued backends pending instead of draining them,
+// returning the restore
+func holdDrains() (restore func()) {
+	old := drainConcurrency
+	drainConcurrency = 0
+	return func() {
+		drainConcurrency = old
+		drains.mux.Lock()
+		drains.pending = nil
+		drains.mux.Unlock()
+	}
+}
+
+func TestDrainOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order string
+		specs []string
+		down  string
+		want  string
+	}{
+		{"lowest weight first", DrainOrderWeight,
+			[]string{"localhost:9101?name=a&weight=3", "localhost:9102?name=b&weight=1", "localhost:9103?name=c&weight=2"}, "", "b,c,a"},
+		{"down first", DrainOrderWeight,
+			[]string{"localhost:9101?name=a&weight=1", "localhost:9102?name=b&weight=3"}, "b", "b,a"},
+		{"lowest capacity first", DrainOrderWeight,
+			[]string{"localhost:9101?name=a&capacity=20", "localhost:9102?name=b&capacity=10", "localhost:9103?name=c"}, "", "b,a,c"},
+		{"equals keep queue order", DrainOrderWeight,
+			[]string{"localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c"}, "", "a,b,c"},
+		{"fifo", DrainOrderFIFO,
+			[]string{"localhost:9101?name=a&weight=3", "localhost:9102?name=b&weight=1", "localhost:9103?name=c"}, "c", "a,b,c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, tt.specs...)()
+			defer holdDrains()()
+			defer func(order string) { drainOrder = order }(drainOrder)
+			drainOrder = tt.order
+			if tt.down != "" {
+				serverPool.GetBackend(tt.down).SetAlive(false)
+			}
+			queued := drains.Queue(serverPool.Backends()...)
+			if len(queued) != len(tt.specs) {
+				t.Fatalf("queued %d backends, want %d", len(queued), len(tt.specs))
+			}
+			// queueing twice doesn't change a thing
+			if again := drains.Queue(serverPool.Backends()...); len(again) != 0 {
+				t.Fatalf("queued %d backends twice", len(again))
+			}
+			var got []string
+			for _, b := range drains.Pending() {
+				got = append(got, b.ID)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Fatalf("drain order %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDrainBackendsHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		code    int
+		pending []string
+	}{
+		{"queue", http.MethodPost, `{"backends":["a","b"]}`, http.StatusAccepted, []string{"b", "a"}},
+		{"list", http.MethodGet, "", http.StatusOK, []string{}},
+		{"unknown backend", http.MethodPost, `{"backends":["a","x"]}`, http.StatusNotFound, nil},
+		{"no backends", http.MethodPost, `{"backends":[]}`, http.StatusBadRequest, nil},
+		{"invalid body", http.MethodPost, `backends`, http.StatusBadRequest, nil},
+		{"wrong method", http.MethodDelete, "", http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a&weight=2", "localhost:9102?name=b")()
+			defer holdDrains()()
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(tt.method, "/drain", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("answered %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.pending == nil {
+				if pending := drains.Pending(); len(pending) != 0 {
+					t.Fatalf("%d backends queued on a failed request", len(pending))
+				}
+				return
+			}
+			var body struct {
+				Order   string   `json:"order"`
+				Pending []string `json:"pending"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Order != drainOrder || strings.Join(body.Pending, ",") != strings.Join(tt.pending, ",") {
+				t.Fatalf("answered %+v, want order %s and %v pending", body, drainOrder, tt.pending)
+			}
+		})
+	}
+}
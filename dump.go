@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// dumpPool writes the state of the server pool in a readable table
+func dumpPool(w io.Writer) {
+	backends := serverPool.Backends()
+	fmt.Fprintf(w, "pool: %d backends, round-robin index %d, %d requests in flight, draining %v\n",
+		len(backends), atomic.LoadUint64(&serverPool.current),
+		atomic.LoadInt64(&inflight), atomic.LoadInt32(&draining) == 1)
+	fmt.Fprintf(w, "%-24s %-32s %-6s %-9s %-8s %-9s %-11s %s\n",
+		"ID", "URL", "ALIVE", "CORDONED", "WARMING", "INFLIGHT", "CONNECTIONS", "ROOM_LOAD")
+	for _, b := range backends {
+		fmt.Fprintf(w, "%-24s %-32s %-6v %-9v %-8v %-9d %-11d %d\n",
+			b.ID, b.URL, b.IsAlive(), b.IsCordoned(), b.IsWarming(),
+			b.Inflight(), b.ActiveConns(), b.roomLoad.Sum())
+	}
+}
+
+// handleDumps logs the pool state whenever the process gets a SIGUSR1
+func handleDumps() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		var dump strings.Builder
+		dumpPool(&dump)
+		log.Print("Received SIGUSR1, pool state\n", dump.String())
+	}
+}
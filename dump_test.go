@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDumpPool(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c")()
+	serverPool.GetBackend("b").SetAlive(false)
+	serverPool.GetBackend("c").SetCordoned(true)
+	serverPool.GetBackend("a").roomLoad.Add(7)
+	serverPool.GetNextPeer()
+	var out bytes.Buffer
+	dumpPool(&out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("dumped %d lines, want a summary, a header and 3 backends:\n%s", len(lines), out.String())
+	}
+	if want := "pool: 3 backends, round-robin index 0, 0 requests in flight, draining false"; lines[0] != want {
+		t.Fatalf("summary %q, want %q", lines[0], want)
+	}
+	if header := strings.Join(strings.Fields(lines[1]), " "); header != "ID URL ALIVE CORDONED WARMING INFLIGHT CONNECTIONS ROOM_LOAD" {
+		t.Fatalf("header %q", header)
+	}
+	rows := []string{
+		"a http://localhost:9101 true false false 0 0 7",
+		"b http://localhost:9102 false false false 0 0 0",
+		"c http://localhost:9103 true true false 0 0 0",
+	}
+	for i, want := range rows {
+		if row := strings.Join(strings.Fields(lines[i+2]), " "); row != want {
+			t.Errorf("row %d %q, want %q", i, row, want)
+		}
+	}
+}
+
+// syncBuffer is a buffer safe to log into from another goroutine
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestDumpOnSIGUSR1(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a")()
+	var out syncBuffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	// the signal would kill the test before the handler listens for it
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, syscall.SIGUSR1)
+	defer signal.Stop(caught)
+	go handleDumps()
+	deadline := time.Now().Add(2 * time.Second)
+	// keep signalling until the handler listens and dumps
+	for !strings.Contains(out.String(), "http://localhost:9101") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no pool state logged, got %q", out.String())
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// connectProxy is an HTTP CONNECT proxy counting the tunnels it opens,
+// refusing the first refuse ones
+type connectProxy struct {
+	listener net.Listener
+	tunnels  int64
+	refuse   int64
+}
+
+func newConnectProxy(t *testing.T) *connectProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &connectProxy{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.tunnel(conn)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) tunnel(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	upstream, err := net.Dial("tcp", req.Host)
+	if err == nil && atomic.AddInt64(&p.refuse, -1) >= 0 {
+		_ = upstream.Close()
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+	atomic.AddInt64(&p.tunnels, 1)
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	go func() { _, _ = io.Copy(upstream, conn) }()
+	_, _ = io.Copy(conn, upstream)
+}
+
+func (p *connectProxy) URL() string {
+	return "http://" + p.listener.Addr().String()
+}
+
+func TestChecksGoThroughProxy(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"ready":true}`)
+	}))
+	defer web.Close()
+	grpcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go func() { _ = grpcServer.Serve(grpcListener) }()
+	defer grpcServer.Stop()
+
+	proxy := newConnectProxy(t)
+	defer proxy.listener.Close()
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadProxy := "http://" + dead.Addr().String()
+	dead.Close()
+
+	webHost := strings.TrimPrefix(web.URL, "http://")
+	tests := []struct {
+		name  string
+		host  string
+		check string
+		proxy string
+		alive bool
+	}{
+		{"tcp", webHost, CheckTCP, proxy.URL(), true},
+		{"http", webHost, CheckHTTP, proxy.URL(), true},
+		{"grpc", grpcListener.Addr().String(), CheckGRPC, proxy.URL(), true},
+		{"tcp with the proxy down", webHost, CheckTCP, deadProxy, false},
+		{"http with the proxy down", webHost, CheckHTTP, deadProxy, false},
+		{"grpc with the proxy down", grpcListener.Addr().String(), CheckGRPC, deadProxy, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := buildBackend(tt.host + "?check=" + tt.check + "&proxy=" + tt.proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := atomic.LoadInt64(&proxy.tunnels)
+			if alive := b.probe(); alive != tt.alive {
+				t.Fatalf("probe() = %v, want %v", alive, tt.alive)
+			}
+			if tunneled := atomic.LoadInt64(&proxy.tunnels) > before; tunneled != tt.alive {
+				t.Fatalf("tunneled through the proxy = %v, want %v", tunneled, tt.alive)
+			}
+		})
+	}
+}
+
+func TestReadinessGoesThroughProxy(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"ready":true}`)
+	}))
+	defer web.Close()
+	proxy := newConnectProxy(t)
+	defer proxy.listener.Close()
+	b, err := buildBackend(strings.TrimPrefix(web.URL, "http://") + "?proxy=" + proxy.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.healthClient.Get(b.URL.String() + "/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt64(&proxy.tunnels) == 0 {
+		t.Fatal("the backend's health client didn't go through its proxy")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+)
+
+// routingError is a failure the balancer answers itself instead of a
+// backend, its code tells the failure classes apart
+type routingError struct {
+	Code    string
+	Status  int
+	Message string // sent to the client
+}
+
+func (e *routingError) Error() string {
+	return e.Message
+}
+
+// Failures answered by the balancer, the configurable statuses are read from
+// the STATUS_* settings
+var (
+	errForbidden      = &routingError{Code: "forbidden", Status: http.StatusForbidden, Message: "Forbidden"}
+	errNoRoute        = &routingError{Code: "no_route", Status: http.StatusNotFound, Message: "URL doesn't match any resource"}
+	errNoServer       = &routingError{Code: "room_not_found", Status: statusRoomNotFound, Message: "Server doesn't exists"}
+	errUnavailable    = &routingError{Code: "no_backend", Status: statusNoBackend, Message: "Service not available"}
+	errMaxAttempts    = &routingError{Code: "max_attempts", Status: statusMaxAttempts, Message: "Service not available"}
+	errRoomFull       = &routingError{Code: "room_full", Status: http.StatusTooManyRequests, Message: "Too many connections to this room"}
+	errTooManyCreates = &routingError{Code: "too_many_creates", Status: http.StatusTooManyRequests, Message: "Too many rooms being created"}
+	errOverloaded     = &routingError{Code: "overloaded", Status: http.StatusServiceUnavailable, Message: "Service not available"}
+	errUpstream       = &routingError{Code: "upstream_error", Status: statusUpstreamError, Message: "Bad gateway"}
+	errTimeout        = &routingError{Code: "timeout", Status: http.StatusGatewayTimeout, Message: "Gateway timeout"}
+	errBodyTooLarge   = &routingError{Code: "body_too_large", Status: http.StatusRequestEntityTooLarge, Message: "Request body too large"}
+	errNoWebsockets   = &routingError{Code: "websockets_unsupported", Status: http.StatusInternalServerError, Message: "Websockets not supported"}
+)
+
+// badRequest returns the error answered for a request the balancer can't make sense of
+func badRequest(err error) *routingError {
+	return &routingError{Code: "bad_request", Status: http.StatusBadRequest, Message: err.Error()}
+}
+
+// writeError answers a request with a routing error
+func writeError(w http.ResponseWriter, e *routingError) {
+	http.Error(w, e.Message, e.Status)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []*routingError{
+		errForbidden, errNoRoute, errNoServer, errUnavailable, errMaxAttempts, errRoomFull,
+		errTooManyCreates, errOverloaded, errUpstream, errTimeout, errBodyTooLarge, errNoWebsockets,
+		badRequest(errors.New("Request target must be a path")),
+	}
+	codes := make(map[string]bool)
+	for _, e := range tests {
+		t.Run(e.Code, func(t *testing.T) {
+			if codes[e.Code] {
+				t.Fatalf("code %s used twice", e.Code)
+			}
+			codes[e.Code] = true
+			w := httptest.NewRecorder()
+			writeError(w, e)
+			if w.Code != e.Status || w.Body.String() != e.Message+"\n" {
+				t.Fatalf("answered %d %q, want %d %q", w.Code, w.Body.String(), e.Status, e.Message)
+			}
+		})
+	}
+}
+
+func TestRoutingFailures(t *testing.T) {
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		down   bool // whether every backend is down
+		setup  func(r *http.Request) *http.Request
+		err    *routingError
+		routed bool // whether route itself gives the error, or lb before it
+	}{
+		{"unknown path", http.MethodGet, "/nope", false, nil, errNoRoute, true},
+		{"invalid room id", http.MethodGet, "/room/abc/state", false, nil, errNoRoute, true},
+		{"room out of range", http.MethodGet, "/room/90000/state", false, nil, errNoServer, true},
+		{"no backend for a new room", http.MethodPost, "/room", true, nil, errUnavailable, true},
+		{"room on a down backend", http.MethodGet, "/room/1/state", true, nil, errUnavailable, true},
+		{"too many attempts", http.MethodPost, "/room", false, func(r *http.Request) *http.Request {
+			return r.WithContext(context.WithValue(r.Context(), Attempts, 4))
+		}, errMaxAttempts, false},
+		{"old websocket", http.MethodGet, "/ws/1", false, func(r *http.Request) *http.Request {
+			r.Proto, r.ProtoMinor = "HTTP/1.0", 0
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			return r
+		}, badRequest(errors.New("Websockets need HTTP/1.1")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b")()
+			if tt.down {
+				for _, b := range serverPool.Backends() {
+					b.SetAlive(false)
+				}
+			}
+			newRequest := func() *http.Request {
+				r := httptest.NewRequest(tt.method, tt.path, nil)
+				if tt.setup != nil {
+					r = tt.setup(r)
+				}
+				return r
+			}
+			if tt.routed {
+				if _, err := route(withDryRun(newRequest())); err != tt.err {
+					t.Fatalf("route failed with %v, want %s", err, tt.err.Code)
+				}
+			}
+			w := httptest.NewRecorder()
+			lb(w, newRequest())
+			if w.Code != tt.err.Status || strings.TrimSpace(w.Body.String()) != tt.err.Message {
+				t.Fatalf("answered %d %q, want %d %q", w.Code, w.Body.String(), tt.err.Status, tt.err.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// excludeHeader names a backend new rooms and unmatched requests should
+// avoid, e.g. one under investigation
+const excludeHeader = "X-LB-Exclude"
+
+// excludeTrustedNetworks are the clients whose excludeHeader is honored,
+// empty ignores it from everyone
+var excludeTrustedNetworks []*net.IPNet
+
+// excludedBackend returns the backend r asks to avoid, nil when it doesn't
+// or isn't trusted to
+func excludedBackend(r *http.Request) *Backend {
+	name := r.Header.Get(excludeHeader)
+	if name == "" || len(excludeTrustedNetworks) == 0 {
+		return nil
+	}
+	if ip := clientIP(r); ip == nil || !inNetworks(ip, excludeTrustedNetworks) {
+		return nil
+	}
+	for _, b := range serverPool.Backends() {
+		if b.ID == name || b.URL.Host == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// pickExcluding runs pick on the backends of pool except the one r asks to
+// avoid, on the whole pool when nothing else is available
+func pickExcluding(pool *ServerPool, r *http.Request, pick func(*ServerPool) *Backend) *Backend {
+	excluded := excludedBackend(r)
+	if excluded == nil {
+		return pick(pool)
+	}
+	backends := pool.Backends()
+	kept := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b != excluded {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) > 0 {
+		sub := excluding(pool, kept)
+		sub.current = keptRotation(pool, excluded)
+		// the zone's rotation too, it's the one moving while local backends take the rooms
+		local := pool.Local()
+		if sub.local != nil && local != nil {
+			sub.local.current = keptRotation(local, excluded)
+		}
+		if peer := pick(sub); peer != nil {
+			// and move them on past the pick, like picking from the pool would
+			if !isDryRun(r) {
+				moveRotationTo(pool, peer)
+				if local != nil {
+					moveRotationTo(local, peer)
+				}
+			}
+			return peer
+		}
+	}
+	log.Printf("%s(%s) Only %s is available, ignoring %s\n", r.RemoteAddr, r.URL.Path, excluded.ID, excludeHeader)
+	return pick(pool)
+}
+
+// keptRotation returns where the rotation of pool is among its backends but
+// excluded: at the last kept backend up to its position, before the first
+// one otherwise
+func keptRotation(pool *ServerPool, excluded *Backend) uint64 {
+	backends := pool.Backends()
+	current := int(atomic.LoadUint64(&pool.current) % uint64(len(backends)))
+	position, kept := -1, 0
+	for i, b := range backends {
+		if b == excluded {
+			continue
+		}
+		if i <= current {
+			position++
+		}
+		kept++
+	}
+	if position < 0 {
+		position = kept - 1
+	}
+	return uint64(position)
+}
+
+// moveRotationTo moves the rotation of pool on to peer, when it's one of its backends
+func moveRotationTo(pool *ServerPool, peer *Backend) {
+	for i, b := range pool.Backends() {
+		if b == peer {
+			atomic.StoreUint64(&pool.current, uint64(i))
+		}
+	}
+}
+
+// excluding returns a view of pool holding the kept backends, whose weighted
+// round robin goes on with the pool's weights
+func excluding(pool *ServerPool, kept []*Backend) *ServerPool {
+	sub := newSubPool(kept)
+	sub.weightsOf = pool
+	if sub.local = localPool(kept); sub.local != nil {
+		sub.local.weightsOf = pool.Local()
+	}
+	return sub
+}
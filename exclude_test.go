@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPickExcluding(t *testing.T) {
+	trusted, err := parseNetworks([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(networks []*net.IPNet) { excludeTrustedNetworks = networks }(excludeTrustedNetworks)
+	excludeTrustedNetworks = trusted
+	defer func(zone string) { localZone = zone }(localZone)
+	weighted := (*ServerPool).GetWeightedPeer
+	roundRobin := (*ServerPool).GetNextPeer
+	tests := []struct {
+		name     string
+		specs    []string
+		zone     string // LB_ZONE
+		exclude  string
+		pick     func(*ServerPool) *Backend
+		picks    int
+		expected map[string]int
+	}{
+		{"weighted keeps the pool's weights", []string{"localhost:9101?name=a&weight=3", "localhost:9102?name=b", "localhost:9103?name=c"},
+			"", "c", weighted, 8, map[string]int{"a": 6, "b": 2}},
+		{"round robin moves on", []string{"localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c"},
+			"", "b", roundRobin, 4, map[string]int{"a": 2, "c": 2}},
+		{"round robin moves on within the zone", []string{"localhost:9101?name=a1&zone=a", "localhost:9102?name=a2&zone=a",
+			"localhost:9103?name=a3&zone=a", "localhost:9104?name=b1&zone=b"},
+			"a", "a1", roundRobin, 4, map[string]int{"a2": 2, "a3": 2}},
+		{"nothing excluded", []string{"localhost:9101?name=a", "localhost:9102?name=b"},
+			"", "", roundRobin, 4, map[string]int{"a": 2, "b": 2}},
+		{"only the excluded one", []string{"localhost:9101?name=a"},
+			"", "a", weighted, 2, map[string]int{"a": 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the local zone is picked out when the pool is set
+			localZone = tt.zone
+			defer setPool(t, tt.specs...)()
+			counts := make(map[string]int)
+			for i := 0; i < tt.picks; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/room", nil)
+				if tt.exclude != "" {
+					r.Header.Set(excludeHeader, tt.exclude)
+				}
+				counts[idOf(pickExcluding(&serverPool, r, tt.pick))]++
+			}
+			if len(counts) != len(tt.expected) {
+				t.Fatalf("picks %v, want %v", counts, tt.expected)
+			}
+			for id, n := range tt.expected {
+				if counts[id] != n {
+					t.Fatalf("picks %v, want %v", counts, tt.expected)
+				}
+			}
+		})
+	}
+}
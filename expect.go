@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Policies for requests sent with Expect: 100-continue
+const (
+	ExpectPassthrough = "passthrough"
+	ExpectBuffer      = "buffer"
+)
+
+// expectContinuePolicy is whether Expect: 100-continue is negotiated with the
+// backend, the client getting its 100 once the backend sent one, or answered
+// by the balancer which buffers the body and sends a plain request
+var expectContinuePolicy = envString("EXPECT_CONTINUE", ExpectPassthrough)
+
+// expectContinueTimeout is how long the backend has to answer 100 before the
+// body is sent anyway
+var expectContinueTimeout = envDuration("EXPECT_CONTINUE_TIMEOUT", time.Second)
+
+// expectBufferMaxBytes caps the bodies buffered for Expect: 100-continue
+var expectBufferMaxBytes = envInt("EXPECT_BUFFER_MAX_BYTES", 10<<20)
+
+// isValidExpectPolicy returns true for the supported EXPECT_CONTINUE values
+func isValidExpectPolicy(policy string) bool {
+	return policy == ExpectPassthrough || policy == ExpectBuffer
+}
+
+// bufferExpectedBody answers Expect: 100-continue for the backend when
+// buffering, reading the whole body so it's sent with a known length
+func bufferExpectedBody(r *http.Request) error {
+	if expectContinuePolicy != ExpectBuffer || !strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return nil
+	}
+	r.Header.Del("Expect")
+	// the server sends the client its 100 Continue on the first read
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(expectBufferMaxBytes)+1))
+	_ = r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > expectBufferMaxBytes {
+		return errBodyTooLarge
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpectContinue(t *testing.T) {
+	defer func(policy string, max int) {
+		expectContinuePolicy, expectBufferMaxBytes = policy, max
+	}(expectContinuePolicy, expectBufferMaxBytes)
+	type received struct {
+		expect string
+		body   string
+	}
+	got := make(chan received, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a backend turning the request down never asks for the body
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			got <- received{expect: r.Header.Get("Expect")}
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- received{r.Header.Get("Expect"), string(body)}
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	const body = "{\"players\":4}"
+	tests := []struct {
+		name      string
+		policy    string
+		max       int
+		auth      bool
+		continued bool // whether the client gets its 100 Continue
+		code      int
+		expect    string // Expect header the backend gets
+		body      string // the backend gets, empty when it's not reached
+	}{
+		{"passthrough", ExpectPassthrough, 1 << 20, true, true, http.StatusOK, "100-continue", body},
+		{"passthrough turned down", ExpectPassthrough, 1 << 20, false, false, http.StatusUnauthorized, "100-continue", ""},
+		{"buffer", ExpectBuffer, 1 << 20, true, true, http.StatusOK, "", body},
+		{"buffer too large", ExpectBuffer, 4, true, true, http.StatusRequestEntityTooLarge, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectContinuePolicy, expectBufferMaxBytes = tt.policy, tt.max
+			conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			auth := ""
+			if tt.auth {
+				auth = "Authorization: Bearer player\r\n"
+			}
+			_, _ = io.WriteString(conn, "POST /room HTTP/1.1\r\nHost: lb\r\nExpect: 100-continue\r\n"+auth+
+				"Content-Type: application/json\r\nContent-Length: 13\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if continued := resp.StatusCode == http.StatusContinue; continued != tt.continued {
+				t.Fatalf("first answer %d, want a 100 Continue %v", resp.StatusCode, tt.continued)
+			}
+			// the body only goes out once the client was told to continue
+			if tt.continued {
+				_, _ = io.WriteString(conn, body)
+				if resp, err = http.ReadResponse(br, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+			var r received
+			select {
+			case r = <-got:
+			default:
+				if tt.body != "" || tt.expect != "" {
+					t.Fatal("the request never reached the backend")
+				}
+				return
+			}
+			if r.expect != tt.expect || r.body != tt.body {
+				t.Fatalf("backend got Expect %q body %q, want %q %q", r.expect, r.body, tt.expect, tt.body)
+			}
+		})
+	}
+}
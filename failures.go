@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// failureLogSize is how many of the latest failed requests GET
+// /admin/failures keeps, 0 disables it
+var failureLogSize = envInt("FAILURE_LOG_SIZE", 50)
+
+// redactedHeaders are masked in failed requests, FAILURE_REDACT_HEADERS adds
+// to them
+var redactedHeaders = append([]string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"},
+	envList("FAILURE_REDACT_HEADERS")...)
+
+// failedRequest is a request the balancer gave up on
+type failedRequest struct {
+	Time     time.Time   `json:"time"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Client   net.IP      `json:"client"`
+	Header   http.Header `json:"header"`
+	Backends []string    `json:"backends"` // picked by each attempt, in order
+	Code     string      `json:"code"`
+	Error    string      `json:"error"`
+}
+
+// failureTrail follows a request through its attempts, it's only touched by
+// the goroutine serving the request
+type failureTrail struct {
+	backends []string
+	lastErr  error // last backend error, reported when the attempts run out
+}
+
+// getFailureTrail returns the trail of r, nil when the failure log is disabled
+func getFailureTrail(r *http.Request) *failureTrail {
+	trail, _ := r.Context().Value(Failures).(*failureTrail)
+	return trail
+}
+
+// FailureLog keeps the latest failed requests in a ring buffer
+type FailureLog struct {
+	mux     sync.Mutex
+	entries []failedRequest
+	next    int
+}
+
+var failureLog FailureLog
+
+// Add stores a failed request, overwriting the oldest once the log is full
+func (l *FailureLog) Add(f failedRequest) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if len(l.entries) < failureLogSize {
+		l.entries = append(l.entries, f)
+		return
+	}
+	l.entries[l.next] = f
+	l.next = (l.next + 1) % failureLogSize
+}
+
+// Recent returns the failed requests, oldest first
+func (l *FailureLog) Recent() []failedRequest {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	recent := make([]failedRequest, 0, len(l.entries))
+	recent = append(recent, l.entries[l.next:]...)
+	return append(recent, l.entries[:l.next]...)
+}
+
+// redactHeader copies header, masking the values of redactedHeaders
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := redacted[http.CanonicalHeaderKey(name)]; ok {
+			redacted.Set(name, "[redacted]")
+		}
+	}
+	return redacted
+}
+
+// recordFailure logs r as failed with e, cause is the error behind it when
+// there's more to it than the answer
+func recordFailure(r *http.Request, e *routingError, cause error) {
+	if failureLogSize <= 0 {
+		return
+	}
+	f := failedRequest{
+		Time:     time.Now(),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Client:   clientIP(r),
+		Header:   redactHeader(r.Header),
+		Backends: []string{},
+		Code:     e.Code,
+		Error:    e.Message,
+	}
+	if trail := getFailureTrail(r); trail != nil {
+		f.Backends = append(f.Backends, trail.backends...)
+		if cause == nil {
+			cause = trail.lastErr
+		}
+	}
+	if cause != nil {
+		f.Error = cause.Error()
+	}
+	failureLog.Add(f)
+}
+
+// failRequest records r as failed and answers it with e
+func failRequest(w http.ResponseWriter, r *http.Request, e *routingError, cause error) {
+	recordFailure(r, e, cause)
+	writeError(w, e)
+}
+
+// failuresHandler lists the latest failed requests on GET /admin/failures
+func failuresHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, failureLog.Recent())
+}
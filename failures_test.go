@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// resetFailureLog empties the failure log
+func resetFailureLog() {
+	failureLog.mux.Lock()
+	failureLog.entries, failureLog.next = nil, 0
+	failureLog.mux.Unlock()
+}
+
+func TestFailureLogRing(t *testing.T) {
+	defer func(size int) { failureLogSize = size }(failureLogSize)
+	tests := []struct {
+		name   string
+		size   int
+		adds   int
+		recent string // paths kept, oldest first
+	}{
+		{"empty", 3, 0, ""},
+		{"not full", 3, 2, "/0,/1"},
+		{"full", 3, 3, "/0,/1,/2"},
+		{"wrapped", 3, 5, "/2,/3,/4"},
+		{"wrapped twice", 3, 7, "/4,/5,/6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failureLogSize = tt.size
+			var log FailureLog
+			for i := 0; i < tt.adds; i++ {
+				log.Add(failedRequest{Path: fmt.Sprintf("/%d", i)})
+			}
+			var paths []string
+			for _, f := range log.Recent() {
+				paths = append(paths, f.Path)
+			}
+			if strings.Join(paths, ",") != tt.recent {
+				t.Fatalf("kept %v, want %s", paths, tt.recent)
+			}
+		})
+	}
+}
+
+func TestFailedRequestsListed(t *testing.T) {
+	defer func(size int, redacted []string) {
+		failureLogSize, redactedHeaders = size, redacted
+	}(failureLogSize, redactedHeaders)
+	failureLogSize = 10
+	redactedHeaders = append(redactedHeaders, "X-Player-Token")
+	defer resetFailureLog()
+	// nothing listens there once closed
+	var dead []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, l.Addr().String())
+		l.Close()
+	}
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer live.Close()
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		specs    []string
+		code     string // of the failure listed, empty when the request went through
+		backends string
+		error    string // part of the error listed
+	}{
+		{"went through", http.MethodPost, "/room", []string{strings.TrimPrefix(live.URL, "http://") + "?name=live"}, "", "", ""},
+		{"unknown path", http.MethodGet, "/nope", []string{dead[0] + "?name=a"}, "no_route", "", "URL doesn't match"},
+		{"every backend down", http.MethodPost, "/room", []string{dead[0] + "?name=a", dead[1] + "?name=b"}, "no_backend", "a,b", "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFailureLog()
+			defer setPool(t, tt.specs...)()
+			for serverPool.PeekNextPeer().ID != serverPool.Backends()[0].ID {
+				serverPool.GetNextPeer()
+			}
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			r.Header.Set("X-Player-Token", "secret")
+			r.Header.Set("User-Agent", "game-client/1.2")
+			lb(httptest.NewRecorder(), r)
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(http.MethodGet, "/admin/failures", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			var failures []failedRequest
+			if err := json.NewDecoder(w.Body).Decode(&failures); err != nil {
+				t.Fatal(err)
+			}
+			if tt.code == "" {
+				if len(failures) != 0 {
+					t.Fatalf("listed %+v, want nothing", failures)
+				}
+				return
+			}
+			if len(failures) != 1 {
+				t.Fatalf("listed %d failures, want 1", len(failures))
+			}
+			f := failures[0]
+			if f.Method != tt.method || f.Path != tt.path || f.Code != tt.code || !f.Client.Equal(net.ParseIP("192.0.2.1")) {
+				t.Fatalf("listed %s %s %s from %s, want %s %s %s", f.Method, f.Path, f.Code, f.Client, tt.method, tt.path, tt.code)
+			}
+			if strings.Join(f.Backends, ",") != tt.backends || !strings.Contains(f.Error, tt.error) {
+				t.Fatalf("listed backends %v error %q, want %s and %q", f.Backends, f.Error, tt.backends, tt.error)
+			}
+			for name, want := range map[string]string{"Authorization": "[redacted]", "X-Player-Token": "[redacted]", "User-Agent": "game-client/1.2"} {
+				if got := f.Header.Get(name); got != want {
+					t.Fatalf("%s listed as %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -1,3 +1,8 @@
 module github.com/coff33un/game-server-balancer
 
 go 1.13
+
+require (
+	google.golang.org/grpc v1.38.1
+	google.golang.org/protobuf v1.25.0
+)
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// adminGRPCAddr is where the gRPC admin service binds, empty disables it.
+// Keep it off public interfaces like ADMIN_ADDR.
+var adminGRPCAddr = envString("ADMIN_GRPC_ADDR", "")
+
+// adminServiceName is the service of admin.proto
+const adminServiceName = "balancer.admin.v1.Admin"
+
+// adminPool is the pool the gRPC admin service works on, the balancer's
+// ServerPool or a fake one
+type adminPool interface {
+	Backends() []*Backend
+	GetBackend(id string) *Backend
+	AddBackend(b *Backend)
+	RemoveBackend(id string) *Backend
+}
+
+// adminService is what adminServiceDesc is registered with
+type adminService struct {
+	pool adminPool
+}
+
+// errBackendExists is returned adding a backend whose id is in the pool
+var errBackendExists = errors.New("backend is already in the pool")
+
+// addBackend builds the backend of spec and puts it in the pool, it's kept
+// over server list reloads like a discovered one
+func (s *adminService) addBackend(spec string) (*Backend, error) {
+	b, err := buildBackend(spec)
+	if err != nil {
+		return nil, err
+	}
+	if s.pool.GetBackend(b.ID) != nil {
+		return nil, fmt.Errorf("%s: %w", b.ID, errBackendExists)
+	}
+	s.pool.AddBackend(b)
+	log.Printf("Configured server: %s\n", b.URL)
+	go b.warm()
+	return b, nil
+}
+
+// adminServiceDesc serves admin.proto. Its messages are well-known types, so
+// it's registered by hand rather than out of generated code.
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: adminServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		adminMethod("Status", newEmpty, func(s *adminService, _ proto.Message) (proto.Message, error) {
+			out := new(structpb.Struct)
+			return out, toProtoJSON(poolStatus(s.pool.Backends()), out)
+		}),
+		adminMethod("ListBackends", newEmpty, func(s *adminService, _ proto.Message) (proto.Message, error) {
+			l := new(structpb.ListValue)
+			return l, toProtoJSON(backendStatuses(s.pool.Backends()), l)
+		}),
+		adminMethod("AddBackend", newString, func(s *adminService, in proto.Message) (proto.Message, error) {
+			b, err := s.addBackend(in.(*wrapperspb.StringValue).GetValue())
+			if errors.Is(err, errBackendExists) {
+				return nil, status.Error(codes.AlreadyExists, err.Error())
+			}
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			added := new(structpb.Struct)
+			return added, toProtoJSON(newBackendStatus(b), added)
+		}),
+		adminMethod("RemoveBackend", newString, func(s *adminService, in proto.Message) (proto.Message, error) {
+			b := s.pool.RemoveBackend(in.(*wrapperspb.StringValue).GetValue())
+			if b == nil {
+				return nil, status.Error(codes.NotFound, "Backend not found")
+			}
+			log.Printf("Removed server: %s\n", b.URL)
+			return new(emptypb.Empty), nil
+		}),
+		backendAction("CordonBackend", func(b *Backend) {
+			b.SetCordoned(true)
+			log.Printf("%s [cordon]\n", b.URL)
+		}),
+		backendAction("UncordonBackend", func(b *Backend) {
+			b.SetCordoned(false)
+			log.Printf("%s [uncordon]\n", b.URL)
+		}),
+		backendAction("DrainBackend", func(b *Backend) { drains.Queue(b) }),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
+
+func newEmpty() proto.Message  { return new(emptypb.Empty) }
+func newString() proto.Message { return new(wrapperspb.StringValue) }
+
+// adminMethod wraps call as a unary method taking the message newIn builds
+func adminMethod(name string, newIn func() proto.Message, call func(*adminService, proto.Message) (proto.Message, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			handle := func(_ context.Context, in interface{}) (interface{}, error) {
+				return call(srv.(*adminService), in.(proto.Message))
+			}
+			in := newIn()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return handle(ctx, in)
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + adminServiceName + "/" + name}, handle)
+		},
+	}
+}
+
+// backendAction is a method applying apply to the backend of the id it's given
+func backendAction(name string, apply func(*Backend)) grpc.MethodDesc {
+	return adminMethod(name, newString, func(s *adminService, in proto.Message) (proto.Message, error) {
+		b := s.pool.GetBackend(in.(*wrapperspb.StringValue).GetValue())
+		if b == nil {
+			return nil, status.Error(codes.NotFound, "Backend not found")
+		}
+		apply(b)
+		return new(emptypb.Empty), nil
+	})
+}
+
+// toProtoJSON fills m with v as the HTTP admin would encode it
+func toProtoJSON(v interface{}, m proto.Message) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := protojson.Unmarshal(data, m); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// serveAdminGRPC serves the gRPC admin service on adminGRPCAddr until server
+// is stopped
+func serveAdminGRPC(server *grpc.Server) {
+	listener, err := net.Listen("tcp", adminGRPCAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("gRPC admin server started at %s\n", adminGRPCAddr)
+	if err := server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+		log.Fatal(err)
+	}
+}
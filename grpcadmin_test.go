@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakePool is an adminPool holding backends in a slice
+type fakePool struct {
+	mux      sync.Mutex
+	backends []*Backend
+}
+
+func newFakePool(t *testing.T, specs ...string) *fakePool {
+	t.Helper()
+	p := &fakePool{}
+	for _, spec := range specs {
+		b, err := buildBackend(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.backends = append(p.backends, b)
+	}
+	return p
+}
+
+func (p *fakePool) Backends() []*Backend {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return append([]*Backend(nil), p.backends...)
+}
+
+func (p *fakePool) GetBackend(id string) *Backend {
+	for _, b := range p.Backends() {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+func (p *fakePool) AddBackend(b *Backend) {
+	p.mux.Lock()
+	p.backends = append(p.backends, b)
+	p.mux.Unlock()
+}
+
+func (p *fakePool) RemoveBackend(id string) *Backend {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for i, b := range p.backends {
+		if b.ID == id {
+			p.backends = append(p.backends[:i:i], p.backends[i+1:]...)
+			return b
+		}
+	}
+	return nil
+}
+
+// ids lists the ids of the backends in the pool
+func (p *fakePool) ids() string {
+	var ids []string
+	for _, b := range p.Backends() {
+		ids = append(ids, b.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// serveAdminOn serves the gRPC admin service on pool, returning a client
+// connection and how to stop it all
+func serveAdminOn(t *testing.T, pool adminPool) (*grpc.ClientConn, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&adminServiceDesc, &adminService{pool: pool})
+	go func() { _ = server.Serve(listener) }()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		server.Stop()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		server.Stop()
+	}
+}
+
+func TestServeAdminGRPCStopped(t *testing.T) {
+	defer func(addr string) { adminGRPCAddr = addr }(adminGRPCAddr)
+	adminGRPCAddr = "127.0.0.1:0"
+	server := grpc.NewServer()
+	server.Stop()
+	// returns rather than exiting on grpc.ErrServerStopped
+	serveAdminGRPC(server)
+}
+
+func TestAdminGRPC(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		arg    string
+		code   codes.Code
+		ids    string // in the pool afterwards
+		check  func(t *testing.T, pool *fakePool, out proto.Message)
+	}{
+		{"status", "Status", "", codes.OK, "a,b", func(t *testing.T, pool *fakePool, out proto.Message) {
+			if n := len(out.(*structpb.Struct).Fields["backends"].GetListValue().GetValues()); n != 2 {
+				t.Fatalf("status lists %d backends, want 2", n)
+			}
+		}},
+		{"list", "ListBackends", "", codes.OK, "a,b", func(t *testing.T, pool *fakePool, out proto.Message) {
+			var ids []string
+			for _, v := range out.(*structpb.ListValue).GetValues() {
+				ids = append(ids, v.GetStructValue().Fields["id"].GetStringValue())
+			}
+			if strings.Join(ids, ",") != "a,b" {
+				t.Fatalf("listed %v, want a and b", ids)
+			}
+		}},
+		{"add", "AddBackend", "localhost:9103?name=c", codes.OK, "a,b,c", func(t *testing.T, pool *fakePool, out proto.Message) {
+			if id := out.(*structpb.Struct).Fields["id"].GetStringValue(); id != "c" {
+				t.Fatalf("answered the status of %q, want c", id)
+			}
+		}},
+		{"add a taken id", "AddBackend", "localhost:9103?name=a", codes.AlreadyExists, "a,b", nil},
+		{"add an invalid spec", "AddBackend", "localhost:9103?weight=0", codes.InvalidArgument, "a,b", nil},
+		{"remove", "RemoveBackend", "a", codes.OK, "b", nil},
+		{"remove an unknown backend", "RemoveBackend", "z", codes.NotFound, "a,b", nil},
+		{"cordon", "CordonBackend", "a", codes.OK, "a,b", func(t *testing.T, pool *fakePool, out proto.Message) {
+			if !pool.GetBackend("a").IsCordoned() {
+				t.Fatal("a not cordoned")
+			}
+		}},
+		{"uncordon", "UncordonBackend", "b", codes.OK, "a,b", func(t *testing.T, pool *fakePool, out proto.Message) {
+			if pool.GetBackend("b").IsCordoned() {
+				t.Fatal("b still cordoned")
+			}
+		}},
+		{"cordon an unknown backend", "CordonBackend", "z", codes.NotFound, "a,b", nil},
+		{"drain", "DrainBackend", "b", codes.OK, "a,b", func(t *testing.T, pool *fakePool, out proto.Message) {
+			if !drains.IsQueued(pool.GetBackend("b")) {
+				t.Fatal("b not queued to drain")
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9201?name=real")()
+			defer holdDrains()()
+			pool := newFakePool(t, "localhost:9101?name=a", "localhost:9102?name=b")
+			pool.GetBackend("b").SetCordoned(true)
+			conn, stop := serveAdminOn(t, pool)
+			defer stop()
+
+			var in, out proto.Message = new(emptypb.Empty), new(emptypb.Empty)
+			if tt.arg != "" {
+				in = wrapperspb.String(tt.arg)
+			}
+			switch tt.method {
+			case "Status", "AddBackend":
+				out = new(structpb.Struct)
+			case "ListBackends":
+				out = new(structpb.ListValue)
+			}
+			err := conn.Invoke(context.Background(), "/"+adminServiceName+"/"+tt.method, in, out)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("%s(%q) answered %v, want %v", tt.method, tt.arg, err, tt.code)
+			}
+			if ids := pool.ids(); ids != tt.ids {
+				t.Fatalf("pool holds %s, want %s", ids, tt.ids)
+			}
+			if tt.check != nil {
+				tt.check(t, pool, out)
+			}
+			// only the pool the service was given is touched
+			if backends := serverPool.Backends(); len(backends) != 1 || backends[0].ID != "real" || backends[0].IsCordoned() {
+				t.Fatal("the balancer's pool was changed")
+			}
+		})
+	}
+}
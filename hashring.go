@@ -0,0 +1,110 @@
+package main
+
+import (
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// hashRingReplicas is the number of points each backend gets on the ring
+var hashRingReplicas = envInt("HASH_RING_REPLICAS", 100)
+
+// hashLoadFactor caps a backend's load at this many times the average, the
+// keys hashing to a backend over it spill to the next one on the ring. 0 disables it
+var hashLoadFactor = envFloat("HASH_LOAD_FACTOR", 0)
+
+// HashRing consistently maps keys to backends, so adding or removing a
+// backend only moves the keys next to it
+type HashRing struct {
+	hashes   []uint32
+	backends map[uint32]*Backend
+	members  []*Backend
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// newHashRing returns a ring holding backends
+func newHashRing(backends []*Backend) *HashRing {
+	ring := &HashRing{}
+	for _, b := range backends {
+		ring.Add(b)
+	}
+	return ring
+}
+
+// Add places a backend on the ring
+func (h *HashRing) Add(b *Backend) {
+	if h.backends == nil {
+		h.backends = make(map[uint32]*Backend)
+	}
+	for i := 0; i < hashRingReplicas; i++ {
+		hash := hashKey(strconv.Itoa(i) + b.ID)
+		if _, ok := h.backends[hash]; ok {
+			continue
+		}
+		h.backends[hash] = b
+		h.hashes = append(h.hashes, hash)
+	}
+	h.members = append(h.members, b)
+	sort.Slice(h.hashes, func(i, j int) bool { return h.hashes[i] < h.hashes[j] })
+}
+
+// Get returns the backend owning key
+func (h *HashRing) Get(key string) *Backend {
+	if len(h.hashes) == 0 {
+		return nil
+	}
+	return h.backends[h.hashes[h.search(key)]]
+}
+
+// GetBounded returns the first backend from key's position on the ring whose
+// load stays within factor times the average once it takes key, falling back
+// to the owner of key when every backend is over it
+func (h *HashRing) GetBounded(key string, factor float64, load func(*Backend) int64) *Backend {
+	if len(h.hashes) == 0 || factor <= 0 {
+		return h.Get(key)
+	}
+	var total int64
+	for _, b := range h.members {
+		total += load(b)
+	}
+	bound := math.Ceil(factor * float64(total+1) / float64(len(h.members)))
+	if b := h.GetFirst(key, func(b *Backend) bool { return float64(load(b)+1) <= bound }); b != nil {
+		return b
+	}
+	return h.Get(key)
+}
+
+// GetFirst returns the first backend from key's position on the ring that
+// accept takes, nil when it takes none
+func (h *HashRing) GetFirst(key string, accept func(*Backend) bool) *Backend {
+	if len(h.hashes) == 0 {
+		return nil
+	}
+	start := h.search(key)
+	seen := make(map[*Backend]bool, len(h.members))
+	for i := 0; i < len(h.hashes) && len(seen) < len(h.members); i++ {
+		b := h.backends[h.hashes[(start+i)%len(h.hashes)]]
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+		if accept(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// search returns the index of the first point at or after key's hash
+func (h *HashRing) search(key string) int {
+	hash := hashKey(key)
+	idx := sort.Search(len(h.hashes), func(i int) bool { return h.hashes[i] >= hash })
+	if idx == len(h.hashes) {
+		idx = 0
+	}
+	return idx
+}
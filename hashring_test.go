@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// ringBackends builds n backends to put on a ring
+func ringBackends(t *testing.T, n int) []*Backend {
+	t.Helper()
+	backends := make([]*Backend, n)
+	for i := range backends {
+		b, err := buildBackend("localhost:" + strconv.Itoa(9101+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends[i] = b
+	}
+	return backends
+}
+
+func TestHashRingMovesFewKeys(t *testing.T) {
+	backends := ringBackends(t, 5)
+	full := newHashRing(backends)
+	// the ring without the last backend
+	smaller := newHashRing(backends[:4])
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		owner := full.Get(key)
+		if owner != backends[4] && smaller.Get(key) != owner {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Fatalf("%d keys moved between the backends that stayed", moved)
+	}
+}
+
+func TestGetBoundedHoldsLoadBound(t *testing.T) {
+	tests := []struct {
+		name    string
+		factor  float64
+		bounded bool // whether no backend goes over factor times the average
+	}{
+		{"unbounded", 0, false},
+		{"1.25", 1.25, true},
+		{"1.5", 1.5, true},
+		{"2", 2, true},
+	}
+	backends := ringBackends(t, 5)
+	ring := newHashRing(backends)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a handful of rooms get most of the players
+			rng := rand.New(rand.NewSource(1))
+			zipf := rand.NewZipf(rng, 1.2, 1, 1000)
+			load := make(map[*Backend]int64)
+			loadOf := func(b *Backend) int64 { return load[b] }
+			within := true
+			for total := int64(1); total <= 5000; total++ {
+				room := strconv.FormatUint(zipf.Uint64(), 10)
+				b := ring.GetBounded(room, tt.factor, loadOf)
+				load[b]++
+				if tt.factor > 0 && float64(load[b]) > math.Ceil(tt.factor*float64(total)/float64(len(backends))) {
+					t.Fatalf("%s holds %d of %d, over %.2f times the average", b.ID, load[b], total, tt.factor)
+				}
+				if float64(load[b]) > math.Ceil(1.25*float64(total)/float64(len(backends))) {
+					within = false
+				}
+			}
+			// without a bound the popular rooms pile up on their owners
+			if !tt.bounded && within {
+				t.Fatalf("loads %v stayed within the bound without one", load)
+			}
+		})
+	}
+}
+
+func TestGetBoundedKeepsOwners(t *testing.T) {
+	backends := ringBackends(t, 5)
+	ring := newHashRing(backends)
+	// with even loads every room stays on the backend owning it
+	even := func(b *Backend) int64 { return 100 }
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if b := ring.GetBounded(key, 1.25, even); b != ring.Get(key) {
+			t.Fatalf("room %s moved to %s off its owner %s", key, b.ID, ring.Get(key).ID)
+		}
+	}
+	// an overloaded owner spills its rooms to the next backend, not anywhere
+	key := "42"
+	owner := ring.Get(key)
+	hot := func(b *Backend) int64 {
+		if b == owner {
+			return 1000
+		}
+		return 100
+	}
+	next := ring.GetFirst(key, func(b *Backend) bool { return b != owner })
+	if b := ring.GetBounded(key, 1.25, hot); b != next {
+		t.Fatalf("room %s spilled to %s, want the next one %s", key, b.ID, next.ID)
+	}
+}
+
+func TestLoadCountsWebsocketsOnce(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String())()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	b := serverPool.Backends()[0]
+
+	defer waitWebsockets(t, 0)
+	for i := 1; i <= 2; i++ {
+		conn, _, resp := openWS(t, front.URL, "/ws/"+strconv.Itoa(i), "")
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		if load := b.Load(); load != int64(i) {
+			t.Fatalf("load %d with %d websockets open (%d in flight, %d connections)",
+				load, i, b.Inflight(), b.ActiveConns())
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// stripRequestHeaders are removed from requests before they reach a backend,
+// e.g. internal auth tokens clients shouldn't be able to forge
+var stripRequestHeaders = envList("STRIP_REQUEST_HEADERS")
+
+// stripResponseHeaders are removed from backend responses before they reach
+// clients, e.g. Server or X-Internal-Node
+var stripResponseHeaders = envList("STRIP_RESPONSE_HEADERS")
+
+// preserveHost forwards the Host clients sent, for backends routing on
+// virtual hosts, false sends the backend's own host:port instead
+var preserveHost = envBool("PRESERVE_HOST", true)
+
+// setRequestHeaders are forced on every request reaching a backend, parsed
+// from `Name:value` items
+var setRequestHeaders http.Header
+
+// parseHeaderSets parses `Name:value` items into the headers they set
+func parseHeaderSets(items []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, item := range items {
+		parts := strings.SplitN(item, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("invalid header %q, expected Name:value", item)
+		}
+		header.Set(name, strings.TrimSpace(parts[1]))
+	}
+	return header, nil
+}
+
+// filterRequestHeaders strips the denied request headers and forces the set ones
+func filterRequestHeaders(header http.Header) {
+	for _, name := range stripRequestHeaders {
+		header.Del(name)
+	}
+	for name, values := range setRequestHeaders {
+		header[name] = append([]string(nil), values...)
+	}
+}
+
+// filterResponseHeaders strips the denied response headers
+func filterResponseHeaders(header http.Header) {
+	for _, name := range stripResponseHeaders {
+		header.Del(name)
+	}
+}
+
+// setHost points req at the backend's own host unless it's to keep the
+// client's Host
+func (b *Backend) setHost(req *http.Request) {
+	if !b.preserveHost {
+		req.Host = b.URL.Host
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseHeaderSets(t *testing.T) {
+	tests := []struct {
+		items []string
+		want  http.Header
+		err   bool
+	}{
+		{nil, http.Header{}, false},
+		{[]string{"X-Env:prod"}, http.Header{"X-Env": {"prod"}}, false},
+		{[]string{"x-env: prod ", "Via:lb"}, http.Header{"X-Env": {"prod"}, "Via": {"lb"}}, false},
+		{[]string{"X-Url:http://lb:8080"}, http.Header{"X-Url": {"http://lb:8080"}}, false},
+		{[]string{"X-Empty:"}, http.Header{"X-Empty": {""}}, false},
+		{[]string{"X-Env"}, nil, true},
+		{[]string{":prod"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseHeaderSets(tt.items)
+		if (err != nil) != tt.err || (!tt.err && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseHeaderSets(%q) = %v, %v, want %v and error %v", tt.items, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestHeaderFiltering(t *testing.T) {
+	var mux sync.Mutex
+	var seen http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		seen = r.Header.Clone()
+		mux.Unlock()
+		if !isWebSocket(r) {
+			w.Header().Set("X-Internal-Node", "node-7")
+			w.Header().Set("X-Room", "1")
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"X-Internal-Node: node-7\r\nX-Room: 1\r\n\r\n"))
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(strip, stripResp []string, set http.Header) {
+		stripRequestHeaders, stripResponseHeaders, setRequestHeaders = strip, stripResp, set
+	}(stripRequestHeaders, stripResponseHeaders, setRequestHeaders)
+	stripRequestHeaders = []string{"Authorization", "X-Internal-Token"}
+	stripResponseHeaders = []string{"X-Internal-Node"}
+	set, err := parseHeaderSets([]string{"X-Lb-Env:prod", "X-Internal-Token:lb-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRequestHeaders = set
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+
+	sent := "Authorization: Bearer player\r\nX-Internal-Token: forged\r\nX-Lb-Env: dev\r\nX-Player: 42\r\n"
+	check := func(t *testing.T, response http.Header) {
+		t.Helper()
+		mux.Lock()
+		defer mux.Unlock()
+		tests := []struct {
+			header string
+			value  string
+		}{
+			{"Authorization", ""},
+			// forced headers replace what clients send
+			{"X-Internal-Token", "lb-secret"},
+			{"X-Lb-Env", "prod"},
+			{"X-Player", "42"},
+		}
+		for _, tt := range tests {
+			if got := strings.Join(seen[http.CanonicalHeaderKey(tt.header)], ","); got != tt.value {
+				t.Errorf("backend got %s %q, want %q", tt.header, got, tt.value)
+			}
+		}
+		if got := response.Get("X-Internal-Node"); got != "" {
+			t.Errorf("client got X-Internal-Node %q, want it stripped", got)
+		}
+		if got := response.Get("X-Room"); got != "1" {
+			t.Errorf("client got X-Room %q, want it kept", got)
+		}
+	}
+
+	t.Run("http", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, front.URL+"/room/1/state", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(sent), "\r\n") {
+			parts := strings.SplitN(line, ": ", 2)
+			req.Header.Set(parts[0], parts[1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		check(t, resp.Header)
+	})
+	t.Run("websocket", func(t *testing.T) {
+		conn, _, resp := openWS(t, front.URL, "/ws/1", sent)
+		defer conn.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		check(t, resp.Header)
+	})
+}
+
+func TestPreserveHost(t *testing.T) {
+	hosts := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		if !isWebSocket(r) {
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(preserve bool) { preserveHost = preserve }(preserveHost)
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name     string
+		preserve bool   // PRESERVE_HOST
+		option   string // preserve_host of the backend, empty when unset
+		kept     bool   // whether the backend gets the client's Host
+	}{
+		{"preserved by default", true, "", true},
+		{"rewritten", false, "", false},
+		{"backend preserves", false, "true", true},
+		{"backend rewrites", true, "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preserveHost = tt.preserve
+			spec := backendHost
+			if tt.option != "" {
+				spec += "?preserve_host=" + tt.option
+			}
+			defer setPool(t, spec)()
+
+			r := httptest.NewRequest(http.MethodGet, "/room/1/state", nil)
+			r.Host = "play.example.com"
+			lb(httptest.NewRecorder(), r)
+			want := backendHost
+			if tt.kept {
+				want = "play.example.com"
+			}
+			if got := <-hosts; got != want {
+				t.Fatalf("http: backend got Host %q, want %q", got, want)
+			}
+
+			conn, _, resp := openWS(t, front.URL, "/ws/1", "")
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			// openWS sends Host: lb
+			if tt.kept {
+				want = "lb"
+			}
+			if got := <-hosts; got != want {
+				t.Fatalf("websocket: backend got Host %q, want %q", got, want)
+			}
+		})
+	}
+	if _, err := buildBackend(backendHost + "?preserve_host=maybe"); err == nil {
+		t.Fatal("built a backend with preserve_host=maybe")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Health check types a backend can be configured with
+const (
+	CheckTCP  = "tcp"
+	CheckHTTP = "http"
+	CheckGRPC = "grpc"
+)
+
+// healthCheckType is used for backends that don't configure their own
+var healthCheckType = envString("HEALTH_CHECK_TYPE", CheckTCP)
+
+// healthCheckPath is requested by the http check
+var healthCheckPath = envString("HEALTH_CHECK_PATH", "/health")
+
+// healthCheckMethod is the method of the http check request
+var healthCheckMethod = envString("HEALTH_CHECK_METHOD", http.MethodGet)
+
+// healthCheckStatus lists the status codes, or classes like 2xx, the http check accepts
+var healthCheckStatus = envString("HEALTH_CHECK_STATUS", "2xx")
+
+// healthCheckBody is a pattern the http check response body must match, if set
+var healthCheckBody = envString("HEALTH_CHECK_BODY", "")
+
+// grpcHealthService is the service name sent by the grpc check, empty means the whole server
+var grpcHealthService = envString("GRPC_HEALTH_SERVICE", "")
+
+// initialHealthCheck checks every backend once before the listener opens, so
+// requests don't go to backends that were down from the start
+var initialHealthCheck = envBool("INITIAL_HEALTH_CHECK", true)
+
+// healthCheckInterval is the time between two health check passes
+var healthCheckInterval = 20 * time.Second
+
+// healthLatencySLO is the probe latency above which a backend is degraded,
+// it only takes new rooms no healthy backend can. 0 disables it.
+var healthLatencySLO = envDuration("HEALTH_LATENCY_SLO", 0)
+
+// healthyThreshold is the number of consecutive successful probes to mark a backend up
+var healthyThreshold = envInt("HEALTHY_THRESHOLD", 2)
+
+// unhealthyThreshold is the number of consecutive failed probes to mark a backend down
+var unhealthyThreshold = envInt("UNHEALTHY_THRESHOLD", 3)
+
+// passiveHealthGrace is how long after being added failed requests don't mark
+// a backend down, leaving it to the active checks while it warms up
+var passiveHealthGrace = envDuration("PASSIVE_HEALTH_GRACE", 0)
+
+// healthCheckConnectTimeout bounds opening the connection of a health check
+var healthCheckConnectTimeout = envDuration("HEALTH_CHECK_CONNECT_TIMEOUT", 2*time.Second)
+
+// healthCheckTimeout bounds a whole health check, so a backend accepting
+// connections but never answering still fails
+var healthCheckTimeout = envDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second)
+
+// healthCheckConcurrency is how many backends are checked at once
+var healthCheckConcurrency = envInt("HEALTH_CHECK_CONCURRENCY", 10)
+
+var healthClient = newHealthClient(nil, nil)
+
+// newHealthClient returns the client of the http check, backends with a TLS
+// config or a proxy of their own get their own client dialing with dial
+func newHealthClient(tlsConfig *tls.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: healthCheckConnectTimeout}).DialContext
+	if dial != nil {
+		transport.DialContext = dial
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: healthCheckTimeout}
+}
+
+// isValidCheckType returns true for the supported health check types
+func isValidCheckType(checkType string) bool {
+	return checkType == CheckTCP || checkType == CheckHTTP || checkType == CheckGRPC
+}
+
+// ejectBackend marks a backend down after failed requests, unless it's still
+// in its grace period
+func ejectBackend(b *Backend) {
+	if time.Since(b.added) < passiveHealthGrace {
+		log.Printf("[%s] still in its grace period, not marking it down\n", b.URL.Host)
+		return
+	}
+	serverPool.MarkBackendStatus(b.ID, false)
+}
+
+// recordLatency flags the backend degraded while its probes answer slower
+// than the latency SLO
+func (b *Backend) recordLatency(latency time.Duration) {
+	if healthLatencySLO <= 0 {
+		return
+	}
+	degraded := latency > healthLatencySLO
+	b.mux.Lock()
+	changed := b.degraded != degraded
+	b.degraded = degraded
+	b.mux.Unlock()
+	if changed && degraded {
+		log.Printf("[%s] degraded, health check took %s\n", b.ID, latency)
+	} else if changed {
+		log.Printf("[%s] healthy again, health check took %s\n", b.ID, latency)
+	}
+}
+
+// IsDegraded returns true while the backend's health checks are too slow
+func (b *Backend) IsDegraded() (degraded bool) {
+	b.mux.RLock()
+	degraded = b.degraded
+	b.mux.RUnlock()
+	return
+}
+
+// onlyAsFallback returns true for backends that only take new rooms no
+// other backend can, while warming up or degraded
+func (b *Backend) onlyAsFallback() bool {
+	return b.IsWarming() || b.IsDegraded()
+}
+
+// probe checks whether the backend is alive using its configured check type
+func (b *Backend) probe() bool {
+	switch b.CheckType {
+	case CheckHTTP:
+		return isHTTPAlive(b.healthClient, b.URL, b.httpProbe)
+	case CheckGRPC:
+		var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+		if b.proxy != nil {
+			dial = b.healthDial
+		}
+		return isGRPCAlive(b.URL, b.clientTLSConfig(), dial)
+	}
+	return isBackendAlive(b)
+}
+
+// httpProbe is the request made by the http check and the answer it expects
+type httpProbe struct {
+	method   string
+	path     string
+	statuses []string       // codes like 200 or classes like 2xx
+	body     *regexp.Regexp // matched against the response body when set
+}
+
+// newHTTPProbe builds the http check of a backend out of its options,
+// falling back to the HEALTH_CHECK_* settings
+func newHTTPProbe(options url.Values) (*httpProbe, error) {
+	p := &httpProbe{
+		method: optionOr(options, "probe_method", healthCheckMethod),
+		path:   optionOr(options, "probe_path", healthCheckPath),
+		statuses: strings.FieldsFunc(optionOr(options, "probe_status", healthCheckStatus), func(r rune) bool {
+			return r == ',' || r == '|'
+		}),
+	}
+	for _, status := range p.statuses {
+		if len(status) != 3 {
+			return nil, fmt.Errorf("invalid probe status %q", status)
+		}
+	}
+	if body := optionOr(options, "probe_body", healthCheckBody); body != "" {
+		re, err := regexp.Compile(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid probe body: %v", err)
+		}
+		p.body = re
+	}
+	return p, nil
+}
+
+// acceptsStatus returns true when code is one of the expected statuses
+func (p *httpProbe) acceptsStatus(code int) bool {
+	s := strconv.Itoa(code)
+	for _, status := range p.statuses {
+		if status == s || (strings.HasSuffix(status, "xx") && status[0] == s[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTPAlive checks whether a backend is Alive by requesting its health
+// path, the status and body must both match what the probe expects
+func isHTTPAlive(client *http.Client, u *url.URL, p *httpProbe) bool {
+	req, err := http.NewRequest(p.method, u.String()+p.path, nil)
+	if err != nil {
+		log.Println("Invalid health check, error: ", err)
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if !p.acceptsStatus(resp.StatusCode) {
+		log.Printf("%s answered health check with %s\n", u, resp.Status)
+		return false
+	}
+	if p.body == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return true
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		log.Println("Health check failed, error: ", err)
+		return false
+	}
+	if !p.body.Match(body) {
+		log.Printf("%s health check body doesn't match %s\n", u, p.body)
+		return false
+	}
+	return true
+}
+
+// isGRPCAlive checks whether a backend is Alive using the grpc health checking
+// protocol, dialing with dial unless it's nil
+func isGRPCAlive(u *url.URL, tlsConfig *tls.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	creds := grpc.WithInsecure()
+	if getSecure() != "" {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	dialCtx, cancelDial := context.WithTimeout(ctx, healthCheckConnectTimeout)
+	defer cancelDial()
+	options := []grpc.DialOption{creds, grpc.WithBlock()}
+	if dial != nil {
+		options = append(options, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		}))
+	}
+	conn, err := grpc.DialContext(dialCtx, u.Host, options...)
+	if err != nil {
+		log.Println("Site unreachable, error: ", err)
+		return false
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: grpcHealthService})
+	if err != nil {
+		log.Println("Health check failed, error: ", err)
+		return false
+	}
+	return resp.GetStatus() == healthpb.HealthCheckResponse_SERVING
+}
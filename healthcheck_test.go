@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("game", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus("lobby", healthpb.HealthCheckResponse_NOT_SERVING)
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Stop()
+	// nothing listens there once closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	defer func(service string) { grpcHealthService = service }(grpcHealthService)
+	tests := []struct {
+		name    string
+		addr    string
+		service string
+		alive   bool
+	}{
+		{"whole server serving", listener.Addr().String(), "", true},
+		{"service serving", listener.Addr().String(), "game", true},
+		{"service not serving", listener.Addr().String(), "lobby", false},
+		{"unknown service", listener.Addr().String(), "chat", false},
+		{"unreachable", closed.Addr().String(), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grpcHealthService = tt.service
+			if alive := isGRPCAlive(&url.URL{Scheme: "http", Host: tt.addr}, nil, nil); alive != tt.alive {
+				t.Fatalf("isGRPCAlive = %v, want %v", alive, tt.alive)
+			}
+		})
+	}
+	t.Run("check type per backend", func(t *testing.T) {
+		grpcHealthService = "lobby"
+		b, err := buildBackend(listener.Addr().String() + "?check=" + CheckGRPC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.probe() {
+			t.Fatal("a backend whose service isn't serving passed the grpc check")
+		}
+		// the port is open, a tcp check can't tell
+		b.CheckType = CheckTCP
+		if !b.probe() {
+			t.Fatal("the tcp check failed on an open port")
+		}
+	})
+	if _, err := buildBackend("localhost:9101?check=udp"); err == nil {
+		t.Fatal("accepted an unknown check type")
+	}
+}
+
+func TestHealthThresholds(t *testing.T) {
+	defer func(healthy, unhealthy int) {
+		healthyThreshold, unhealthyThreshold = healthy, unhealthy
+	}(healthyThreshold, unhealthyThreshold)
+	tests := []struct {
+		name      string
+		healthy   int
+		unhealthy int
+		start     bool   // alive before the probes
+		probes    string // + for a success, - for a failure
+		alive     string // alive after each probe
+	}{
+		{"single blip stays up", 2, 3, true, "+-+", "+++"},
+		{"down after consecutive failures", 2, 3, true, "---", "++-"},
+		{"failures must be consecutive", 2, 3, true, "--+--", "+++++"},
+		{"single success stays down", 2, 3, false, "+-+", "---"},
+		{"up after consecutive successes", 2, 3, false, "++", "-+"},
+		{"thresholds of one flip at once", 1, 1, true, "-+-", "-+-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthyThreshold, unhealthyThreshold = tt.healthy, tt.unhealthy
+			b, err := buildBackend("localhost:9101")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b.seedProbe(tt.start)
+			for i, probe := range tt.probes {
+				if alive := b.recordProbe(probe == '+'); alive != (tt.alive[i] == '+') {
+					t.Fatalf("alive after probe %d = %v, want %v", i, alive, !alive)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/degraded":
+			_, _ = io.WriteString(w, `{"status":"degraded"}`)
+		case r.URL.Path == "/starting":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = io.WriteString(w, `{"status":"ok"}`)
+		case r.URL.Path == "/accepted":
+			w.WriteHeader(http.StatusAccepted)
+		case r.Method != http.MethodPost && r.URL.Path == "/post-only":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			_, _ = io.WriteString(w, `{"status":"ok"}`)
+		}
+	}))
+	defer backend.Close()
+	tests := []struct {
+		name    string
+		options url.Values
+		alive   bool
+	}{
+		{"defaults", url.Values{}, true},
+		{"degraded body", url.Values{"probe_path": {"/degraded"}, "probe_body": {`"status":"ok"`}}, false},
+		{"degraded body unchecked", url.Values{"probe_path": {"/degraded"}}, true},
+		{"healthy body", url.Values{"probe_body": {`"status":\s*"ok"`}}, true},
+		{"healthy body with a bad status", url.Values{"probe_path": {"/starting"}, "probe_body": {`"status":"ok"`}}, false},
+		{"exact status", url.Values{"probe_path": {"/accepted"}, "probe_status": {"200"}}, false},
+		{"one of the statuses", url.Values{"probe_path": {"/accepted"}, "probe_status": {"200|202"}}, true},
+		{"wrong method", url.Values{"probe_path": {"/post-only"}}, false},
+		{"configured method", url.Values{"probe_path": {"/post-only"}, "probe_method": {http.MethodPost}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.options.Set("check", CheckHTTP)
+			b, err := buildBackend(strings.TrimPrefix(backend.URL, "http://") + "?" + tt.options.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if alive := b.probe(); alive != tt.alive {
+				t.Fatalf("probe() = %v, want %v", alive, tt.alive)
+			}
+		})
+	}
+	for _, options := range []string{"probe_status=20", "probe_status=200|abcd", "probe_body=%28"} {
+		if _, err := buildBackend("localhost:9101?" + options); err == nil {
+			t.Errorf("built a backend with %s", options)
+		}
+	}
+}
+
+func TestPassiveHealthGrace(t *testing.T) {
+	// nothing listens there once closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	defer func(grace time.Duration) { passiveHealthGrace = grace }(passiveHealthGrace)
+	defer func(retries int) { wsDialRetries = retries }(wsDialRetries)
+	wsDialRetries = 0
+	tests := []struct {
+		name    string
+		grace   time.Duration
+		age     time.Duration // since the backend was added
+		path    string
+		ejected bool
+	}{
+		{"no grace", 0, 0, "/room", true},
+		{"within the grace", time.Minute, 0, "/room", false},
+		{"after the grace", time.Minute, 2 * time.Minute, "/room", true},
+		{"websocket within the grace", time.Minute, 0, "/ws/1", false},
+		{"websocket after the grace", time.Minute, 2 * time.Minute, "/ws/1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, dead)()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			passiveHealthGrace = tt.grace
+			b := serverPool.Backends()[0]
+			b.added = time.Now().Add(-tt.age)
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.path != "/room" {
+				req = httptest.NewRequest(http.MethodGet, tt.path, nil)
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			lb(httptest.NewRecorder(), req)
+			if ejected := !b.IsAlive(); ejected != tt.ejected {
+				t.Fatalf("marked down = %v, want %v", ejected, tt.ejected)
+			}
+		})
+	}
+}
+
+func TestGraceAppliesToAddedBackends(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a")()
+	defer func(grace time.Duration) { passiveHealthGrace = grace }(passiveHealthGrace)
+	passiveHealthGrace = time.Minute
+	a := serverPool.GetBackend("a")
+	a.added = time.Now().Add(-2 * time.Minute)
+	b, err := (&adminService{pool: &serverPool}).addBackend("localhost:9102?name=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ejectBackend(a)
+	ejectBackend(b)
+	if a.IsAlive() || !b.IsAlive() {
+		t.Fatalf("a alive = %v and b alive = %v, want only the new b spared", a.IsAlive(), b.IsAlive())
+	}
+}
+
+// stallingListener accepts connections and never answers on them
+func stallingListener(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestProbeTimesOutOnStalledBackend(t *testing.T) {
+	stalled := stallingListener(t)
+	defer stalled.Close()
+	defer func(timeout time.Duration, client *http.Client) {
+		healthCheckTimeout, healthClient = timeout, client
+	}(healthCheckTimeout, healthClient)
+	healthCheckTimeout = 100 * time.Millisecond
+	healthClient = newHealthClient(nil, nil)
+	tests := []struct {
+		check string
+		alive bool
+	}{
+		// connecting is all the tcp check asks for
+		{CheckTCP, true},
+		{CheckHTTP, false},
+		{CheckGRPC, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.check, func(t *testing.T) {
+			b, err := buildBackend(stalled.Addr().String() + "?check=" + tt.check)
+			if err != nil {
+				t.Fatal(err)
+			}
+			started := time.Now()
+			if alive := b.probe(); alive != tt.alive {
+				t.Fatalf("probe() = %v, want %v", alive, tt.alive)
+			}
+			if took := time.Since(started); took > time.Second {
+				t.Fatalf("probe took %s, want it bounded by the %s timeout", took, healthCheckTimeout)
+			}
+		})
+	}
+}
+
+func TestHealthCheckConcurrency(t *testing.T) {
+	stalled := stallingListener(t)
+	defer stalled.Close()
+	defer func(timeout time.Duration, client *http.Client, concurrency int) {
+		healthCheckTimeout, healthClient, healthCheckConcurrency = timeout, client, concurrency
+	}(healthCheckTimeout, healthClient, healthCheckConcurrency)
+	healthCheckTimeout = 100 * time.Millisecond
+	healthClient = newHealthClient(nil, nil)
+	tests := []struct {
+		concurrency int
+		rounds      int // of stalled checks it takes to go through the pool
+	}{
+		{1, 4},
+		{2, 2},
+		{4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.concurrency), func(t *testing.T) {
+			healthCheckConcurrency = tt.concurrency
+			specs := make([]string, 4)
+			for i := range specs {
+				specs[i] = stalled.Addr().String() + "?check=http&name=" + strconv.Itoa(i)
+			}
+			defer setPool(t, specs...)()
+			started := time.Now()
+			serverPool.HealthCheck()
+			took := time.Since(started)
+			want := time.Duration(tt.rounds) * healthCheckTimeout
+			if took < want || took > want+healthCheckTimeout*3/2 {
+				t.Fatalf("checking took %s, want about %s", took, want)
+			}
+		})
+	}
+}
+
+func TestLatencyDegrades(t *testing.T) {
+	defer func(slo time.Duration) { healthLatencySLO = slo }(healthLatencySLO)
+	var delay int64 // of a's health checks
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&delay)))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	tests := []struct {
+		name     string
+		slo      time.Duration
+		delays   []time.Duration // of a's health checks, one per pass
+		degraded string          // whether a is degraded after each pass
+	}{
+		{"healthy", 40 * time.Millisecond, []time.Duration{0, 0}, "--"},
+		{"degraded and back", 40 * time.Millisecond, []time.Duration{0, 80 * time.Millisecond, 80 * time.Millisecond, 0}, "-++-"},
+		{"degraded again", 40 * time.Millisecond, []time.Duration{80 * time.Millisecond, 0, 80 * time.Millisecond}, "+-+"},
+		{"no slo", 0, []time.Duration{80 * time.Millisecond}, "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthLatencySLO = tt.slo
+			defer setPool(t, strings.TrimPrefix(slow.URL, "http://")+"?name=a&check=http",
+				strings.TrimPrefix(fast.URL, "http://")+"?name=b&check=http")()
+			a, b := serverPool.GetBackend("a"), serverPool.GetBackend("b")
+			for i, d := range tt.delays {
+				atomic.StoreInt64(&delay, int64(d))
+				serverPool.InitialHealthCheck()
+				degraded := tt.degraded[i] == '+'
+				if a.IsDegraded() != degraded || b.IsDegraded() {
+					t.Fatalf("pass %d: a degraded %v, b %v, want %v and false", i, a.IsDegraded(), b.IsDegraded(), degraded)
+				}
+				// degraded isn't down, it keeps serving
+				if !a.IsAlive() {
+					t.Fatalf("pass %d: a marked down", i)
+				}
+				w := httptest.NewRecorder()
+				statusHandler(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+				var status struct{ Backends []backendStatus }
+				if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+					t.Fatal(err)
+				}
+				if status.Backends[0].Degraded != degraded {
+					t.Fatalf("pass %d: status says degraded %v, want %v", i, status.Backends[0].Degraded, degraded)
+				}
+				// a degraded backend only gets new rooms b can't take
+				picked := make(map[string]bool)
+				for j := 0; j < 4; j++ {
+					picked[serverPool.GetNextPeer().ID] = true
+				}
+				if picked["a"] == degraded {
+					t.Fatalf("pass %d: new rooms landed on %v", i, picked)
+				}
+				if degraded {
+					b.SetAlive(false)
+					if peer := serverPool.GetNextPeer(); peer != a {
+						t.Fatalf("pass %d: with b down the room went to %q, want a", i, idOf(peer))
+					}
+					b.SetAlive(true)
+				}
+			}
+		})
+	}
+}
+
+func TestInitialHealthCheck(t *testing.T) {
+	defer func(healthy, unhealthy int) {
+		healthyThreshold, unhealthyThreshold = healthy, unhealthy
+	}(healthyThreshold, unhealthyThreshold)
+	healthyThreshold, unhealthyThreshold = 2, 3
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer live.Close()
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	tests := []struct {
+		name    string
+		initial bool // whether the first pass is the initial one
+		alive   string
+		created int // of 4 new rooms, created on live
+	}{
+		// a single regular pass waits for the thresholds
+		{"initial", true, "live", 4},
+		{"regular", false, "dead,live", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, deadAddr+"?name=dead", strings.TrimPrefix(live.URL, "http://")+"?name=live")()
+			if tt.initial {
+				serverPool.InitialHealthCheck()
+			} else {
+				serverPool.HealthCheck()
+			}
+			var alive []string
+			for _, b := range serverPool.Backends() {
+				if b.IsAlive() {
+					alive = append(alive, b.ID)
+				}
+			}
+			if strings.Join(alive, ",") != tt.alive {
+				t.Fatalf("alive after the first pass: %v, want %s", alive, tt.alive)
+			}
+			created := 0
+			for i := 0; i < 4; i++ {
+				if peer := serverPool.GetNextPeer(); peer != nil && peer.ID == "live" {
+					created++
+				}
+			}
+			if created != tt.created {
+				t.Fatalf("%d of 4 new rooms on live, want %d", created, tt.created)
+			}
+		})
+	}
+}
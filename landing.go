@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// landingPageFile is served on GET to the landingPaths instead of a 404,
+// e.g. a maintenance notice. It's reread on SIGHUP.
+var landingPageFile = envString("LANDING_PAGE_FILE", "")
+
+// landingRedirect is where GET requests to the landingPaths are redirected
+// to, when there's no landing page
+var landingRedirect = envString("LANDING_REDIRECT", "")
+
+// landingPaths get the landing page, exactly or as a prefix when they end with
+// a *, only / when unset. The room routes always get routed.
+var landingPaths = envList("LANDING_PATHS")
+
+// landingPage holds the loaded landing page
+type landingPage struct {
+	mux     sync.RWMutex
+	content []byte
+	modTime time.Time
+}
+
+var landing landingPage
+
+// loadLandingPage (re)reads landingPageFile, keeping the current page on error
+func loadLandingPage() error {
+	if landingPageFile == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(landingPageFile)
+	if err != nil {
+		return err
+	}
+	landing.mux.Lock()
+	landing.content, landing.modTime = content, time.Now()
+	landing.mux.Unlock()
+	log.Printf("Loaded landing page %s, %d bytes\n", landingPageFile, len(content))
+	return nil
+}
+
+// isLandingPath returns true when path gets the landing page
+func isLandingPath(path string) bool {
+	if classifyRoute(path) != "" {
+		return false
+	}
+	for _, landingPath := range landingPaths {
+		if prefix := strings.TrimSuffix(landingPath, "*"); prefix != landingPath {
+			if strings.HasPrefix(path, prefix) {
+				return true
+			}
+		} else if path == landingPath {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLanding answers GET and HEAD requests to the landing paths with the
+// landing page or redirect, returning false when r is to be routed
+func serveLanding(w http.ResponseWriter, r *http.Request) bool {
+	if (landingPageFile == "" && landingRedirect == "") || (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		isWebSocket(r) || !isLandingPath(r.URL.Path) {
+		return false
+	}
+	if landingPageFile == "" {
+		http.Redirect(w, r, landingRedirect, http.StatusFound)
+		return true
+	}
+	landing.mux.RLock()
+	content, modTime := landing.content, landing.modTime
+	landing.mux.RUnlock()
+	// the content type goes by the page's extension
+	http.ServeContent(w, r, filepath.Base(landingPageFile), modTime, bytes.NewReader(content))
+	return true
+}
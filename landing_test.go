@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeLanding(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	page, cleanup := writeTempFile(t, "<html>down for maintenance</html>")
+	defer cleanup()
+	defer func(file, redirect string, paths []string) {
+		landingPageFile, landingRedirect, landingPaths = file, redirect, paths
+	}(landingPageFile, landingRedirect, landingPaths)
+	landingPageFile = page
+	if err := loadLandingPage(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		file     string
+		redirect string
+		paths    []string
+		method   string
+		path     string
+		code     int
+		body     string // or Location of a redirect
+	}{
+		{"root", page, "", []string{"/"}, http.MethodGet, "/", http.StatusOK, "<html>down for maintenance</html>"},
+		{"head", page, "", []string{"/"}, http.MethodHead, "/", http.StatusOK, ""},
+		{"creation still routed", page, "", []string{"/"}, http.MethodPost, "/room", http.StatusOK, "backend /room"},
+		{"room still routed", page, "", []string{"/*"}, http.MethodGet, "/room/1/state", http.StatusOK, "backend /room/1/state"},
+		{"not a landing path", page, "", []string{"/"}, http.MethodGet, "/about", http.StatusNotFound, "URL doesn't match any resource\n"},
+		{"prefix", page, "", []string{"/", "/help/*"}, http.MethodGet, "/help/faq", http.StatusOK, "<html>down for maintenance</html>"},
+		{"exact only", page, "", []string{"/help"}, http.MethodGet, "/help/faq", http.StatusNotFound, "URL doesn't match any resource\n"},
+		{"not a GET", page, "", []string{"/"}, http.MethodPost, "/", http.StatusNotFound, "URL doesn't match any resource\n"},
+		{"redirect", "", "https://example.com/play", []string{"/"}, http.MethodGet, "/", http.StatusFound, "https://example.com/play"},
+		{"disabled", "", "", []string{"/"}, http.MethodGet, "/", http.StatusNotFound, "URL doesn't match any resource\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			landingPageFile, landingRedirect, landingPaths = tt.file, tt.redirect, tt.paths
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			got := w.Body.String()
+			if tt.code == http.StatusFound {
+				got = w.Header().Get("Location")
+			}
+			if got != tt.body {
+				t.Fatalf("got %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestReloadLandingPage(t *testing.T) {
+	page, cleanup := writeTempFile(t, "<html>v1</html>")
+	defer cleanup()
+	defer func(file string, paths []string) { landingPageFile, landingPaths = file, paths }(landingPageFile, landingPaths)
+	landingPageFile, landingPaths = page, []string{"/"}
+	for _, content := range []string{"<html>v1</html>", "<html>v2</html>"} {
+		if err := ioutil.WriteFile(page, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadLandingPage(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		lb(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Body.String() != content {
+			t.Fatalf("served %q, want %q", w.Body.String(), content)
+		}
+	}
+	// a page that can't be read keeps the last one
+	cleanup()
+	if err := loadLandingPage(); err == nil {
+		t.Fatal("loaded a removed landing page")
+	}
+	w := httptest.NewRecorder()
+	lb(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != "<html>v2</html>" {
+		t.Fatalf("served %q after a failed reload, want the last page", w.Body.String())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// drainLockFile is a file on storage shared by the replicas, holding it
+// lets one replica drain at a time
+var drainLockFile = os.Getenv("DRAIN_LOCK_FILE")
+
+// drainLockURL is a coordination endpoint granting the drain lease on POST
+// and taking it back on DELETE, used instead of drainLockFile
+var drainLockURL = os.Getenv("DRAIN_LOCK_URL")
+
+// drainLockWait is how long to wait for another replica to finish draining
+// before draining anyway
+var drainLockWait = envDuration("DRAIN_LOCK_WAIT", 5*time.Minute)
+
+// drainLockTTL is when a lock file left behind by a crashed replica is taken over
+var drainLockTTL = envDuration("DRAIN_LOCK_TTL", 10*time.Minute)
+
+// drainLockPoll is how often a held lease is asked for again
+var drainLockPoll = envDuration("DRAIN_LOCK_POLL", time.Second)
+
+// drainLease serializes draining across replicas
+type drainLease interface {
+	// Acquire takes the lease, false when another replica holds it
+	Acquire() (bool, error)
+	Release() error
+}
+
+// errLeaseBusy is answered by a lease held by someone else
+var errLeaseBusy = errors.New("drain lease held by another replica")
+
+// newDrainLease returns the configured lease, nil when draining isn't coordinated
+func newDrainLease() drainLease {
+	holder := strconv.Itoa(os.Getpid())
+	if host, err := os.Hostname(); err == nil {
+		holder = host + "-" + holder
+	}
+	switch {
+	case drainLockURL != "":
+		return &httpLease{url: drainLockURL, holder: holder}
+	case drainLockFile != "":
+		return &fileLease{path: drainLockFile, holder: holder}
+	}
+	return nil
+}
+
+// holdDrainLease waits for the lease and returns its release, falling back
+// to draining right away when coordination fails or takes too long
+func holdDrainLease(lease drainLease) func() {
+	noop := func() {}
+	if lease == nil {
+		return noop
+	}
+	deadline := time.Now().Add(drainLockWait)
+	for {
+		ok, err := lease.Acquire()
+		if err != nil {
+			log.Println("Drain coordination unavailable, draining now: ", err)
+			return noop
+		}
+		if ok {
+			log.Println("Acquired the drain lease")
+			return func() {
+				if err := lease.Release(); err != nil {
+					log.Println("Failed to release the drain lease: ", err)
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			log.Println("Another replica is still draining, draining now")
+			return noop
+		}
+		time.Sleep(drainLockPoll)
+	}
+}
+
+// fileLease is held by whoever manages to create the lock file
+type fileLease struct {
+	path   string
+	holder string
+}
+
+func (l *fileLease) Acquire() (bool, error) {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		info, err := os.Stat(l.path)
+		if err != nil || time.Since(info.ModTime()) < drainLockTTL {
+			return false, nil
+		}
+		log.Printf("Taking over the drain lock left at %s\n", l.path)
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return l.Acquire()
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = f.WriteString(l.holder)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err == nil, err
+}
+
+func (l *fileLease) Release() error {
+	// never remove a lock that was taken over in the meantime
+	holder, err := ioutil.ReadFile(l.path)
+	if err != nil || string(holder) != l.holder {
+		return err
+	}
+	return os.Remove(l.path)
+}
+
+// httpLease asks a coordination endpoint for the lease, it answers 2xx when
+// granted and 409 while another replica holds it
+type httpLease struct {
+	url    string
+	holder string
+}
+
+func (l *httpLease) Acquire() (bool, error) {
+	err := l.do(http.MethodPost)
+	if err == errLeaseBusy {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *httpLease) Release() error {
+	return l.do(http.MethodDelete)
+}
+
+func (l *httpLease) do(method string) error {
+	u, err := url.Parse(l.url)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("holder", l.holder)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errLeaseBusy
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("%s %s answered %s", method, l.url, resp.Status)
+	}
+	return nil
+}
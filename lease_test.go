@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "balancer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "drain.lock")
+	a := &fileLease{path: path, holder: "a"}
+	b := &fileLease{path: path, holder: "b"}
+	acquire := func(l *fileLease, want bool) {
+		t.Helper()
+		if ok, err := l.Acquire(); err != nil || ok != want {
+			t.Fatalf("%s.Acquire() = %v, %v, want %v", l.holder, ok, err, want)
+		}
+	}
+
+	acquire(a, true)
+	acquire(b, false)
+	// releasing a lease someone else holds leaves it alone
+	if err := b.Release(); err != nil {
+		t.Fatal(err)
+	}
+	acquire(b, false)
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	acquire(b, true)
+
+	// a lock left behind past its ttl is taken over
+	old := time.Now().Add(-drainLockTTL - time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	acquire(a, true)
+	if err := b.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if holder, err := ioutil.ReadFile(path); err != nil || string(holder) != "a" {
+		t.Fatalf("lock holds %q (%v) after the replaced holder released it, want a", holder, err)
+	}
+}
+
+// leaseServer is a coordination endpoint granting the lease to one holder at a time
+type leaseServer struct {
+	mux    sync.Mutex
+	holder string
+	broken bool
+}
+
+func (s *leaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	holder := r.URL.Query().Get("holder")
+	switch {
+	case s.broken:
+		w.WriteHeader(http.StatusInternalServerError)
+	case r.Method == http.MethodPost && s.holder != "" && s.holder != holder:
+		w.WriteHeader(http.StatusConflict)
+	case r.Method == http.MethodPost:
+		s.holder = holder
+	case r.Method == http.MethodDelete && s.holder == holder:
+		s.holder = ""
+	}
+}
+
+func TestHTTPLease(t *testing.T) {
+	coordinator := &leaseServer{}
+	server := httptest.NewServer(coordinator)
+	defer server.Close()
+	a := &httpLease{url: server.URL + "/lease?pool=lb", holder: "a"}
+	b := &httpLease{url: server.URL + "/lease?pool=lb", holder: "b"}
+	tests := []struct {
+		name   string
+		lease  *httpLease
+		action string
+		ok     bool
+		err    bool
+	}{
+		{"a takes it", a, "acquire", true, false},
+		{"b waits", b, "acquire", false, false},
+		{"a asks again", a, "acquire", true, false},
+		{"a gives it back", a, "release", false, false},
+		{"b takes it", b, "acquire", true, false},
+		{"a waits", a, "acquire", false, false},
+	}
+	for _, tt := range tests {
+		var ok bool
+		var err error
+		if tt.action == "acquire" {
+			ok, err = tt.lease.Acquire()
+		} else {
+			err = tt.lease.Release()
+		}
+		if ok != tt.ok || (err != nil) != tt.err {
+			t.Fatalf("%s: got %v, %v, want %v and error %v", tt.name, ok, err, tt.ok, tt.err)
+		}
+	}
+	coordinator.broken = true
+	if _, err := a.Acquire(); err == nil {
+		t.Fatal("a failing coordinator granted the lease")
+	}
+}
+
+// fakeLease is busy for its first acquisitions, or fails with err
+type fakeLease struct {
+	busy     int
+	err      error
+	released bool
+}
+
+func (l *fakeLease) Acquire() (bool, error) {
+	if l.err != nil {
+		return false, l.err
+	}
+	if l.busy > 0 {
+		l.busy--
+		return false, nil
+	}
+	return true, nil
+}
+
+func (l *fakeLease) Release() error {
+	l.released = true
+	return nil
+}
+
+func TestHoldDrainLease(t *testing.T) {
+	defer func(wait, poll time.Duration) { drainLockWait, drainLockPoll = wait, poll }(drainLockWait, drainLockPoll)
+	drainLockWait, drainLockPoll = 50*time.Millisecond, time.Millisecond
+	tests := []struct {
+		name     string
+		lease    *fakeLease
+		released bool // whether the returned release gives the lease back
+	}{
+		{"free", &fakeLease{}, true},
+		{"after another replica", &fakeLease{busy: 3}, true},
+		{"coordination down", &fakeLease{err: errors.New("unreachable")}, false},
+		{"held too long", &fakeLease{busy: 1 << 30}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := time.Now()
+			release := holdDrainLease(tt.lease)
+			if took := time.Since(started); took > time.Second {
+				t.Fatalf("waited %s for the lease", took)
+			}
+			release()
+			if tt.lease.released != tt.released {
+				t.Fatalf("released = %v, want %v", tt.lease.released, tt.released)
+			}
+		})
+	}
+	// without coordination draining starts right away
+	holdDrainLease(nil)()
+}
+
+func TestNewDrainLease(t *testing.T) {
+	defer func(url, file string) { drainLockURL, drainLockFile = url, file }(drainLockURL, drainLockFile)
+	tests := []struct {
+		url, file string
+		want      string
+	}{
+		{"", "", "<nil>"},
+		{"", "/run/lb/drain.lock", "*main.fileLease"},
+		{"http://coordinator/lease", "", "*main.httpLease"},
+		{"http://coordinator/lease", "/run/lb/drain.lock", "*main.httpLease"},
+	}
+	for _, tt := range tests {
+		drainLockURL, drainLockFile = tt.url, tt.file
+		if got := fmt.Sprintf("%T", newDrainLease()); got != tt.want {
+			t.Errorf("url %q file %q: lease %s, want %s", tt.url, tt.file, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxInflight caps the concurrent requests proxied by the balancer, 0 disables it
+var maxInflight = envInt("MAX_INFLIGHT", 0)
+
+// maxInflightPerBackend caps the concurrent requests proxied to each backend, 0 disables it
+var maxInflightPerBackend = envInt("MAX_INFLIGHT_PER_BACKEND", 0)
+
+// maxWebsockets caps the concurrent websockets proxied by the balancer, 0 disables it
+var maxWebsockets = envInt("MAX_WEBSOCKETS", 0)
+
+// maxConnsPerRoom caps the concurrent websockets of a single room, e.g.
+// against a spectator flood, 0 disables it
+var maxConnsPerRoom = envInt("MAX_CONNS_PER_ROOM", 0)
+
+// maxCreatesPerClient caps the room creations a single client has in flight,
+// 0 disables it. Unlike a rate limit it only bounds concurrency.
+var maxCreatesPerClient = envInt("MAX_CREATES_PER_CLIENT", 0)
+
+// createClientKey tells clients apart for maxCreatesPerClient, set up from
+// CREATE_CLIENT_KEY
+var createClientKey = func(r *http.Request) string { return clientIP(r).String() }
+
+// parseClientKey builds the client key described by source, `ip` or
+// `header:Name` like header:Authorization. Clients without the header go
+// by their address.
+func parseClientKey(source string) (func(r *http.Request) string, error) {
+	if source == "ip" {
+		return func(r *http.Request) string { return clientIP(r).String() }, nil
+	}
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[0] != "header" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid CREATE_CLIENT_KEY %q, expected ip or header:Name", source)
+	}
+	return func(r *http.Request) string {
+		if value := r.Header.Get(parts[1]); value != "" {
+			return "header:" + value
+		}
+		return clientIP(r).String()
+	}, nil
+}
+
+// inflight counts the requests currently being proxied
+var inflight int64
+
+// websockets counts the websockets currently being upgraded or proxied
+var websockets int64
+
+// acquireSlot increments counter unless it would go over limit
+func acquireSlot(counter *int64, limit int) bool {
+	if atomic.AddInt64(counter, 1) > int64(limit) && limit > 0 {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+// releaseSlot gives back a slot taken by acquireSlot
+func releaseSlot(counter *int64) {
+	atomic.AddInt64(counter, -1)
+}
+
+// keyedCounter counts what's currently going on per key, e.g. the websockets
+// open to each room
+type keyedCounter struct {
+	mux    sync.Mutex
+	counts map[string]int
+}
+
+// roomConns counts the websockets open to each room
+var roomConns keyedCounter
+
+// createsPerClient counts the room creations each client has in flight
+var createsPerClient keyedCounter
+
+// Acquire counts one more for key unless it already reached limit
+func (c *keyedCounter) Acquire(key string, limit int) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.counts[key] >= limit {
+		return false
+	}
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[key]++
+	return true
+}
+
+// Release gives back one counted by Acquire
+func (c *keyedCounter) Release(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.counts[key]--; c.counts[key] <= 0 {
+		delete(c.counts, key)
+	}
+}
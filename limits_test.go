@@ -0,0 +1,245 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInflightCaps(t *testing.T) {
+	tests := []struct {
+		name       string
+		global     int
+		perBackend int
+		admitted   int // of the requests held by the backend
+	}{
+		{"global cap", 2, 0, 2},
+		{"per backend cap", 0, 3, 3},
+		{"lowest cap wins", 4, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrived, release := make(chan struct{}), make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				arrived <- struct{}{}
+				<-release
+			}))
+			defer backend.Close()
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			defer func(global, perBackend int) {
+				maxInflight, maxInflightPerBackend = global, perBackend
+			}(maxInflight, maxInflightPerBackend)
+			maxInflight, maxInflightPerBackend = tt.global, tt.perBackend
+
+			var wg sync.WaitGroup
+			codes := make(chan int, tt.admitted)
+			for i := 0; i < tt.admitted; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					w := httptest.NewRecorder()
+					lb(w, httptest.NewRequest(http.MethodGet, "/room/1/state", nil))
+					codes <- w.Code
+				}()
+				<-arrived
+			}
+			b := serverPool.Backends()[0]
+			if inflight := newBackendStatus(b).Inflight; inflight != int64(tt.admitted) {
+				t.Errorf("status shows %d in flight, want %d", inflight, tt.admitted)
+			}
+			// at the cap, the next one is turned away without reaching the backend
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, "/room/1/state", nil))
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("request over the cap answered %d, want 503", w.Code)
+			}
+			close(release)
+			wg.Wait()
+			close(codes)
+			for code := range codes {
+				if code != http.StatusOK {
+					t.Errorf("admitted request answered %d", code)
+				}
+			}
+			if inflight := b.Inflight(); inflight != 0 {
+				t.Errorf("%d still in flight once done", inflight)
+			}
+		})
+	}
+}
+
+func TestInflightCapsSkipWebsockets(t *testing.T) {
+	tests := []struct {
+		name       string
+		global     int
+		perBackend int
+	}{
+		{"global cap", 1, 0},
+		{"per backend cap", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := wsBackend(t, nil)
+			defer backend.Close()
+			defer setPool(t, backend.Addr().String())()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			defer func(global, perBackend int) {
+				maxInflight, maxInflightPerBackend = global, perBackend
+			}(maxInflight, maxInflightPerBackend)
+			maxInflight, maxInflightPerBackend = tt.global, tt.perBackend
+			front := httptest.NewServer(http.HandlerFunc(lb))
+			defer front.Close()
+			b := serverPool.Backends()[0]
+
+			defer waitWebsockets(t, 0)
+			conn, _, resp := openWS(t, front.URL, "/ws/1", "")
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			// an open game session leaves room for plain requests
+			if n := atomic.LoadInt64(&inflight); n != 0 {
+				t.Errorf("%d requests in flight with a websocket open", n)
+			}
+			if b.Inflight() != 0 || b.IsSaturated() {
+				t.Errorf("backend shows %d in flight, saturated %v, with a websocket open", b.Inflight(), b.IsSaturated())
+			}
+		})
+	}
+}
+
+func TestAcquireSlot(t *testing.T) {
+	var counter int64
+	for i, want := range []bool{true, true, false} {
+		if got := acquireSlot(&counter, 2); got != want {
+			t.Fatalf("acquire %d = %v, want %v", i, got, want)
+		}
+	}
+	releaseSlot(&counter)
+	if !acquireSlot(&counter, 2) {
+		t.Fatal("a released slot can't be taken again")
+	}
+	// no limit
+	for i := 0; i < 10; i++ {
+		if !acquireSlot(&counter, 0) {
+			t.Fatal("acquireSlot refused without a limit")
+		}
+	}
+}
+
+func TestParseClientKey(t *testing.T) {
+	tests := []struct {
+		source string
+		header string // X-Player sent by the client
+		want   string
+	}{
+		{"ip", "p1", "10.0.0.1"},
+		{"header:X-Player", "p1", "header:p1"},
+		{"header:X-Player", "", "10.0.0.1"},
+		{"header:", "", ""},
+		{"cookie:session", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		key, err := parseClientKey(tt.source)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseClientKey(%q) accepted an invalid source", tt.source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseClientKey(%q): %v", tt.source, err)
+			continue
+		}
+		r := httptest.NewRequest(http.MethodPost, "/room", nil)
+		r.RemoteAddr = "10.0.0.1:4000"
+		if tt.header != "" {
+			r.Header.Set("X-Player", tt.header)
+		}
+		if got := key(r); got != tt.want {
+			t.Errorf("%s key = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestCreatesPerClient(t *testing.T) {
+	type client struct{ addr, player string }
+	tests := []struct {
+		name   string
+		source string
+		limit  int
+		held   []client // creations kept in flight by the backend
+		next   client
+		want   int
+	}{
+		{"same client over the cap", "ip", 1, []client{{"10.0.0.1", ""}}, client{"10.0.0.1", ""}, http.StatusTooManyRequests},
+		{"same client under the cap", "ip", 2, []client{{"10.0.0.1", ""}}, client{"10.0.0.1", ""}, http.StatusOK},
+		{"other client", "ip", 1, []client{{"10.0.0.1", ""}}, client{"10.0.0.2", ""}, http.StatusOK},
+		{"same player from another address", "header:X-Player", 1, []client{{"10.0.0.1", "p1"}}, client{"10.0.0.2", "p1"}, http.StatusTooManyRequests},
+		{"other player behind the same address", "header:X-Player", 1, []client{{"10.0.0.1", "p1"}}, client{"10.0.0.1", "p2"}, http.StatusOK},
+		{"disabled", "ip", 0, []client{{"10.0.0.1", ""}, {"10.0.0.1", ""}}, client{"10.0.0.1", ""}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arrived, release := make(chan struct{}), make(chan struct{})
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Hold") != "" {
+					arrived <- struct{}{}
+					<-release
+				}
+			}))
+			defer backend.Close()
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			defer func(limit int, key func(r *http.Request) string) {
+				maxCreatesPerClient, createClientKey = limit, key
+			}(maxCreatesPerClient, createClientKey)
+			key, err := parseClientKey(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			maxCreatesPerClient, createClientKey = tt.limit, key
+
+			create := func(c client, hold bool) int {
+				r := httptest.NewRequest(http.MethodPost, "/room", nil)
+				r.RemoteAddr = c.addr + ":4000"
+				if c.player != "" {
+					r.Header.Set("X-Player", c.player)
+				}
+				if hold {
+					r.Header.Set("X-Hold", "1")
+				}
+				w := httptest.NewRecorder()
+				lb(w, r)
+				return w.Code
+			}
+			var wg sync.WaitGroup
+			for _, c := range tt.held {
+				wg.Add(1)
+				go func(c client) {
+					defer wg.Done()
+					if code := create(c, true); code != http.StatusOK {
+						t.Errorf("held creation answered %d", code)
+					}
+				}(c)
+				<-arrived
+			}
+			if code := create(tt.next, false); code != tt.want {
+				t.Errorf("next creation answered %d, want %d", code, tt.want)
+			}
+			close(release)
+			wg.Wait()
+
+			createsPerClient.mux.Lock()
+			defer createsPerClient.mux.Unlock()
+			if len(createsPerClient.counts) != 0 {
+				t.Fatalf("clients still counted once done: %v", createsPerClient.counts)
+			}
+		})
+	}
+}
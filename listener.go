@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// maxConns caps the client connections held at once, past it new ones wait
+// in the kernel's accept queue instead of being answered with a 503. 0 disables it.
+var maxConns = envInt("MAX_CONNS", 0)
+
+// limitListener stops accepting connections while limit of them are open
+type limitListener struct {
+	net.Listener
+	slots  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newLimitListener wraps l so at most limit connections are open at once
+func newLimitListener(l net.Listener, limit int) net.Listener {
+	return &limitListener{Listener: l, slots: make(chan struct{}, limit), closed: make(chan struct{})}
+}
+
+// Accept waits for a free slot before taking the next connection
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.closed:
+		// websockets may hold every slot, shutting down can't wait for them
+		return l.Listener.Accept()
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// Close stops the listener, waking up a pending Accept
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back once closed, hijacked websockets included
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// askOver sends a request over conn and returns the status of the answer,
+// or the error when none comes within wait
+func askOver(conn net.Conn, br *bufio.Reader, wait time.Duration) (int, error) {
+	if _, err := io.WriteString(conn, "GET /ping HTTP/1.1\r\nHost: lb\r\n\r\n"); err != nil {
+		return 0, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestLimitListenerDelaysOverCap(t *testing.T) {
+	for _, limit := range []int{1, 2, 5} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+		go func() { _ = server.Serve(newLimitListener(l, limit)) }()
+
+		// connections up to the cap are served and kept open
+		held := make([]net.Conn, limit)
+		for i := range held {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if code, err := askOver(conn, bufio.NewReader(conn), time.Second); err != nil || code != http.StatusOK {
+				t.Fatalf("limit %d: connection %d got %d, %v", limit, i, code, err)
+			}
+			held[i] = conn
+		}
+		// the next one waits in the accept queue, neither refused nor answered
+		extra, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("limit %d: connection over the cap refused: %v", limit, err)
+		}
+		defer extra.Close()
+		br := bufio.NewReader(extra)
+		code, err := askOver(extra, br, 100*time.Millisecond)
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("limit %d: connection over the cap got %d, %v, want it held", limit, code, err)
+		}
+		// it's served as soon as a slot frees up
+		held[0].Close()
+		_ = extra.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("limit %d: held connection got %v, %v once a slot freed", limit, resp, err)
+		}
+		resp.Body.Close()
+		server.Close()
+	}
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(inner, 1)
+	go func() {
+		if conn, err := net.Dial("tcp", inner.Addr().String()); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// every slot is taken, closing must still wake the next Accept up
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatal("Accept on a closed listener succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept still waiting for a slot after Close")
+	}
+}
@@ -2,23 +2,38 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"google.golang.org/grpc"
 )
 
+// ctxKey keeps the request context values of the balancer apart from any
+// other package's
+type ctxKey int
+
 const (
-	Attempts int = iota
+	Attempts ctxKey = iota
 	Retry
+	Route
+	DryRun
+	Trace
+	CacheKey
+	Failures
+	Refused
 )
 
 // ServerPool holds information about reachable backends
@@ -31,7 +46,7 @@ func GetAttemptsFromContext(r *http.Request) int {
 	return 1
 }
 
-// GetAttemptsFromContext returns the attempts for request
+// GetRetryFromContext returns the retries against the current backend
 func GetRetryFromContext(r *http.Request) int {
 	if retry, ok := r.Context().Value(Retry).(int); ok {
 		return retry
@@ -39,54 +54,386 @@ func GetRetryFromContext(r *http.Request) int {
 	return 0
 }
 
+// GetRouteFromContext returns the route class the request matched
+func GetRouteFromContext(r *http.Request) string {
+	if route, ok := r.Context().Value(Route).(string); ok {
+		return route
+	}
+	return ""
+}
+
+// isDryRun returns true for requests only asking where they would be routed
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := r.Context().Value(DryRun).(bool)
+	return dryRun
+}
+
+// exposeRetries sets X-LB-Attempts and X-LB-Retries on backend responses, so
+// clients can tell a request only went through after failing over
+var exposeRetries = envBool("EXPOSE_RETRY_HEADERS", false)
+
+// setRetryHeaders reports the attempts and retries that led to resp
+func setRetryHeaders(resp *http.Response) {
+	if !exposeRetries {
+		return
+	}
+	resp.Header.Set("X-LB-Attempts", strconv.Itoa(GetAttemptsFromContext(resp.Request)))
+	resp.Header.Set("X-LB-Retries", strconv.Itoa(GetRetryFromContext(resp.Request)))
+}
+
 var apiPrefix string = os.Getenv("API_PREFIX")
 
-var roomAction, roomConnection *regexp.Regexp = regexp.MustCompile(`/room/[0-9]+(/.+)*`), regexp.MustCompile(`/ws/[0-9]`)
+var roomAction, roomConnection *regexp.Regexp = roomRoutes(defaultRoomIdSource)
+
+// roomRoutes builds the patterns of room actions and connections under
+// apiPrefix. Ids out of the path segments are matched there, ids from
+// anywhere else are left to the extractor.
+func roomRoutes(source string) (action, connection *regexp.Regexp) {
+	prefix := `^` + regexp.QuoteMeta(apiPrefix)
+	if source != defaultRoomIdSource {
+		return regexp.MustCompile(prefix + `/room/.+$`), regexp.MustCompile(prefix + `/ws(/.*)?$`)
+	}
+	return regexp.MustCompile(prefix + `/room/` + roomIdPattern() + `(/.+)*$`),
+		regexp.MustCompile(prefix + `/ws/` + roomIdPattern() + `(/.+)*$`)
+}
+
+// Route classes lb tells requests apart by
+const (
+	RouteCreate  = "create"
+	RouteAction  = "action"
+	RouteConnect = "connect"
+	RouteDefault = "default" // unmatched paths passed through to the default backend
+)
+
+// Policies for paths that match no route
+const (
+	UnmatchedStrict      = "strict"
+	UnmatchedPassThrough = "passthrough"
+)
+
+// unmatchedPolicy either rejects unmatched paths with a 404 or passes them through
+var unmatchedPolicy = envString("UNMATCHED_POLICY", UnmatchedStrict)
+
+// defaultBackend is the backend id unmatched paths are passed to, round-robin when empty
+var defaultBackend = os.Getenv("DEFAULT_BACKEND")
+
+// requestDeadline bounds how long a request may take across all of its
+// retries and failovers, 0 leaves it unbounded. Websockets are exempt.
+var requestDeadline = envDuration("REQUEST_DEADLINE", 0)
+
+// routeTimeouts bounds how long each route class may take, 0 leaves it untimed
+var routeTimeouts = map[string]time.Duration{
+	RouteCreate:  envDuration("ROUTE_CREATE_TIMEOUT", 0),
+	RouteAction:  envDuration("ROUTE_ACTION_TIMEOUT", 0),
+	RouteConnect: envDuration("ROUTE_CONNECT_TIMEOUT", 0),
+}
+
+// classifyRoute returns the route class of path, empty when it matches none
+func classifyRoute(path string) string {
+	switch {
+	case path == apiPrefix+"/room":
+		return RouteCreate
+	case roomAction.MatchString(path):
+		return RouteAction
+	case roomConnection.MatchString(path):
+		return RouteConnect
+	case wsSubprotocolRouting && path == apiPrefix+"/ws":
+		// the room comes with the subprotocol
+		return RouteConnect
+	}
+	return ""
+}
+
+// isWebSocket returns true for websocket upgrade requests
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
 
 // lb load balances the incoming request
 func lb(w http.ResponseWriter, r *http.Request) {
+	// retries re-enter lb, the first attempt logs the request once it's done
+	if GetAttemptsFromContext(r) == 1 {
+		aw := &accessWriter{ResponseWriter: w}
+		defer logAccess(aw, r, time.Now())
+		w = aw
+	}
+	if ip := clientIP(r); !acl.Permits(ip) {
+		log.Printf("%s(%s) Client %s not allowed\n", r.RemoteAddr, r.URL.Path, ip)
+		failRequest(w, r, errForbidden, nil)
+		return
+	}
+	if err := checkRequest(r); err != nil {
+		log.Printf("%s(%s) Malformed request: %s\n", r.RemoteAddr, r.URL.Path, err.Error())
+		failRequest(w, r, badRequest(err), nil)
+		return
+	}
+	if serveLanding(w, r) {
+		return
+	}
 	attempts := GetAttemptsFromContext(r)
 	if attempts > 3 {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+		failRequest(w, r, errMaxAttempts, nil)
 		return
 	}
-	path := r.URL.Path
-	log.Printf("Incoming Request: %v\n", path)
-	// Load Balance Room Creation Request!
-	if path == apiPrefix+"/room" {
-		peer := serverPool.GetNextPeer()
-		if peer != nil {
-			peer.ServeHTTP(w, r)
+	// failover re-enters lb while the first attempt still holds its slot
+	if attempts == 1 {
+		// websockets are capped by MAX_WEBSOCKETS instead, they'd hold a slot
+		// for the whole game session
+		if !isWebSocket(r) {
+			if !acquireSlot(&inflight, maxInflight) {
+				log.Printf("%s(%s) Too many requests in flight\n", r.RemoteAddr, r.URL.Path)
+				failRequest(w, r, errOverloaded, nil)
+				return
+			}
+			metrics.SetGauge("lb_requests_inflight", float64(atomic.LoadInt64(&inflight)))
+			defer func() {
+				releaseSlot(&inflight)
+				metrics.SetGauge("lb_requests_inflight", float64(atomic.LoadInt64(&inflight)))
+			}()
+		}
+		// close to running out of connections, new rooms go first
+		if classifyRoute(r.URL.Path) == RouteCreate && shouldShed() {
+			log.Printf("%s(%s) Shedding new room\n", r.RemoteAddr, r.URL.Path)
+			recordFailure(r, errOverloaded, nil)
+			shed(w)
 			return
 		}
-	} else {
-		//Route other requests
-		if !roomAction.MatchString(path) && !roomConnection.MatchString(path) {
-			log.Println("URL doesn't match any resource")
-			http.Error(w, "URL doesn't match any resource", http.StatusNotFound)
+		if classifyRoute(r.URL.Path) == RouteCreate && maxCreatesPerClient > 0 {
+			key := createClientKey(r)
+			if !createsPerClient.Acquire(key, maxCreatesPerClient) {
+				log.Printf("%s(%s) Client has too many rooms being created\n", r.RemoteAddr, r.URL.Path)
+				failRequest(w, r, errTooManyCreates, nil)
+				return
+			}
+			defer createsPerClient.Release(key)
+		}
+		if err := bufferExpectedBody(r); err != nil {
+			log.Printf("%s(%s) Failed to buffer body: %s\n", r.RemoteAddr, r.URL.Path, err.Error())
+			routeErr, ok := err.(*routingError)
+			if !ok {
+				routeErr = badRequest(err)
+			}
+			failRequest(w, r, routeErr, err)
 			return
 		}
-		s := strings.Split(path, "/")
-		roomId, _ := strconv.Atoi(s[2])
-		log.Printf("roomId: %v", roomId)
-		peer := serverPool.GetPeer(roomId)
-		if peer == nil {
-			log.Println("Server doesn't exists")
-			http.Error(w, "Server doesn't exists", http.StatusServiceUnavailable)
+		retryBudget.Deposit()
+		// failover re-enters lb with a context derived from this one, keeping the deadline
+		if requestDeadline > 0 && !isWebSocket(r) {
+			ctx, cancel := context.WithTimeout(r.Context(), requestDeadline)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if failureLogSize > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), Failures, &failureTrail{}))
+		}
+		if collectingMetrics() {
+			trace := &requestTrace{}
+			r = r.WithContext(context.WithValue(r.Context(), Trace, trace))
+			defer trace.record()
+		}
+	}
+	if trace := getTrace(r); trace != nil {
+		trace.attempts = attempts
+	}
+	if key := cacheKey(r); key != "" && attempts == 1 {
+		if serveCached(w, r, key) {
 			return
 		}
-		peer.ServeHTTP(w, r)
+		r = r.WithContext(context.WithValue(r.Context(), CacheKey, key))
+	}
+	decision, err := route(r)
+	class, peer := decision.Class, decision.Backend
+	if err != nil {
+		log.Println(err)
+		failRequest(w, r, err, nil)
 		return
 	}
-	log.Println("Service not available")
-	http.Error(w, "Service not available", http.StatusServiceUnavailable)
+	r = r.WithContext(context.WithValue(r.Context(), Route, class))
+	// websockets are long lived, only plain requests get a deadline
+	if timeout := routeTimeouts[class]; timeout > 0 && !isWebSocket(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	forward(w, r, peer)
+}
+
+// checkRequest rejects requests the proxy can't make sense of
+func checkRequest(r *http.Request) error {
+	if !strings.HasPrefix(r.URL.Path, "/") {
+		return errors.New("Request target must be a path")
+	}
+	if isWebSocket(r) && !r.ProtoAtLeast(1, 1) {
+		return errors.New("Websockets need HTTP/1.1")
+	}
+	return nil
+}
+
+// Status codes answered for each failure class, so clients can tell them apart
+var (
+	statusUpstreamError = envInt("STATUS_UPSTREAM_ERROR", http.StatusBadGateway)
+	statusNoBackend     = envInt("STATUS_NO_BACKEND", http.StatusServiceUnavailable)
+	statusMaxAttempts   = envInt("STATUS_MAX_ATTEMPTS", http.StatusBadGateway)
+	statusRoomNotFound  = envInt("STATUS_ROOM_NOT_FOUND", http.StatusNotFound)
+)
+
+// routeDecision is where route sends a request and which branch picked it
+type routeDecision struct {
+	Class   string
+	Branch  string
+	Backend *Backend
+}
+
+// route picks the backend serving r. Dry runs take the same branches
+// without advancing the rotation or registering rooms.
+func route(r *http.Request) (routeDecision, *routingError) {
+	path := r.URL.Path
+	d := routeDecision{Class: classifyRoute(path)}
+	// rules come first, they may route paths no built-in route matches. Room
+	// actions and connections skip them, the room lives on its owner.
+	if rule := routingRules.Match(r); rule != nil && d.Class != RouteAction && d.Class != RouteConnect {
+		if d.Class == "" {
+			d.Class = RouteDefault
+		}
+		return routeByRule(r, d, rule)
+	}
+	if d.Class == "" {
+		if unmatchedPolicy != UnmatchedPassThrough {
+			return d, errNoRoute
+		}
+		d.Class = RouteDefault
+	}
+	// a shard key co-locates related rooms, overriding the default mapping
+	if key := shardKey(r); key != "" && d.Class != RouteDefault {
+		d.Branch = "shard-hash"
+		get := func() *Backend { return serverPool.Ring().Get(key) }
+		d.Backend = selectPeer(r, d.Branch, get, get)
+		if d.Backend == nil {
+			return d, errNoServer
+		}
+		if !d.Backend.IsAlive() {
+			log.Printf("%s is down, can't route shard %s\n", d.Backend.URL, key)
+			return d, errUnavailable
+		}
+		return d, nil
+	}
+	// Load Balance Room Creation Request!
+	if d.Class == RouteCreate {
+		d.Branch = lbStrategy
+		d.Backend = newRoomPeer(r)
+		if !isDryRun(r) {
+			logPlacement(r, d.Backend)
+		}
+		if d.Backend == nil {
+			return d, errUnavailable
+		}
+		if !isDryRun(r) {
+			d.Backend.roomLoad.Add(roomCost(r))
+		}
+		return d, nil
+	}
+	if d.Class == RouteDefault {
+		d.Branch = "default"
+		if d.Backend = defaultPeer(r); d.Backend != nil {
+			return d, nil
+		}
+		return d, errUnavailable
+	}
+	//Route other requests
+	roomId := requestRoomId(r, d.Class)
+	if !roomIdRegexp.MatchString(roomId) {
+		return d, errNoRoute
+	}
+	d.Branch = roomStrategy()
+	if roomPins.Lookup(roomId) != nil {
+		d.Branch = "pinned"
+	} else if serverPool.rooms.Lookup(roomId) != nil {
+		d.Branch = "registry"
+	}
+	d.Backend = selectPeer(r, roomStrategy(),
+		func() *Backend { return serverPool.GetPeer(roomId) },
+		func() *Backend { return serverPool.PeekPeer(roomId) })
+	if d.Backend == nil {
+		return d, errNoServer
+	}
+	// rooms live on a single server, so fail fast instead of retrying a dead
+	// one, unless they may move to another
+	if roomFailover == RoomFailoverRehash && d.Branch != "pinned" &&
+		(!d.Backend.IsAlive() || d.Backend == refusedBackend(r)) {
+		if next := serverPool.rehashRoom(r, roomId, d.Backend); next != nil {
+			d.Branch, d.Backend = "rehash", next
+			return d, nil
+		}
+	}
+	if !d.Backend.IsAlive() {
+		log.Printf("%s is down, can't route room %s\n", d.Backend.URL, roomId)
+		return d, errUnavailable
+	}
+	return d, nil
+}
+
+// requestRoomId returns the room r goes to, out of the routing subprotocol
+// of connections offering one or else out of the request
+func requestRoomId(r *http.Request, class string) string {
+	if proto := routingSubprotocol(r); class == RouteConnect && proto != "" {
+		return strings.TrimPrefix(proto, wsSubprotocolPrefix)
+	}
+	return extractRoomId(r)
+}
+
+// selectPeer runs a selection strategy, or its side effect free peek on dry runs
+func selectPeer(r *http.Request, strategy string, get, peek func() *Backend) *Backend {
+	if isDryRun(r) {
+		return peek()
+	}
+	return timeSelection(strategy, get)
+}
+
+// shardKeyHeader names the header carrying a custom shard key, empty disables shard keys
+var shardKeyHeader = os.Getenv("SHARD_KEY_HEADER")
+
+// shardKey returns the shard key sent with r, if any
+func shardKey(r *http.Request) string {
+	if shardKeyHeader == "" {
+		return ""
+	}
+	return r.Header.Get(shardKeyHeader)
+}
+
+// defaultPeer returns the backend unmatched paths are passed through to
+func defaultPeer(r *http.Request) *Backend {
+	if defaultBackend == "" {
+		return pickExcluding(&serverPool, r, func(p *ServerPool) *Backend {
+			return selectPeer(r, "round-robin", p.GetNextPeer, p.PeekNextPeer)
+		})
+	}
+	if peer := serverPool.GetBackend(defaultBackend); peer != nil && peer.IsAlive() {
+		return peer
+	}
+	return nil
+}
+
+// forward proxies the request to peer unless it reached its in-flight cap,
+// websockets are counted by the backend's open connections instead
+func forward(w http.ResponseWriter, r *http.Request, peer *Backend) {
+	if !isWebSocket(r) {
+		if !acquireSlot(&peer.inflight, maxInflightPerBackend) {
+			log.Printf("%s(%s) %s has too many requests in flight\n", r.RemoteAddr, r.URL.Path, peer.URL)
+			failRequest(w, r, errOverloaded, nil)
+			return
+		}
+		defer releaseSlot(&peer.inflight)
+	}
+	if trail := getFailureTrail(r); trail != nil {
+		trail.backends = append(trail.backends, peer.ID)
+	}
+	peer.ServeHTTP(w, r)
 }
 
 // isAlive checks whether a backend is Alive by establishing a TCP connection
-func isBackendAlive(u *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+func isBackendAlive(b *Backend) bool {
+	conn, err := b.dialTimeout("tcp", b.URL.Host, healthCheckConnectTimeout)
 	if err != nil {
 		log.Println("Site unreachable, error: ", err)
 		return false
@@ -95,9 +442,9 @@ func isBackendAlive(u *url.URL) bool {
 	return true
 }
 
-// healthCheck runs a routine for check status of the backends every 2 mins
+// healthCheck runs a routine for check status of the backends every healthCheckInterval
 func healthCheck() {
-	t := time.NewTicker(time.Second * 20)
+	t := time.NewTicker(healthCheckInterval)
 	for {
 		select {
 		case <-t.C:
@@ -110,14 +457,76 @@ func healthCheck() {
 
 var serverPool ServerPool
 
-func createProxy(u *url.URL) *httputil.ReverseProxy {
+func createProxy(b *Backend) *httputil.ReverseProxy {
+	u := b.URL
 	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = b.transport
+	if chaosEnabled {
+		proxy.Transport = &chaosTransport{backend: b, next: b.transport}
+	}
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		b.rewritePath(req.URL)
+		director(req)
+		b.setHost(req)
+		filterRequestHeaders(req.Header)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		b.recordOutcome(resp.StatusCode < http.StatusInternalServerError)
+		b.recordCapacityHeader(resp.Header)
+		if trace := getTrace(resp.Request); trace != nil {
+			trace.served = true
+		}
+		if shouldRetryStatus(resp) {
+			return &retryStatusError{status: resp.StatusCode}
+		}
+		handleRedirect(resp)
+		filterResponseHeaders(resp.Header)
+		setRetryHeaders(resp)
+		if err := rewriteResponse(resp); err != nil {
+			return err
+		}
+		if err := storeCached(resp); err != nil {
+			return err
+		}
+		resp.Body = countBytes(resp.Body, &b.usage.BytesOut)
+		mirror(resp)
+		return nil
+	}
 	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
 		log.Printf("[%s] %s\n", u.Host, e.Error())
+		if e == errResponseTooLarge {
+			failRequest(writer, request, errUpstream, e)
+			return
+		}
+		// failed over statuses were already recorded as the response came in
+		_, badStatus := e.(*retryStatusError)
+		if !badStatus {
+			b.recordOutcome(false)
+		}
+		metrics.IncBackendError(b.ID)
+		// the route deadline covers every retry, give up once it's gone
+		if request.Context().Err() == context.DeadlineExceeded {
+			log.Printf("%s(%s) Deadline exceeded, terminating\n", request.RemoteAddr, request.URL.Path)
+			failRequest(writer, request, errTimeout, e)
+			return
+		}
+		// retries past the budget would only amplify an outage
+		if !retryBudget.Withdraw() {
+			log.Printf("%s(%s) Retry budget exhausted, terminating\n", request.RemoteAddr, request.URL.Path)
+			failRequest(writer, request, errUpstream, e)
+			return
+		}
 		retries := GetRetryFromContext(request)
-		if retries < 3 {
+		// a closed port won't open in a few milliseconds and a backend answering
+		// an error status won't change its mind, fail over right away
+		if retries < 3 && !isUnreachable(e) && !badStatus {
 			select {
 			case <-time.After(10 * time.Millisecond):
+				if trace := getTrace(request); trace != nil {
+					trace.retries++
+				}
+				noteRetry(writer)
 				ctx := context.WithValue(request.Context(), Retry, retries+1)
 				proxy.ServeHTTP(writer, request.WithContext(ctx))
 			}
@@ -125,17 +534,36 @@ func createProxy(u *url.URL) *httputil.ReverseProxy {
 		}
 
 		// after 3 retries, mark this backend as down
-		serverPool.MarkBackendStatus(u, false)
+		if !badStatus {
+			ejectBackend(b)
+		}
+		if trail := getFailureTrail(request); trail != nil {
+			trail.lastErr = e
+		}
 
 		// if the same request routing for few attempts with different backends, increase the count
 		attempts := GetAttemptsFromContext(request)
 		log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
+		noteRetry(writer)
 		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		// the next attempt can move a room off a backend that refused it, by
+		// connection or status, while other requests move on anyway
+		if isUnreachable(e) || badStatus {
+			ctx = context.WithValue(ctx, Refused, b)
+		}
 		lb(writer, request.WithContext(ctx))
 	}
 	return proxy
 }
 
+// isUnreachable returns true for errors showing nothing is listening on the
+// backend, unlike timeouts and resets those aren't worth retrying
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
+
 func getSecure() string {
 	if os.Getenv("SECURE_LAYER") != "" {
 		return "s"
@@ -144,45 +572,310 @@ func getSecure() string {
 }
 
 func main() {
-	var serverList string
 	var port int
-	serverList = os.Getenv("SERVER_LIST")
+	var selftest bool
 	//flag.StringVar(&serverList, "backends", "", "Load balanced backends, use commas to separate")
 	flag.IntVar(&port, "port", 3030, "Port to serve")
+	flag.BoolVar(&selftest, "selftest", false, "Check how requests would be routed and exit")
 	flag.Parse()
 
-	if len(serverList) == 0 {
+	serverList, err := loadServerList()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(serverList) == 0 && dnsDiscovery == "" {
 		log.Fatal("Please provide one or more backends to load balance")
 	}
+	if roomIdPattern() == "" {
+		log.Fatalf("Unknown ROOM_ID_TYPE %q", roomIdType)
+	}
+	if extractRoomId, err = parseRoomIdSource(roomIdSource); err != nil {
+		log.Fatal(err)
+	}
+	roomAction, roomConnection = roomRoutes(roomIdSource)
+
+	if trustedProxies, err = parseNetworks(envList("TRUSTED_PROXIES")); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadBackendClientCert(); err != nil {
+		log.Fatal(err)
+	}
+	if excludeTrustedNetworks, err = parseNetworks(envList("EXCLUDE_TRUSTED_NETWORKS")); err != nil {
+		log.Fatal(err)
+	}
+	if retryOnStatus, err = parseRetryStatuses(envList("RETRY_ON_STATUS")); err != nil {
+		log.Fatal(err)
+	}
+	if setRequestHeaders, err = parseHeaderSets(envList("SET_REQUEST_HEADERS")); err != nil {
+		log.Fatal(err)
+	}
+	if createClientKey, err = parseClientKey(envString("CREATE_CLIENT_KEY", "ip")); err != nil {
+		log.Fatal(err)
+	}
+	if mirrorTarget, err = parseMirrorTarget(envString("MIRROR_TARGET", "")); err != nil {
+		log.Fatal(err)
+	}
+	if metricsEnabled {
+		metrics = prometheusMetrics{}
+	}
+	if err := loadACL(); err != nil {
+		log.Fatal(err)
+	}
+	reloaders = append(reloaders, loadACL)
+	if err := loadLandingPage(); err != nil {
+		log.Fatal(err)
+	}
+	reloaders = append(reloaders, loadLandingPage)
+	if len(landingPaths) == 0 {
+		landingPaths = []string{"/"}
+	}
+
+	rewriter, err := parseURLRewrites(envList("URL_REWRITES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	urlRewriter = rewriter
+	if types := envList("URL_REWRITE_TYPES"); len(types) > 0 {
+		urlRewriteTypes = types
+	}
 
 	// parse servers
-	tokens := strings.Split(serverList, ",")
-	for _, tok := range tokens {
-		log.Printf("Try add Backend: %v", tok)
-		serverUrl, err := url.Parse("http" + getSecure() + "://" + tok)
-		if err != nil {
+	backends, err := buildServerList(serverList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, backend := range backends {
+		serverPool.AddBackend(backend)
+		configuredIDs[backend.ID] = true
+		log.Printf("Configured server: %s\n", backend.URL)
+	}
+	// only a file can change under a running balancer
+	if os.Getenv("SERVER_LIST_FILE") != "" {
+		reloaders = append(reloaders, reloadServerList)
+	}
+
+	split, err := parseTrafficSplit(envList("TRAFFIC_SPLIT"))
+	if err == nil {
+		err = trafficSplit.Set(split)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for pool := range split {
+		// discovered backends only show up later
+		if serverPool.Pool(pool) == nil && dnsDiscovery == "" {
+			log.Fatalf("TRAFFIC_SPLIT pool %s has no backend", pool)
+		}
+	}
+	applyMaintenance(time.Now())
+	// discovered backends join the configured ones
+	var discovery *discoverer
+	var discoveryWait time.Duration
+	if dnsDiscovery != "" {
+		if discovery, err = newDiscoverer(dnsDiscovery); err != nil {
 			log.Fatal(err)
 		}
-
-		serverPool.AddBackend(&Backend{
-			URL:          serverUrl,
-			Alive:        true,
-			ReverseProxy: createProxy(serverUrl),
-		})
-		log.Printf("Configured server: %s\n", serverUrl)
+		discoveryWait = discovery.refresh()
 	}
+	if err := loadRoomPins(); err != nil {
+		log.Fatal(err)
+	}
+	reloaders = append(reloaders, loadRoomPins)
+	if err := loadRoutingRules(); err != nil {
+		log.Fatal(err)
+	}
+	reloaders = append(reloaders, loadRoutingRules)
 
 	// create http server
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(lb),
+	server := newServer(fmt.Sprintf(":%d", port))
+	// operator endpoints stay off the listener game clients connect to
+	adminServer := &http.Server{
+		Addr:    adminAddr,
+		Handler: adminMux(),
+	}
+
+	for name, status := range map[string]int{
+		"STATUS_UPSTREAM_ERROR": statusUpstreamError,
+		"STATUS_NO_BACKEND":     statusNoBackend,
+		"STATUS_MAX_ATTEMPTS":   statusMaxAttempts,
+		"STATUS_ROOM_NOT_FOUND": statusRoomNotFound,
+	} {
+		if status < 400 || status > 599 {
+			log.Fatalf("%s must be an error status code, got %d", name, status)
+		}
+	}
+	if _, err := parseProxy(backendProxy); err != nil {
+		log.Fatal(err)
+	}
+	if accessLogSample < 1 {
+		log.Fatalf("ACCESS_LOG_SAMPLE must be at least 1, got %d", accessLogSample)
+	}
+	if accessLogRate < 0 {
+		log.Fatalf("ACCESS_LOG_RATE can't be negative, got %d", accessLogRate)
+	}
+	if healthCheckConcurrency < 1 {
+		log.Fatalf("HEALTH_CHECK_CONCURRENCY must be at least 1, got %d", healthCheckConcurrency)
+	}
+	if !isValidRedirectPolicy(redirectPolicy) {
+		log.Fatalf("Unknown REDIRECT_POLICY %q", redirectPolicy)
+	}
+	if redirectPolicy == RedirectRewrite && urlRewriter == nil {
+		log.Fatal("REDIRECT_POLICY rewrite needs URL_REWRITES")
+	}
+	if !isValidExpectPolicy(expectContinuePolicy) {
+		log.Fatalf("Unknown EXPECT_CONTINUE %q", expectContinuePolicy)
+	}
+	if logLevel != "info" && logLevel != "debug" {
+		log.Fatalf("Unknown LOG_LEVEL %q", logLevel)
+	}
+	if wsDrainCloseCode < 1000 || wsDrainCloseCode > 4999 {
+		log.Fatalf("Invalid WS_DRAIN_CLOSE_CODE %d, expected 1000 to 4999", wsDrainCloseCode)
+	}
+	if !isValidZonePolicy(zonePolicy) {
+		log.Fatalf("Unknown ZONE_POLICY %q", zonePolicy)
+	}
+	if !isValidStrategy(lbStrategy) {
+		log.Fatalf("Unknown LB_STRATEGY %q", lbStrategy)
+	}
+	if hashLoadFactor != 0 && hashLoadFactor < 1 {
+		log.Fatalf("HASH_LOAD_FACTOR must be 0 or at least 1, got %v", hashLoadFactor)
+	}
+	if bufferOverflow != OverflowStream && bufferOverflow != OverflowError {
+		log.Fatalf("Unknown BUFFER_OVERFLOW %q", bufferOverflow)
+	}
+	if !isValidRoomFailover(roomFailover) {
+		log.Fatalf("Unknown ROOM_FAILOVER %q", roomFailover)
+	}
+	if !isValidDrainOrder(drainOrder) {
+		log.Fatalf("Unknown DRAIN_ORDER %q", drainOrder)
+	}
+	if backendMaxConns < 0 || backendMaxStreams < 0 {
+		log.Fatal("BACKEND_MAX_CONNS and BACKEND_MAX_STREAMS_PER_CONN can't be negative")
+	}
+	if backendMaxStreams > 0 && backendMaxConns == 0 {
+		log.Fatal("BACKEND_MAX_STREAMS_PER_CONN needs BACKEND_MAX_CONNS")
+	}
+	if drainConcurrency < 1 {
+		log.Fatal("DRAIN_CONCURRENCY must be at least 1")
+	}
+	if unmatchedPolicy != UnmatchedStrict && unmatchedPolicy != UnmatchedPassThrough {
+		log.Fatalf("Unknown UNMATCHED_POLICY %q", unmatchedPolicy)
+	}
+	if defaultBackend != "" && serverPool.GetBackend(defaultBackend) == nil {
+		log.Fatalf("DEFAULT_BACKEND %s is not one of the backends", defaultBackend)
+	}
+
+	if selftest {
+		if !runSelfTest(os.Stdout) {
+			os.Exit(1)
+		}
+		return
 	}
 
 	// start health checking
-	//go healthCheck()
+	if initialHealthCheck {
+		log.Println("Starting initial health check...")
+		serverPool.InitialHealthCheck()
+		log.Println("Initial health check completed")
+	}
+	go healthCheck()
+	go expireRooms()
+	go scheduleMaintenance()
+	if discovery != nil {
+		go discovery.discover(discoveryWait)
+	}
+	go flushUsage()
+	for _, b := range serverPool.Backends() {
+		go b.warm()
+	}
+	go serveDebug()
+	go handleReloads()
+	go handleDumps()
+
+	go func() {
+		log.Printf("Admin server started at %s\n", adminAddr)
+		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	var adminGRPC *grpc.Server
+	if adminGRPCAddr != "" {
+		adminGRPC = grpc.NewServer()
+		adminGRPC.RegisterService(&adminServiceDesc, &adminService{pool: &serverPool})
+		go serveAdminGRPC(adminGRPC)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		waitForShutdown()
+		shutdown(server, adminServer, adminGRPC)
+		close(stopped)
+	}()
 
+	if chaosEnabled {
+		log.Println("Chaos mode enabled, faults can be injected into backend requests")
+	}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if maxConns > 0 {
+		listener = newLimitListener(listener, maxConns)
+	}
 	log.Printf("Load Balancer started at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
+	if err := server.Serve(listener); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-stopped
+}
+
+// shutdownTimeout bounds how long in-flight requests get to finish on shutdown
+var shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+// waitForShutdown blocks until the process is asked to stop
+func waitForShutdown() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down\n", <-sig)
+}
+
+// maxHeaderBytes caps the size of request headers, e.g. bloated cookies
+var maxHeaderBytes = envInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+
+// newServer creates the server game clients connect to, requests over
+// maxHeaderBytes are answered with 431 before reaching lb
+func newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        http.HandlerFunc(lb),
+		MaxHeaderBytes: maxHeaderBytes,
+		ConnState:      trackConn,
+	}
+}
+
+// shutdown stops taking new requests and waits for the in-flight ones and
+// the open websockets to drain, the admin servers stay up until then
+func shutdown(server, adminServer *http.Server, adminGRPC *grpc.Server) {
+	// replicas drain one at a time, this one keeps serving meanwhile
+	release := holdDrainLease(newDrainLease())
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	atomic.StoreInt32(&draining, 1)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown of %s failed: %s\n", server.Addr, err.Error())
+	}
+	// hijacked websockets aren't tracked by the server
+	waitForDrain(ctx)
+	if usageFile != "" {
+		if err := writeUsage(); err != nil {
+			log.Println("Failed to write usage: ", err)
+		}
+	}
+	log.Println("Drained, stopping admin server")
+	if err := adminServer.Close(); err != nil {
+		log.Printf("Shutdown of %s failed: %s\n", adminServer.Addr, err.Error())
+	}
+	if adminGRPC != nil {
+		adminGRPC.Stop()
+	}
 }
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRoomOnDeadBackendFailsFast(t *testing.T) {
+	var hits int64
+	mapped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer mapped.Close()
+	defer func(policy string) { roomFailover = policy }(roomFailover)
+	roomFailover = RoomFailoverNone
+	tests := []struct {
+		name  string
+		path  string
+		alive bool
+		code  int
+		hits  int64
+	}{
+		{"alive", "/room/1/state", true, http.StatusOK, 1},
+		{"dead", "/room/1/state", false, statusNoBackend, 0},
+		{"dead connection", "/ws/1", false, statusNoBackend, 0},
+		{"room out of range", "/room/90001/state", true, statusRoomNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, strings.TrimPrefix(mapped.URL, "http://"), "localhost:9102")()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			serverPool.Backends()[0].SetAlive(tt.alive)
+			atomic.StoreInt64(&hits, 0)
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if n := atomic.LoadInt64(&hits); n != tt.hits {
+				t.Fatalf("mapped backend hit %d times, want %d", n, tt.hits)
+			}
+		})
+	}
+}
+
+func TestRouteTimeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer func(timeouts map[string]time.Duration) { routeTimeouts = timeouts }(routeTimeouts)
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		timeouts map[string]time.Duration
+		code     int
+	}{
+		{"creation over its timeout", http.MethodPost, "/room", map[string]time.Duration{RouteCreate: 20 * time.Millisecond, RouteAction: time.Second}, http.StatusGatewayTimeout},
+		{"creation within its timeout", http.MethodPost, "/room", map[string]time.Duration{RouteCreate: time.Second, RouteAction: 20 * time.Millisecond}, http.StatusOK},
+		{"action over its timeout", http.MethodGet, "/room/1/state", map[string]time.Duration{RouteCreate: time.Second, RouteAction: 20 * time.Millisecond}, http.StatusGatewayTimeout},
+		{"action within its timeout", http.MethodGet, "/room/1/state", map[string]time.Duration{RouteCreate: 20 * time.Millisecond, RouteAction: time.Second}, http.StatusOK},
+		{"connection over its timeout", http.MethodGet, "/ws/1", map[string]time.Duration{RouteConnect: 20 * time.Millisecond}, http.StatusGatewayTimeout},
+		{"untimed", http.MethodGet, "/room/1/state", map[string]time.Duration{}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, strings.TrimPrefix(slow.URL, "http://"))()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			routeTimeouts = tt.timeouts
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	// backends that fail slowly, so every try on them takes a while
+	delays := []time.Duration{15 * time.Millisecond, 60 * time.Millisecond}
+	var hits [2]int64
+	var failing []*httptest.Server
+	for i := range hits {
+		i := i
+		failing = append(failing, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits[i], 1)
+			time.Sleep(delays[i])
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		})))
+		defer failing[i].Close()
+	}
+	var served int64
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&served, 1)
+	}))
+	defer live.Close()
+	defer func(deadline time.Duration) { requestDeadline = deadline }(requestDeadline)
+	defer func(min float64) { retryBudgetMinPerSecond = min }(retryBudgetMinPerSecond)
+	retryBudgetMinPerSecond = 1000
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		code     int
+		reached  int // backends the request got to
+	}{
+		// a takes 4 tries of some 25ms, b a single one of 60ms as the
+		// retries carry over, so c answers after about 150ms
+		{"unbounded", 0, http.StatusOK, 3},
+		{"within the deadline", time.Second, http.StatusOK, 3},
+		{"during the first backend", 50 * time.Millisecond, http.StatusGatewayTimeout, 1},
+		{"during the second backend", 120 * time.Millisecond, http.StatusGatewayTimeout, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestDeadline = tt.deadline
+			for i := range hits {
+				atomic.StoreInt64(&hits[i], 0)
+			}
+			atomic.StoreInt64(&served, 0)
+			defer setPool(t, strings.TrimPrefix(failing[0].URL, "http://")+"?name=a",
+				strings.TrimPrefix(failing[1].URL, "http://")+"?name=b",
+				strings.TrimPrefix(live.URL, "http://")+"?name=c")()
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			w := httptest.NewRecorder()
+			started := time.Now()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			took := time.Since(started)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if tt.code == http.StatusGatewayTimeout {
+				if took > tt.deadline+50*time.Millisecond {
+					t.Fatalf("answered after %s, want about %s", took, tt.deadline)
+				}
+				if n := strings.Count(w.Body.String(), errTimeout.Message); n != 1 {
+					t.Fatalf("body %q holds %d timeouts, want a single one", w.Body.String(), n)
+				}
+			}
+			reached := 0
+			for i := range hits {
+				if atomic.LoadInt64(&hits[i]) > 0 {
+					reached++
+				}
+			}
+			if atomic.LoadInt64(&served) > 0 {
+				reached++
+			}
+			if reached != tt.reached {
+				t.Fatalf("reached %d backends, want %d", reached, tt.reached)
+			}
+		})
+	}
+}
+
+func TestRequestDeadlineSkipsWebsockets(t *testing.T) {
+	defer func(deadline time.Duration) { requestDeadline = deadline }(requestDeadline)
+	requestDeadline = 20 * time.Millisecond
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String())()
+	conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+	defer waitWebsockets(t, 0)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	time.Sleep(5 * requestDeadline)
+	if _, err := conn.Write([]byte("\x81\x85\x00\x00\x00\x00hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	hello := make([]byte, 7)
+	if _, err := io.ReadFull(br, hello); err != nil || string(hello) != "\x81\x05hello" {
+		t.Fatalf("read %q (%v) past the deadline, want the websocket still open", hello, err)
+	}
+}
+
+func TestUnmatchedPolicy(t *testing.T) {
+	var hits [2]int64
+	var backends [2]*httptest.Server
+	for i := range backends {
+		i := i
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&hits[i], 1)
+		}))
+		defer backends[i].Close()
+	}
+	defer func(policy, backend string) { unmatchedPolicy, defaultBackend = policy, backend }(unmatchedPolicy, defaultBackend)
+	tests := []struct {
+		name    string
+		policy  string
+		backend string // DEFAULT_BACKEND
+		down    bool   // whether the default backend is down
+		code    int
+		hits    [2]int64
+	}{
+		{"strict", UnmatchedStrict, "", false, http.StatusNotFound, [2]int64{0, 0}},
+		{"pass through round robin", UnmatchedPassThrough, "", false, http.StatusOK, [2]int64{1, 1}},
+		{"pass through to the default", UnmatchedPassThrough, "b", false, http.StatusOK, [2]int64{0, 2}},
+		{"default down", UnmatchedPassThrough, "b", true, statusNoBackend, [2]int64{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, strings.TrimPrefix(backends[0].URL, "http://")+"?name=a", strings.TrimPrefix(backends[1].URL, "http://")+"?name=b")()
+			unmatchedPolicy, defaultBackend = tt.policy, tt.backend
+			serverPool.GetBackend("b").SetAlive(!tt.down)
+			atomic.StoreInt64(&hits[0], 0)
+			atomic.StoreInt64(&hits[1], 0)
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				lb(w, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+				if w.Code != tt.code {
+					t.Fatalf("status %d, want %d", w.Code, tt.code)
+				}
+			}
+			if got := [2]int64{atomic.LoadInt64(&hits[0]), atomic.LoadInt64(&hits[1])}; got != tt.hits {
+				t.Fatalf("backends hit %v, want %v", got, tt.hits)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	var hits int64
+	var cookies int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		if r.Header.Get("Cookie") != "" {
+			atomic.AddInt64(&cookies, 1)
+		}
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer func(n int, strip []string) { maxHeaderBytes, stripRequestHeaders = n, strip }(maxHeaderBytes, stripRequestHeaders)
+	maxHeaderBytes = 1 << 10
+	stripRequestHeaders = []string{"Cookie"}
+	front := httptest.NewUnstartedServer(nil)
+	front.Config = newServer("")
+	front.Start()
+	defer front.Close()
+	tests := []struct {
+		name   string
+		cookie int // bytes of cookie sent
+		code   int
+		hits   int64
+	}{
+		{"small", 100, http.StatusOK, 1},
+		// the server allows 4KB of slack over the limit before refusing
+		{"oversized", 16 << 10, http.StatusRequestHeaderFieldsTooLarge, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&hits, 0)
+			atomic.StoreInt64(&cookies, 0)
+			req, err := http.NewRequest(http.MethodPost, front.URL+"/room", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Cookie", "session="+strings.Repeat("x", tt.cookie))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+			if n := atomic.LoadInt64(&hits); n != tt.hits {
+				t.Fatalf("backend hit %d times, want %d", n, tt.hits)
+			}
+			if atomic.LoadInt64(&cookies) != 0 {
+				t.Fatal("the stripped cookie reached the backend")
+			}
+		})
+	}
+}
+
+func TestShardKeyRouting(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c", "localhost:9104?name=d")()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(header string) { shardKeyHeader = header }(shardKeyHeader)
+	shardKeyHeader = "X-Shard-Key"
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/room"},
+		{http.MethodGet, "/room/1/state"},
+		{http.MethodGet, "/room/30001/state"},
+		{http.MethodGet, "/ws/20001"},
+	}
+	for _, key := range []string{"match-1", "match-2", "guild/77", "eu"} {
+		t.Run(key, func(t *testing.T) {
+			want := serverPool.Ring().Get(key)
+			for _, rr := range requests {
+				req := httptest.NewRequest(rr.method, rr.path, nil)
+				req.Header.Set("X-Shard-Key", key)
+				d, err := route(withDryRun(req))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d.Backend != want || d.Branch != "shard-hash" {
+					t.Fatalf("%s %s went to %q by %s, want %q by shard-hash", rr.method, rr.path, idOf(d.Backend), d.Branch, idOf(want))
+				}
+			}
+		})
+	}
+
+	// without the header rooms map as usual
+	d, err := route(withDryRun(httptest.NewRequest(http.MethodGet, "/room/30001/state", nil)))
+	if err != nil || idOf(d.Backend) != "d" {
+		t.Fatalf("room 30001 routed to %q (%v), want d", idOf(d.Backend), err)
+	}
+	// nor is the header read once disabled
+	shardKeyHeader = ""
+	req := httptest.NewRequest(http.MethodGet, "/room/30001/state", nil)
+	req.Header.Set("X-Shard-Key", "match-1")
+	if d, err := route(withDryRun(req)); err != nil || d.Branch == "shard-hash" {
+		t.Fatalf("routed by %s (%v) with shard keys disabled", d.Branch, err)
+	}
+}
+
+func TestIsUnreachable(t *testing.T) {
+	// nothing listens there once closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	_, refused := net.Dial("tcp", l.Addr().String())
+	opError := func(errno error) error {
+		return &url.Error{Op: "Post", URL: "http://backend/room", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}}
+	}
+	tests := []struct {
+		name        string
+		err         error
+		unreachable bool
+	}{
+		{"refused dial", refused, true},
+		{"refused in a proxy error", opError(syscall.ECONNREFUSED), true},
+		{"no route to host", opError(syscall.EHOSTUNREACH), true},
+		{"network unreachable", opError(syscall.ENETUNREACH), true},
+		{"reset", opError(syscall.ECONNRESET), false},
+		{"timeout", opError(syscall.ETIMEDOUT), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"closed early", io.ErrUnexpectedEOF, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if unreachable := isUnreachable(tt.err); unreachable != tt.unreachable {
+				t.Fatalf("isUnreachable(%v) = %v, want %v", tt.err, unreachable, tt.unreachable)
+			}
+		})
+	}
+}
+
+// resettingListener resets the first resets connections it accepts
+type resettingListener struct {
+	net.Listener
+	resets int64
+}
+
+func (l *resettingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || atomic.AddInt64(&l.resets, -1) < 0 {
+			return conn, err
+		}
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = conn.Close()
+	}
+}
+
+func TestRefusedFailsOverAtOnce(t *testing.T) {
+	defer func(expose bool) { exposeRetries = expose }(exposeRetries)
+	exposeRetries = true
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	tests := []struct {
+		name     string
+		resets   int64 // connections the first backend resets, -1 when it's down
+		attempts string
+		retries  string
+		alive    bool // whether the first backend is still alive afterwards
+	}{
+		{"refused", -1, "2", "0", false},
+		{"reset once", 1, "1", "1", true},
+		{"reset twice", 2, "1", "2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := deadAddr
+			if tt.resets >= 0 {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+				go func() { _ = server.Serve(&resettingListener{Listener: l, resets: tt.resets}) }()
+				defer server.Close()
+				first = l.Addr().String()
+			}
+			live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer live.Close()
+			defer setPool(t, first+"?name=first", strings.TrimPrefix(live.URL, "http://")+"?name=live")()
+			for serverPool.PeekNextPeer().ID != "first" {
+				serverPool.GetNextPeer()
+			}
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			if attempts, retries := w.Header().Get("X-LB-Attempts"), w.Header().Get("X-LB-Retries"); attempts != tt.attempts || retries != tt.retries {
+				t.Fatalf("%s attempts and %s retries, want %s and %s", attempts, retries, tt.attempts, tt.retries)
+			}
+			if alive := serverPool.GetBackend("first").IsAlive(); alive != tt.alive {
+				t.Fatalf("first backend alive = %v, want %v", alive, tt.alive)
+			}
+		})
+	}
+}
+
+func TestRetryHeaders(t *testing.T) {
+	defer func(expose bool) { exposeRetries = expose }(exposeRetries)
+	// nothing listens there once closed
+	var dead []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, l.Addr().String())
+		l.Close()
+	}
+	tests := []struct {
+		name     string
+		expose   bool
+		dead     int // down backends tried before the live one
+		attempts string
+		retries  string
+	}{
+		{"off", false, 1, "", ""},
+		{"first try", true, 0, "1", "0"},
+		{"failed over once", true, 1, "2", "0"},
+		{"failed over twice", true, 2, "3", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exposeRetries = tt.expose
+			live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer live.Close()
+			var specs []string
+			for i, addr := range dead[:tt.dead] {
+				specs = append(specs, fmt.Sprintf("%s?name=dead%d", addr, i))
+			}
+			specs = append(specs, strings.TrimPrefix(live.URL, "http://")+"?name=live")
+			defer setPool(t, specs...)()
+			for serverPool.PeekNextPeer().ID != serverPool.Backends()[0].ID {
+				serverPool.GetNextPeer()
+			}
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			if attempts, retries := w.Header().Get("X-LB-Attempts"), w.Header().Get("X-LB-Retries"); attempts != tt.attempts || retries != tt.retries {
+				t.Fatalf("attempts %q retries %q, want %q %q", attempts, retries, tt.attempts, tt.retries)
+			}
+		})
+	}
+}
+
+func TestFailureStatuses(t *testing.T) {
+	// nothing listens on those once closed
+	var dead []string
+	for i := 0; i < 4; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, l.Addr().String())
+		l.Close()
+	}
+	defer func(retries int) { wsDialRetries = retries }(wsDialRetries)
+	wsDialRetries = 0
+	tests := []struct {
+		name   string
+		err    *routingError
+		def    int
+		pool   []string
+		down   bool // whether the pool is marked down first
+		method string
+		path   string
+	}{
+		{"upstream error", errUpstream, http.StatusBadGateway, dead[:1], false, http.MethodGet, "/ws/1"},
+		{"no backend", errUnavailable, http.StatusServiceUnavailable, dead[:2], true, http.MethodPost, "/room"},
+		{"max attempts", errMaxAttempts, http.StatusBadGateway, dead, false, http.MethodPost, "/room"},
+		{"room not found", errNoServer, http.StatusNotFound, dead[:1], false, http.MethodGet, "/room/90001/state"},
+	}
+	for _, tt := range tests {
+		if tt.err.Status != tt.def {
+			t.Fatalf("%s answers %d by default, want %d", tt.name, tt.err.Status, tt.def)
+		}
+		// the STATUS_* settings end up as the statuses of the failures
+		for _, status := range []int{tt.def, 530} {
+			t.Run(tt.name+" "+strconv.Itoa(status), func(t *testing.T) {
+				defer func(status int) { tt.err.Status = status }(tt.err.Status)
+				tt.err.Status = status
+				defer setPool(t, tt.pool...)()
+				defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+				if tt.down {
+					for _, b := range serverPool.Backends() {
+						b.SetAlive(false)
+					}
+				}
+				req := httptest.NewRequest(tt.method, tt.path, nil)
+				if tt.path == "/ws/1" {
+					req.Header.Set("Connection", "Upgrade")
+					req.Header.Set("Upgrade", "websocket")
+				}
+				w := httptest.NewRecorder()
+				lb(w, req)
+				if w.Code != status {
+					t.Fatalf("status %d, want %d", w.Code, status)
+				}
+			})
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		proto     string
+		websocket bool
+		ok        bool
+	}{
+		{"http/1.1", "/room", "HTTP/1.1", false, true},
+		{"http/1.0", "/room", "HTTP/1.0", false, true},
+		{"absolute target", "http://lb.example/room", "HTTP/1.1", false, true},
+		{"asterisk target", "*", "HTTP/1.1", false, false},
+		{"websocket", "/ws/1", "HTTP/1.1", true, true},
+		{"http/1.0 websocket", "/ws/1", "HTTP/1.0", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Proto = tt.proto
+			r.ProtoMajor, r.ProtoMinor, _ = http.ParseHTTPVersion(tt.proto)
+			if tt.websocket {
+				r.Header.Set("Upgrade", "websocket")
+			}
+			if err := checkRequest(r); (err == nil) != tt.ok {
+				t.Fatalf("checkRequest() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOldAndHostlessClients(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	defer setPool(t, host)()
+	front := httptest.NewUnstartedServer(nil)
+	front.Config = newServer("")
+	front.Start()
+	defer front.Close()
+	tests := []struct {
+		name    string
+		request string
+		code    int
+		host    string // seen by the backend
+	}{
+		{"http/1.0 without host", "POST /room HTTP/1.0\r\nContent-Length: 0\r\n\r\n", http.StatusOK, host},
+		{"http/1.0 with host", "POST /room HTTP/1.0\r\nHost: lb.example\r\nContent-Length: 0\r\n\r\n", http.StatusOK, "lb.example"},
+		{"http/1.1 without host", "POST /room HTTP/1.1\r\nContent-Length: 0\r\n\r\n", http.StatusBadRequest, ""},
+		{"asterisk target", "GET * HTTP/1.1\r\nHost: lb.example\r\n\r\n", http.StatusBadRequest, ""},
+		{"http/1.0 websocket", "GET /ws/1 HTTP/1.0\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d: %s", resp.StatusCode, tt.code, body)
+			}
+			if tt.code == http.StatusOK && string(body) != tt.host {
+				t.Fatalf("backend saw host %q, want %q", body, tt.host)
+			}
+			// an HTTP/1.0 client reads until the connection closes
+			if resp.ProtoMajor == 1 && resp.ProtoMinor == 0 && !resp.Close {
+				t.Fatal("HTTP/1.0 response left the connection open")
+			}
+		})
+	}
+}
+
+func TestContextKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []interface{} // set in order, to 5, 6, ...
+		attempts int
+		retry    int
+		plain    int // under the int key of the same value as Attempts
+	}{
+		{"unset", nil, 1, 0, 0},
+		{"attempts", []interface{}{Attempts}, 5, 0, 0},
+		{"retry", []interface{}{Retry}, 1, 5, 0},
+		{"both", []interface{}{Attempts, Retry}, 5, 6, 0},
+		// another package's int keys of the same value stay apart
+		{"plain ints only", []interface{}{int(Attempts), int(Retry)}, 1, 0, 5},
+		{"plain ints over ours", []interface{}{Attempts, Retry, int(Attempts), int(Retry)}, 5, 6, 7},
+		{"ours over plain ints", []interface{}{int(Attempts), int(Retry), Attempts, Retry}, 7, 8, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			for i, key := range tt.keys {
+				ctx = context.WithValue(ctx, key, 5+i)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/room", nil).WithContext(ctx)
+			if attempts := GetAttemptsFromContext(r); attempts != tt.attempts {
+				t.Errorf("attempts %d, want %d", attempts, tt.attempts)
+			}
+			if retry := GetRetryFromContext(r); retry != tt.retry {
+				t.Errorf("retry %d, want %d", retry, tt.retry)
+			}
+			if plain, _ := ctx.Value(int(Attempts)).(int); plain != tt.plain {
+				t.Errorf("int key holds %d, want %d", plain, tt.plain)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maintenanceTZ is the timezone of maintenance windows that don't set their own
+var maintenanceTZ = envString("MAINTENANCE_TZ", "UTC")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// maintenanceWindow is a recurring time range a backend takes no new rooms
+// in, a range ending before it starts runs past midnight
+type maintenanceWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+// maintenanceSchedule is when a backend is under maintenance, in its timezone
+type maintenanceSchedule struct {
+	windows  []maintenanceWindow
+	location *time.Location
+}
+
+// newMaintenanceSchedule builds a backend's schedule out of its options,
+// windows look like `Mon-Fri@02:00-04:00` or `03:00-03:30` for every day,
+// separated by `|`
+func newMaintenanceSchedule(options url.Values) (*maintenanceSchedule, error) {
+	value := options.Get("maintenance")
+	if value == "" {
+		return nil, nil
+	}
+	location, err := time.LoadLocation(optionOr(options, "maintenance_tz", maintenanceTZ))
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance timezone: %v", err)
+	}
+	s := &maintenanceSchedule{location: location}
+	for _, spec := range strings.FieldsFunc(value, func(r rune) bool { return r == '|' }) {
+		w, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// parseMaintenanceWindow parses a single `[days@]HH:MM-HH:MM` window
+func parseMaintenanceWindow(spec string) (maintenanceWindow, error) {
+	var w maintenanceWindow
+	days, hours := "", spec
+	if i := strings.Index(spec, "@"); i >= 0 {
+		days, hours = spec[:i], spec[i+1:]
+	}
+	if days == "" {
+		for d := range w.days {
+			w.days[d] = true
+		}
+	} else {
+		parts := strings.SplitN(strings.ToLower(days), "-", 2)
+		first, okFirst := weekdays[parts[0]]
+		last, okLast := first, okFirst
+		if len(parts) == 2 {
+			last, okLast = weekdays[parts[1]]
+		}
+		if !okFirst || !okLast {
+			return w, fmt.Errorf("invalid maintenance days %q", days)
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	bounds := strings.SplitN(hours, "-", 2)
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", spec)
+	}
+	var err error
+	if w.start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(value string) (int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) == 2 {
+		h, errH := strconv.Atoi(parts[0])
+		m, errM := strconv.Atoi(parts[1])
+		if errH == nil && errM == nil && h >= 0 && h < 24 && m >= 0 && m < 60 {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid maintenance time %q, expected HH:MM", value)
+}
+
+// contains returns true when t, in the schedule's timezone, is in the window
+func (w maintenanceWindow) contains(t time.Time) bool {
+	minute, day := t.Hour()*60+t.Minute(), t.Weekday()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	// past midnight the window belongs to the day it started on
+	return (w.days[day] && minute >= w.start) || (w.days[(day+6)%7] && minute < w.end)
+}
+
+// active returns true when t falls in one of the windows
+func (s *maintenanceSchedule) active(t time.Time) bool {
+	if s == nil {
+		return false
+	}
+	t = t.In(s.location)
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMaintenance cordons the backends entering a maintenance window and
+// uncordons them once it's over. Backends cordoned by an operator are left
+// alone, and an operator cordoning or uncordoning during the window takes the
+// backend over until it's cordoned by the next window.
+func applyMaintenance(now time.Time) {
+	for _, b := range serverPool.Backends() {
+		active := b.maintenance.active(now)
+		b.mux.Lock()
+		switch {
+		case active && !b.inMaintenance:
+			b.inMaintenance = true
+			if !b.Cordoned {
+				b.Cordoned, b.maintenanceCordon = true, true
+				log.Printf("%s [maintenance started]\n", b.URL)
+			}
+		case !active && b.inMaintenance:
+			b.inMaintenance = false
+			if b.maintenanceCordon {
+				b.Cordoned, b.maintenanceCordon = false, false
+				log.Printf("%s [maintenance over]\n", b.URL)
+			}
+		}
+		b.mux.Unlock()
+	}
+}
+
+// scheduleMaintenance runs a routine applying the maintenance windows
+func scheduleMaintenance() {
+	t := time.NewTicker(30 * time.Second)
+	for {
+		select {
+		case now := <-t.C:
+			applyMaintenance(now)
+		}
+	}
+}
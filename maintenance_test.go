@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceScheduleActive(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		schedule string
+		now      time.Time
+		active   bool
+	}{
+		{"every day inside", "03:00-03:30", at(14, 3, 10), true},
+		{"every day at the end", "03:00-03:30", at(14, 3, 30), false},
+		{"weekdays on monday", "Mon-Fri@02:00-04:00", at(12, 2, 0), true},
+		{"weekdays on sunday", "Mon-Fri@02:00-04:00", at(18, 2, 0), false},
+		{"wrapping days", "Sat-Mon@02:00-04:00", at(12, 3, 0), true},
+		{"past midnight the day it started", "Fri@23:00-01:00", at(16, 23, 30), true},
+		{"past midnight the day after", "Fri@23:00-01:00", at(17, 0, 30), true},
+		{"past midnight another day", "Fri@23:00-01:00", at(16, 0, 30), false},
+		{"second window", "01:00-02:00|05:00-06:00", at(13, 5, 15), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newMaintenanceSchedule(url.Values{"maintenance": {tt.schedule}, "maintenance_tz": {"UTC"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active := s.active(tt.now); active != tt.active {
+				t.Fatalf("active(%s) = %v, want %v", tt.now, active, tt.active)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowErrors(t *testing.T) {
+	for _, spec := range []string{"03:00", "25:00-26:00", "03:60-04:00", "Someday@03:00-04:00", "Mon-Xyz@03:00-04:00"} {
+		if _, err := parseMaintenanceWindow(spec); err == nil {
+			t.Errorf("parseMaintenanceWindow(%q) accepted an invalid window", spec)
+		}
+	}
+}
+
+func TestApplyMaintenanceWithOperator(t *testing.T) {
+	inside := time.Date(2026, 10, 12, 3, 0, 0, 0, time.UTC)
+	outside := time.Date(2026, 10, 12, 5, 0, 0, 0, time.UTC)
+	// a step either applies the schedule at a time or is an operator's cordon
+	type step struct {
+		now      time.Time
+		operator string // "cordon" or "uncordon" instead of applying the schedule
+		cordoned bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"window alone", []step{
+			{now: inside, cordoned: true},
+			{now: outside, cordoned: false},
+		}},
+		{"cordoned during the window", []step{
+			{now: inside, cordoned: true},
+			{operator: "cordon", cordoned: true},
+			{now: outside, cordoned: true},
+		}},
+		{"uncordoned during the window", []step{
+			{now: inside, cordoned: true},
+			{operator: "uncordon", cordoned: false},
+			{now: inside, cordoned: false},
+			{now: outside, cordoned: false},
+		}},
+		{"cordoned before the window", []step{
+			{operator: "cordon", cordoned: true},
+			{now: inside, cordoned: true},
+			{now: outside, cordoned: true},
+		}},
+		{"next window after an uncordon", []step{
+			{now: inside, cordoned: true},
+			{operator: "uncordon", cordoned: false},
+			{now: outside, cordoned: false},
+			{now: inside, cordoned: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?maintenance=02:00-04:00&maintenance_tz=UTC")()
+			b := serverPool.Backends()[0]
+			for i, s := range tt.steps {
+				switch s.operator {
+				case "cordon":
+					b.SetCordoned(true)
+				case "uncordon":
+					b.SetCordoned(false)
+				default:
+					applyMaintenance(s.now)
+				}
+				if cordoned := b.IsCordoned(); cordoned != s.cordoned {
+					t.Fatalf("step %d: cordoned = %v, want %v", i, cordoned, s.cordoned)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsEnabled turns on metric collection and the /metrics endpoint
+var metricsEnabled = envBool("METRICS_ENABLED", false)
+
+// metric is anything exposed on the /metrics endpoint
+type metric interface {
+	write(w io.Writer)
+}
+
+var registeredMetrics []metric
+
+// registerMetric adds m to the metrics endpoint
+func registerMetric(m metric) metric {
+	registeredMetrics = append(registeredMetrics, m)
+	return m
+}
+
+// Histogram counts observations into buckets, partitioned by a single label
+type Histogram struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mux     sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogram creates and registers a histogram
+func newHistogram(name, help, label string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registerMetric(h)
+	return h
+}
+
+// Observe records a value for the given label value
+func (h *Histogram) Observe(labelValue string, v float64) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// write renders the histogram in the prometheus text format
+func (h *Histogram) write(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	values := make([]string, 0, len(h.series))
+	for value := range h.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		s := h.series[value]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", h.name, h.label, value, strconv.FormatFloat(upper, 'g', -1, 64), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, value, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, h.label, value, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, value, s.count)
+	}
+}
+
+// Counter counts events, partitioned by a set of labels
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mux    sync.Mutex
+	counts map[string]uint64 // keyed by the label values joined with \xff
+}
+
+// newCounter creates and registers a counter
+func newCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		counts: make(map[string]uint64),
+	}
+	registerMetric(c)
+	return c
+}
+
+// Inc counts an event with the given label values, in the order of the labels
+func (c *Counter) Inc(values ...string) {
+	c.mux.Lock()
+	c.counts[strings.Join(values, "\xff")]++
+	c.mux.Unlock()
+}
+
+// write renders the counter in the prometheus text format
+func (c *Counter) write(w io.Writer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := strings.Split(key, "\xff")
+		pairs := make([]string, len(c.labels))
+		for i, label := range c.labels {
+			pairs[i] = fmt.Sprintf("%s=%q", label, values[i])
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, strings.Join(pairs, ","), c.counts[key])
+	}
+}
+
+// metricsHandler exposes the registered metrics to prometheus
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range registeredMetrics {
+		m.write(w)
+	}
+}
+
+// Metrics receives what the balancer measures. The routing code only goes
+// through it, prometheusMetrics backs the /metrics endpoint and another
+// implementation, e.g. for StatsD, can be assigned to metrics instead.
+type Metrics interface {
+	// IncRequest counts a finished request by its attempts, retries and outcome
+	IncRequest(attempts, retries int, outcome string)
+	// ObserveSelection records how long a strategy took to pick a backend
+	ObserveSelection(strategy string, d time.Duration)
+	// IncBackendError counts a failed attempt on a backend
+	IncBackendError(backend string)
+	// IncMirror counts a mirrored request by how its answer compared
+	IncMirror(result string)
+	// SetGauge sets the current value of a gauge, e.g. the requests in flight
+	SetGauge(name string, value float64)
+}
+
+// metrics is where measurements go, nowhere until METRICS_ENABLED is set
+var metrics Metrics = noopMetrics{}
+
+// collectingMetrics returns false when measurements go nowhere, so they
+// aren't even taken
+func collectingMetrics() bool {
+	_, noop := metrics.(noopMetrics)
+	return !noop
+}
+
+// noopMetrics drops every measurement
+type noopMetrics struct{}
+
+func (noopMetrics) IncRequest(int, int, string)            {}
+func (noopMetrics) ObserveSelection(string, time.Duration) {}
+func (noopMetrics) IncBackendError(string)                 {}
+func (noopMetrics) IncMirror(string)                       {}
+func (noopMetrics) SetGauge(string, float64)               {}
+
+// prometheusMetrics exposes the measurements on the /metrics endpoint
+type prometheusMetrics struct{}
+
+func (prometheusMetrics) IncRequest(attempts, retries int, outcome string) {
+	requestAttempts.Inc(strconv.Itoa(attempts), outcome)
+	requestRetries.Inc(strconv.Itoa(retries), outcome)
+}
+
+func (prometheusMetrics) ObserveSelection(strategy string, d time.Duration) {
+	selectionDuration.Observe(strategy, d.Seconds())
+}
+
+func (prometheusMetrics) IncBackendError(backend string) {
+	backendErrors.Inc(backend)
+}
+
+func (prometheusMetrics) IncMirror(result string) {
+	mirrorResults.Inc(result)
+}
+
+func (prometheusMetrics) SetGauge(name string, value float64) {
+	gauges.Set(name, value)
+}
+
+var selectionDuration = newHistogram(
+	"lb_selection_duration_seconds",
+	"Time taken to pick a backend.",
+	"strategy",
+	[]float64{.000001, .0000025, .000005, .00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01},
+)
+
+// timeSelection runs a backend selection, timing it when metrics are collected
+func timeSelection(strategy string, selectPeer func() *Backend) *Backend {
+	if !collectingMetrics() {
+		return selectPeer()
+	}
+	start := time.Now()
+	peer := selectPeer()
+	metrics.ObserveSelection(strategy, time.Since(start))
+	return peer
+}
+
+var requestAttempts = newCounter(
+	"lb_request_attempts_total",
+	"Requests by the backend attempt they finished on.",
+	"attempts", "outcome",
+)
+
+var requestRetries = newCounter(
+	"lb_request_retries_total",
+	"Requests by the retries they took across every attempt.",
+	"retries", "outcome",
+)
+
+var backendErrors = newCounter(
+	"lb_backend_errors_total",
+	"Failed attempts on each backend.",
+	"backend",
+)
+
+var mirrorResults = newCounter(
+	"lb_mirror_responses_total",
+	"Mirrored requests by how the mirror's answer compared to the backend's.",
+	"result",
+)
+
+// GaugeSet holds gauges set by name, each rendered as its own metric. A name
+// may carry labels, e.g. lb_backend_requests_total{backend="a"}.
+type GaugeSet struct {
+	mux    sync.Mutex
+	values map[string]float64
+}
+
+var gauges = registerMetric(&GaugeSet{values: make(map[string]float64)}).(*GaugeSet)
+
+// Set sets the current value of the named gauge
+func (g *GaugeSet) Set(name string, value float64) {
+	g.mux.Lock()
+	g.values[name] = value
+	g.mux.Unlock()
+}
+
+// write renders the gauges in the prometheus text format
+func (g *GaugeSet) write(w io.Writer) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	names := make([]string, 0, len(g.values))
+	for name := range g.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// labelled gauges share the type line of their metric
+	typed := ""
+	for _, name := range names {
+		metric := name
+		if i := strings.Index(name, "{"); i >= 0 {
+			metric = name[:i]
+		}
+		if metric != typed {
+			fmt.Fprintf(w, "# TYPE %s gauge\n", metric)
+			typed = metric
+		}
+		fmt.Fprintf(w, "%s %v\n", name, g.values[name])
+	}
+}
+
+// requestTrace follows a request through its retries and failovers, it's
+// only touched by the goroutine serving the request
+type requestTrace struct {
+	attempts int
+	retries  int
+	served   bool // a backend answered, whatever the status
+}
+
+// getTrace returns the trace of r, nil when metrics aren't collected
+func getTrace(r *http.Request) *requestTrace {
+	trace, _ := r.Context().Value(Trace).(*requestTrace)
+	return trace
+}
+
+// record counts the finished request
+func (t *requestTrace) record() {
+	outcome := "failure"
+	if t.served {
+		outcome = "success"
+	}
+	metrics.IncRequest(t.attempts, t.retries, outcome)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingMetrics keeps the selections observed, the requests counted and
+// the mirror results, dropping the rest
+type recordingMetrics struct {
+	noopMetrics
+	mux        sync.Mutex
+	selections []string
+	requests   []string // as attempts/retries/outcome
+	mirrors    []string
+}
+
+func (m *recordingMetrics) ObserveSelection(strategy string, d time.Duration) {
+	m.mux.Lock()
+	m.selections = append(m.selections, strategy)
+	m.mux.Unlock()
+}
+
+func (m *recordingMetrics) IncRequest(attempts, retries int, outcome string) {
+	m.mux.Lock()
+	m.requests = append(m.requests, fmt.Sprintf("%d/%d/%s", attempts, retries, outcome))
+	m.mux.Unlock()
+}
+
+func (m *recordingMetrics) IncMirror(result string) {
+	m.mux.Lock()
+	m.mirrors = append(m.mirrors, result)
+	m.mux.Unlock()
+}
+
+// setMetrics sends the measurements to m, returning how to put the previous
+// sink back
+func setMetrics(m Metrics) (restore func()) {
+	old := metrics
+	metrics = m
+	return func() { metrics = old }
+}
+
+func TestSelectionObserved(t *testing.T) {
+	defer func(strategy string) { lbStrategy = strategy }(lbStrategy)
+	tests := []struct {
+		name     string
+		strategy string
+		method   string
+		path     string
+		dryRun   bool
+		observed []string
+	}{
+		{"round robin", StrategyRoundRobin, http.MethodPost, "/room", false, []string{StrategyRoundRobin}},
+		{"least load", StrategyLeastLoad, http.MethodPost, "/room", false, []string{StrategyLeastLoad}},
+		{"weighted", StrategyWeighted, http.MethodPost, "/room", false, []string{StrategyWeighted}},
+		{"ip hash", StrategyIPHash, http.MethodPost, "/room", false, []string{StrategyIPHash}},
+		{"room lookup", StrategyRoundRobin, http.MethodGet, "/room/1/state", false, []string{"room-range"}},
+		{"dry run", StrategyRoundRobin, http.MethodPost, "/room", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101", "localhost:9102")()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			recorder := &recordingMetrics{}
+			defer setMetrics(recorder)()
+			lbStrategy = tt.strategy
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.dryRun {
+				r = withDryRun(r)
+			}
+			if _, err := route(r); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(recorder.selections) != fmt.Sprint(tt.observed) {
+				t.Fatalf("observed %v, want %v", recorder.selections, tt.observed)
+			}
+		})
+	}
+}
+
+func TestSelectionHistogram(t *testing.T) {
+	defer setMetrics(prometheusMetrics{})()
+	timeSelection("test-strategy", func() *Backend { return nil })
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `lb_selection_duration_seconds_count{strategy="test-strategy"} 1`) {
+		t.Fatalf("selection missing from the metrics:\n%s", w.Body.String())
+	}
+}
+
+func BenchmarkSelection(b *testing.B) {
+	defer func(strategy string) { lbStrategy = strategy }(lbStrategy)
+	specs := make([]string, 100)
+	for i := range specs {
+		specs[i] = fmt.Sprintf("localhost:%d", 10000+i)
+	}
+	defer setPool(b, specs...)()
+	r := httptest.NewRequest(http.MethodPost, "/room", nil)
+	for _, strategy := range []string{StrategyRoundRobin, StrategyLeastLoad, StrategyWeighted, StrategyIPHash} {
+		for _, sink := range []Metrics{noopMetrics{}, prometheusMetrics{}} {
+			b.Run(fmt.Sprintf("%s/%T", strategy, sink), func(b *testing.B) {
+				defer setMetrics(sink)()
+				lbStrategy = strategy
+				for i := 0; i < b.N; i++ {
+					pickRoomPeer(r)
+				}
+			})
+		}
+	}
+}
+
+func TestAttemptsCounted(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer live.Close()
+	liveHost := strings.TrimPrefix(live.URL, "http://")
+	// nothing listens on those once closed
+	var dead []string
+	for i := 0; i < 4; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, l.Addr().String()+"?name=dead"+strconv.Itoa(i))
+		l.Close()
+	}
+	resetting, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resets := &resettingListener{Listener: resetting}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = server.Serve(resets) }()
+	defer server.Close()
+	tests := []struct {
+		name     string
+		pool     []string
+		resets   int64
+		requests []string
+	}{
+		{"first attempt", []string{liveHost}, 0, []string{"1/0/success"}},
+		{"failed over", []string{dead[0], liveHost}, 0, []string{"2/0/success"}},
+		{"retried", []string{resetting.Addr().String()}, 1, []string{"1/1/success"}},
+		// the fourth attempt is turned down before reaching a backend
+		{"given up", dead, 0, []string{"3/0/failure"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, tt.pool...)()
+			recorder := &recordingMetrics{}
+			defer setMetrics(recorder)()
+			atomic.StoreInt64(&resets.resets, tt.resets)
+			// start the rotation at the first backend
+			for serverPool.PeekNextPeer() != serverPool.Backends()[0] {
+				serverPool.GetNextPeer()
+			}
+			lb(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/room", nil))
+			if fmt.Sprint(recorder.requests) != fmt.Sprint(tt.requests) {
+				t.Fatalf("counted %v, want %v", recorder.requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestCounterFormat(t *testing.T) {
+	c := &Counter{name: "test_total", help: "Test events.", labels: []string{"attempts", "outcome"}, counts: make(map[string]uint64)}
+	c.Inc("2", "success")
+	c.Inc("1", "success")
+	c.Inc("2", "success")
+	var out strings.Builder
+	c.write(&out)
+	want := "# HELP test_total Test events.\n# TYPE test_total counter\n" +
+		"test_total{attempts=\"1\",outcome=\"success\"} 1\n" +
+		"test_total{attempts=\"2\",outcome=\"success\"} 2\n"
+	if out.String() != want {
+		t.Fatalf("wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// callRecorder is a Metrics keeping every call in order
+type callRecorder struct {
+	mux   sync.Mutex
+	calls []string
+}
+
+func (m *callRecorder) record(format string, v ...interface{}) {
+	m.mux.Lock()
+	m.calls = append(m.calls, fmt.Sprintf(format, v...))
+	m.mux.Unlock()
+}
+
+func (m *callRecorder) IncRequest(attempts, retries int, outcome string) {
+	m.record("request %d/%d/%s", attempts, retries, outcome)
+}
+
+func (m *callRecorder) ObserveSelection(strategy string, d time.Duration) {
+	m.record("selection %s", strategy)
+}
+
+func (m *callRecorder) IncBackendError(backend string) {
+	m.record("backend error %s", backend)
+}
+
+func (m *callRecorder) IncMirror(result string) {
+	m.record("mirror %s", result)
+}
+
+func (m *callRecorder) SetGauge(name string, value float64) {
+	m.record("gauge %s=%v", name, value)
+}
+
+// usageGauges are the usage counters published once a request to backend,
+// answered with out bytes, is done
+func usageGauges(backend string, out int) []string {
+	return []string{
+		fmt.Sprintf("gauge lb_backend_requests_total{backend=%q}=1", backend),
+		fmt.Sprintf("gauge lb_backend_bytes_total{backend=%q,direction=\"in\",traffic=\"http\"}=0", backend),
+		fmt.Sprintf("gauge lb_backend_bytes_total{backend=%q,direction=\"out\",traffic=\"http\"}=%d", backend, out),
+		fmt.Sprintf("gauge lb_backend_bytes_total{backend=%q,direction=\"in\",traffic=\"websocket\"}=0", backend),
+		fmt.Sprintf("gauge lb_backend_bytes_total{backend=%q,direction=\"out\",traffic=\"websocket\"}=0", backend),
+	}
+}
+
+func TestMetricsCalls(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer live.Close()
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		pool   []string
+		calls  []string
+	}{
+		{"new room", http.MethodPost, "/room", []string{strings.TrimPrefix(live.URL, "http://") + "?name=live"}, append(append([]string{
+			"gauge lb_requests_inflight=1",
+			"selection round-robin",
+		}, usageGauges("live", 2)...),
+			"request 1/0/success",
+			"gauge lb_requests_inflight=0",
+		)},
+		// the failover runs within the attempt on the dead backend
+		{"failed over", http.MethodPost, "/room", []string{deadAddr + "?name=dead", strings.TrimPrefix(live.URL, "http://") + "?name=live"}, append(append(append([]string{
+			"gauge lb_requests_inflight=1",
+			"selection round-robin",
+			"backend error dead",
+			"selection round-robin",
+		}, usageGauges("live", 2)...), usageGauges("dead", 0)...),
+			"request 2/0/success",
+			"gauge lb_requests_inflight=0",
+		)},
+		{"room action", http.MethodGet, "/room/1/state", []string{strings.TrimPrefix(live.URL, "http://") + "?name=live"}, append(append([]string{
+			"gauge lb_requests_inflight=1",
+			"selection room-range",
+		}, usageGauges("live", 2)...),
+			"request 1/0/success",
+			"gauge lb_requests_inflight=0",
+		)},
+		{"no route", http.MethodGet, "/nope", []string{strings.TrimPrefix(live.URL, "http://") + "?name=live"}, []string{
+			"gauge lb_requests_inflight=1",
+			"request 1/0/failure",
+			"gauge lb_requests_inflight=0",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, tt.pool...)()
+			for serverPool.PeekNextPeer() != serverPool.Backends()[0] {
+				serverPool.GetNextPeer()
+			}
+			recorder := &callRecorder{}
+			defer setMetrics(recorder)()
+			lb(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+			if strings.Join(recorder.calls, "\n") != strings.Join(tt.calls, "\n") {
+				t.Fatalf("calls:\n%s\nwant:\n%s", strings.Join(recorder.calls, "\n"), strings.Join(tt.calls, "\n"))
+			}
+		})
+	}
+}
+
+func TestWebsocketMetricsCalls(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String()+"?name=ws")()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	recorder := &callRecorder{}
+	defer setMetrics(recorder)()
+
+	conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if _, err := io.ReadFull(br, make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// the usage is published once the handler is done with the websocket
+	want := []string{
+		"selection room-range",
+		"gauge lb_websockets_active=1",
+		"gauge lb_websockets_active=0",
+		"gauge lb_backend_requests_total{backend=\"ws\"}=1",
+		"gauge lb_backend_bytes_total{backend=\"ws\",direction=\"in\",traffic=\"http\"}=0",
+		"gauge lb_backend_bytes_total{backend=\"ws\",direction=\"out\",traffic=\"http\"}=0",
+		"gauge lb_backend_bytes_total{backend=\"ws\",direction=\"in\",traffic=\"websocket\"}=0",
+		"gauge lb_backend_bytes_total{backend=\"ws\",direction=\"out\",traffic=\"websocket\"}=7",
+		"request 1/0/success",
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		recorder.mux.Lock()
+		calls := strings.Join(recorder.calls, "\n")
+		recorder.mux.Unlock()
+		if calls == strings.Join(want, "\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("calls:\n%s\nwant:\n%s", calls, strings.Join(want, "\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGaugeSetLabels(t *testing.T) {
+	g := &GaugeSet{values: make(map[string]float64)}
+	g.Set(`lb_backend_requests_total{backend="b"}`, 2)
+	g.Set("lb_requests_inflight", 1)
+	g.Set(`lb_backend_requests_total{backend="a"}`, 3)
+	var out strings.Builder
+	g.write(&out)
+	want := "# TYPE lb_backend_requests_total gauge\n" +
+		"lb_backend_requests_total{backend=\"a\"} 3\n" +
+		"lb_backend_requests_total{backend=\"b\"} 2\n" +
+		"# TYPE lb_requests_inflight gauge\n" +
+		"lb_requests_inflight 1\n"
+	if out.String() != want {
+		t.Fatalf("rendered:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
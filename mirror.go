@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// mirrorTarget gets a copy of GET and HEAD requests, e.g. a canary of a new
+// build, and its answers are compared to the backends'. Nil disables it.
+var mirrorTarget *url.URL
+
+// mirrorShare is the share of the requests mirrored
+var mirrorShare = envFloat("MIRROR_SHARE", 1)
+
+// mirrorCompareFields are the JSON fields compared on top of the status,
+// dots go into nested objects
+var mirrorCompareFields = envList("MIRROR_COMPARE_FIELDS")
+
+// mirrorMaxBodyBytes caps the answers kept for comparison, larger ones only
+// get their status compared
+var mirrorMaxBodyBytes = envInt("MIRROR_MAX_BODY_BYTES", 64<<10)
+
+var mirrorClient = &http.Client{
+	Timeout: envDuration("MIRROR_TIMEOUT", 5*time.Second),
+	// the mirror's redirects are compared, not followed
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// parseMirrorTarget parses the scheme://host:port requests are mirrored to
+func parseMirrorTarget(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror target %q: %v", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid mirror target %q, expected a http(s)://host:port URL", raw)
+	}
+	return u, nil
+}
+
+// mirrorCapture keeps a copy of the body the client reads, for comparison
+// once it's done
+type mirrorCapture struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	complete bool // read to the end without overflowing
+	overflow bool
+	once     sync.Once
+	captured chan []byte // gets the body, nil when incomplete
+}
+
+func (c *mirrorCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.overflow {
+		if c.buf.Len()+n > mirrorMaxBodyBytes {
+			c.overflow = true
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !c.overflow {
+		c.complete = true
+	}
+	return n, err
+}
+
+func (c *mirrorCapture) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() {
+		if c.complete {
+			c.captured <- c.buf.Bytes()
+		} else {
+			c.captured <- nil
+		}
+	})
+	return err
+}
+
+// mirror sends a copy of the request behind resp to mirrorTarget, when it's
+// to be mirrored, and compares both answers in the background. The client
+// gets resp as it is.
+func mirror(resp *http.Response) {
+	req := resp.Request
+	if mirrorTarget == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+		isWebSocket(req) || rand.Float64() >= mirrorShare {
+		return
+	}
+	target := *mirrorTarget
+	target.Path, target.RawQuery = req.URL.Path, req.URL.RawQuery
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorClient.Timeout)
+	out, err := http.NewRequestWithContext(ctx, req.Method, target.String(), nil)
+	if err != nil {
+		cancel()
+		log.Printf("Failed to mirror %s %s: %s\n", req.Method, req.URL.Path, err.Error())
+		return
+	}
+	out.Header = req.Header.Clone()
+	out.Host = req.Host
+	capture := &mirrorCapture{ReadCloser: resp.Body, captured: make(chan []byte, 1)}
+	resp.Body = capture
+	status := resp.StatusCode
+	go func() {
+		defer cancel()
+		mirrorStatus, mirrorBody, err := fetchMirror(out)
+		body := <-capture.captured
+		if err != nil {
+			metrics.IncMirror("error")
+			log.Printf("Mirror of %s %s failed: %s\n", req.Method, req.URL.Path, err.Error())
+			return
+		}
+		if diff := compareAnswers(status, body, mirrorStatus, mirrorBody); diff != "" {
+			metrics.IncMirror("diverged")
+			log.Printf("Mirror diverged on %s %s: %s\n", req.Method, req.URL.Path, diff)
+			return
+		}
+		metrics.IncMirror("match")
+	}()
+}
+
+// fetchMirror sends a mirrored request, the body is nil when it's larger than
+// mirrorMaxBodyBytes
+func fetchMirror(req *http.Request) (int, []byte, error) {
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(mirrorMaxBodyBytes)+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(body) > mirrorMaxBodyBytes {
+		body = nil
+	}
+	return resp.StatusCode, body, nil
+}
+
+// compareAnswers describes how the mirror's answer differs from the
+// backend's, empty when they match. Fields are only compared when the
+// backend's body was kept and is JSON.
+func compareAnswers(status int, body []byte, mirrorStatus int, mirrorBody []byte) string {
+	if status != mirrorStatus {
+		return fmt.Sprintf("status %d, mirror %d", status, mirrorStatus)
+	}
+	if len(mirrorCompareFields) == 0 || body == nil {
+		return ""
+	}
+	var value interface{}
+	if json.Unmarshal(body, &value) != nil {
+		return ""
+	}
+	var mirrorValue interface{}
+	if mirrorBody == nil || json.Unmarshal(mirrorBody, &mirrorValue) != nil {
+		return "mirror answer is not JSON"
+	}
+	for _, field := range mirrorCompareFields {
+		expected, _ := jsonField(value, field)
+		got, _ := jsonField(mirrorValue, field)
+		if !reflect.DeepEqual(expected, got) {
+			return fmt.Sprintf("%s is %v, mirror %v", field, expected, got)
+		}
+	}
+	return ""
+}
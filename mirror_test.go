@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMirrorTarget(t *testing.T) {
+	tests := []struct {
+		raw  string
+		host string // empty when disabled
+		err  bool
+	}{
+		{"", "", false},
+		{"http://canary:8080", "canary:8080", false},
+		{"https://canary:8443/", "canary:8443", false},
+		{"canary:8080", "", true},
+		{"ftp://canary:21", "", true},
+		{"http://canary:8080/v2", "", true},
+		{"http://", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			u, err := parseMirrorTarget(tt.raw)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			host := ""
+			if u != nil {
+				host = u.Host
+			}
+			if host != tt.host {
+				t.Fatalf("mirrored to %q, want %q", host, tt.host)
+			}
+		})
+	}
+}
+
+func TestCompareAnswers(t *testing.T) {
+	defer func(fields []string) { mirrorCompareFields = fields }(mirrorCompareFields)
+	const body = `{"room":1,"state":{"players":2},"build":"v1"}`
+	tests := []struct {
+		name       string
+		fields     []string
+		status     int
+		body       string
+		mirrorBody string
+		diverged   bool
+	}{
+		{"same", []string{"room", "state.players"}, 200, body, body, false},
+		{"status", nil, 500, body, body, true},
+		{"field", []string{"room", "state.players"}, 200, body, `{"room":1,"state":{"players":3},"build":"v1"}`, true},
+		{"field not compared", []string{"room", "state.players"}, 200, body, `{"room":1,"state":{"players":2},"build":"v2"}`, false},
+		{"field missing", []string{"room"}, 200, body, `{"state":{"players":2}}`, true},
+		{"no fields", nil, 200, body, `{"room":7}`, false},
+		{"mirror not json", []string{"room"}, 200, body, `<html>`, true},
+		{"backend not json", []string{"room"}, 200, `ok`, `{"room":1}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirrorCompareFields = tt.fields
+			diff := compareAnswers(200, []byte(tt.body), tt.status, []byte(tt.mirrorBody))
+			if (diff != "") != tt.diverged {
+				t.Fatalf("diff %q, want diverged %v", diff, tt.diverged)
+			}
+		})
+	}
+}
+
+// mirrored returns the mirror results counted so far
+func (m *recordingMetrics) mirrored() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]string(nil), m.mirrors...)
+}
+
+func TestMirror(t *testing.T) {
+	defer func(share float64, fields []string) {
+		mirrorTarget, mirrorShare, mirrorCompareFields = nil, share, fields
+	}(mirrorShare, mirrorCompareFields)
+	mirrorCompareFields = []string{"room", "state.players"}
+	const body = `{"room":1,"state":{"players":2},"build":"v1"}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "http://" + dead.Addr().String()
+	dead.Close()
+	tests := []struct {
+		name   string
+		method string
+		share  float64
+		status int
+		answer string // of the canary, empty when it's down
+		result string // counted, empty when not mirrored
+	}{
+		{"matching", http.MethodGet, 1, http.StatusOK, body, "match"},
+		{"other build", http.MethodGet, 1, http.StatusOK, `{"room":1,"state":{"players":2},"build":"v2"}`, "match"},
+		{"diverging field", http.MethodGet, 1, http.StatusOK, `{"room":1,"state":{"players":0},"build":"v2"}`, "diverged"},
+		{"diverging status", http.MethodGet, 1, http.StatusInternalServerError, body, "diverged"},
+		{"canary down", http.MethodGet, 1, 0, "", "error"},
+		{"not a GET", http.MethodPost, 1, http.StatusOK, body, ""},
+		{"not sampled", http.MethodGet, 0, http.StatusOK, body, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, tt.answer)
+			}))
+			defer canary.Close()
+			target := canary.URL
+			if tt.answer == "" {
+				target = deadURL
+			}
+			if mirrorTarget, err = parseMirrorTarget(target); err != nil {
+				t.Fatal(err)
+			}
+			mirrorShare = tt.share
+			recorder := &recordingMetrics{}
+			defer setMetrics(recorder)()
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, "/room/1/state", nil))
+			// the client gets the backend's answer whatever the canary says
+			if w.Code != http.StatusOK || w.Body.String() != body {
+				t.Fatalf("client got %d %q, want the backend's answer", w.Code, w.Body.String())
+			}
+			if tt.result == "" {
+				time.Sleep(50 * time.Millisecond)
+				if mirrors := recorder.mirrored(); len(mirrors) != 0 {
+					t.Fatalf("counted %v, want nothing mirrored", mirrors)
+				}
+				return
+			}
+			// the answers are compared in the background
+			deadline := time.Now().Add(2 * time.Second)
+			for len(recorder.mirrored()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if mirrors := recorder.mirrored(); len(mirrors) != 1 || mirrors[0] != tt.result {
+				t.Fatalf("counted %v, want %s", mirrors, tt.result)
+			}
+		})
+	}
+}
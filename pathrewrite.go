@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// pathRewrite swaps a leading path prefix for the one a backend expects,
+// e.g. /room to /api/v2/room
+type pathRewrite struct {
+	from string
+	to   string
+}
+
+// parsePathRewrites parses `from:to` prefix rules separated by `|`
+func parsePathRewrites(value string) ([]pathRewrite, error) {
+	var rules []pathRewrite
+	for _, rule := range strings.FieldsFunc(value, func(r rune) bool { return r == '|' }) {
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || !strings.HasPrefix(parts[1], "/") {
+			return nil, fmt.Errorf("invalid path rewrite %q, expected /from:/to", rule)
+		}
+		rules = append(rules, pathRewrite{
+			from: strings.TrimSuffix(parts[0], "/"),
+			to:   strings.TrimSuffix(parts[1], "/"),
+		})
+	}
+	return rules, nil
+}
+
+// rewritePath applies the first rule whose prefix matches whole segments of
+// u's path, the rest of the path and the query are kept as they are
+func (b *Backend) rewritePath(u *url.URL) {
+	for _, rule := range b.pathRewrites {
+		if u.Path != rule.from && !strings.HasPrefix(u.Path, rule.from+"/") {
+			continue
+		}
+		u.Path = rule.to + strings.TrimPrefix(u.Path, rule.from)
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		// escaped slashes in the rest of the path must reach the backend escaped
+		if u.RawPath != "" && strings.HasPrefix(u.RawPath, rule.from) {
+			u.RawPath = rule.to + strings.TrimPrefix(u.RawPath, rule.from)
+		} else {
+			u.RawPath = ""
+		}
+		return
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePathRewrites(t *testing.T) {
+	tests := []struct {
+		value string
+		rules []pathRewrite
+		err   bool
+	}{
+		{"/room:/api/v2/room", []pathRewrite{{"/room", "/api/v2/room"}}, false},
+		{"/room/:/api/v2/room/|/ws:/v2/ws", []pathRewrite{{"/room", "/api/v2/room"}, {"/ws", "/v2/ws"}}, false},
+		{"/api:/", []pathRewrite{{"/api", ""}}, false},
+		{"", nil, false},
+		{"/room", nil, true},
+		{"room:/api/room", nil, true},
+		{"/room:api/room", nil, true},
+	}
+	for _, tt := range tests {
+		rules, err := parsePathRewrites(tt.value)
+		if (err != nil) != tt.err {
+			t.Fatalf("parsePathRewrites(%q) error = %v, want error %v", tt.value, err, tt.err)
+		}
+		if len(rules) != len(tt.rules) {
+			t.Fatalf("parsePathRewrites(%q) = %v, want %v", tt.value, rules, tt.rules)
+		}
+		for i := range rules {
+			if rules[i] != tt.rules[i] {
+				t.Fatalf("parsePathRewrites(%q) = %v, want %v", tt.value, rules, tt.rules)
+			}
+		}
+	}
+}
+
+func TestPathRewriteReachesBackend(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?path_rewrite=/room:/api/v2/room|/:/game")()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(policy string) { unmatchedPolicy = policy }(unmatchedPolicy)
+	unmatchedPolicy = UnmatchedPassThrough
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{"creation", http.MethodPost, "/room", "/api/v2/room"},
+		{"action keeps the room and query", http.MethodGet, "/room/42/state?seat=3&x=%2F", "/api/v2/room/42/state?seat=3&x=%2F"},
+		{"escaped segment", http.MethodGet, "/room/42/players/a%2Fb", "/api/v2/room/42/players/a%2Fb"},
+		{"whole segments only", http.MethodGet, "/roomy", "/game/roomy"},
+		{"first rule wins", http.MethodGet, "/lobby", "/game/lobby"},
+		{"escaped segment under the root rule", http.MethodGet, "/lobby/a%2Fb", "/game/lobby/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got != tt.want {
+				t.Fatalf("backend got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
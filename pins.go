@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// roomPinsFile lists rooms forced onto a backend, one `roomId=backendId` per
+// line. It's reread on SIGHUP and rewritten when pins change over the admin API.
+var roomPinsFile = envString("ROOM_PINS_FILE", "")
+
+// RoomPins forces rooms onto a given backend, ahead of the registry and the
+// room mapping, e.g. to debug a room or host a VIP match
+type RoomPins struct {
+	mux  sync.RWMutex
+	pins map[string]string // backend id by room id
+}
+
+var roomPins RoomPins
+
+// parseRoomPins parses `roomId=backendId` items
+func parseRoomPins(items []string) (map[string]string, error) {
+	pins := make(map[string]string)
+	for _, item := range items {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid room pin %q, expected roomId=backendId", item)
+		}
+		pins[parts[0]] = parts[1]
+	}
+	return pins, nil
+}
+
+// Lookup returns the backend a room is pinned to, nil when it isn't pinned
+// or its backend left the pool
+func (p *RoomPins) Lookup(roomId string) *Backend {
+	p.mux.RLock()
+	id, ok := p.pins[roomId]
+	p.mux.RUnlock()
+	if !ok {
+		return nil
+	}
+	return serverPool.GetBackend(id)
+}
+
+// Pins returns a copy of the backend ids by pinned room id
+func (p *RoomPins) Pins() map[string]string {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+	pins := make(map[string]string, len(p.pins))
+	for roomId, id := range p.pins {
+		pins[roomId] = id
+	}
+	return pins
+}
+
+// Pin forces a room onto a backend and saves the pins
+func (p *RoomPins) Pin(roomId, id string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.pins == nil {
+		p.pins = make(map[string]string)
+	}
+	previous, ok := p.pins[roomId]
+	p.pins[roomId] = id
+	if err := p.save(); err != nil {
+		if ok {
+			p.pins[roomId] = previous
+		} else {
+			delete(p.pins, roomId)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unpin lets a room be mapped as usual again and saves the pins
+func (p *RoomPins) Unpin(roomId string) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	id, ok := p.pins[roomId]
+	if !ok {
+		return nil
+	}
+	delete(p.pins, roomId)
+	if err := p.save(); err != nil {
+		p.pins[roomId] = id
+		return err
+	}
+	return nil
+}
+
+// save rewrites roomPinsFile with the current pins, the lock must be held
+func (p *RoomPins) save() error {
+	if roomPinsFile == "" {
+		return nil
+	}
+	rooms := make([]string, 0, len(p.pins))
+	for roomId := range p.pins {
+		rooms = append(rooms, roomId)
+	}
+	sort.Strings(rooms)
+	var data strings.Builder
+	data.WriteString("# room pins, roomId=backendId\n")
+	for _, roomId := range rooms {
+		fmt.Fprintf(&data, "%s=%s\n", roomId, p.pins[roomId])
+	}
+	return writeFileAtomic(roomPinsFile, []byte(data.String()))
+}
+
+// loadRoomPins (re)reads roomPinsFile, keeping the current pins on error
+func loadRoomPins() error {
+	if roomPinsFile == "" {
+		return nil
+	}
+	items, err := readListFile(roomPinsFile)
+	if err != nil {
+		return err
+	}
+	pins, err := parseRoomPins(items)
+	if err != nil {
+		return err
+	}
+	for roomId, id := range pins {
+		if serverPool.GetBackend(id) == nil {
+			log.Printf("Room %s is pinned to unknown backend %s, it's mapped as usual\n", roomId, id)
+		}
+	}
+	roomPins.mux.Lock()
+	roomPins.pins = pins
+	roomPins.mux.Unlock()
+	log.Printf("Loaded %d room pins\n", len(pins))
+	return nil
+}
+
+// pinsHandler shows the pins on GET /admin/pins, and pins a room on PUT
+// /admin/pins/{roomId} with {"backend":"id"} or unpins it on DELETE
+func pinsHandler(w http.ResponseWriter, r *http.Request, roomId string) {
+	if roomId == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, roomPins.Pins())
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var pin struct {
+			Backend string `json:"backend"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&pin); err != nil {
+			http.Error(w, "Invalid pin: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if serverPool.GetBackend(pin.Backend) == nil {
+			http.Error(w, "Backend not found", http.StatusNotFound)
+			return
+		}
+		if err := roomPins.Pin(roomId, pin.Backend); err != nil {
+			http.Error(w, "Failed to save pins: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Room %s pinned to %s\n", roomId, pin.Backend)
+	case http.MethodDelete:
+		if err := roomPins.Unpin(roomId); err != nil {
+			http.Error(w, "Failed to save pins: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Room %s unpinned\n", roomId)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
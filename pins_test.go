@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestParseRoomPins(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []string
+		pins  map[string]string
+		err   bool
+	}{
+		{"pins", []string{"1=a", "2=b"}, map[string]string{"1": "a", "2": "b"}, false},
+		{"none", nil, map[string]string{}, false},
+		{"no backend", []string{"1="}, nil, true},
+		{"no separator", []string{"1"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parseRoomPins(tt.items)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseRoomPins error = %v, want error %v", err, tt.err)
+			}
+			if len(pins) != len(tt.pins) {
+				t.Fatalf("parseRoomPins = %v, want %v", pins, tt.pins)
+			}
+			for roomId, id := range tt.pins {
+				if pins[roomId] != id {
+					t.Fatalf("parseRoomPins = %v, want %v", pins, tt.pins)
+				}
+			}
+		})
+	}
+}
+
+// idOf returns the id of b, empty when nil
+func idOf(b *Backend) string {
+	if b == nil {
+		return ""
+	}
+	return b.ID
+}
+
+func TestUnpinTakesRoomBack(t *testing.T) {
+	tests := []struct {
+		name       string
+		registered bool   // whether the room was joined before being pinned
+		pinTo      string // backend pinned to
+	}{
+		{"new room", false, "localhost:9103"},
+		{"known room", true, "localhost:9103"},
+		{"pinned where it maps", false, "localhost:9101"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101", "localhost:9102", "localhost:9103")()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			// room 1 maps to the first backend's range
+			mapped := serverPool.Backends()[0]
+			if tt.registered {
+				serverPool.GetPeer("1")
+			}
+			if err := roomPins.Pin("1", tt.pinTo); err != nil {
+				t.Fatal(err)
+			}
+			defer roomPins.Unpin("1")
+			for i := 0; i < 2; i++ {
+				if peer := serverPool.GetPeer("1"); idOf(peer) != tt.pinTo {
+					t.Fatalf("pinned room went to %q, want %s", idOf(peer), tt.pinTo)
+				}
+			}
+			if err := roomPins.Unpin("1"); err != nil {
+				t.Fatal(err)
+			}
+			if peer := serverPool.GetPeer("1"); peer != mapped {
+				t.Fatalf("unpinned room went to %q, want %s", idOf(peer), mapped.ID)
+			}
+		})
+	}
+}
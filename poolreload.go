@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// configuredIDs are the ids of the backends out of the server list, as
+// opposed to discovered ones, only touched on startup and reloads
+var configuredIDs = make(map[string]bool)
+
+// buildServerList builds the backends of a server list, failing on the
+// first invalid spec or duplicate id
+func buildServerList(specs []string) ([]*Backend, error) {
+	backends := make([]*Backend, 0, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		log.Printf("Try add Backend: %v", spec)
+		b, err := buildBackend(spec)
+		if err != nil {
+			return nil, err
+		}
+		if seen[b.ID] {
+			return nil, fmt.Errorf("Duplicate backend %s, give them distinct names", b.ID)
+		}
+		seen[b.ID] = true
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// reloadServerList rereads SERVER_LIST_FILE and swaps the configured
+// backends for the ones it lists. The whole list is built and checked first,
+// any error keeps the running pool as it is.
+func reloadServerList() error {
+	specs, err := loadServerList()
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 && dnsDiscovery == "" {
+		return errors.New("server list is empty, keeping the current backends")
+	}
+	backends, err := buildServerList(specs)
+	if err != nil {
+		return fmt.Errorf("%v, keeping the current backends", err)
+	}
+	ids := make(map[string]bool, len(backends))
+	pools := make(map[string]bool)
+	for _, b := range backends {
+		ids[b.ID] = true
+		pools[b.Pool] = true
+	}
+	// discovered backends only show up later
+	if dnsDiscovery == "" {
+		for pool := range trafficSplit.Weights() {
+			if !pools[pool] {
+				return fmt.Errorf("TRAFFIC_SPLIT pool %s would have no backend, keeping the current backends", pool)
+			}
+		}
+	}
+	if defaultBackend != "" && !ids[defaultBackend] {
+		return fmt.Errorf("DEFAULT_BACKEND %s would be gone, keeping the current backends", defaultBackend)
+	}
+
+	added, removed, retiring := serverPool.swapConfigured(backends, configuredIDs)
+	configuredIDs = ids
+	for _, b := range added {
+		log.Printf("Configured server: %s\n", b.URL)
+		go b.warm()
+	}
+	for _, b := range removed {
+		log.Printf("Removed server: %s\n", b.URL)
+	}
+	for _, b := range drains.Queue(retiring...) {
+		log.Printf("%s [queued for draining]\n", b.URL)
+	}
+	log.Printf("Reloaded server list, %d backends, %d added, %d removed, %d draining\n",
+		len(backends), len(added), len(removed), len(retiring))
+	return nil
+}
+
+// swapConfigured replaces the configured backends of the pool, previous
+// holding their ids, with configured while keeping the discovered ones.
+// Backends whose spec didn't change stay as they are, with their state and
+// rooms. With drainRemovedBackends the ones no longer listed stay in the pool
+// as retiring, to be drained.
+func (s *ServerPool) swapConfigured(configured []*Backend, previous map[string]bool) (added, removed, retiring []*Backend) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	current := make(map[string]*Backend, len(s.backends))
+	for _, b := range s.backends {
+		current[b.ID] = b
+	}
+	backends := make([]*Backend, 0, len(configured)+len(s.backends))
+	kept := make(map[*Backend]bool, len(configured))
+	for _, b := range configured {
+		if old := current[b.ID]; old != nil && previous[b.ID] && old.spec == b.spec {
+			backends = append(backends, old)
+			kept[old] = true
+			continue
+		}
+		backends = append(backends, b)
+		added = append(added, b)
+	}
+	taken := make(map[string]bool, len(backends))
+	for _, b := range backends {
+		taken[b.ID] = true
+	}
+	for _, b := range s.backends {
+		if kept[b] {
+			continue
+		}
+		if previous[b.ID] && !taken[b.ID] && drainRemovedBackends {
+			backends = append(backends, b)
+			retiring = append(retiring, b)
+			continue
+		}
+		// a configured backend replaces a discovered one of the same id
+		if previous[b.ID] || taken[b.ID] {
+			removed = append(removed, b)
+			continue
+		}
+		backends = append(backends, b)
+	}
+	s.setBackends(backends)
+	for _, b := range removed {
+		s.rooms.Forget(b)
+		clientAffinity.Forget(b)
+	}
+	return added, removed, retiring
+}
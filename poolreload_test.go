@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReloadServerList(t *testing.T) {
+	initial := []string{"localhost:9101?name=a&pool=blue", "localhost:9102?name=b&pool=blue"}
+	discovered := "localhost:9109?name=d"
+	tests := []struct {
+		name     string
+		list     string
+		split    map[string]int
+		fallback string // DEFAULT_BACKEND
+		err      bool
+		ids      []string // in the pool once reloaded
+		rooms    []string // still registered, each room is named after its backend
+	}{
+		{"unchanged", "localhost:9101?name=a&pool=blue\nlocalhost:9102?name=b&pool=blue", nil, "", false, []string{"a", "b", "d"}, []string{"a", "b", "d"}},
+		{"added and removed", "localhost:9101?name=a&pool=blue\nlocalhost:9103?name=c&pool=blue", nil, "", false, []string{"a", "c", "d"}, []string{"a", "d"}},
+		{"changed spec", "localhost:9111?name=a&pool=blue\nlocalhost:9102?name=b&pool=blue", nil, "", false, []string{"a", "b", "d"}, []string{"b", "d"}},
+		{"replaces a discovered backend", "localhost:9101?name=a&pool=blue\nlocalhost:9102?name=b&pool=blue\nlocalhost:9119?name=d", nil, "", false, []string{"a", "b", "d"}, []string{"a", "b"}},
+		{"invalid spec", "localhost:9101?name=a&weight=x", nil, "", true, nil, nil},
+		{"duplicate id", "localhost:9101?name=a\nlocalhost:9102?name=a", nil, "", true, nil, nil},
+		{"empty", "# nothing\n", nil, "", true, nil, nil},
+		{"split pool emptied", "localhost:9101?name=a&pool=green", map[string]int{"blue": 100}, "", true, nil, nil},
+		{"default backend gone", "localhost:9101?name=a&pool=blue", nil, "b", true, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, remove := writeTempFile(t, tt.list)
+			defer remove()
+			defer setEnv("SERVER_LIST", "")()
+			defer setEnv("SERVER_LIST_FILE", file)()
+			defer setPool(t, append(initial, discovered)...)()
+			defer setSplit(t, tt.split)()
+			defer func(ids map[string]bool, fallback string) {
+				configuredIDs, defaultBackend = ids, fallback
+			}(configuredIDs, defaultBackend)
+			configuredIDs, defaultBackend = map[string]bool{"a": true, "b": true}, tt.fallback
+			before := serverPool.Backends()
+			for _, b := range before {
+				serverPool.rooms.Record(b.ID, b)
+			}
+
+			err := reloadServerList()
+			if (err != nil) != tt.err {
+				t.Fatalf("reloadServerList error = %v, want error %v", err, tt.err)
+			}
+			ids, rooms := tt.ids, tt.rooms
+			if tt.err {
+				// the running pool is left as it was
+				ids, rooms = []string{"a", "b", "d"}, []string{"a", "b", "d"}
+			}
+			var got []string
+			for _, b := range serverPool.Backends() {
+				got = append(got, b.ID)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(ids, ",") {
+				t.Fatalf("pool holds %v, want %v", got, ids)
+			}
+			for _, b := range before {
+				registered := serverPool.rooms.Lookup(b.ID) == b
+				want := strings.Contains(","+strings.Join(rooms, ",")+",", ","+b.ID+",")
+				if registered != want {
+					t.Errorf("room on %s still registered = %v, want %v", b.ID, registered, want)
+				}
+				if want && serverPool.GetBackend(b.ID) != b {
+					t.Errorf("%s was rebuilt, want it kept with its state", b.ID)
+				}
+			}
+			if tt.err {
+				return
+			}
+			specs, _ := readListFile(file)
+			if len(configuredIDs) != len(specs) {
+				t.Errorf("configured ids = %v, want the %d listed", configuredIDs, len(specs))
+			}
+			if configuredIDs["d"] != strings.Contains(tt.list, "name=d") {
+				t.Errorf("configured ids = %v, d counted wrong", configuredIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// quarantineAfter is how many consecutive failed probes put a backend in
+// quarantine, where it's re-checked less and less often. 0 disables it.
+var quarantineAfter = envInt("QUARANTINE_AFTER", 15)
+
+// quarantineMaxInterval caps the time between re-checks of a quarantined backend
+var quarantineMaxInterval = envDuration("QUARANTINE_MAX_INTERVAL", 10*time.Minute)
+
+// dueForProbe returns false while a quarantined backend waits for its next re-check
+func (b *Backend) dueForProbe(now time.Time) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !b.quarantined || !now.Before(b.nextProbe)
+}
+
+// updateQuarantine quarantines a backend that kept failing, doubling the
+// time to its next re-check on every failure, and releases it once a probe succeeds
+func (b *Backend) updateQuarantine(ok bool, now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if ok {
+		if b.quarantined {
+			log.Printf("%s [out of quarantine]\n", b.URL)
+		}
+		b.quarantined, b.quarantineInterval = false, 0
+		return
+	}
+	if quarantineAfter <= 0 || b.failures < quarantineAfter {
+		return
+	}
+	if !b.quarantined {
+		b.quarantined, b.quarantineInterval = true, healthCheckInterval
+		log.Printf("%s [quarantined]\n", b.URL)
+	}
+	b.quarantineInterval *= 2
+	if b.quarantineInterval > quarantineMaxInterval {
+		b.quarantineInterval = quarantineMaxInterval
+	}
+	b.nextProbe = now.Add(b.quarantineInterval)
+}
+
+// IsQuarantined returns true while the backend is only re-checked from time to time
+func (b *Backend) IsQuarantined() (quarantined bool) {
+	b.mux.RLock()
+	quarantined = b.quarantined
+	b.mux.RUnlock()
+	return
+}
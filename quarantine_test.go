@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQuarantineSchedule(t *testing.T) {
+	defer func(after int, interval, max time.Duration) {
+		quarantineAfter, healthCheckInterval, quarantineMaxInterval = after, interval, max
+	}(quarantineAfter, healthCheckInterval, quarantineMaxInterval)
+	quarantineAfter, healthCheckInterval, quarantineMaxInterval = 3, 20*time.Second, 2*time.Minute
+	defer setPool(t, "localhost:9101?name=a")()
+	b := serverPool.GetBackend("a")
+	steps := []struct {
+		ok          bool
+		quarantined bool
+		recheck     time.Duration // until the next probe, 0 when due on every pass
+	}{
+		{false, false, 0},
+		{false, false, 0},
+		// the third failure in a row quarantines, re-checks back off from there
+		{false, true, 40 * time.Second},
+		{false, true, 80 * time.Second},
+		{false, true, 2 * time.Minute},
+		{false, true, 2 * time.Minute},
+		{true, false, 0},
+		// a single failure after recovering starts over
+		{false, false, 0},
+		{false, false, 0},
+		{false, true, 40 * time.Second},
+		{true, false, 0},
+	}
+	now := time.Now()
+	for i, step := range steps {
+		b.recordProbe(step.ok)
+		b.updateQuarantine(step.ok, now)
+		if b.IsQuarantined() != step.quarantined {
+			t.Fatalf("step %d: quarantined %v, want %v", i, b.IsQuarantined(), step.quarantined)
+		}
+		if step.recheck == 0 {
+			if !b.dueForProbe(now) {
+				t.Fatalf("step %d: not due for a probe", i)
+			}
+		} else if b.dueForProbe(now.Add(step.recheck-time.Second)) || !b.dueForProbe(now.Add(step.recheck)) {
+			t.Fatalf("step %d: next probe isn't %s away", i, step.recheck)
+		}
+		now = now.Add(step.recheck)
+	}
+}
+
+func TestQuarantineDisabled(t *testing.T) {
+	defer func(after int) { quarantineAfter = after }(quarantineAfter)
+	quarantineAfter = 0
+	defer setPool(t, "localhost:9101?name=a")()
+	b := serverPool.GetBackend("a")
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		b.recordProbe(false)
+		b.updateQuarantine(false, now)
+	}
+	if b.IsQuarantined() || !b.dueForProbe(now) {
+		t.Fatal("backend quarantined with quarantine disabled")
+	}
+}
+
+func TestQuarantineSkipsProbes(t *testing.T) {
+	var probes, healthy int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&probes, 1)
+		if atomic.LoadInt64(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	defer func(after int) { quarantineAfter = after }(quarantineAfter)
+	quarantineAfter = 2
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?name=a&check=http")()
+	b := serverPool.GetBackend("a")
+	quarantined := func() bool {
+		w := httptest.NewRecorder()
+		statusHandler(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+		var status struct {
+			Backends []backendStatus `json:"backends"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || len(status.Backends) != 1 {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+		return status.Backends[0].Quarantined
+	}
+	tests := []struct {
+		name        string
+		healthy     bool
+		due         bool // back-dates the next probe
+		probes      int64
+		quarantined bool
+	}{
+		{"first failure", false, false, 1, false},
+		{"quarantined", false, false, 1, true},
+		{"skipped while quarantined", false, false, 0, true},
+		{"skipped again", false, false, 0, true},
+		{"re-checked when due", false, true, 1, true},
+		{"skipped after the re-check", false, false, 0, true},
+		{"released by a good probe", true, true, 1, false},
+		{"probed every pass again", true, false, 1, false},
+	}
+	for _, tt := range tests {
+		if tt.healthy {
+			atomic.StoreInt64(&healthy, 1)
+		}
+		if tt.due {
+			b.mux.Lock()
+			b.nextProbe = time.Now().Add(-time.Second)
+			b.mux.Unlock()
+		}
+		atomic.StoreInt64(&probes, 0)
+		serverPool.HealthCheck()
+		if n := atomic.LoadInt64(&probes); n != tt.probes {
+			t.Fatalf("%s: %d probes, want %d", tt.name, n, tt.probes)
+		}
+		if quarantined() != tt.quarantined {
+			t.Fatalf("%s: status shows quarantined %v, want %v", tt.name, !tt.quarantined, tt.quarantined)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// readinessCheckPath is requested along the health check to learn whether
+// the game engine takes new matches, empty disables it. Backends failing it
+// keep their rooms but get no new ones.
+var readinessCheckPath = envString("READINESS_CHECK_PATH", "")
+
+// readinessField is the boolean field of the readiness JSON answer telling
+// whether the backend is ready, dots go into nested objects
+var readinessField = envString("READINESS_FIELD", "matchmaking_ready")
+
+// IsReady returns false when the backend said it takes no new matches
+func (b *Backend) IsReady() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !b.notReady
+}
+
+// probeReadiness runs the readiness check of the backend, if it has one, and
+// records the result
+func (b *Backend) probeReadiness() {
+	if b.readinessPath == "" {
+		return
+	}
+	ready, err := b.fetchReadiness()
+	if err != nil {
+		log.Printf("[%s] readiness check failed, %s\n", b.ID, err.Error())
+	}
+	b.mux.Lock()
+	changed := b.notReady == ready
+	b.notReady = !ready
+	b.mux.Unlock()
+	if changed && ready {
+		log.Printf("[%s] ready for new rooms\n", b.ID)
+	} else if changed {
+		log.Printf("[%s] not ready for new rooms\n", b.ID)
+	}
+}
+
+// fetchReadiness requests the readiness path and reads readinessField out of
+// the answer
+func (b *Backend) fetchReadiness() (bool, error) {
+	value, err := b.fetchField(b.readinessPath, readinessField)
+	if err != nil {
+		return false, err
+	}
+	ready, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is not a boolean", readinessField)
+	}
+	return ready, nil
+}
+
+// fetchField requests path and reads field out of the JSON answer, dots go
+// into nested objects
+func (b *Backend) fetchField(path, field string) (interface{}, error) {
+	resp, err := b.healthClient.Get(b.URL.String() + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("answered with %s", resp.Status)
+	}
+	var value interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid answer: %v", err)
+	}
+	value, ok := jsonField(value, field)
+	if !ok {
+		return nil, fmt.Errorf("no %s field in answer", field)
+	}
+	return value, nil
+}
+
+// jsonField returns field out of a decoded JSON value, dots go into nested
+// objects. It's false when the value has no such objects.
+func jsonField(value interface{}, field string) (interface{}, bool) {
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value = object[name]
+	}
+	return value, true
+}
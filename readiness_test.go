@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadinessCheck(t *testing.T) {
+	defer func(field string) { readinessField = field }(readinessField)
+	var answer atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			return
+		}
+		a := answer.Load().(string)
+		if a == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, a)
+	}))
+	defer backend.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	tests := []struct {
+		name   string
+		field  string
+		answer string // of the readiness path, empty for a 503
+		ready  bool
+	}{
+		{"ready", "matchmaking_ready", `{"matchmaking_ready":true}`, true},
+		{"not ready", "matchmaking_ready", `{"matchmaking_ready":false,"players":12}`, false},
+		{"missing field", "matchmaking_ready", `{"players":12}`, false},
+		{"not a boolean", "matchmaking_ready", `{"matchmaking_ready":"yes"}`, false},
+		{"not json", "matchmaking_ready", `ready`, false},
+		{"unavailable", "matchmaking_ready", ``, false},
+		{"nested", "engine.accepting", `{"engine":{"accepting":true}}`, true},
+		{"nested not ready", "engine.accepting", `{"engine":{"accepting":false}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readinessField = tt.field
+			answer.Store(tt.answer)
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?name=a&readiness_path=/ready",
+				strings.TrimPrefix(other.URL, "http://")+"?name=b")()
+			serverPool.InitialHealthCheck()
+			a := serverPool.GetBackend("a")
+			// readiness is about new matches, not being alive
+			if !a.IsAlive() || a.IsReady() != tt.ready {
+				t.Fatalf("a alive %v ready %v, want alive and ready %v", a.IsAlive(), a.IsReady(), tt.ready)
+			}
+			if status := newBackendStatus(a); status.Ready != tt.ready {
+				t.Fatalf("status says ready %v, want %v", status.Ready, tt.ready)
+			}
+			created := false
+			for i := 0; i < 4; i++ {
+				if serverPool.GetNextPeer() == a {
+					created = true
+				}
+			}
+			if created != tt.ready {
+				t.Fatalf("new rooms on a = %v, want %v", created, tt.ready)
+			}
+			// the rooms it already has are still routed to it
+			d, err := route(withDryRun(httptest.NewRequest(http.MethodGet, "/room/1/state", nil)))
+			if err != nil || d.Backend != a {
+				t.Fatalf("room 1 routed to %q (%v), want a", idOf(d.Backend), err)
+			}
+		})
+	}
+}
+
+func TestReadinessRecovers(t *testing.T) {
+	var ready int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt64(&ready) == 1 {
+			_, _ = io.WriteString(w, `{"matchmaking_ready":true}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"matchmaking_ready":false}`)
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?name=a&readiness_path=/ready")()
+	a := serverPool.GetBackend("a")
+	for i, want := range []bool{false, true, false} {
+		if want {
+			atomic.StoreInt64(&ready, 1)
+		} else {
+			atomic.StoreInt64(&ready, 0)
+		}
+		serverPool.InitialHealthCheck()
+		if a.IsReady() != want || (serverPool.GetNextPeer() == a) != want {
+			t.Fatalf("pass %d: ready %v, want %v", i, a.IsReady(), want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sort"
+)
+
+// rebalanceLoad is the current and suggested room count of a backend
+type rebalanceLoad struct {
+	Backend  string `json:"backend"`
+	Rooms    int    `json:"rooms"`
+	Inflight int64  `json:"inflight"`
+	Target   int    `json:"target"`
+}
+
+// rebalanceMove suggests moving a room between backends
+type rebalanceMove struct {
+	Room string `json:"room"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// rebalancePlan evens out the rooms across the schedulable backends
+type rebalancePlan struct {
+	Backends []rebalanceLoad `json:"backends"`
+	Moves    []rebalanceMove `json:"moves"`
+}
+
+// planRebalance suggests the room moves that would even out rooms across
+// the alive, uncordoned backends. Rooms on the other backends are all moved.
+func planRebalance(backends []*Backend, rooms map[*Backend][]string) rebalancePlan {
+	var eligible []*Backend
+	total := 0
+	for _, b := range backends {
+		total += len(rooms[b])
+		if b.IsAlive() && !b.IsCordoned() {
+			eligible = append(eligible, b)
+		}
+	}
+
+	targets := make(map[*Backend]int)
+	if len(eligible) > 0 {
+		// the busiest backends keep the remainder, so fewer rooms move
+		sort.SliceStable(eligible, func(i, j int) bool {
+			return len(rooms[eligible[i]]) > len(rooms[eligible[j]])
+		})
+		for i, b := range eligible {
+			targets[b] = total / len(eligible)
+			if i < total%len(eligible) {
+				targets[b]++
+			}
+		}
+	}
+
+	plan := rebalancePlan{Moves: []rebalanceMove{}}
+	var surplus []rebalanceMove
+	for _, b := range backends {
+		plan.Backends = append(plan.Backends, rebalanceLoad{
+			Backend:  b.ID,
+			Rooms:    len(rooms[b]),
+			Inflight: b.Inflight(),
+			Target:   targets[b],
+		})
+		ids, keep := rooms[b], targets[b]
+		if keep > len(ids) {
+			keep = len(ids)
+		}
+		for _, roomId := range ids[keep:] {
+			surplus = append(surplus, rebalanceMove{Room: roomId, From: b.ID})
+		}
+	}
+	for _, b := range eligible {
+		for missing := targets[b] - len(rooms[b]); missing > 0 && len(surplus) > 0; missing-- {
+			move := surplus[0]
+			surplus = surplus[1:]
+			move.To = b.ID
+			plan.Moves = append(plan.Moves, move)
+		}
+	}
+	return plan
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		rooms    []int  // rooms held by each backend
+		down     []bool // backends that are down
+		cordoned []bool // backends that are cordoned
+		moves    int
+	}{
+		{"skewed", []int{9, 0, 0}, nil, nil, 6},
+		{"balanced", []int{3, 3, 3}, nil, nil, 0},
+		{"uneven remainder", []int{5, 2, 0}, nil, nil, 2},
+		{"new backend", []int{4, 4, 0}, nil, nil, 2},
+		{"down backend emptied", []int{2, 2, 2}, []bool{false, false, true}, nil, 2},
+		{"cordoned backend emptied", []int{1, 5, 0}, nil, []bool{true, false, false}, 3},
+		{"nothing eligible", []int{2, 2}, []bool{true, true}, nil, 0},
+		{"no rooms", []int{0, 0}, nil, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backends []*Backend
+			rooms := make(map[*Backend][]string)
+			room := 0
+			for i, n := range tt.rooms {
+				b, err := buildBackend(fmt.Sprintf("localhost:%d", 9101+i))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i < len(tt.down) && tt.down[i] {
+					b.SetAlive(false)
+				}
+				if i < len(tt.cordoned) && tt.cordoned[i] {
+					b.SetCordoned(true)
+				}
+				for j := 0; j < n; j++ {
+					room++
+					rooms[b] = append(rooms[b], fmt.Sprint(room))
+				}
+				backends = append(backends, b)
+			}
+			plan := planRebalance(backends, rooms)
+			if len(plan.Moves) != tt.moves {
+				t.Fatalf("%d moves, want %d: %+v", len(plan.Moves), tt.moves, plan.Moves)
+			}
+			// applying the plan leaves eligible backends within a room of
+			// each other and nothing anywhere else
+			counts := make(map[string]int)
+			for b, ids := range rooms {
+				counts[b.ID] = len(ids)
+			}
+			for _, move := range plan.Moves {
+				counts[move.From]--
+				counts[move.To]++
+			}
+			min, max := -1, -1
+			for _, b := range backends {
+				n := counts[b.ID]
+				if !b.IsAlive() || b.IsCordoned() {
+					if n != 0 && tt.moves > 0 {
+						t.Fatalf("%s keeps %d rooms", b.ID, n)
+					}
+					continue
+				}
+				if min < 0 || n < min {
+					min = n
+				}
+				if n > max {
+					max = n
+				}
+			}
+			if max-min > 1 {
+				t.Fatalf("plan leaves %v", counts)
+			}
+		})
+	}
+}
+
+func TestRebalancePlanHandlerMovesNothing(t *testing.T) {
+	defer setPool(t, "localhost:9101", "localhost:9102")()
+	first := serverPool.Backends()[0]
+	for _, roomId := range []string{"1", "2", "3", "4"} {
+		serverPool.rooms.Record(roomId, first)
+	}
+	w := httptest.NewRecorder()
+	adminHandler(w, httptest.NewRequest(http.MethodGet, "/admin/rebalance/plan", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if rooms := serverPool.rooms.Rooms(); len(rooms[first]) != 4 {
+		t.Fatalf("the plan moved rooms: %v", rooms)
+	}
+}
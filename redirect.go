@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// Policies for redirects answered by backends
+const (
+	RedirectPassthrough = "passthrough"
+	RedirectRewrite     = "rewrite"
+	RedirectFollow      = "follow"
+)
+
+// redirectPolicy is what happens to backend redirects: passed through as
+// they are, their Location rewritten with URL_REWRITES, or followed by the
+// balancer when they point to another backend
+var redirectPolicy = envString("REDIRECT_POLICY", RedirectPassthrough)
+
+// redirectMaxFollows caps the redirects followed for a single request
+var redirectMaxFollows = envInt("REDIRECT_MAX_FOLLOWS", 3)
+
+// isValidRedirectPolicy returns true for the supported REDIRECT_POLICY values
+func isValidRedirectPolicy(policy string) bool {
+	return policy == RedirectPassthrough || policy == RedirectRewrite || policy == RedirectFollow
+}
+
+// isRedirect returns true for the statuses carrying a Location to go to
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// handleRedirect applies the redirect policy to a backend response
+func handleRedirect(resp *http.Response) {
+	switch redirectPolicy {
+	case RedirectRewrite:
+		if location := resp.Header.Get("Location"); isRedirect(resp.StatusCode) && location != "" {
+			resp.Header.Set("Location", urlRewriter.Replace(location))
+		}
+	case RedirectFollow:
+		for follows := 0; isRedirect(resp.StatusCode) && follows < redirectMaxFollows; follows++ {
+			followed := followRedirect(resp)
+			if followed == nil {
+				// the client gets the redirect as it is
+				return
+			}
+			_ = resp.Body.Close()
+			followed.Request = resp.Request
+			*resp = *followed
+		}
+	}
+}
+
+// followRedirect requests the Location of resp from the backend it points
+// to, nil when it's not one of the backends, the request can't be replayed
+// or the backend can't be reached
+func followRedirect(resp *http.Response) *http.Response {
+	req := resp.Request
+	// a consumed body can't be sent again, except on a 303 which drops it
+	if req.Body != nil && req.Body != http.NoBody && resp.StatusCode != http.StatusSeeOther {
+		return nil
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	var target *Backend
+	for _, b := range serverPool.Backends() {
+		if b.URL.Scheme == location.Scheme && b.URL.Host == location.Host {
+			target = b
+			break
+		}
+	}
+	if target == nil {
+		return nil
+	}
+	outreq := req.Clone(req.Context())
+	outreq.URL, outreq.Host = location, location.Host
+	if resp.StatusCode == http.StatusSeeOther && req.Method != http.MethodHead {
+		outreq.Method, outreq.Body, outreq.ContentLength = http.MethodGet, http.NoBody, 0
+	}
+	log.Printf("%s(%s) Following redirect to %s\n", req.RemoteAddr, req.URL.Path, location)
+	followed, err := target.transport.RoundTrip(outreq)
+	if err != nil {
+		log.Printf("[%s] Following redirect failed: %s\n", target.ID, err.Error())
+		return nil
+	}
+	return followed
+}
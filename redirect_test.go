@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBackendRedirects(t *testing.T) {
+	var hops int64
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " from b"))
+	}))
+	defer other.Close()
+	var self string
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hops, 1)
+		switch r.URL.Query().Get("to") {
+		case "b":
+			http.Redirect(w, r, other.URL+"/room/created", http.StatusFound)
+		case "b-see-other":
+			http.Redirect(w, r, other.URL+"/room/created", http.StatusSeeOther)
+		case "elsewhere":
+			http.Redirect(w, r, "http://elsewhere.example/room", http.StatusFound)
+		case "self":
+			http.Redirect(w, r, self+"/room?to=self", http.StatusTemporaryRedirect)
+		default:
+			w.Write([]byte(r.Method + " from a"))
+		}
+	}))
+	defer first.Close()
+	self = first.URL
+	defer setPool(t, strings.TrimPrefix(first.URL, "http://")+"?name=a", strings.TrimPrefix(other.URL, "http://")+"?name=b")()
+	defer func(policy string, max int, rewriter *strings.Replacer) {
+		redirectPolicy, redirectMaxFollows, urlRewriter = policy, max, rewriter
+	}(redirectPolicy, redirectMaxFollows, urlRewriter)
+	redirectMaxFollows = 3
+	urlRewriter = strings.NewReplacer(other.URL, "https://games.example.com")
+	tests := []struct {
+		name     string
+		policy   string
+		to       string
+		body     string
+		code     int
+		location string
+		answer   string
+		hops     int64 // requests reaching a
+	}{
+		{"passthrough", RedirectPassthrough, "b", "", http.StatusFound, other.URL + "/room/created", "", 1},
+		{"rewrite", RedirectRewrite, "b", "", http.StatusFound, "https://games.example.com/room/created", "", 1},
+		{"rewrite unknown", RedirectRewrite, "elsewhere", "", http.StatusFound, "http://elsewhere.example/room", "", 1},
+		{"rewrite leaves answers alone", RedirectRewrite, "", "", http.StatusOK, "", "POST from a", 1},
+		{"follow", RedirectFollow, "b", "", http.StatusOK, "", "POST from b", 1},
+		{"follow see other", RedirectFollow, "b-see-other", `{"players":2}`, http.StatusOK, "", "GET from b", 1},
+		// a body already sent can't be replayed
+		{"follow with a body", RedirectFollow, "b", `{"players":2}`, http.StatusFound, other.URL + "/room/created", "", 1},
+		{"follow outside the pool", RedirectFollow, "elsewhere", "", http.StatusFound, "http://elsewhere.example/room", "", 1},
+		{"follow a loop", RedirectFollow, "self", "", http.StatusTemporaryRedirect, first.URL + "/room?to=self", "", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirectPolicy = tt.policy
+			atomic.StoreInt64(&hops, 0)
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room?to="+tt.to, strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if location := w.Header().Get("Location"); location != tt.location {
+				t.Fatalf("Location %q, want %q", location, tt.location)
+			}
+			if tt.answer != "" && w.Body.String() != tt.answer {
+				t.Fatalf("answered %q, want %q", w.Body.String(), tt.answer)
+			}
+			if n := atomic.LoadInt64(&hops); n != tt.hops {
+				t.Fatalf("a reached %d times, want %d", n, tt.hops)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// roomTTL is how long a room stays registered without seeing any traffic
+var roomTTL = envDuration("ROOM_TTL", time.Hour)
+
+// RoomRegistry remembers which backend each room was routed to, so rooms
+// stay on their server when the pool changes
+type RoomRegistry struct {
+	mux   sync.RWMutex
+	rooms map[string]*roomEntry
+}
+
+type roomEntry struct {
+	backend  *Backend
+	lastSeen time.Time
+}
+
+// Lookup returns the backend a room was registered on, nil when unknown or expired
+func (r *RoomRegistry) Lookup(roomId string) *Backend {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	entry, ok := r.rooms[roomId]
+	if !ok || time.Since(entry.lastSeen) > roomTTL {
+		return nil
+	}
+	return entry.backend
+}
+
+// Record registers a room on a backend and refreshes its expiry
+func (r *RoomRegistry) Record(roomId string, b *Backend) {
+	r.mux.Lock()
+	if r.rooms == nil {
+		r.rooms = make(map[string]*roomEntry)
+	}
+	r.rooms[roomId] = &roomEntry{backend: b, lastSeen: time.Now()}
+	r.mux.Unlock()
+}
+
+// Forget drops every room registered on b
+func (r *RoomRegistry) Forget(b *Backend) {
+	r.mux.Lock()
+	for roomId, entry := range r.rooms {
+		if entry.backend == b {
+			delete(r.rooms, roomId)
+		}
+	}
+	r.mux.Unlock()
+}
+
+// Expire drops rooms that haven't seen traffic for roomTTL
+func (r *RoomRegistry) Expire() {
+	r.mux.Lock()
+	for roomId, entry := range r.rooms {
+		if time.Since(entry.lastSeen) > roomTTL {
+			delete(r.rooms, roomId)
+		}
+	}
+	r.mux.Unlock()
+}
+
+// Rooms returns the registered room ids grouped by backend, sorted
+func (r *RoomRegistry) Rooms() map[*Backend][]string {
+	r.mux.RLock()
+	rooms := make(map[*Backend][]string)
+	for roomId, entry := range r.rooms {
+		if time.Since(entry.lastSeen) <= roomTTL {
+			rooms[entry.backend] = append(rooms[entry.backend], roomId)
+		}
+	}
+	r.mux.RUnlock()
+	for _, ids := range rooms {
+		sort.Strings(ids)
+	}
+	return rooms
+}
+
+// expireRooms runs a routine that drops idle rooms from the registry, and
+// expired client affinities
+func expireRooms() {
+	t := time.NewTicker(time.Minute)
+	for {
+		select {
+		case <-t.C:
+			serverPool.rooms.Expire()
+			clientAffinity.Expire()
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloaders are run on SIGHUP to pick up changed configuration files
+var reloaders []func() error
+
+// handleReloads runs the reloaders whenever the process gets a SIGHUP
+func handleReloads() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Println("Received SIGHUP, reloading")
+		for _, reload := range reloaders {
+			if err := reload(); err != nil {
+				log.Println("Reload failed: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudgetRatio is the share of original requests that may be retried
+var retryBudgetRatio = envFloat("RETRY_BUDGET_RATIO", 0.1)
+
+// retryBudgetMinPerSecond retries are allowed each second regardless of traffic
+var retryBudgetMinPerSecond = envFloat("RETRY_BUDGET_MIN_PER_SECOND", 10)
+
+// RetryBudget is a token bucket filled by original requests and by time,
+// and drained by retries, so retries can't multiply the load on an outage
+type RetryBudget struct {
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+var retryBudget RetryBudget
+
+// Deposit credits the budget for an original request
+func (b *RetryBudget) Deposit() {
+	b.mux.Lock()
+	b.refill()
+	b.tokens += retryBudgetRatio
+	b.mux.Unlock()
+}
+
+// Withdraw takes a retry out of the budget, false when the budget is spent
+func (b *RetryBudget) Withdraw() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.refill()
+	// deposits like 0.1 don't add up to exactly 1 in floating point
+	if b.tokens < 1-1e-9 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the time based tokens, the bucket holds at most 10 seconds of
+// them but always room for a retry, or requests alone could never earn one
+func (b *RetryBudget) refill() {
+	now := time.Now()
+	capacity := retryBudgetMinPerSecond * 10
+	if capacity < 1 {
+		capacity = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * retryBudgetMinPerSecond
+	}
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.last = now
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	defer func(ratio, min float64) { retryBudgetRatio, retryBudgetMinPerSecond = ratio, min }(retryBudgetRatio, retryBudgetMinPerSecond)
+	tests := []struct {
+		name     string
+		ratio    float64
+		min      float64
+		requests int
+		low      int // retries allowed when every request fails
+		high     int
+	}{
+		{"ratio alone", 0.1, 0, 1000, 99, 101},
+		{"minimum alone", 0, 5, 1000, 50, 51},
+		{"minimum then ratio", 0.1, 10, 1000, 199, 201},
+		{"a fifth", 0.2, 0, 500, 99, 101},
+		{"disabled", 0, 0, 1000, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryBudgetRatio, retryBudgetMinPerSecond = tt.ratio, tt.min
+			var budget RetryBudget
+			retries := 0
+			for i := 0; i < tt.requests; i++ {
+				budget.Deposit()
+				if budget.Withdraw() {
+					retries++
+				}
+			}
+			if retries < tt.low || retries > tt.high {
+				t.Fatalf("%d retries allowed, want %d to %d", retries, tt.low, tt.high)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetStopsRetries(t *testing.T) {
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+	}))
+	defer backend.Close()
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	defer func(ratio, min float64) { retryBudgetRatio, retryBudgetMinPerSecond = ratio, min }(retryBudgetRatio, retryBudgetMinPerSecond)
+	retryBudgetRatio, retryBudgetMinPerSecond = 0, 0
+	tests := []struct {
+		name   string
+		tokens float64
+		code   int
+		hits   int64
+	}{
+		{"budget left", 1, http.StatusOK, 1},
+		{"budget spent", 0, statusUpstreamError, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, deadAddr+"?name=dead", strings.TrimPrefix(backend.URL, "http://")+"?name=live")()
+			retryBudget.mux.Lock()
+			tokens, last := retryBudget.tokens, retryBudget.last
+			retryBudget.tokens, retryBudget.last = tt.tokens, time.Now()
+			retryBudget.mux.Unlock()
+			defer func() {
+				retryBudget.mux.Lock()
+				retryBudget.tokens, retryBudget.last = tokens, last
+				retryBudget.mux.Unlock()
+			}()
+			// the next new room goes to the dead backend first
+			for serverPool.PeekNextPeer().ID != "dead" {
+				serverPool.GetNextPeer()
+			}
+			atomic.StoreInt64(&hits, 0)
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if n := atomic.LoadInt64(&hits); n != tt.hits {
+				t.Fatalf("live backend hit %d times, want %d", n, tt.hits)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// retryOnStatus holds the backend statuses failed over like connection
+// errors, parsed from RETRY_ON_STATUS like 502,503
+var retryOnStatus map[int]bool
+
+// parseRetryStatuses parses a list of status codes
+func parseRetryStatuses(items []string) (map[int]bool, error) {
+	statuses := make(map[int]bool, len(items))
+	for _, item := range items {
+		status, err := strconv.Atoi(item)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid retry status %q", item)
+		}
+		statuses[status] = true
+	}
+	return statuses, nil
+}
+
+// retryStatusError fails over a response whose status is worth retrying
+type retryStatusError struct {
+	status int
+}
+
+func (e *retryStatusError) Error() string {
+	return fmt.Sprintf("backend answered %d, failing over", e.status)
+}
+
+// isIdempotent returns true for the methods that can safely be sent twice
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// shouldRetryStatus returns true when resp is to be failed over, its status
+// is listed and the request can be replayed. The last attempt gets the
+// response as it is.
+func shouldRetryStatus(resp *http.Response) bool {
+	req := resp.Request
+	if !retryOnStatus[resp.StatusCode] || !isIdempotent(req.Method) {
+		return false
+	}
+	// a consumed body can't be sent again
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return GetAttemptsFromContext(req) < 3
+}
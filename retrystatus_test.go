@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseRetryStatuses(t *testing.T) {
+	tests := []struct {
+		items    []string
+		statuses []int
+		err      bool
+	}{
+		{[]string{"502", "503"}, []int{502, 503}, false},
+		{nil, nil, false},
+		{[]string{"99"}, nil, true},
+		{[]string{"600"}, nil, true},
+		{[]string{"bad"}, nil, true},
+	}
+	for _, tt := range tests {
+		statuses, err := parseRetryStatuses(tt.items)
+		if (err != nil) != tt.err {
+			t.Fatalf("parseRetryStatuses(%v) error = %v, want error %v", tt.items, err, tt.err)
+		}
+		if len(statuses) != len(tt.statuses) {
+			t.Fatalf("parseRetryStatuses(%v) = %v, want %v", tt.items, statuses, tt.statuses)
+		}
+		for _, status := range tt.statuses {
+			if !statuses[status] {
+				t.Fatalf("parseRetryStatuses(%v) = %v, want %v", tt.items, statuses, tt.statuses)
+			}
+		}
+	}
+}
+
+func TestShouldRetryStatus(t *testing.T) {
+	defer func(statuses map[int]bool) { retryOnStatus = statuses }(retryOnStatus)
+	retryOnStatus = map[int]bool{503: true}
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		status   int
+		attempts int
+		retry    bool
+	}{
+		{"listed status", http.MethodGet, "", 503, 0, true},
+		{"other status", http.MethodGet, "", 500, 0, false},
+		{"not idempotent", http.MethodPost, "", 503, 0, false},
+		{"with a body", http.MethodPut, "data", 503, 0, false},
+		{"last attempt", http.MethodGet, "", 503, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/room/1", nil)
+			if tt.body != "" {
+				req = httptest.NewRequest(tt.method, "/room/1", strings.NewReader(tt.body))
+			}
+			req = req.WithContext(context.WithValue(req.Context(), Attempts, tt.attempts))
+			if retry := shouldRetryStatus(&http.Response{StatusCode: tt.status, Request: req}); retry != tt.retry {
+				t.Fatalf("shouldRetryStatus = %v, want %v", retry, tt.retry)
+			}
+		})
+	}
+}
+
+func TestRoomRetryOnStatus(t *testing.T) {
+	var failingHits, healthyHits int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&failingHits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&healthyHits, 1)
+	}))
+	defer healthy.Close()
+	defer func(statuses map[int]bool, policy string) {
+		retryOnStatus, roomFailover = statuses, policy
+	}(retryOnStatus, roomFailover)
+	retryOnStatus = map[int]bool{http.StatusServiceUnavailable: true}
+
+	tests := []struct {
+		policy      string
+		status      int
+		failingHits int64
+		healthyHits int64
+	}{
+		// the room only lives on its backend, which gets the last word
+		{RoomFailoverNone, http.StatusServiceUnavailable, 3, 0},
+		{RoomFailoverRehash, http.StatusOK, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			defer setPool(t, strings.TrimPrefix(failing.URL, "http://"), strings.TrimPrefix(healthy.URL, "http://"))()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			roomFailover = tt.policy
+			atomic.StoreInt64(&failingHits, 0)
+			atomic.StoreInt64(&healthyHits, 0)
+			serverPool.rooms.Record("1", serverPool.Backends()[0])
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, "/room/1/state", nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if hits := atomic.LoadInt64(&failingHits); hits != tt.failingHits {
+				t.Fatalf("failing backend hit %d times, want %d", hits, tt.failingHits)
+			}
+			if hits := atomic.LoadInt64(&healthyHits); hits != tt.healthyHits {
+				t.Fatalf("healthy backend hit %d times, want %d", hits, tt.healthyHits)
+			}
+		})
+	}
+}
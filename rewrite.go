@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// urlRewriter maps backend-internal URLs to the ones clients can reach, nil when disabled
+var urlRewriter *strings.Replacer
+
+// urlRewriteTypes are the content types whose bodies get rewritten
+var urlRewriteTypes = []string{"application/json"}
+
+// Policies for responses too large to buffer
+const (
+	OverflowStream = "stream"
+	OverflowError  = "error"
+)
+
+// maxBufferedResponseBytes is the largest response buffered for rewriting
+var maxBufferedResponseBytes = envInt("MAX_BUFFERED_RESPONSE_BYTES", 1<<20)
+
+// bufferLimits is the largest response buffered on each route class
+var bufferLimits = map[string]int{
+	RouteCreate:  envInt("MAX_BUFFERED_RESPONSE_BYTES_CREATE", maxBufferedResponseBytes),
+	RouteAction:  envInt("MAX_BUFFERED_RESPONSE_BYTES_ACTION", maxBufferedResponseBytes),
+	RouteConnect: envInt("MAX_BUFFERED_RESPONSE_BYTES_CONNECT", maxBufferedResponseBytes),
+	RouteDefault: envInt("MAX_BUFFERED_RESPONSE_BYTES_DEFAULT", maxBufferedResponseBytes),
+}
+
+// bufferOverflow either streams responses over the limit as they are or fails them with a 502
+var bufferOverflow = envString("BUFFER_OVERFLOW", OverflowStream)
+
+var errResponseTooLarge = errors.New("response too large to buffer")
+
+// parseURLRewrites builds a replacer out of `internal=public` pairs
+func parseURLRewrites(pairs []string) (*strings.Replacer, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	var oldnew []string
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid url rewrite %q, expected internal=public", pair)
+		}
+		oldnew = append(oldnew, pair[:i], pair[i+1:])
+	}
+	return strings.NewReplacer(oldnew...), nil
+}
+
+// isRewritable returns true when the response body should go through the rewriter
+func isRewritable(resp *http.Response) bool {
+	if urlRewriter == nil || resp.Body == nil || resp.Body == http.NoBody {
+		return false
+	}
+	// compressed bodies would need to be decoded first, leave them alone
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range urlRewriteTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteResponse replaces backend-internal URLs in the response body
+func rewriteResponse(resp *http.Response) error {
+	if !isRewritable(resp) {
+		return nil
+	}
+	// reading the body also de-chunks it, so the result is sent with a fixed length
+	limit := bufferLimits[GetRouteFromContext(resp.Request)]
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(limit)+1))
+	if err != nil {
+		_ = resp.Body.Close()
+		return err
+	}
+	if len(body) > limit {
+		log.Printf("%s response is over %d bytes, not rewriting it\n", resp.Request.URL.Path, limit)
+		if bufferOverflow == OverflowError {
+			_ = resp.Body.Close()
+			return errResponseTooLarge
+		}
+		// pass what was read along with the rest of the body untouched
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	_ = resp.Body.Close()
+	body = []byte(urlRewriter.Replace(string(body)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
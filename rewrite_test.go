@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseURLRewrites(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		in    string
+		out   string
+		err   bool
+	}{
+		{[]string{"ws://internal:9000=wss://games.example.com"}, `{"url":"ws://internal:9000/ws/42"}`, `{"url":"wss://games.example.com/ws/42"}`, false},
+		{[]string{"http://a:1=https://x", "http://b:2=https://x"}, "http://b:2/room", "https://x/room", false},
+		{[]string{"=https://x"}, "", "", true},
+		{[]string{"no-separator"}, "", "", true},
+	}
+	for _, tt := range tests {
+		r, err := parseURLRewrites(tt.pairs)
+		if (err != nil) != tt.err {
+			t.Fatalf("parseURLRewrites(%v) error = %v, want error %v", tt.pairs, err, tt.err)
+		}
+		if err == nil && r.Replace(tt.in) != tt.out {
+			t.Fatalf("rewrote %q to %q, want %q", tt.in, r.Replace(tt.in), tt.out)
+		}
+	}
+	if r, err := parseURLRewrites(nil); r != nil || err != nil {
+		t.Fatalf("parseURLRewrites(nil) = %v, %v, want disabled", r, err)
+	}
+}
+
+func TestRewriteInternalURLs(t *testing.T) {
+	const internal = `{"url":"ws://internal-host:9000/ws/42"}`
+	const public = `{"url":"wss://games.example.com/ws/42"}`
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		chunked     bool
+		overflow    string
+		limit       int
+		code        int
+		body        string
+	}{
+		{"json", "application/json", "", false, OverflowStream, 1 << 20, http.StatusOK, public},
+		{"json with charset", "application/json; charset=utf-8", "", false, OverflowStream, 1 << 20, http.StatusOK, public},
+		{"chunked json", "application/json", "", true, OverflowStream, 1 << 20, http.StatusOK, public},
+		{"plain text", "text/plain", "", false, OverflowStream, 1 << 20, http.StatusOK, internal},
+		{"compressed", "application/json", "br", false, OverflowStream, 1 << 20, http.StatusOK, internal},
+		{"at the limit", "application/json", "", false, OverflowError, len(internal), http.StatusOK, public},
+		{"over the limit streamed", "application/json", "", false, OverflowStream, 10, http.StatusOK, internal},
+		{"chunked over the limit streamed", "application/json", "", true, OverflowStream, 10, http.StatusOK, internal},
+		{"over the limit refused", "application/json", "", false, OverflowError, 10, statusUpstreamError, ""},
+		{"over the limit but not rewritten", "text/plain", "", false, OverflowError, 10, http.StatusOK, internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				half := len(internal) / 2
+				_, _ = w.Write([]byte(internal[:half]))
+				if tt.chunked {
+					w.(http.Flusher).Flush()
+				}
+				_, _ = w.Write([]byte(internal[half:]))
+			}))
+			defer backend.Close()
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+			defer func(r *strings.Replacer, overflow string, limit int) {
+				urlRewriter, bufferOverflow, bufferLimits[RouteCreate] = r, overflow, limit
+			}(urlRewriter, bufferOverflow, bufferLimits[RouteCreate])
+			urlRewriter = strings.NewReplacer("ws://internal-host:9000", "wss://games.example.com")
+			bufferOverflow, bufferLimits[RouteCreate] = tt.overflow, tt.limit
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == http.StatusOK && w.Body.String() != tt.body {
+				t.Fatalf("body %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestBufferLimitsPerRoute(t *testing.T) {
+	const internal = `{"url":"ws://internal-host:9000/ws/42"}`
+	var hits int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(internal))
+	}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(r *strings.Replacer, overflow string, limits map[string]int) {
+		urlRewriter, bufferOverflow, bufferLimits = r, overflow, limits
+	}(urlRewriter, bufferOverflow, bufferLimits)
+	urlRewriter = strings.NewReplacer("ws://internal-host:9000", "wss://games.example.com")
+	bufferOverflow = OverflowError
+	// creations can be buffered, room actions can't
+	bufferLimits = map[string]int{RouteCreate: 1 << 20, RouteAction: 10, RouteConnect: 1 << 20, RouteDefault: 1 << 20}
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodPost, "/room", http.StatusOK},
+		{http.MethodGet, "/room/1/state", statusUpstreamError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			atomic.StoreInt64(&hits, 0)
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			// an oversized response isn't asked for again
+			if n := atomic.LoadInt64(&hits); n != 1 {
+				t.Fatalf("backend hit %d times, want 1", n)
+			}
+		})
+	}
+}
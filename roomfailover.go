@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// Policies for requests to a room whose backend is down
+const (
+	RoomFailoverNone   = "none"
+	RoomFailoverRehash = "rehash"
+)
+
+// roomFailover is what happens to requests to a room whose backend is down or
+// refused the request: none fails them, or retries them there, the room only
+// lives there, rehash moves the room to the next live backend on the hash ring
+var roomFailover = envString("ROOM_FAILOVER", RoomFailoverNone)
+
+// isValidRoomFailover returns true for the supported ROOM_FAILOVER values
+func isValidRoomFailover(policy string) bool {
+	return policy == RoomFailoverNone || policy == RoomFailoverRehash
+}
+
+// refusedBackend returns the backend that refused the previous attempt of r,
+// its port closed or answering a RETRY_ON_STATUS status, if any
+func refusedBackend(r *http.Request) *Backend {
+	b, _ := r.Context().Value(Refused).(*Backend)
+	return b
+}
+
+// rehashRoom returns the first live backend from the room's position on the
+// hash ring other than down, registering the room on it unless it's a dry
+// run. It's nil when no other backend is alive.
+func (s *ServerPool) rehashRoom(r *http.Request, roomId string, down *Backend) *Backend {
+	next := s.Ring().GetFirst(roomId, func(b *Backend) bool { return b != down && b.IsAlive() })
+	if next != nil && !isDryRun(r) {
+		s.rooms.Record(roomId, next)
+		log.Printf("Room %s moved from %s to %s\n", roomId, down.ID, next.ID)
+	}
+	return next
+}
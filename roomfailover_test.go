@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoomFailoverRehash(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	a, b, c := named("a"), named("b"), named("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	// nothing listens there once closed
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+	defer func(policy string) { roomFailover = policy }(roomFailover)
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	tests := []struct {
+		name    string
+		policy  string
+		refuses bool // whether room 1's backend refuses connections, or is marked down
+		pinned  bool
+		others  bool // whether the other backends are alive
+		code    int
+	}{
+		{"refused without failover", RoomFailoverNone, true, false, true, statusNoBackend},
+		{"down without failover", RoomFailoverNone, false, false, true, statusNoBackend},
+		{"refused", RoomFailoverRehash, true, false, true, http.StatusOK},
+		{"down", RoomFailoverRehash, false, false, true, http.StatusOK},
+		{"pinned", RoomFailoverRehash, false, true, true, statusNoBackend},
+		{"nowhere to go", RoomFailoverRehash, false, false, false, statusNoBackend},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roomFailover = tt.policy
+			first := strings.TrimPrefix(a.URL, "http://")
+			if tt.refuses {
+				first = deadAddr
+			}
+			defer setPool(t, first+"?name=a", strings.TrimPrefix(b.URL, "http://")+"?name=b",
+				strings.TrimPrefix(c.URL, "http://")+"?name=c")()
+			if !tt.refuses {
+				serverPool.GetBackend("a").SetAlive(false)
+			}
+			if !tt.others {
+				serverPool.GetBackend("b").SetAlive(false)
+				serverPool.GetBackend("c").SetAlive(false)
+			}
+			if tt.pinned {
+				if err := roomPins.Pin("1", "a"); err != nil {
+					t.Fatal(err)
+				}
+				defer roomPins.Unpin("1")
+			}
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, "/room/1/state", nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				if moved := serverPool.rooms.Lookup("1"); moved != nil && moved.ID != "a" {
+					t.Fatalf("room 1 moved to %s, want it left on a", moved.ID)
+				}
+				return
+			}
+			moved := serverPool.rooms.Lookup("1")
+			if moved == nil || moved.ID == "a" || w.Body.String() != moved.ID {
+				t.Fatalf("served by %q, room 1 registered on %q, want another backend", w.Body.String(), idOf(moved))
+			}
+			// the room stays where it moved, even once a is back
+			serverPool.GetBackend("a").SetAlive(true)
+			w = httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, "/ws/1", nil))
+			if w.Body.String() != moved.ID {
+				t.Fatalf("next request served by %q, want %s", w.Body.String(), moved.ID)
+			}
+		})
+	}
+}
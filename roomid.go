@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Room id types, integer ids map to ranges of backends while the others
+// are spread with consistent hashing
+const (
+	RoomIdInt  = "int"
+	RoomIdUUID = "uuid"
+)
+
+// roomIdTypes maps each supported room id type to the pattern its ids match
+var roomIdTypes = map[string]string{
+	RoomIdInt:  `[0-9]+`,
+	RoomIdUUID: `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+// roomIdType is the kind of room ids the game servers hand out
+var roomIdType = envString("ROOM_ID_TYPE", RoomIdInt)
+
+// roomIdRegexp matches a whole room id of the configured type
+var roomIdRegexp = regexp.MustCompile(`^` + roomIdPattern() + `$`)
+
+// roomIdPattern returns the pattern matching a room id of the configured type
+func roomIdPattern() string {
+	return roomIdTypes[roomIdType]
+}
+
+// roomStrategy names how rooms are mapped to backends
+func roomStrategy() string {
+	if roomIdType == RoomIdInt {
+		return "room-range"
+	}
+	return "room-hash"
+}
+
+// defaultRoomIdSource takes the id out of /room/{id} and /ws/{id}, segments
+// count from API_PREFIX on
+const defaultRoomIdSource = "segment:2"
+
+// roomIdSource is where room ids are found: `segment:N` for the Nth path
+// segment, `query:name` for a query parameter, or `regex:pattern` for the
+// first capture group of a pattern matched against the path
+var roomIdSource = envString("ROOM_ID_SOURCE", defaultRoomIdSource)
+
+// extractRoomId returns the room id of a request, set up from roomIdSource
+var extractRoomId = func(r *http.Request) string { return pathSegment(r.URL.Path, 2) }
+
+// parseRoomIdSource builds the extractor described by source
+func parseRoomIdSource(source string) (func(r *http.Request) string, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid ROOM_ID_SOURCE %q, expected segment:N, query:name or regex:pattern", source)
+	}
+	switch parts[0] {
+	case "segment":
+		index, err := strconv.Atoi(parts[1])
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("invalid ROOM_ID_SOURCE segment %q, expected a positive index", parts[1])
+		}
+		return func(r *http.Request) string { return pathSegment(r.URL.Path, index) }, nil
+	case "query":
+		return func(r *http.Request) string { return r.URL.Query().Get(parts[1]) }, nil
+	case "regex":
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ROOM_ID_SOURCE regex: %v", err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("ROOM_ID_SOURCE regex %q needs a capture group for the id", parts[1])
+		}
+		return func(r *http.Request) string {
+			if m := re.FindStringSubmatch(r.URL.Path); m != nil {
+				return m[1]
+			}
+			return ""
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown ROOM_ID_SOURCE kind %q", parts[0])
+}
+
+// pathSegment returns the index-th segment of path after apiPrefix counting
+// from 1, empty when it's shorter
+func pathSegment(path string, index int) string {
+	if s := strings.Split(strings.TrimPrefix(path, apiPrefix), "/"); len(s) > index {
+		return s[index]
+	}
+	return ""
+}
+
+// roomPath returns a path under API_PREFIX that routes to roomId the way
+// extractRoomId finds it, kind being "room" or "ws". A regex source can't
+// be turned back into a path.
+func roomPath(kind, roomId string) (string, error) {
+	base := apiPrefix + "/" + kind
+	parts := strings.SplitN(roomIdSource, ":", 2)
+	switch parts[0] {
+	case "segment":
+		index, err := strconv.Atoi(parts[1])
+		if err != nil || index < 2 {
+			break
+		}
+		// the segments up to the id only need to be there
+		path := base
+		for i := 2; i <= index; i++ {
+			path += "/" + url.PathEscape(roomId)
+		}
+		return path, nil
+	case "query":
+		return base + "/" + url.PathEscape(roomId) + "?" + url.Values{parts[1]: {roomId}}.Encode(), nil
+	}
+	return "", fmt.Errorf("room paths can't be built from ROOM_ID_SOURCE %s", roomIdSource)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// setRoomRoutes switches the room routes to prefix, idType and source,
+// returning how to switch them back
+func setRoomRoutes(t *testing.T, prefix, idType, source string) (restore func()) {
+	t.Helper()
+	oldPrefix, oldType, oldSource := apiPrefix, roomIdType, roomIdSource
+	oldIdRegexp, oldAction, oldConnection, oldExtract := roomIdRegexp, roomAction, roomConnection, extractRoomId
+	restore = func() {
+		apiPrefix, roomIdType, roomIdSource = oldPrefix, oldType, oldSource
+		roomIdRegexp, roomAction, roomConnection, extractRoomId = oldIdRegexp, oldAction, oldConnection, oldExtract
+	}
+	apiPrefix, roomIdType, roomIdSource = prefix, idType, source
+	roomIdRegexp = regexp.MustCompile(`^` + roomIdPattern() + `$`)
+	extract, err := parseRoomIdSource(source)
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	extractRoomId = extract
+	roomAction, roomConnection = roomRoutes(source)
+	return restore
+}
+
+func TestClassifyRoute(t *testing.T) {
+	const uuid = "123e4567-e89b-12d3-a456-426614174000"
+	tests := []struct {
+		name   string
+		prefix string
+		idType string
+		path   string
+		class  string
+		roomId string
+	}{
+		{"create", "", RoomIdInt, "/room", RouteCreate, ""},
+		{"int action", "", RoomIdInt, "/room/42/state", RouteAction, "42"},
+		{"int connection", "", RoomIdInt, "/ws/42", RouteConnect, "42"},
+		{"uuid action", "", RoomIdUUID, "/room/" + uuid + "/join", RouteAction, uuid},
+		{"uuid connection", "", RoomIdUUID, "/ws/" + uuid, RouteConnect, uuid},
+		{"int id with uuid type", "", RoomIdUUID, "/room/42", "", ""},
+		{"uuid with int type", "", RoomIdInt, "/ws/" + uuid, "", ""},
+		{"not anchored", "", RoomIdInt, "/static/room/42", "", ""},
+		{"prefixed create", "/api", RoomIdInt, "/api/room", RouteCreate, ""},
+		{"prefixed action", "/api", RoomIdInt, "/api/room/42/state", RouteAction, "42"},
+		{"prefixed connection", "/api", RoomIdInt, "/api/ws/42", RouteConnect, "42"},
+		{"prefixed uuid", "/api/v1", RoomIdUUID, "/api/v1/ws/" + uuid, RouteConnect, uuid},
+		{"missing prefix", "/api", RoomIdInt, "/room/42", "", ""},
+		{"prefix is literal", "/a.i", RoomIdInt, "/api/room/42", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoomRoutes(t, tt.prefix, tt.idType, defaultRoomIdSource)()
+			if class := classifyRoute(tt.path); class != tt.class {
+				t.Fatalf("classifyRoute(%q) = %q, want %q", tt.path, class, tt.class)
+			}
+			if tt.roomId == "" {
+				return
+			}
+			if id := extractRoomId(httptest.NewRequest("GET", tt.path, nil)); id != tt.roomId {
+				t.Fatalf("room id of %q = %q, want %q", tt.path, id, tt.roomId)
+			}
+		})
+	}
+}
+
+func TestParseRoomIdSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		source string
+		path   string
+		roomId string
+		err    bool
+	}{
+		{"segment", "", "segment:3", "/room/game/7", "7", false},
+		{"segment after prefix", "/api", "segment:2", "/api/room/7", "7", false},
+		{"segment past the end", "", "segment:5", "/room/7", "", false},
+		{"query", "", "query:id", "/room?id=9", "9", false},
+		{"regex", "", `regex:^/room/game-(\d+)`, "/room/game-12", "12", false},
+		{"regex without match", "", `regex:^/room/game-(\d+)`, "/room/12", "", false},
+		{"zero segment", "", "segment:0", "", "", true},
+		{"regex without group", "", `regex:^/room/\d+`, "", "", true},
+		{"unknown kind", "", "header:X-Room", "", "", true},
+		{"missing value", "", "query:", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoomRoutes(t, tt.prefix, RoomIdInt, defaultRoomIdSource)()
+			extract, err := parseRoomIdSource(tt.source)
+			if (err != nil) != tt.err {
+				t.Fatalf("parseRoomIdSource(%q) error = %v, want error %v", tt.source, err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if id := extract(httptest.NewRequest("GET", tt.path, nil)); id != tt.roomId {
+				t.Fatalf("room id of %q = %q, want %q", tt.path, id, tt.roomId)
+			}
+		})
+	}
+}
+
+func TestCustomSourceRoutesUnderPrefix(t *testing.T) {
+	defer setRoomRoutes(t, "/api", RoomIdInt, "query:room")()
+	for path, class := range map[string]string{
+		"/api/room/anything": RouteAction,
+		"/api/ws":            RouteConnect,
+		"/api/ws/lobby":      RouteConnect,
+		"/ws":                "",
+		"/room/anything":     "",
+	} {
+		if got := classifyRoute(path); got != class {
+			t.Errorf("classifyRoute(%q) = %q, want %q", path, got, class)
+		}
+	}
+}
+
+func TestRoomPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		source string
+		kind   string
+		path   string
+		err    bool
+	}{
+		{"room", "", defaultRoomIdSource, "room", "/room/42", false},
+		{"connection under prefix", "/api", defaultRoomIdSource, "ws", "/api/ws/42", false},
+		{"deeper segment", "", "segment:3", "room", "/room/42/42", false},
+		{"query", "/api", "query:id", "ws", "/api/ws/42?id=42", false},
+		{"first segment", "", "segment:1", "room", "", true},
+		{"regex", "", `regex:^/room/game-(\d+)`, "room", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoomRoutes(t, tt.prefix, RoomIdInt, tt.source)()
+			path, err := roomPath(tt.kind, "42")
+			if (err != nil) != tt.err {
+				t.Fatalf("roomPath error = %v, want error %v", err, tt.err)
+			}
+			if path != tt.path {
+				t.Fatalf("roomPath = %q, want %q", path, tt.path)
+			}
+			if err == nil {
+				if id := extractRoomId(httptest.NewRequest("GET", path, nil)); id != "42" {
+					t.Fatalf("room id of %q = %q, want 42", path, id)
+				}
+			}
+		})
+	}
+}
+
+func TestRoomIdSourceRouting(t *testing.T) {
+	var specs []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		defer backend.Close()
+		specs = append(specs, strings.TrimPrefix(backend.URL, "http://")+"?name="+name)
+	}
+	// integer ids map to backends by ranges of 10000
+	defer setPool(t, specs...)()
+	tests := []struct {
+		name   string
+		source string
+		path   string
+		code   int
+		peer   string
+	}{
+		{"default segment", defaultRoomIdSource, "/room/10001/state", http.StatusOK, "b"},
+		{"path index", "segment:3", "/room/game/20001", http.StatusOK, "c"},
+		{"path index connection", "segment:3", "/ws/game/5", http.StatusOK, "a"},
+		{"path index missing", "segment:3", "/room/game", http.StatusNotFound, ""},
+		{"query param", "query:id", "/room/state?id=10001", http.StatusOK, "b"},
+		{"query param connection", "query:id", "/ws?id=20001", http.StatusOK, "c"},
+		{"query param missing", "query:id", "/room/state", http.StatusNotFound, ""},
+		{"query param of the wrong type", "query:id", "/room/state?id=lobby", http.StatusNotFound, ""},
+		{"regex capture", `regex:^/room/game-(\d+)`, "/room/game-5/join", http.StatusOK, "a"},
+		{"regex capture connection", `regex:^/ws/game-(\d+)`, "/ws/game-20001", http.StatusOK, "c"},
+		{"regex without match", `regex:^/room/game-(\d+)`, "/room/match-5/join", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoomRoutes(t, "", RoomIdInt, tt.source)()
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if tt.peer != "" && w.Body.String() != tt.peer {
+				t.Fatalf("served by %q, want %q", w.Body.String(), tt.peer)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// routingRulesFile holds routing rules evaluated in order ahead of the
+// built-in routes, the first matching one decides. It's reread on SIGHUP.
+var routingRulesFile = envString("ROUTING_RULES_FILE", "")
+
+// routingRule sends the requests matching a path pattern, optionally a method
+// and a header, to a backend or to a pool with a strategy. Rules are written
+// like backend specs, e.g. /api/room?method=POST&header=X-Beta:1&pool=beta
+type routingRule struct {
+	rule        string
+	pattern     string // exact path, or a prefix when it ends with a *
+	method      string
+	header      string
+	headerValue string // empty matches any value
+	backend     string
+	pool        string
+	strategy    string
+}
+
+// parseRoutingRule parses a rule of the rules file
+func parseRoutingRule(item string) (routingRule, error) {
+	rule := routingRule{rule: item}
+	parts := strings.SplitN(item, "?", 2)
+	rule.pattern = parts[0]
+	if !strings.HasPrefix(rule.pattern, "/") {
+		return rule, fmt.Errorf("invalid routing rule %q, expected a path starting with /", item)
+	}
+	if len(parts) == 1 {
+		return rule, fmt.Errorf("invalid routing rule %q, expected a backend, pool or strategy", item)
+	}
+	options, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return rule, fmt.Errorf("invalid routing rule %q: %v", item, err)
+	}
+	for name := range options {
+		switch name {
+		case "method", "header", "backend", "pool", "strategy":
+		default:
+			return rule, fmt.Errorf("invalid routing rule %q, unknown option %s", item, name)
+		}
+	}
+	rule.method = strings.ToUpper(options.Get("method"))
+	if header := options.Get("header"); header != "" {
+		nameValue := strings.SplitN(header, ":", 2)
+		rule.header = http.CanonicalHeaderKey(strings.TrimSpace(nameValue[0]))
+		if len(nameValue) == 2 {
+			rule.headerValue = strings.TrimSpace(nameValue[1])
+		}
+	}
+	rule.backend, rule.pool, rule.strategy = options.Get("backend"), options.Get("pool"), options.Get("strategy")
+	switch {
+	case rule.backend == "" && rule.pool == "" && rule.strategy == "":
+		return rule, fmt.Errorf("invalid routing rule %q, expected a backend, pool or strategy", item)
+	case rule.backend != "" && (rule.pool != "" || rule.strategy != ""):
+		return rule, fmt.Errorf("invalid routing rule %q, a backend goes without pool and strategy", item)
+	case rule.strategy != "" && !isValidStrategy(rule.strategy):
+		return rule, fmt.Errorf("invalid routing rule %q, unknown strategy %s", item, rule.strategy)
+	}
+	return rule, nil
+}
+
+// matches returns true when r falls under the rule
+func (rule *routingRule) matches(r *http.Request) bool {
+	if prefix := strings.TrimSuffix(rule.pattern, "*"); prefix != rule.pattern {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	} else if r.URL.Path != rule.pattern {
+		return false
+	}
+	if rule.method != "" && r.Method != rule.method {
+		return false
+	}
+	if rule.header != "" {
+		values, ok := r.Header[rule.header]
+		if !ok {
+			return false
+		}
+		if rule.headerValue != "" && !containsString(values, rule.headerValue) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// RoutingRules holds the rules loaded from routingRulesFile
+type RoutingRules struct {
+	mux   sync.RWMutex
+	rules []routingRule
+}
+
+var routingRules RoutingRules
+
+// Match returns the first rule r falls under, nil when there's none
+func (rr *RoutingRules) Match(r *http.Request) *routingRule {
+	rr.mux.RLock()
+	defer rr.mux.RUnlock()
+	for i := range rr.rules {
+		if rr.rules[i].matches(r) {
+			rule := rr.rules[i]
+			return &rule
+		}
+	}
+	return nil
+}
+
+// loadRoutingRules (re)reads routingRulesFile, keeping the current rules on error
+func loadRoutingRules() error {
+	if routingRulesFile == "" {
+		return nil
+	}
+	items, err := readListFile(routingRulesFile)
+	if err != nil {
+		return err
+	}
+	rules := make([]routingRule, 0, len(items))
+	for _, item := range items {
+		rule, err := parseRoutingRule(item)
+		if err != nil {
+			return err
+		}
+		// backends may join later, e.g. when discovered
+		if rule.backend != "" && serverPool.GetBackend(rule.backend) == nil {
+			log.Printf("Routing rule %s targets unknown backend %s\n", rule.rule, rule.backend)
+		}
+		if rule.pool != "" && serverPool.Pool(rule.pool) == nil {
+			log.Printf("Routing rule %s targets unknown pool %s\n", rule.rule, rule.pool)
+		}
+		rules = append(rules, rule)
+	}
+	routingRules.mux.Lock()
+	routingRules.rules = rules
+	routingRules.mux.Unlock()
+	log.Printf("Loaded %d routing rules\n", len(rules))
+	return nil
+}
+
+// routeByRule routes r as rule says. Only creates and paths outside the room
+// routes get here, new rooms are placed and counted like any other.
+func routeByRule(r *http.Request, d routeDecision, rule *routingRule) (routeDecision, *routingError) {
+	d.Branch = "rule"
+	if rule.backend != "" {
+		d.Backend = serverPool.GetBackend(rule.backend)
+		if d.Backend == nil {
+			return d, errNoServer
+		}
+		if !d.Backend.IsAlive() {
+			log.Printf("%s is down, can't route by rule %s\n", d.Backend.URL, rule.rule)
+			return d, errUnavailable
+		}
+	} else {
+		pool := &serverPool
+		if rule.pool != "" {
+			if pool = serverPool.Pool(rule.pool); pool == nil {
+				return d, errNoServer
+			}
+		}
+		strategy := rule.strategy
+		if strategy == "" {
+			strategy = lbStrategy
+		}
+		d.Backend = pickExcluding(pool, r, func(p *ServerPool) *Backend { return pickWithStrategy(p, r, strategy) })
+	}
+	if d.Class == RouteCreate && !isDryRun(r) {
+		logPlacement(r, d.Backend)
+	}
+	if d.Backend == nil {
+		return d, errUnavailable
+	}
+	if d.Class == RouteCreate && !isDryRun(r) {
+		d.Backend.roomLoad.Add(roomCost(r))
+	}
+	return d, nil
+}
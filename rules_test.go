@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setRoutingRules sets the routing rules, returning their restore
+func setRoutingRules(t *testing.T, items ...string) (restore func()) {
+	t.Helper()
+	rules := make([]routingRule, 0, len(items))
+	for _, item := range items {
+		rule, err := parseRoutingRule(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	routingRules.mux.Lock()
+	old := routingRules.rules
+	routingRules.rules = rules
+	routingRules.mux.Unlock()
+	return func() {
+		routingRules.mux.Lock()
+		routingRules.rules = old
+		routingRules.mux.Unlock()
+	}
+}
+
+func TestParseRoutingRule(t *testing.T) {
+	tests := []struct {
+		item string
+		want routingRule
+		err  bool
+	}{
+		{"/room?method=post&header=x-beta:1&pool=beta", routingRule{pattern: "/room", method: "POST", header: "X-Beta", headerValue: "1", pool: "beta"}, false},
+		{"/static/*?backend=cdn", routingRule{pattern: "/static/*", backend: "cdn"}, false},
+		{"/room?header=X-Beta&strategy=least-load", routingRule{pattern: "/room", header: "X-Beta", strategy: StrategyLeastLoad}, false},
+		{"room?backend=a", routingRule{}, true},
+		{"/room", routingRule{}, true},
+		{"/room?method=POST", routingRule{}, true},
+		{"/room?backend=a&pool=beta", routingRule{}, true},
+		{"/room?strategy=random", routingRule{}, true},
+		{"/room?backend=a&weight=2", routingRule{}, true},
+		{"/room?backend=%zz", routingRule{}, true},
+	}
+	for _, tt := range tests {
+		rule, err := parseRoutingRule(tt.item)
+		if (err != nil) != tt.err {
+			t.Errorf("parseRoutingRule(%q) error = %v, want error %v", tt.item, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		tt.want.rule = tt.item
+		if rule != tt.want {
+			t.Errorf("parseRoutingRule(%q) = %+v, want %+v", tt.item, rule, tt.want)
+		}
+	}
+}
+
+func TestRoutingRules(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	a, b, c := named("a"), named("b"), named("c")
+	defer a.Close()
+	defer b.Close()
+	defer c.Close()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer setRoutingRules(t,
+		"/room?method=POST&header=X-Beta:1&pool=beta",
+		"/static/*?backend=c",
+		"/room/*?backend=c",
+		"/lobby?backend=x",
+	)()
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		beta   string // X-Beta sent along
+		cDown  bool
+		code   int
+		body   string
+	}{
+		{"header and method", http.MethodPost, "/room", "1", false, http.StatusOK, "b"},
+		{"other header value", http.MethodPost, "/room", "2", false, http.StatusOK, "a"},
+		{"without header", http.MethodPost, "/room", "", false, http.StatusOK, "a"},
+		{"other method", http.MethodGet, "/room", "1", false, http.StatusOK, "a"},
+		{"prefix outside the built-in routes", http.MethodGet, "/static/app.js", "", false, http.StatusOK, "c"},
+		{"prefix not matched", http.MethodGet, "/static", "", false, http.StatusNotFound, ""},
+		{"backend down", http.MethodGet, "/static/app.js", "", true, statusNoBackend, ""},
+		{"unknown backend", http.MethodGet, "/lobby", "", false, statusRoomNotFound, ""},
+		{"room action goes to its owner, not the rule", http.MethodGet, "/room/1/state", "", false, http.StatusOK, "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, strings.TrimPrefix(a.URL, "http://")+"?name=a",
+				strings.TrimPrefix(b.URL, "http://")+"?name=b&pool=beta",
+				strings.TrimPrefix(c.URL, "http://")+"?name=c")()
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			if tt.cDown {
+				serverPool.GetBackend("c").SetAlive(false)
+			}
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.beta != "" {
+				req.Header.Set("X-Beta", tt.beta)
+			}
+			w := httptest.NewRecorder()
+			lb(w, req)
+			if w.Code != tt.code {
+				t.Fatalf("answered %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Fatalf("routed to %s, want %s", w.Body, tt.body)
+			}
+		})
+	}
+}
+
+func TestLoadRoutingRules(t *testing.T) {
+	defer setRoutingRules(t, "/old?backend=a")()
+	defer func(file string) { routingRulesFile = file }(routingRulesFile)
+	tests := []struct {
+		name  string
+		rules string
+		err   bool
+		want  string // pattern of the first rule once loaded
+	}{
+		{"valid", "# beta testers\n/room?header=X-Beta&pool=beta\n/static/*?backend=c\n", false, "/room"},
+		{"invalid rule", "/room?pool=beta\n/static?weight=2\n", true, "/old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoutingRules(t, "/old?backend=a")()
+			file, remove := writeTempFile(t, tt.rules)
+			defer remove()
+			routingRulesFile = file
+			err := loadRoutingRules()
+			if (err != nil) != tt.err {
+				t.Fatalf("loadRoutingRules error = %v, want error %v", err, tt.err)
+			}
+			routingRules.mux.RLock()
+			defer routingRules.mux.RUnlock()
+			if got := routingRules.rules[0].pattern; got != tt.want {
+				t.Fatalf("first rule %s, want %s", got, tt.want)
+			}
+		})
+	}
+	// a missing file keeps the rules too
+	routingRulesFile = "/nonexistent/rules"
+	if err := loadRoutingRules(); err == nil {
+		t.Fatal("loaded a missing rules file")
+	}
+	if rule := routingRules.Match(httptest.NewRequest(http.MethodGet, "/old", nil)); rule == nil {
+		t.Fatal("rules dropped on a missing file")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// scaleInSignalDir gets a file named after each backend once it's safe to
+// terminate, e.g. for an autoscaler watching a shared volume
+var scaleInSignalDir = envString("SCALE_IN_SIGNAL_DIR", "")
+
+// scaleInSignalURL gets a POST of the scale-in status of each backend once
+// it's safe to terminate
+var scaleInSignalURL = envString("SCALE_IN_SIGNAL_URL", "")
+
+// scaleInStatus tells an autoscaler whether a backend can be terminated
+type scaleInStatus struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	Safe        bool   `json:"safe"`
+	Reason      string `json:"reason"`
+	InPool      bool   `json:"in_pool"`
+	Draining    bool   `json:"draining"`
+	Inflight    int64  `json:"inflight"`
+	Connections int64  `json:"connections"`
+}
+
+// newScaleInStatus reports a backend of the pool as safe once it's draining
+// and drained the way drainBackend waits for, TERMINATION_READY_PATH included
+func newScaleInStatus(b *Backend) scaleInStatus {
+	status := scaleInStatus{
+		ID:          b.ID,
+		URL:         b.URL.String(),
+		InPool:      true,
+		Draining:    b.IsDraining(),
+		Inflight:    b.Inflight(),
+		Connections: b.ActiveConns(),
+	}
+	switch {
+	case !status.Draining && drains.IsQueued(b):
+		status.Reason = "queued to drain, new rooms can still land on it"
+	case !status.Draining:
+		status.Reason = "not draining, new rooms can land on it"
+	case status.Inflight > 0 || status.Connections > 0:
+		status.Reason = "draining, still serving its rooms"
+	case !b.drained():
+		status.Reason = "draining, not ready to terminate yet"
+	default:
+		status.Safe, status.Reason = true, "drained"
+	}
+	return status
+}
+
+// retiredBackends remembers the backends drained out of the pool, so the
+// autoscaler can still ask about them
+var retiredBackends = struct {
+	sync.RWMutex
+	statuses map[string]scaleInStatus
+}{statuses: make(map[string]scaleInStatus)}
+
+// retire records b leaving the pool after draining, busy when it was removed
+// on BACKEND_DRAIN_TIMEOUT, and signals it when it's safe to terminate
+func retire(b *Backend, busy bool) {
+	status := scaleInStatus{ID: b.ID, URL: b.URL.String(), Safe: !busy, Reason: "drained and removed"}
+	if busy {
+		status.Inflight, status.Connections = b.Inflight(), b.ActiveConns()
+		status.Reason = "removed while still serving on BACKEND_DRAIN_TIMEOUT"
+	}
+	retiredBackends.Lock()
+	retiredBackends.statuses[b.ID] = status
+	retiredBackends.Unlock()
+	if status.Safe {
+		signalScaleIn(status)
+	}
+}
+
+// scaleInStatusOf reports the backend of id, from the pool or once retired
+func scaleInStatusOf(id string) (scaleInStatus, bool) {
+	if b := serverPool.GetBackend(id); b != nil {
+		return newScaleInStatus(b), true
+	}
+	retiredBackends.RLock()
+	defer retiredBackends.RUnlock()
+	status, ok := retiredBackends.statuses[id]
+	return status, ok
+}
+
+// signalScaleIn writes the signal file and posts to the signal URL, failures
+// are only logged as the status stays available on the admin endpoint
+func signalScaleIn(status scaleInStatus) {
+	if scaleInSignalDir == "" && scaleInSignalURL == "" {
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Println("Failed to encode scale-in signal: ", err)
+		return
+	}
+	if scaleInSignalDir != "" {
+		// a backend name could hold a slash
+		name := filepath.Join(scaleInSignalDir, strings.Replace(status.ID, "/", "_", -1))
+		if err := writeFileAtomic(name, data); err != nil {
+			log.Printf("Failed to write scale-in signal of %s: %s\n", status.ID, err.Error())
+		}
+	}
+	if scaleInSignalURL != "" {
+		if err := postScaleIn(data); err != nil {
+			log.Printf("Failed to post scale-in signal of %s: %s\n", status.ID, err.Error())
+		}
+	}
+	log.Printf("%s [safe to terminate]\n", status.URL)
+}
+
+func postScaleIn(data []byte) error {
+	resp, err := healthClient.Post(scaleInSignalURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", scaleInSignalURL, resp.Status)
+	}
+	return nil
+}
+
+// scaleInHandler reports which backends are safe to terminate on GET
+// /admin/scale-in, and a single one on /admin/scale-in/{id} answering 200
+// when it's safe and 409 when it isn't
+func scaleInHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if id != "" {
+		status, ok := scaleInStatusOf(id)
+		if !ok {
+			http.Error(w, "Backend not found", http.StatusNotFound)
+			return
+		}
+		code := http.StatusOK
+		if !status.Safe {
+			code = http.StatusConflict
+		}
+		writeJSON(w, code, status)
+		return
+	}
+	statuses := make([]scaleInStatus, 0)
+	inPool := make(map[string]bool)
+	for _, b := range serverPool.Backends() {
+		statuses = append(statuses, newScaleInStatus(b))
+		inPool[b.ID] = true
+	}
+	retiredBackends.RLock()
+	for id, status := range retiredBackends.statuses {
+		if !inPool[id] {
+			statuses = append(statuses, status)
+		}
+	}
+	retiredBackends.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"backends": statuses})
+}
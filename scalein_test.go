@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// resetRetired forgets the backends retired by a test
+func resetRetired() {
+	retiredBackends.Lock()
+	retiredBackends.statuses = make(map[string]scaleInStatus)
+	retiredBackends.Unlock()
+}
+
+func TestScaleInHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		id     string
+		setup  func(b *Backend)
+		code   int
+		reason string
+	}{
+		{"serving", "a", func(b *Backend) {}, http.StatusConflict, "not draining, new rooms can land on it"},
+		{"queued", "a", func(b *Backend) { drains.Queue(b) }, http.StatusConflict, "queued to drain, new rooms can still land on it"},
+		{"draining with requests", "a", func(b *Backend) {
+			b.startDraining()
+			atomic.AddInt64(&b.inflight, 1)
+		}, http.StatusConflict, "draining, still serving its rooms"},
+		{"draining with websockets", "a", func(b *Backend) {
+			b.startDraining()
+			atomic.AddInt64(&b.activeConns, 1)
+		}, http.StatusConflict, "draining, still serving its rooms"},
+		{"drained", "a", func(b *Backend) { b.startDraining() }, http.StatusOK, "drained"},
+		{"drained but not ready", "a", func(b *Backend) {
+			b.startDraining()
+			b.readyPath = "/not-ready"
+		}, http.StatusConflict, "draining, not ready to terminate yet"},
+		{"drained and ready", "a", func(b *Backend) {
+			b.startDraining()
+			b.readyPath = "/ready"
+		}, http.StatusOK, "drained"},
+		{"retired", "a", func(b *Backend) {
+			serverPool.RemoveBackend(b.ID)
+			retire(b, false)
+		}, http.StatusOK, "drained and removed"},
+		{"retired on the timeout", "a", func(b *Backend) {
+			serverPool.RemoveBackend(b.ID)
+			retire(b, true)
+		}, http.StatusConflict, "removed while still serving on BACKEND_DRAIN_TIMEOUT"},
+		{"unknown", "x", func(b *Backend) {}, http.StatusNotFound, ""},
+	}
+	// answers the termination ready check of backends
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?name=a", "localhost:9102?name=b")()
+			defer holdDrains()()
+			defer resetRetired()
+			tt.setup(serverPool.GetBackend("a"))
+
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(http.MethodGet, "/scale-in/"+tt.id, nil))
+			if w.Code != tt.code {
+				t.Fatalf("answered %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if tt.code == http.StatusNotFound {
+				return
+			}
+			var status scaleInStatus
+			if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.ID != "a" || status.Reason != tt.reason || status.Safe != (tt.code == http.StatusOK) {
+				t.Fatalf("status %+v, want reason %q", status, tt.reason)
+			}
+
+			// the listing holds every backend, retired ones included
+			w = httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(http.MethodGet, "/scale-in", nil))
+			var list struct {
+				Backends []scaleInStatus `json:"backends"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+				t.Fatal(err)
+			}
+			listed := make(map[string]scaleInStatus)
+			for _, s := range list.Backends {
+				listed[s.ID] = s
+			}
+			if len(listed) != 2 || listed["a"] != status {
+				t.Fatalf("listed %+v, want a as %+v and b", list.Backends, status)
+			}
+		})
+	}
+}
+
+func TestRetireSignals(t *testing.T) {
+	tests := []struct {
+		name   string
+		busy   bool
+		signal bool
+	}{
+		{"drained", false, true},
+		{"removed while busy", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posted := make(chan scaleInStatus, 1)
+			autoscaler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var status scaleInStatus
+				if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+					t.Error(err)
+				}
+				posted <- status
+			}))
+			defer autoscaler.Close()
+			dir, err := ioutil.TempDir("", "balancer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			defer func(dir, url string) {
+				scaleInSignalDir, scaleInSignalURL = dir, url
+			}(scaleInSignalDir, scaleInSignalURL)
+			scaleInSignalDir, scaleInSignalURL = dir, autoscaler.URL
+			defer resetRetired()
+
+			b, err := buildBackend("localhost:9101?name=game/1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			retire(b, tt.busy)
+
+			data, err := ioutil.ReadFile(filepath.Join(dir, "game_1"))
+			if !tt.signal {
+				if err == nil {
+					t.Fatal("signal file written for a busy backend")
+				}
+				select {
+				case status := <-posted:
+					t.Fatalf("posted %+v for a busy backend", status)
+				default:
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var status scaleInStatus
+			if err := json.Unmarshal(data, &status); err != nil {
+				t.Fatal(err)
+			}
+			if status.ID != "game/1" || !status.Safe {
+				t.Fatalf("signal file holds %+v", status)
+			}
+			select {
+			case got := <-posted:
+				if got != status {
+					t.Fatalf("posted %+v, want %+v", got, status)
+				}
+			default:
+				t.Fatal("nothing posted to the signal URL")
+			}
+		})
+	}
+}
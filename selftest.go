@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+// selfTestCase is a synthetic request and the routing it should get
+type selfTestCase struct {
+	name    string
+	req     *http.Request
+	class   string
+	backend *Backend // expected backend, nil when any backend will do
+}
+
+// selfTestCases synthesizes a room creation plus a room action and a
+// connection for every backend's room range, the latter when room paths can
+// be built from ROOM_ID_SOURCE
+func selfTestCases() []selfTestCase {
+	cases := []selfTestCase{{
+		name:  "room creation",
+		req:   httptest.NewRequest(http.MethodPost, apiPrefix+"/room", nil),
+		class: RouteCreate,
+	}}
+	for i, b := range serverPool.Backends() {
+		roomId := "123e4567-e89b-12d3-a456-426614174000"
+		var expected *Backend
+		if roomIdType == RoomIdInt {
+			// the first room of each backend's range
+			roomId, expected = strconv.Itoa(i*10000+1), b
+		}
+		actionPath, err := roomPath("room", roomId)
+		if err != nil {
+			break
+		}
+		wsPath, _ := roomPath("ws", roomId)
+		action := httptest.NewRequest(http.MethodGet, actionPath, nil)
+		action.URL.Path += "/state"
+		ws := httptest.NewRequest(http.MethodGet, wsPath, nil)
+		ws.Header.Set("Connection", "Upgrade")
+		ws.Header.Set("Upgrade", "websocket")
+		cases = append(cases,
+			selfTestCase{
+				name:    "room action " + roomId,
+				req:     action,
+				class:   RouteAction,
+				backend: expected,
+			},
+			selfTestCase{
+				name:    "connection " + roomId,
+				req:     ws,
+				class:   RouteConnect,
+				backend: expected,
+			},
+		)
+		if roomIdType != RoomIdInt {
+			break
+		}
+	}
+	return cases
+}
+
+// runSelfTest dry runs synthetic requests through the configured pool, so
+// nothing is proxied, registered or counted, reporting where each would go.
+// Returns true when all pass.
+func runSelfTest(w io.Writer) bool {
+	if _, err := roomPath("room", "0"); err != nil {
+		fmt.Fprintln(w, "Skipping room actions and connections:", err)
+	}
+	passed := true
+	for _, c := range selfTestCases() {
+		decision, err := route(withDryRun(c.req))
+		class, peer := decision.Class, decision.Backend
+		result, target := "PASS", "-"
+		if peer != nil {
+			target = peer.URL.String()
+		}
+		switch {
+		case err != nil:
+			result = "FAIL (" + err.Error() + ")"
+		case class != c.class:
+			result = "FAIL (matched " + class + " route, expected " + c.class + ")"
+		case c.backend != nil && peer != c.backend:
+			result = "FAIL (expected " + c.backend.URL.String() + ")"
+		}
+		if result != "PASS" {
+			passed = false
+		}
+		fmt.Fprintf(w, "%-50s %s -> %s %s\n", c.name, c.req.URL.RequestURI(), target, result)
+	}
+	if passed {
+		fmt.Fprintln(w, "Self test passed")
+	} else {
+		fmt.Fprintln(w, "Self test failed")
+	}
+	return passed
+}
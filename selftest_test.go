@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		idType string
+		source string
+		rooms  bool // whether room actions and connections are tried
+	}{
+		{"int rooms", "", RoomIdInt, defaultRoomIdSource, true},
+		{"under prefix", "/api", RoomIdInt, defaultRoomIdSource, true},
+		{"uuid rooms under prefix", "/api/v1", RoomIdUUID, defaultRoomIdSource, true},
+		{"query source", "/api", RoomIdInt, "query:room", true},
+		{"regex source", "", RoomIdInt, `regex:^/room/game-(\d+)`, false},
+	}
+	defer setPool(t, "localhost:9101", "localhost:9102", "localhost:9103")()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoomRoutes(t, tt.prefix, tt.idType, tt.source)()
+			current := atomic.LoadUint64(&serverPool.current)
+			var out bytes.Buffer
+			if !runSelfTest(&out) {
+				t.Fatalf("self test failed:\n%s", out.String())
+			}
+			if tried := strings.Contains(out.String(), "/state"); tried != tt.rooms {
+				t.Fatalf("room actions tried = %v, want %v:\n%s", tried, tt.rooms, out.String())
+			}
+			if rooms := serverPool.rooms.Rooms(); len(rooms) != 0 {
+				t.Fatalf("self test registered rooms: %v", rooms)
+			}
+			if moved := atomic.LoadUint64(&serverPool.current); moved != current {
+				t.Fatalf("self test moved the rotation from %d to %d", current, moved)
+			}
+		})
+	}
+}
@@ -2,71 +2,442 @@ package main
 
 import (
 	"log"
-	"net/url"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// ServerPool holds the backends being balanced. The backends slice and the
+// ring are replaced rather than modified, so readers take a snapshot and
+// use it without holding the lock.
 type ServerPool struct {
+	mux      sync.RWMutex
 	backends []*Backend
 	current  uint64
+	rooms    RoomRegistry
+	lookups  flightGroup // concurrent lookups of the same room share one
+	ring     *HashRing
+	pools    map[string]*ServerPool // backends grouped by their pool option
+	local    *ServerPool            // backends in the balancer's zone
+	// current weights of the smooth weighted round robin by backend id
+	weightedMux sync.Mutex
+	weighted    map[string]float64
+	weightsOf   *ServerPool // pool whose weights a view of it shares, nil for its own
+}
+
+// newSubPool returns a pool of some of the backends, with a rotation of its own
+func newSubPool(backends []*Backend) *ServerPool {
+	return &ServerPool{backends: backends, ring: newHashRing(backends)}
 }
 
 // AddBackend to the server pool
 func (s *ServerPool) AddBackend(backend *Backend) {
-	s.backends = append(s.backends, backend)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	backends := make([]*Backend, len(s.backends), len(s.backends)+1)
+	copy(backends, s.backends)
+	s.setBackends(append(backends, backend))
 }
 
-// NextIndex atomically increase the counter and return an index
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
+// RemoveBackend takes a backend out of the pool and forgets its rooms
+func (s *ServerPool) RemoveBackend(id string) *Backend {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	backends := make([]*Backend, 0, len(s.backends))
+	var removed *Backend
+	for _, b := range s.backends {
+		if b.ID == id {
+			removed = b
+			continue
+		}
+		backends = append(backends, b)
+	}
+	if removed != nil {
+		s.setBackends(backends)
+		s.rooms.Forget(removed)
+		clientAffinity.Forget(removed)
+	}
+	return removed
 }
 
-// MarkBackendStatus changes a status of a backend
-func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
+// UpdateBackend changes the weight and zone of a backend in place, a nil
+// value is left as it is. The local zone is rebuilt so the next selection
+// sees the change.
+func (s *ServerPool) UpdateBackend(id string, weight *int, zone *string) *Backend {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	for _, b := range s.backends {
-		if b.URL.String() == backendUrl.String() {
-			b.SetAlive(alive)
-			break
+		if b.ID != id {
+			continue
 		}
+		b.mux.Lock()
+		if weight != nil {
+			b.Weight = *weight
+		}
+		if zone != nil {
+			b.Zone = *zone
+		}
+		b.mux.Unlock()
+		s.setBackends(s.backends)
+		return b
 	}
+	return nil
 }
 
-// GetNextPeer returns next active peer to take a connection
+// setBackends swaps in a new set of backends and rebuilds the ring, the
+// named pools and the local zone for it
+func (s *ServerPool) setBackends(backends []*Backend) {
+	grouped := make(map[string][]*Backend)
+	for _, b := range backends {
+		if b.Pool != "" {
+			grouped[b.Pool] = append(grouped[b.Pool], b)
+		}
+	}
+	pools := make(map[string]*ServerPool, len(grouped))
+	for name, members := range grouped {
+		pools[name] = newSubPool(members)
+		pools[name].local = localPool(members)
+	}
+	s.backends, s.ring, s.pools, s.local = backends, newHashRing(backends), pools, localPool(backends)
+	// keep the rotation within the new backends, where it would have gone next
+	if current := atomic.LoadUint64(&s.current); len(backends) > 0 && current >= uint64(len(backends)) {
+		atomic.CompareAndSwapUint64(&s.current, current, current%uint64(len(backends)))
+	}
+}
+
+// Pool returns the backends of a named pool as a pool of their own, nil when
+// no backend is in it
+func (s *ServerPool) Pool(name string) *ServerPool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.pools[name]
+}
+
+// Local returns the backends in the balancer's zone as a pool of their own,
+// nil when there's none
+func (s *ServerPool) Local() *ServerPool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.local
+}
+
+// Backends returns the current backends, the slice must not be modified
+func (s *ServerPool) Backends() []*Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.backends
+}
+
+// Ring returns the consistent hash ring of the current backends
+func (s *ServerPool) Ring() *HashRing {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.ring == nil {
+		return &HashRing{}
+	}
+	return s.ring
+}
+
+// MarkBackendStatus changes a status of a backend
+func (s *ServerPool) MarkBackendStatus(id string, alive bool) {
+	if b := s.GetBackend(id); b != nil {
+		b.SetAlive(alive)
+	}
+}
+
+// GetBackend returns the backend with the given id, if any
+func (s *ServerPool) GetBackend(id string) *Backend {
+	for _, b := range s.Backends() {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// GetNextPeer returns next active peer to take a connection, in the
+// balancer's zone when possible
 func (s *ServerPool) GetNextPeer() *Backend {
-	// loop entire backends to find out an Alive backend
-	next := s.NextIndex()
-	l := len(s.backends) + next // start from next and move a full cycle
-	for i := next; i < l; i++ {
-		idx := i % len(s.backends)     // take an index by modding
-		if s.backends[idx].IsAlive() { // if we have an alive backend, use it and store if its not the original one
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
-			}
-			return s.backends[idx]
+	return s.preferLocal((*ServerPool).getNextPeer)
+}
+
+func (s *ServerPool) getNextPeer() *Backend {
+	backends := s.Backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	for {
+		current := atomic.LoadUint64(&s.current)
+		idx := nextEligible(backends, int(current%uint64(len(backends)))+1)
+		if idx < 0 {
+			return nil
+		}
+		// the rotation only moves forward from where this pick started, even
+		// when backends are skipped, a concurrent pick makes us scan again
+		if atomic.CompareAndSwapUint64(&s.current, current, uint64(idx)) {
+			return backends[idx]
 		}
 	}
+}
+
+// PeekNextPeer returns the peer GetNextPeer would pick, without moving the rotation
+func (s *ServerPool) PeekNextPeer() *Backend {
+	return s.preferLocal((*ServerPool).peekNextPeer)
+}
+
+func (s *ServerPool) peekNextPeer() *Backend {
+	backends := s.Backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	current := atomic.LoadUint64(&s.current)
+	if idx := nextEligible(backends, int(current%uint64(len(backends)))+1); idx >= 0 {
+		return backends[idx]
+	}
 	return nil
 }
 
-func (s *ServerPool) GetPeer(roomId int) *Backend {
+// nextEligible returns the index of the first backend from start on that
+// can take a new room, -1 when there's none
+func nextEligible(backends []*Backend, start int) int {
+	fallback := -1
+	l := len(backends) + start // start from next and move a full cycle
+	for i := start; i < l; i++ {
+		idx := i % len(backends) // take an index by modding
+		if !backends[idx].takesNewRooms() {
+			continue
+		}
+		// warming and degraded backends only take rooms nobody else can
+		if backends[idx].onlyAsFallback() {
+			if fallback < 0 {
+				fallback = idx
+			}
+			continue
+		}
+		// flaky backends only take a share of their turns, the rest move on
+		if rand.Float64() >= backends[idx].EffectiveWeight() {
+			if fallback < 0 {
+				fallback = idx
+			}
+			continue
+		}
+		return idx
+	}
+	return fallback
+}
+
+// GetLeastLoaded returns the peer with the lowest room load for its weight,
+// or share of its capacity when it reports one, warming and degraded peers only when nobody else can take the room, in the
+// balancer's zone when possible
+func (s *ServerPool) GetLeastLoaded() *Backend {
+	return s.preferLocal((*ServerPool).getLeastLoaded)
+}
+
+func (s *ServerPool) getLeastLoaded() *Backend {
+	var best, fallback *Backend
+	var bestScore float64
+	for _, b := range s.Backends() {
+		if !b.takesNewRooms() {
+			continue
+		}
+		if b.onlyAsFallback() {
+			if fallback == nil {
+				fallback = b
+			}
+			continue
+		}
+		score := float64(b.roomLoad.Sum()) / b.EffectiveWeight()
+		// with a known capacity, the share of it in use
+		if capacity := b.Capacity(); capacity > 0 {
+			score /= float64(capacity)
+		}
+		if best == nil || score < bestScore {
+			best, bestScore = b, score
+		}
+	}
+	if best == nil {
+		return fallback
+	}
+	return best
+}
+
+// GetWeightedPeer returns the next peer of a smooth weighted round robin,
+// in the balancer's zone when possible
+func (s *ServerPool) GetWeightedPeer() *Backend {
+	return s.preferLocal(func(s *ServerPool) *Backend { return s.nextWeighted(true) })
+}
+
+// PeekWeightedPeer returns the peer GetWeightedPeer would pick, without moving the rotation
+func (s *ServerPool) PeekWeightedPeer() *Backend {
+	return s.preferLocal(func(s *ServerPool) *Backend { return s.nextWeighted(false) })
+}
+
+// nextWeighted runs a round of smooth weighted round robin as nginx does:
+// every eligible backend gains its weight, the one that gained the most is
+// picked and pays back the total. Skipped backends don't gain anything, so
+// they don't burst when they come back.
+func (s *ServerPool) nextWeighted(commit bool) *Backend {
+	var eligible, warming []*Backend
+	for _, b := range s.Backends() {
+		if !b.takesNewRooms() {
+			continue
+		}
+		// warming and degraded backends only take rooms nobody else can
+		if b.onlyAsFallback() {
+			warming = append(warming, b)
+			continue
+		}
+		eligible = append(eligible, b)
+	}
+	if len(eligible) == 0 {
+		eligible = warming
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	w := s
+	if s.weightsOf != nil {
+		w = s.weightsOf
+	}
+	w.weightedMux.Lock()
+	defer w.weightedMux.Unlock()
+	if w.weighted == nil {
+		w.weighted = make(map[string]float64)
+	}
+	var best *Backend
+	var total float64
+	current := make(map[string]float64, len(eligible))
+	for _, b := range eligible {
+		// flaky backends see their weight decay like they do in round robin
+		weight := float64(b.GetWeight()) * b.EffectiveWeight()
+		total += weight
+		current[b.ID] = w.weighted[b.ID] + weight
+		if best == nil || current[b.ID] > current[best.ID] {
+			best = b
+		}
+	}
+	if commit {
+		current[best.ID] -= total
+		for id, weight := range current {
+			w.weighted[id] = weight
+		}
+	}
+	return best
+}
+
+// GetByClient consistently maps a client address to a peer, moving on along
+// the ring when its peer can't take new rooms
+func (s *ServerPool) GetByClient(ip net.IP) *Backend {
+	return s.Ring().GetFirst(ip.String(), (*Backend).takesNewRooms)
+}
+
+// GetPeer returns the peer serving a room, keeping known rooms where they
+// were. A burst of players joining a new room resolves it once, so they
+// can't be mapped apart while the load they add moves the bounded ring.
+// Pinned rooms stay out of the registry so unpinning them takes them back.
+func (s *ServerPool) GetPeer(roomId string) *Backend {
+	if peer := roomPins.Lookup(roomId); peer != nil {
+		return peer
+	}
+	return s.lookups.Do(roomId, func() *Backend {
+		peer := s.peekUnpinned(roomId)
+		if peer != nil {
+			s.rooms.Record(roomId, peer)
+		}
+		return peer
+	})
+}
+
+// PeekPeer returns the peer serving a room without registering it, pins
+// first, then the registry and the room mapping
+func (s *ServerPool) PeekPeer(roomId string) *Backend {
+	if peer := roomPins.Lookup(roomId); peer != nil {
+		return peer
+	}
+	return s.peekUnpinned(roomId)
+}
+
+// peekUnpinned returns the peer serving a room leaving the pins aside
+func (s *ServerPool) peekUnpinned(roomId string) *Backend {
+	if peer := s.rooms.Lookup(roomId); peer != nil {
+		return peer
+	}
+	return s.mapRoom(roomId)
+}
+
+// mapRoom maps integer room ids to ranges of backends and hashes any other id
+func (s *ServerPool) mapRoom(roomId string) *Backend {
+	if roomIdType != RoomIdInt {
+		return s.Ring().GetBounded(roomId, hashLoadFactor, (*Backend).Load)
+	}
+	id, err := strconv.Atoi(roomId)
+	if err != nil {
+		return nil
+	}
 	// Good To Make Dynamic
-	serverId := (roomId - 1) / 10000
+	serverId := (id - 1) / 10000
 	log.Printf("serverId: %v", serverId)
-	if serverId <= len(s.backends) {
-		return s.backends[serverId]
+	if backends := s.Backends(); serverId >= 0 && serverId < len(backends) {
+		return backends[serverId]
 	}
 	return nil
 }
 
 // HealthCheck pings the backends and update the status
 func (s *ServerPool) HealthCheck() {
-	for _, b := range s.backends {
-		status := "up"
-		alive := isBackendAlive(b.URL)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
+	s.checkHealth(false)
+}
+
+// InitialHealthCheck pings every backend once and takes the results as they
+// are, without waiting for the thresholds, so the first requests avoid the
+// backends that are down
+func (s *ServerPool) InitialHealthCheck() {
+	s.checkHealth(true)
+}
+
+func (s *ServerPool) checkHealth(initial bool) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, healthCheckConcurrency)
+	now := time.Now()
+	for _, b := range s.Backends() {
+		if !b.dueForProbe(now) {
+			continue
 		}
-		log.Printf("%s [%s]\n", b.URL, status)
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(b *Backend) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			status := "up"
+			wasAlive := b.IsAlive()
+			started := time.Now()
+			ok := b.probe()
+			if ok {
+				b.recordLatency(time.Since(started))
+				b.probeWS()
+				b.probeReadiness()
+				b.probeCapacity()
+			}
+			var alive bool
+			if initial {
+				alive = b.seedProbe(ok)
+			} else {
+				alive = b.recordProbe(ok)
+			}
+			b.updateQuarantine(ok, now)
+			if alive && !wasAlive {
+				go b.warm()
+			}
+			if !alive {
+				status = "down"
+			}
+			log.Printf("%s [%s]\n", b.URL, status)
+		}(b)
 	}
+	wg.Wait()
 }
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRoundRobinFairAcrossFlaps(t *testing.T) {
+	tests := []struct {
+		name string
+		flap func(i int) bool // whether c is alive at pick i
+	}{
+		{"always up", func(i int) bool { return true }},
+		{"always down", func(i int) bool { return false }},
+		{"every other pick", func(i int) bool { return i%2 == 0 }},
+		{"every seventh pick", func(i int) bool { return i%7 != 0 }},
+		{"in bursts", func(i int) bool { return i/50%2 == 0 }},
+	}
+	const picks = 6000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c", "localhost:9104?name=d")()
+			c := serverPool.GetBackend("c")
+			counts := make(map[string]int)
+			for i := 0; i < picks; i++ {
+				c.SetAlive(tt.flap(i))
+				peer := serverPool.GetNextPeer()
+				if peer == nil {
+					t.Fatal("no peer picked")
+				}
+				if peer == c && !c.IsAlive() {
+					t.Fatal("picked c while it was down")
+				}
+				counts[peer.ID]++
+			}
+			// the backends that never went down get the same share
+			lo, hi := picks, 0
+			for _, id := range []string{"a", "b", "d"} {
+				if counts[id] < lo {
+					lo = counts[id]
+				}
+				if counts[id] > hi {
+					hi = counts[id]
+				}
+			}
+			if hi-lo > picks/100 {
+				t.Fatalf("uneven shares %v", counts)
+			}
+		})
+	}
+}
+
+func TestRoundRobinConcurrentPicks(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c")()
+	var mux sync.Mutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				peer := serverPool.GetNextPeer()
+				mux.Lock()
+				counts[peer.ID]++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// every pick moves the rotation by exactly one backend
+	for _, id := range []string{"a", "b", "c"} {
+		if counts[id] != 800 {
+			t.Fatalf("shares %v, want 800 each", counts)
+		}
+	}
+}
+
+func TestBuildServerListIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		ids   []string
+		err   bool
+	}{
+		{"host and port", []string{"localhost:9101", "localhost:9102"}, []string{"localhost:9101", "localhost:9102"}, false},
+		{"names", []string{"localhost:9101?name=web", "localhost:9101?name=socket"}, []string{"web", "socket"}, false},
+		{"same host twice", []string{"localhost:9101", "localhost:9101"}, nil, true},
+		{"same name twice", []string{"localhost:9101?name=a", "localhost:9102?name=a"}, nil, true},
+		{"name taking a host's id", []string{"localhost:9101", "localhost:9102?name=localhost:9101"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backends, err := buildServerList(tt.specs)
+			if (err != nil) != tt.err {
+				t.Fatalf("buildServerList error = %v, want error %v", err, tt.err)
+			}
+			var ids []string
+			for _, b := range backends {
+				ids = append(ids, b.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.ids) {
+				t.Fatalf("ids %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestMarkBackendStatusByID(t *testing.T) {
+	// both share a URL, only their ids tell them apart
+	defer setPool(t, "localhost:9101?name=web", "localhost:9101?name=socket", "localhost:9102")()
+	tests := []struct {
+		id    string
+		alive map[string]bool
+	}{
+		{"socket", map[string]bool{"web": true, "socket": false, "localhost:9102": true}},
+		{"web", map[string]bool{"web": false, "socket": true, "localhost:9102": true}},
+		{"localhost:9102", map[string]bool{"web": true, "socket": true, "localhost:9102": false}},
+		// a URL isn't an id
+		{"http://localhost:9101", map[string]bool{"web": true, "socket": true, "localhost:9102": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			for _, b := range serverPool.Backends() {
+				b.SetAlive(true)
+			}
+			serverPool.MarkBackendStatus(tt.id, false)
+			for _, b := range serverPool.Backends() {
+				if b.IsAlive() != tt.alive[b.ID] {
+					t.Fatalf("%s alive = %v, want %v", b.ID, b.IsAlive(), tt.alive[b.ID])
+				}
+			}
+		})
+	}
+}
+
+func TestSmoothWeightedDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		down    func(i int) bool // whether the last backend is down at pick i
+	}{
+		{"even", []int{1, 1, 1}, nil},
+		{"nginx example", []int{5, 1, 1}, nil},
+		{"mixed", []int{3, 2, 1}, nil},
+		{"one heavy", []int{10, 1}, nil},
+		{"many", []int{4, 3, 2, 2, 1}, nil},
+		{"last skipped in bursts", []int{3, 2, 1}, func(i int) bool { return i/60%2 == 1 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var specs []string
+			total := 0
+			for i, weight := range tt.weights {
+				specs = append(specs, fmt.Sprintf("localhost:%d?name=b%d&weight=%d", 9101+i, i, weight))
+				total += weight
+			}
+			defer setPool(t, specs...)()
+			last := serverPool.Backends()[len(specs)-1]
+			// every window of total picks while all are up holds each
+			// backend exactly its weight, so the spread is perfect
+			window := make(map[string]int)
+			counts := make(map[string]int)
+			up := 0
+			for i := 0; i < 100*total; i++ {
+				down := tt.down != nil && tt.down(i)
+				last.SetAlive(!down)
+				peek := serverPool.PeekWeightedPeer()
+				peer := serverPool.GetWeightedPeer()
+				if peer != peek {
+					t.Fatalf("pick %d: got %s, peeked %s", i, idOf(peer), idOf(peek))
+				}
+				if down {
+					if peer == last {
+						t.Fatalf("pick %d went to a down backend", i)
+					}
+					window, up = make(map[string]int), 0
+					continue
+				}
+				counts[peer.ID]++
+				window[peer.ID]++
+				if up++; up%total != 0 {
+					continue
+				}
+				for j, weight := range tt.weights {
+					if id := fmt.Sprintf("b%d", j); window[id] != weight {
+						t.Fatalf("picks %d to %d: %v, want weights %v", i+1-total, i, window, tt.weights)
+					}
+				}
+				window = make(map[string]int)
+			}
+			if tt.down != nil {
+				return
+			}
+			for j, weight := range tt.weights {
+				if id := fmt.Sprintf("b%d", j); counts[id] != 100*weight {
+					t.Fatalf("%s picked %d times, want %d", id, counts[id], 100*weight)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildBackendIPv6(t *testing.T) {
+	tests := []struct {
+		spec string
+		host string // dialed by the health check, empty when the spec is rejected
+		id   string
+	}{
+		{"[::1]:3030", "[::1]:3030", "[::1]:3030"},
+		{"[::1]:3030?name=v6", "[::1]:3030", "v6"},
+		{"[2001:db8::7]:80?weight=2", "[2001:db8::7]:80", "[2001:db8::7]:80"},
+		{"[fe80::1%25eth0]:3030", "[fe80::1%eth0]:3030", "[fe80::1%eth0]:3030"},
+		{"127.0.0.1:3030", "127.0.0.1:3030", "127.0.0.1:3030"},
+		{"::1:3030", "", ""},
+		{"2001:db8::7:80", "", ""},
+		{"[127.0.0.1]:3030", "", ""},
+		{"[not-an-ip]:3030", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			b, err := buildBackend(tt.spec)
+			if tt.host == "" {
+				if err == nil {
+					t.Fatalf("built %s, want an error", b.URL.Host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.URL.Host != tt.host || b.ID != tt.id {
+				t.Fatalf("host %s id %s, want %s %s", b.URL.Host, b.ID, tt.host, tt.id)
+			}
+		})
+	}
+}
+
+func TestIPv6Backend(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	backend := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("v6 " + r.URL.Path))
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer setPool(t, l.Addr().String())()
+	b := serverPool.Backends()[0]
+	if b.URL.Host != l.Addr().String() {
+		t.Fatalf("dialing %s, want %s", b.URL.Host, l.Addr())
+	}
+	b.SetAlive(false)
+	serverPool.InitialHealthCheck()
+	if !b.IsAlive() {
+		t.Fatal("health check marked the IPv6 backend down")
+	}
+	w := httptest.NewRecorder()
+	lb(w, httptest.NewRequest(http.MethodGet, "/room/1/state", nil))
+	if body, _ := ioutil.ReadAll(w.Body); w.Code != http.StatusOK || string(body) != "v6 /room/1/state" {
+		t.Fatalf("got %d %q from the IPv6 backend", w.Code, body)
+	}
+	backend.Close()
+	serverPool.InitialHealthCheck()
+	if b.IsAlive() {
+		t.Fatal("health check kept the closed IPv6 backend up")
+	}
+}
+
+func TestNextPeerBounded(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int // backends in the pool at each stage
+		start uint64
+	}{
+		{"fixed", []int{3}, 0},
+		{"grown", []int{3, 5}, 0},
+		{"shrunk", []int{5, 2}, 0},
+		{"down to one", []int{4, 1, 3}, 0},
+		{"near the wrap", []int{3}, ^uint64(0) - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pool ServerPool
+			pool.current = tt.start
+			for _, size := range tt.sizes {
+				backends := make([]*Backend, size)
+				index := make(map[*Backend]int, size)
+				for i := range backends {
+					b, err := buildBackend(fmt.Sprintf("localhost:%d", 9101+i))
+					if err != nil {
+						t.Fatal(err)
+					}
+					backends[i] = b
+					index[b] = i
+				}
+				pool.mux.Lock()
+				pool.setBackends(backends)
+				pool.mux.Unlock()
+				if pool.current >= uint64(size) {
+					t.Fatalf("current %d after resizing to %d", pool.current, size)
+				}
+				// concurrent rounds still spread evenly
+				const rounds = 100
+				counts := make([]int64, size)
+				var wg sync.WaitGroup
+				for g := 0; g < 4; g++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < rounds*size/4; i++ {
+							idx, ok := index[pool.GetNextPeer()]
+							if !ok {
+								t.Errorf("picked a backend out of the %d in the pool", size)
+								return
+							}
+							atomic.AddInt64(&counts[idx], 1)
+						}
+					}()
+				}
+				wg.Wait()
+				if current := atomic.LoadUint64(&pool.current); current >= uint64(size) {
+					t.Fatalf("current %d out of %d backends", current, size)
+				}
+				for idx, n := range counts {
+					if n != rounds {
+						t.Fatalf("index %d picked %d times out of %d rounds of %d", idx, n, rounds, size)
+					}
+				}
+			}
+		})
+	}
+}
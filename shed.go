@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Past the soft limits a share of new rooms is turned away, past the hard
+// limits all of them are, while existing rooms keep being served. 0 disables a limit.
+var (
+	shedConnsSoft      = envInt("SHED_CONNS_SOFT", 0)
+	shedConnsHard      = envInt("SHED_CONNS_HARD", 0)
+	shedGoroutinesSoft = envInt("SHED_GOROUTINES_SOFT", 0)
+	shedGoroutinesHard = envInt("SHED_GOROUTINES_HARD", 0)
+)
+
+// shedFraction is the share of new rooms turned away past a soft limit
+var shedFraction = envFloat("SHED_FRACTION", 0.5)
+
+// shedRetryAfter is sent to shed clients as Retry-After
+var shedRetryAfter = envDuration("SHED_RETRY_AFTER", 5*time.Second)
+
+// openConns counts the client connections held by the public server
+var openConns int64
+
+// trackConn keeps openConns up to date, set as the server's ConnState hook
+func trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&openConns, 1)
+	case http.StateClosed, http.StateHijacked:
+		// hijacked websockets are counted by their backend
+		atomic.AddInt64(&openConns, -1)
+	}
+}
+
+// currentConns returns the client connections and websockets open
+func currentConns() int64 {
+	conns := atomic.LoadInt64(&openConns)
+	for _, b := range serverPool.Backends() {
+		conns += b.ActiveConns()
+	}
+	return conns
+}
+
+// over returns true when a limit is enabled and value reached it
+func over(value int64, limit int) bool {
+	return limit > 0 && value >= int64(limit)
+}
+
+// shouldShed returns true when a new room should be turned away
+func shouldShed() bool {
+	if shedConnsSoft <= 0 && shedConnsHard <= 0 && shedGoroutinesSoft <= 0 && shedGoroutinesHard <= 0 {
+		return false
+	}
+	conns, goroutines := currentConns(), int64(runtime.NumGoroutine())
+	if over(conns, shedConnsHard) || over(goroutines, shedGoroutinesHard) {
+		return true
+	}
+	if over(conns, shedConnsSoft) || over(goroutines, shedGoroutinesSoft) {
+		return rand.Float64() < shedFraction
+	}
+	return false
+}
+
+// shed turns a request away, asking the client to come back later
+func shed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(shedRetryAfter.Seconds())))
+	writeError(w, errOverloaded)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setShedLimits sets the shedding limits, returning their restore
+func setShedLimits(connsSoft, connsHard, goroutinesSoft, goroutinesHard int, fraction float64) (restore func()) {
+	oldConnsSoft, oldConnsHard := shedConnsSoft, shedConnsHard
+	oldGoroutinesSoft, oldGoroutinesHard := shedGoroutinesSoft, shedGoroutinesHard
+	oldFraction := shedFraction
+	shedConnsSoft, shedConnsHard = connsSoft, connsHard
+	shedGoroutinesSoft, shedGoroutinesHard = goroutinesSoft, goroutinesHard
+	shedFraction = fraction
+	return func() {
+		shedConnsSoft, shedConnsHard = oldConnsSoft, oldConnsHard
+		shedGoroutinesSoft, shedGoroutinesHard = oldGoroutinesSoft, oldGoroutinesHard
+		shedFraction = oldFraction
+	}
+}
+
+func TestShouldShed(t *testing.T) {
+	defer setPool(t, "127.0.0.1:1")()
+	defer func(conns int64) { atomic.StoreInt64(&openConns, conns) }(atomic.LoadInt64(&openConns))
+	// goroutine limits far below and far above what any test run holds
+	const few, many = 1, 1 << 20
+	tests := []struct {
+		name           string
+		conns          int64
+		connsSoft      int
+		connsHard      int
+		goroutinesSoft int
+		goroutinesHard int
+		fraction       float64
+		shed           bool
+	}{
+		{"no limits", 1000, 0, 0, 0, 0, 1, false},
+		{"under the limits", 10, 50, 100, many, many, 1, false},
+		{"soft limit sheds the fraction", 50, 50, 100, 0, 0, 1, true},
+		{"soft limit with nothing to shed", 99, 50, 100, 0, 0, 0, false},
+		{"hard limit sheds all", 100, 50, 100, 0, 0, 0, true},
+		{"hard limit alone", 100, 0, 100, 0, 0, 0, true},
+		{"goroutines past the soft limit", 0, 0, 0, few, 0, 1, true},
+		{"goroutines past the soft limit with nothing to shed", 0, 0, 0, few, 0, 0, false},
+		{"goroutines past the hard limit", 0, 0, 0, 0, few, 0, true},
+		{"goroutines under the limits", 0, 0, 0, many, many, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setShedLimits(tt.connsSoft, tt.connsHard, tt.goroutinesSoft, tt.goroutinesHard, tt.fraction)()
+			atomic.StoreInt64(&openConns, tt.conns)
+			if shed := shouldShed(); shed != tt.shed {
+				t.Fatalf("shouldShed() = %v, want %v", shed, tt.shed)
+			}
+		})
+	}
+}
+
+func TestShedFraction(t *testing.T) {
+	defer setPool(t, "127.0.0.1:1")()
+	defer func(conns int64) { atomic.StoreInt64(&openConns, conns) }(atomic.LoadInt64(&openConns))
+	defer setShedLimits(10, 100, 0, 0, 0.25)()
+	atomic.StoreInt64(&openConns, 50)
+	const rooms = 10000
+	shed := 0
+	for i := 0; i < rooms; i++ {
+		if shouldShed() {
+			shed++
+		}
+	}
+	if share := float64(shed) / rooms; share < 0.2 || share > 0.3 {
+		t.Fatalf("shed %d of %d rooms, want about a quarter", shed, rooms)
+	}
+}
+
+func TestShedKeepsExistingRooms(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(conns int64) { atomic.StoreInt64(&openConns, conns) }(atomic.LoadInt64(&openConns))
+	defer func(after time.Duration) { shedRetryAfter = after }(shedRetryAfter)
+	shedRetryAfter = 7 * time.Second
+	defer setShedLimits(0, 100, 0, 0, 0)()
+	tests := []struct {
+		name       string
+		conns      int64
+		method     string
+		path       string
+		code       int
+		retryAfter string
+	}{
+		{"new room under the limit", 99, http.MethodPost, "/room", http.StatusOK, ""},
+		{"new room at the limit", 100, http.MethodPost, "/room", http.StatusServiceUnavailable, "7"},
+		{"existing room at the limit", 100, http.MethodGet, "/room/1/state", http.StatusOK, ""},
+		{"new room past the limit", 5000, http.MethodPost, "/room", http.StatusServiceUnavailable, "7"},
+		{"existing room past the limit", 5000, http.MethodGet, "/room/1/state", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt64(&openConns, tt.conns)
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
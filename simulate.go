@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync/atomic"
+)
+
+// simulation replays request paths against a copy of the pool's selection
+// state, new rooms are placed as the strategy would place them one after the
+// other while nothing is registered or proxied
+type simulation struct {
+	strategy string
+	pools    map[string]*ServerPool
+	load     map[*Backend]int64 // rooms placed on top of each backend's room load
+}
+
+func newSimulation(strategy string) *simulation {
+	return &simulation{strategy: strategy, pools: make(map[string]*ServerPool), load: make(map[*Backend]int64)}
+}
+
+// pool returns the copy of the named pool the simulation picks from, its
+// rotation starting where the real one is
+func (s *simulation) pool(name string) *ServerPool {
+	if pool, ok := s.pools[name]; ok {
+		return pool
+	}
+	real := &serverPool
+	if name != "" {
+		real = serverPool.Pool(name)
+	}
+	var pool *ServerPool
+	if real != nil {
+		backends := real.Backends()
+		pool = newSubPool(backends)
+		pool.local = localPool(backends)
+		pool.current = atomic.LoadUint64(&real.current)
+	}
+	s.pools[name] = pool
+	return pool
+}
+
+// route returns the backend the request would go to, nil with the reason it
+// would be refused. New rooms, rule-routed and passthrough requests move the
+// copies' rotation and load along, existing rooms go to their owner.
+func (s *simulation) route(r *http.Request) (*Backend, string) {
+	class := classifyRoute(r.URL.Path)
+	var peer *Backend
+	switch rule := routingRules.Match(r); {
+	case rule != nil && class != RouteAction && class != RouteConnect:
+		if rule.backend != "" {
+			if peer = serverPool.GetBackend(rule.backend); peer == nil {
+				return nil, errNoServer.Error()
+			}
+			if !peer.IsAlive() {
+				return nil, errUnavailable.Error()
+			}
+			break
+		}
+		pool := s.pool(rule.pool)
+		if pool == nil {
+			return nil, errNoServer.Error()
+		}
+		strategy := rule.strategy
+		if strategy == "" {
+			strategy = s.strategy
+		}
+		peer = s.pick(pool, r, strategy)
+	case class == "" && unmatchedPolicy == UnmatchedPassThrough && defaultBackend == "":
+		// passed through round-robin like defaultPeer does
+		if pool := s.pool(""); pool != nil {
+			peer = pool.GetNextPeer()
+		}
+	case class == RouteCreate && shardKey(r) == "":
+		if name := trafficSplit.Pick(); name != "" {
+			if pool := s.pool(name); pool != nil {
+				peer = s.pick(pool, r, s.strategy)
+			}
+		}
+		if peer == nil {
+			peer = s.pick(s.pool(""), r, s.strategy)
+		}
+	default:
+		// rooms, shards and the default backend go where a dry run says, the
+		// strategy doesn't move them
+		d, err := route(r)
+		if err != nil {
+			return nil, err.Error()
+		}
+		return d.Backend, ""
+	}
+	if peer == nil {
+		return nil, errUnavailable.Error()
+	}
+	if class == RouteCreate {
+		s.load[peer] += int64(roomCost(r))
+	}
+	return peer, ""
+}
+
+// pick places a new room within pool with strategy
+func (s *simulation) pick(pool *ServerPool, r *http.Request, strategy string) *Backend {
+	// the copy's rotation moves on, without the selection metrics of a live pick
+	switch strategy {
+	case StrategyWeighted:
+		return pool.GetWeightedPeer()
+	case StrategyIPHash:
+		if ip := clientIP(r); ip != nil {
+			return pool.GetByClient(ip)
+		}
+	case StrategyLeastLoad:
+		return s.leastLoaded(pool)
+	}
+	return pool.GetNextPeer()
+}
+
+// leastLoaded scores backends like GetLeastLoaded, with the rooms the
+// simulation placed on top of their load
+func (s *simulation) leastLoaded(pool *ServerPool) *Backend {
+	return pool.preferLocal(func(p *ServerPool) *Backend {
+		var best, fallback *Backend
+		var bestScore float64
+		for _, b := range p.Backends() {
+			if !b.takesNewRooms() {
+				continue
+			}
+			if b.onlyAsFallback() {
+				if fallback == nil {
+					fallback = b
+				}
+				continue
+			}
+			score := float64(b.roomLoad.Sum()+s.load[b]) / b.EffectiveWeight()
+			if capacity := b.Capacity(); capacity > 0 {
+				score /= float64(capacity)
+			}
+			if best == nil || score < bestScore {
+				best, bestScore = b, score
+			}
+		}
+		if best == nil {
+			return fallback
+		}
+		return best
+	})
+}
+
+// simulatedBackend is the share of the sample a backend got
+type simulatedBackend struct {
+	ID     string  `json:"id"`
+	Weight int     `json:"weight"`
+	Count  int     `json:"count"`
+	Share  float64 `json:"share"`
+}
+
+// simulationResult is the distribution of a sample over the pool. Balance
+// is the largest count per unit of weight over the mean, 1 when traffic is
+// spread by weight, and spread its coefficient of variation.
+type simulationResult struct {
+	Strategy string             `json:"strategy"`
+	Requests int                `json:"requests"`
+	Backends []simulatedBackend `json:"backends"`
+	Refused  map[string]int     `json:"refused"`
+	Balance  float64            `json:"balance"`
+	Spread   float64            `json:"spread"`
+}
+
+// simulate distributes paths over the pool with strategy
+func simulate(paths []string, strategy string) simulationResult {
+	sim := newSimulation(strategy)
+	counts := make(map[*Backend]int)
+	result := simulationResult{Strategy: strategy, Requests: len(paths), Refused: make(map[string]int)}
+	for _, path := range paths {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			result.Refused[err.Error()]++
+			continue
+		}
+		req = withDryRun(req)
+		peer, reason := sim.route(req)
+		if peer == nil {
+			result.Refused[reason]++
+			continue
+		}
+		counts[peer]++
+	}
+	backends := serverPool.Backends()
+	var sum, sumSquares float64
+	max := 0.0
+	for _, b := range backends {
+		count := counts[b]
+		share := 0.0
+		if len(paths) > 0 {
+			share = float64(count) / float64(len(paths))
+		}
+		result.Backends = append(result.Backends, simulatedBackend{ID: b.ID, Weight: b.GetWeight(), Count: count, Share: share})
+		perWeight := float64(count) / float64(b.GetWeight())
+		sum += perWeight
+		sumSquares += perWeight * perWeight
+		max = math.Max(max, perWeight)
+	}
+	if n := float64(len(backends)); n > 0 && sum > 0 {
+		mean := sum / n
+		result.Balance = max / mean
+		result.Spread = math.Sqrt(math.Max(sumSquares/n-mean*mean, 0)) / mean
+	}
+	return result
+}
+
+// simulateHandler reports how a sample of request paths would spread over
+// the backends on POST /admin/simulate, e.g. {"paths":["/api/room"],
+// "strategy":"least-load"}, with LB_STRATEGY unless given. Nothing is
+// proxied, registered or counted.
+func simulateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var sample struct {
+		Paths    []string `json:"paths"`
+		Strategy string   `json:"strategy"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&sample); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sample.Strategy == "" {
+		sample.Strategy = lbStrategy
+	}
+	if !isValidStrategy(sample.Strategy) {
+		http.Error(w, "Unknown strategy "+sample.Strategy, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, simulate(sample.Paths, sample.Strategy))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	rooms := func(n int) []string {
+		paths := make([]string, n)
+		for i := range paths {
+			paths[i] = "/room"
+		}
+		return paths
+	}
+	tests := []struct {
+		name     string
+		strategy string
+		specs    []string
+		down     []string
+		load     int // rooms already on a
+		paths    []string
+		counts   map[string]int
+		refused  map[string]int
+		balance  float64
+	}{
+		{"round robin", StrategyRoundRobin, []string{"localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c"},
+			nil, 0, rooms(6), map[string]int{"a": 2, "b": 2, "c": 2}, map[string]int{}, 1},
+		{"by weight", StrategyWeighted, []string{"localhost:9101?name=a&weight=2", "localhost:9102?name=b"},
+			nil, 0, rooms(6), map[string]int{"a": 4, "b": 2}, map[string]int{}, 1},
+		{"least load", StrategyLeastLoad, []string{"localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c"},
+			nil, 4, rooms(6), map[string]int{"a": 0, "b": 3, "c": 3}, map[string]int{}, 1.5},
+		{"backend down", StrategyRoundRobin, []string{"localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c"},
+			[]string{"c"}, 0, rooms(4), map[string]int{"a": 2, "b": 2, "c": 0}, map[string]int{}, 1.5},
+		{"refused", StrategyRoundRobin, []string{"localhost:9101?name=a", "localhost:9102?name=b"},
+			[]string{"a", "b"}, 0, append(rooms(2), "/nothing"), map[string]int{"a": 0, "b": 0},
+			map[string]int{errUnavailable.Message: 2, errNoRoute.Message: 1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, tt.specs...)()
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			for _, id := range tt.down {
+				serverPool.GetBackend(id).SetAlive(false)
+			}
+			serverPool.GetBackend("a").roomLoad.Add(tt.load)
+			body, _ := json.Marshal(map[string]interface{}{"paths": tt.paths, "strategy": tt.strategy})
+
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(http.MethodPost, "/simulate", strings.NewReader(string(body))))
+			if w.Code != http.StatusOK {
+				t.Fatalf("answered %d: %s", w.Code, w.Body)
+			}
+			var result simulationResult
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			counts := make(map[string]int)
+			for _, b := range result.Backends {
+				counts[b.ID] = b.Count
+			}
+			if !reflect.DeepEqual(counts, tt.counts) || !reflect.DeepEqual(result.Refused, tt.refused) {
+				t.Fatalf("spread %v refusing %v, want %v refusing %v", counts, result.Refused, tt.counts, tt.refused)
+			}
+			if result.Requests != len(tt.paths) || result.Strategy != tt.strategy {
+				t.Fatalf("result for %d requests with %s", result.Requests, result.Strategy)
+			}
+			if result.Balance < tt.balance-0.001 || result.Balance > tt.balance+0.001 {
+				t.Fatalf("balance %.3f, want %.3f", result.Balance, tt.balance)
+			}
+
+			// nothing is placed for real
+			if peer := serverPool.PeekNextPeer(); peer != nil && peer.ID != "a" && len(tt.down) == 0 {
+				t.Errorf("rotation moved on to %s", peer.ID)
+			}
+			if load := serverPool.GetBackend("a").roomLoad.Sum(); load != int64(tt.load) {
+				t.Errorf("a carries %d rooms, want %d", load, tt.load)
+			}
+			if rooms := serverPool.rooms.Rooms(); len(rooms) != 0 {
+				t.Errorf("rooms registered: %v", rooms)
+			}
+		})
+	}
+}
+
+func TestSimulateMovesAlong(t *testing.T) {
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(policy, backend string) { unmatchedPolicy, defaultBackend = policy, backend }(unmatchedPolicy, defaultBackend)
+	unmatchedPolicy, defaultBackend = UnmatchedPassThrough, ""
+	tests := []struct {
+		name   string
+		rules  []string
+		path   string
+		load   int // rooms already on a
+		counts map[string]int
+	}{
+		{"passthrough", nil, "/static/app.js", 0, map[string]int{"a": 2, "b": 2, "c": 2}},
+		{"rule with a strategy", []string{"/room?strategy=least-load"}, "/room", 4, map[string]int{"a": 0, "b": 3, "c": 3}},
+		{"rule with the simulated strategy", []string{"/static/*?pool=beta"}, "/static/app.js", 0, map[string]int{"a": 0, "b": 3, "c": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setRoutingRules(t, tt.rules...)()
+			defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b&pool=beta", "localhost:9103?name=c&pool=beta")()
+			for serverPool.PeekNextPeer().ID != "a" {
+				serverPool.GetNextPeer()
+			}
+			serverPool.GetBackend("a").roomLoad.Add(tt.load)
+			paths := make([]string, 6)
+			for i := range paths {
+				paths[i] = tt.path
+			}
+			result := simulate(paths, StrategyRoundRobin)
+			counts := make(map[string]int)
+			for _, b := range result.Backends {
+				counts[b.ID] = b.Count
+			}
+			if !reflect.DeepEqual(counts, tt.counts) || len(result.Refused) != 0 {
+				t.Fatalf("spread %v refusing %v, want %v", counts, result.Refused, tt.counts)
+			}
+		})
+	}
+}
+
+func TestSimulateHandlerRejects(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a")()
+	tests := []struct {
+		method string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "paths", http.StatusBadRequest},
+		{http.MethodPost, `{"paths":["/room"],"strategy":"random"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		adminHandler(w, httptest.NewRequest(tt.method, "/simulate", strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%s %q answered %d, want %d", tt.method, tt.body, w.Code, tt.code)
+		}
+	}
+}
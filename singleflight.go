@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+)
+
+// flightGroup runs one resolution per key at a time, callers asking for a
+// key already being resolved wait and share its result
+type flightGroup struct {
+	mux   sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg   sync.WaitGroup
+	peer *Backend
+}
+
+// Do returns the result of fn for key, only running it when no call for key
+// is in flight
+func (g *flightGroup) Do(key string, fn func() *Backend) *Backend {
+	g.mux.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mux.Unlock()
+		c.wg.Wait()
+		return c.peer
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mux.Unlock()
+
+	defer func() {
+		g.mux.Lock()
+		delete(g.calls, key)
+		g.mux.Unlock()
+		c.wg.Done()
+	}()
+	c.peer = fn()
+	return c.peer
+}
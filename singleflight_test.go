@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalesces(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a")()
+	peer := serverPool.GetBackend("a")
+	tests := []struct {
+		name    string
+		callers int
+		keys    int // callers are spread over
+		calls   int64
+	}{
+		{"alone", 1, 1, 1},
+		{"same room", 10, 1, 1},
+		{"crowd in the same room", 200, 1, 1},
+		{"different rooms", 10, 10, 10},
+		{"a few rooms", 60, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g flightGroup
+			var calls, arrived int64
+			var wg sync.WaitGroup
+			results := make(chan *Backend, tt.callers)
+			for i := 0; i < tt.callers; i++ {
+				wg.Add(1)
+				go func(key string) {
+					defer wg.Done()
+					atomic.AddInt64(&arrived, 1)
+					results <- g.Do(key, func() *Backend {
+						atomic.AddInt64(&calls, 1)
+						// hold the lookup until every caller is in
+						for atomic.LoadInt64(&arrived) < int64(tt.callers) {
+							time.Sleep(time.Millisecond)
+						}
+						time.Sleep(20 * time.Millisecond)
+						return peer
+					})
+				}(fmt.Sprintf("room-%d", i%tt.keys))
+			}
+			wg.Wait()
+			close(results)
+			for result := range results {
+				if result != peer {
+					t.Fatalf("caller got %v, want the looked up peer", idOf(result))
+				}
+			}
+			if n := atomic.LoadInt64(&calls); n != tt.calls {
+				t.Fatalf("lookup ran %d times, want %d", n, tt.calls)
+			}
+			// once done, the next lookup runs again
+			g.Do("room-0", func() *Backend { atomic.AddInt64(&calls, 1); return peer })
+			if n := atomic.LoadInt64(&calls); n != tt.calls+1 {
+				t.Fatalf("lookup after the crowd ran %d times in all, want %d", n, tt.calls+1)
+			}
+		})
+	}
+}
+
+func TestGetPeerConcurrentSameRoom(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c")()
+	// hashed ids go through the bounded ring, which moves with the load
+	defer setRoomRoutes(t, "", RoomIdUUID, defaultRoomIdSource)()
+	const roomId = "0b8c43d6-5f6a-4d0e-9a51-0c2f1e3d7a42"
+	const callers = 100
+	var wg sync.WaitGroup
+	peers := make([]*Backend, callers)
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			peers[i] = serverPool.GetPeer(roomId)
+		}(i)
+	}
+	wg.Wait()
+	for i, peer := range peers {
+		if peer == nil || peer != peers[0] {
+			t.Fatalf("caller %d got %s, caller 0 got %s", i, idOf(peer), idOf(peers[0]))
+		}
+	}
+	if recorded := serverPool.rooms.Lookup(roomId); recorded != peers[0] {
+		t.Fatalf("registry holds %s, want %s", idOf(recorded), idOf(peers[0]))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TrafficSplit shares new rooms between named pools of backends by weight,
+// e.g. blue and green during a deploy. Existing rooms stay where they are.
+type TrafficSplit struct {
+	mux     sync.RWMutex
+	weights map[string]int
+}
+
+var trafficSplit TrafficSplit
+
+// parseTrafficSplit parses `pool=weight` items like blue=90,green=10
+func parseTrafficSplit(items []string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range items {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid traffic split %q, expected pool=weight", item)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid traffic split weight %q: %v", item, err)
+		}
+		weights[parts[0]] = weight
+	}
+	return weights, nil
+}
+
+// Set replaces the weights, they must not be negative and can't all be 0
+func (t *TrafficSplit) Set(weights map[string]int) error {
+	total := 0
+	for pool, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight %d for pool %s", weight, pool)
+		}
+		total += weight
+	}
+	if len(weights) > 0 && total == 0 {
+		return fmt.Errorf("at least one pool needs a weight")
+	}
+	t.mux.Lock()
+	t.weights = weights
+	t.mux.Unlock()
+	return nil
+}
+
+// Weights returns a copy of the current weights
+func (t *TrafficSplit) Weights() map[string]int {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	weights := make(map[string]int, len(t.weights))
+	for pool, weight := range t.weights {
+		weights[pool] = weight
+	}
+	return weights
+}
+
+// Pick returns the pool of a new room, empty when traffic isn't split
+func (t *TrafficSplit) Pick() string {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	total := 0
+	pools := make([]string, 0, len(t.weights))
+	for pool, weight := range t.weights {
+		total += weight
+		pools = append(pools, pool)
+	}
+	if total == 0 {
+		return ""
+	}
+	// a stable order keeps the draw fair whatever the map iteration order
+	sort.Strings(pools)
+	n := rand.Intn(total)
+	for _, pool := range pools {
+		if n < t.weights[pool] {
+			return pool
+		}
+		n -= t.weights[pool]
+	}
+	return ""
+}
+
+// splitHandler shows the traffic split on GET and replaces it on PUT with a
+// JSON object of pool weights, e.g. {"blue":0,"green":100}
+func splitHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var weights map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			http.Error(w, "Invalid weights: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for pool := range weights {
+			if serverPool.Pool(pool) == nil {
+				http.Error(w, "No backend in pool "+pool, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := trafficSplit.Set(weights); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Traffic split set to %v\n", weights)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, trafficSplit.Weights())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var splitPool = []string{
+	"localhost:9101?name=blue1&pool=blue", "localhost:9102?name=blue2&pool=blue",
+	"localhost:9103?name=green1&pool=green", "localhost:9104?name=green2&pool=green",
+}
+
+// setSplit sets the traffic split, returning its restore
+func setSplit(t *testing.T, weights map[string]int) (restore func()) {
+	t.Helper()
+	old := trafficSplit.Weights()
+	if err := trafficSplit.Set(weights); err != nil {
+		t.Fatal(err)
+	}
+	return func() { trafficSplit.Set(old) }
+}
+
+func TestParseTrafficSplit(t *testing.T) {
+	tests := []struct {
+		items []string
+		want  map[string]int
+		err   bool
+	}{
+		{nil, map[string]int{}, false},
+		{[]string{"blue=90", "green=10"}, map[string]int{"blue": 90, "green": 10}, false},
+		{[]string{"green=100"}, map[string]int{"green": 100}, false},
+		{[]string{"blue"}, nil, true},
+		{[]string{"blue=most"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTrafficSplit(tt.items)
+		if (err != nil) != tt.err || (!tt.err && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseTrafficSplit(%v) = %v, %v, want %v and error %v", tt.items, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestTrafficSplitRatio(t *testing.T) {
+	defer setPool(t, splitPool...)()
+	tests := []struct {
+		name    string
+		weights map[string]int
+		green   float64 // share of new rooms in green
+	}{
+		{"not split", map[string]int{}, 0.5},
+		{"all blue", map[string]int{"blue": 100, "green": 0}, 0},
+		{"canary", map[string]int{"blue": 90, "green": 10}, 0.1},
+		{"halfway", map[string]int{"blue": 1, "green": 1}, 0.5},
+		{"cut over", map[string]int{"blue": 0, "green": 100}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setSplit(t, tt.weights)()
+			const rooms = 4000
+			green := 0
+			for i := 0; i < rooms; i++ {
+				peer := newRoomPeer(httptest.NewRequest(http.MethodPost, "/room", nil))
+				if peer == nil {
+					t.Fatal("no backend for a new room")
+				}
+				if peer.Pool == "green" {
+					green++
+				}
+			}
+			if share := float64(green) / rooms; share < tt.green-0.03 || share > tt.green+0.03 {
+				t.Fatalf("%.3f of new rooms went green, want %.2f", share, tt.green)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitFallsBack(t *testing.T) {
+	defer setPool(t, splitPool...)()
+	defer setSplit(t, map[string]int{"green": 100})()
+	for _, b := range serverPool.Backends() {
+		if b.Pool == "green" {
+			b.SetAlive(false)
+		}
+	}
+	// a pool with nothing up doesn't stop rooms from being created
+	for i := 0; i < 10; i++ {
+		if peer := newRoomPeer(httptest.NewRequest(http.MethodPost, "/room", nil)); peer == nil || peer.Pool != "blue" {
+			t.Fatalf("new room went to %q, want a blue backend", idOf(peer))
+		}
+	}
+}
+
+func TestCutoverKeepsExistingRooms(t *testing.T) {
+	defer setPool(t, splitPool...)()
+	defer setSplit(t, map[string]int{"blue": 100})()
+	rooms := make(map[string]string)
+	for _, roomId := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		rooms[roomId] = idOf(serverPool.GetPeer(roomId))
+	}
+	trafficSplit.Set(map[string]int{"green": 100})
+	for roomId, id := range rooms {
+		if got := idOf(serverPool.GetPeer(roomId)); got != id {
+			t.Errorf("room %s moved from %s to %s on cutover", roomId, id, got)
+		}
+	}
+}
+
+func TestSplitHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		code   int
+		split  map[string]int // afterwards
+	}{
+		{"show", http.MethodGet, ``, http.StatusOK, map[string]int{"blue": 90, "green": 10}},
+		{"shift", http.MethodPut, `{"blue":50,"green":50}`, http.StatusOK, map[string]int{"blue": 50, "green": 50}},
+		{"cut over", http.MethodPut, `{"blue":0,"green":100}`, http.StatusOK, map[string]int{"blue": 0, "green": 100}},
+		{"stop splitting", http.MethodPut, `{}`, http.StatusOK, map[string]int{}},
+		{"unknown pool", http.MethodPut, `{"red":100}`, http.StatusBadRequest, map[string]int{"blue": 90, "green": 10}},
+		{"negative weight", http.MethodPut, `{"blue":-1,"green":100}`, http.StatusBadRequest, map[string]int{"blue": 90, "green": 10}},
+		{"no weight at all", http.MethodPut, `{"blue":0,"green":0}`, http.StatusBadRequest, map[string]int{"blue": 90, "green": 10}},
+		{"not json", http.MethodPut, `blue=100`, http.StatusBadRequest, map[string]int{"blue": 90, "green": 10}},
+		{"wrong method", http.MethodPost, `{"green":100}`, http.StatusMethodNotAllowed, map[string]int{"blue": 90, "green": 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, splitPool...)()
+			defer setSplit(t, map[string]int{"blue": 90, "green": 10})()
+			w := httptest.NewRecorder()
+			adminHandler(w, httptest.NewRequest(tt.method, "/admin/split", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if got := trafficSplit.Weights(); !reflect.DeepEqual(got, tt.split) {
+				t.Fatalf("split %v, want %v", got, tt.split)
+			}
+		})
+	}
+}
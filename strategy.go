@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Strategies picking the backend of new rooms
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyLeastLoad  = "least-load"
+	StrategyIPHash     = "ip-hash"
+	StrategyWeighted   = "weighted-round-robin"
+)
+
+// lbStrategy picks the backend of new rooms
+var lbStrategy = envString("LB_STRATEGY", StrategyRoundRobin)
+
+// roomCostHeader carries how expensive a new room is, e.g. its max players
+var roomCostHeader = envString("ROOM_COST_HEADER", "X-Room-Cost")
+
+// maxRoomCost caps the cost a single room creation can claim
+var maxRoomCost = envInt("MAX_ROOM_COST", 100)
+
+// roomLoadWindow is how long a created room counts towards its backend's load
+var roomLoadWindow = envDuration("ROOM_LOAD_WINDOW", 10*time.Minute)
+
+// isValidStrategy returns true for the supported LB_STRATEGY values
+func isValidStrategy(strategy string) bool {
+	return strategy == StrategyRoundRobin || strategy == StrategyLeastLoad || strategy == StrategyIPHash ||
+		strategy == StrategyWeighted
+}
+
+// newRoomPeer picks the backend of a new room, the one the client is sticky
+// to while its affinity lasts, or else with the configured strategy
+func newRoomPeer(r *http.Request) *Backend {
+	if clientAffinityTTL <= 0 || lbStrategy == StrategyIPHash {
+		return pickRoomPeer(r)
+	}
+	ip := clientIP(r)
+	if ip == nil {
+		return pickRoomPeer(r)
+	}
+	if peer := clientAffinity.Lookup(ip.String()); peer != nil && peer.takesNewRooms() && peer != excludedBackend(r) {
+		return peer
+	}
+	peer := pickRoomPeer(r)
+	if peer != nil && !isDryRun(r) {
+		clientAffinity.Record(ip.String(), peer)
+	}
+	return peer
+}
+
+// pickRoomPeer picks the backend of a new room, within the pool the traffic
+// split picks if any, with the configured strategy
+func pickRoomPeer(r *http.Request) *Backend {
+	if name := trafficSplit.Pick(); name != "" {
+		if pool := serverPool.Pool(name); pool != nil {
+			if peer := pickExcluding(pool, r, func(p *ServerPool) *Backend { return newRoomPeerIn(p, r) }); peer != nil {
+				return peer
+			}
+		}
+		// a pool with nothing available doesn't stop rooms from being created
+		log.Printf("No backend of pool %s can take a new room\n", name)
+	}
+	return pickExcluding(&serverPool, r, func(p *ServerPool) *Backend { return newRoomPeerIn(p, r) })
+}
+
+// newRoomPeerIn picks the backend of a new room among the backends of pool
+func newRoomPeerIn(pool *ServerPool, r *http.Request) *Backend {
+	return pickWithStrategy(pool, r, lbStrategy)
+}
+
+// pickWithStrategy picks a backend among the backends of pool with strategy
+func pickWithStrategy(pool *ServerPool, r *http.Request, strategy string) *Backend {
+	switch strategy {
+	case StrategyLeastLoad:
+		return selectPeer(r, strategy, pool.GetLeastLoaded, pool.GetLeastLoaded)
+	case StrategyWeighted:
+		return selectPeer(r, strategy, pool.GetWeightedPeer, pool.PeekWeightedPeer)
+	case StrategyIPHash:
+		// players without a known address are spread like any other room
+		if ip := clientIP(r); ip != nil {
+			get := func() *Backend { return pool.GetByClient(ip) }
+			return selectPeer(r, strategy, get, get)
+		}
+	}
+	return selectPeer(r, StrategyRoundRobin, pool.GetNextPeer, pool.PeekNextPeer)
+}
+
+// roomCost returns the cost hint of a room creation, 1 when missing or invalid
+func roomCost(r *http.Request) int {
+	cost, err := strconv.Atoi(r.Header.Get(roomCostHeader))
+	if err != nil || cost < 1 {
+		return 1
+	}
+	if cost > maxRoomCost {
+		return maxRoomCost
+	}
+	return cost
+}
+
+// roomLoad sums the cost of the rooms a backend took within roomLoadWindow
+type roomLoad struct {
+	mux     sync.Mutex
+	entries []roomLoadEntry
+	total   int64
+}
+
+type roomLoadEntry struct {
+	at   time.Time
+	cost int64
+}
+
+// Add counts a new room of the given cost
+func (l *roomLoad) Add(cost int) {
+	l.mux.Lock()
+	l.expire()
+	l.entries = append(l.entries, roomLoadEntry{at: time.Now(), cost: int64(cost)})
+	l.total += int64(cost)
+	l.mux.Unlock()
+}
+
+// Sum returns the cost of the rooms taken within the window
+func (l *roomLoad) Sum() int64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.expire()
+	return l.total
+}
+
+// expire drops the rooms that left the window, entries are in time order
+func (l *roomLoad) expire() {
+	i := 0
+	for ; i < len(l.entries) && time.Since(l.entries[i].at) > roomLoadWindow; i++ {
+		l.total -= l.entries[i].cost
+	}
+	l.entries = l.entries[i:]
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomCost(t *testing.T) {
+	defer func(max int) { maxRoomCost = max }(maxRoomCost)
+	maxRoomCost = 100
+	tests := []struct {
+		hint string
+		cost int
+	}{
+		{"", 1},
+		{"5", 5},
+		{"100", 100},
+		{"1000", 100},
+		{"0", 1},
+		{"-3", 1},
+		{"2.5", 1},
+		{"big", 1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/room", nil)
+		if tt.hint != "" {
+			r.Header.Set(roomCostHeader, tt.hint)
+		}
+		if cost := roomCost(r); cost != tt.cost {
+			t.Errorf("roomCost(%q) = %d, want %d", tt.hint, cost, tt.cost)
+		}
+	}
+}
+
+func TestLeastLoadCountsCost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	host := strings.TrimPrefix(backend.URL, "http://")
+	defer func(strategy string) { lbStrategy = strategy }(lbStrategy)
+	lbStrategy = StrategyLeastLoad
+	tests := []struct {
+		name  string
+		specs []string
+		costs []int    // of the rooms created in order
+		want  []string // backends they land on
+	}{
+		{"cheap rooms", []string{host + "?name=a", host + "?name=b"}, []int{1, 1, 1, 1}, []string{"a", "b", "a", "b"}},
+		// a few expensive rooms weigh as much as many cheap ones
+		{"an expensive room", []string{host + "?name=a", host + "?name=b"}, []int{5, 1, 1, 1, 1, 1, 1}, []string{"a", "b", "b", "b", "b", "b", "a"}},
+		{"three backends", []string{host + "?name=a", host + "?name=b", host + "?name=c"}, []int{3, 2, 1, 1, 1}, []string{"a", "b", "c", "c", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setPool(t, tt.specs...)()
+			for i, cost := range tt.costs {
+				r := httptest.NewRequest(http.MethodPost, "/room", nil)
+				r.Header.Set(roomCostHeader, strconv.Itoa(cost))
+				w := httptest.NewRecorder()
+				lb(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("room %d: status %d", i, w.Code)
+				}
+				// only a real placement counts towards the load
+				d, err := route(withDryRun(httptest.NewRequest(http.MethodPost, "/room", nil)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i+1 < len(tt.want) && idOf(d.Backend) != tt.want[i+1] {
+					t.Fatalf("room %d would land on %q, want %q", i+1, idOf(d.Backend), tt.want[i+1])
+				}
+			}
+			var loads []string
+			total := 0
+			for _, cost := range tt.costs {
+				total += cost
+			}
+			var sum int64
+			for _, b := range serverPool.Backends() {
+				sum += b.roomLoad.Sum()
+				loads = append(loads, b.ID+"="+strconv.FormatInt(b.roomLoad.Sum(), 10))
+			}
+			if sum != int64(total) {
+				t.Fatalf("loads %v, want %d in all", loads, total)
+			}
+		})
+	}
+}
+
+func TestRoomLoadWindow(t *testing.T) {
+	defer func(window time.Duration) { roomLoadWindow = window }(roomLoadWindow)
+	roomLoadWindow = 50 * time.Millisecond
+	var l roomLoad
+	l.Add(3)
+	l.Add(4)
+	if sum := l.Sum(); sum != 7 {
+		t.Fatalf("Sum() = %d, want 7", sum)
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.Add(2)
+	if sum := l.Sum(); sum != 2 {
+		t.Fatalf("Sum() = %d after the first rooms left the window, want 2", sum)
+	}
+}
+
+// ipHashPicks returns the backend ip-hash sends each remote address to
+func ipHashPicks(remotes []string) map[string]string {
+	picks := make(map[string]string, len(remotes))
+	for _, remote := range remotes {
+		r := httptest.NewRequest(http.MethodPost, "/room", nil)
+		r.RemoteAddr = remote
+		picks[remote] = idOf(pickWithStrategy(&serverPool, r, StrategyIPHash))
+	}
+	return picks
+}
+
+func TestIPHashSticky(t *testing.T) {
+	defer func(trusted []*net.IPNet) { trustedProxies = trusted }(trustedProxies)
+	proxies, err := parseNetworks([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxies = proxies
+	defer setPool(t, "127.0.0.1:1?name=a", "127.0.0.1:2?name=b", "127.0.0.1:3?name=c", "127.0.0.1:4?name=d")()
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		same   string // the remote address whose backend it must share
+	}{
+		{"ipv4", "203.0.113.5:1234", "", "203.0.113.5:1234"},
+		{"ipv4 other port", "203.0.113.5:5678", "", "203.0.113.5:1234"},
+		{"ipv6", "[2001:db8::1]:1234", "", "[2001:db8::1]:1234"},
+		{"ipv6 other port", "[2001:db8::1]:5678", "", "[2001:db8::1]:1234"},
+		{"behind a trusted proxy", "10.0.0.2:1234", "203.0.113.5", "203.0.113.5:1234"},
+		{"behind two trusted proxies", "10.0.0.2:1234", "203.0.113.5, 10.0.0.3", "203.0.113.5:1234"},
+		{"ipv6 behind a trusted proxy", "[fd00::2]:1234", "2001:db8::1", "[2001:db8::1]:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := ipHashPicks([]string{tt.same})[tt.same]
+			for i := 0; i < 10; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/room", nil)
+				r.RemoteAddr = tt.remote
+				if tt.xff != "" {
+					r.Header.Set("X-Forwarded-For", tt.xff)
+				}
+				if got := idOf(pickWithStrategy(&serverPool, r, StrategyIPHash)); got != want || got == "" {
+					t.Fatalf("request %d went to %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIPHashAddingBackendMovesFewClients(t *testing.T) {
+	var remotes []string
+	for i := 0; i < 500; i++ {
+		remotes = append(remotes, net.JoinHostPort(net.IPv4(198, 51, byte(i>>8), byte(i)).String(), "1234"))
+		remotes = append(remotes, net.JoinHostPort(fmt.Sprintf("2001:db8::%x", i), "1234"))
+	}
+	specs := []string{"127.0.0.1:1?name=a", "127.0.0.1:2?name=b", "127.0.0.1:3?name=c", "127.0.0.1:4?name=d"}
+	restore := setPool(t, specs...)
+	before := ipHashPicks(remotes)
+	restore()
+	defer setPool(t, append(specs, "127.0.0.1:5?name=e")...)()
+	after := ipHashPicks(remotes)
+
+	moved := 0
+	for _, remote := range remotes {
+		if before[remote] == after[remote] {
+			continue
+		}
+		// clients only leave for the new backend, never between old ones
+		if after[remote] != "e" {
+			t.Fatalf("%s moved from %s to %s", remote, before[remote], after[remote])
+		}
+		moved++
+	}
+	// a fifth of the clients is fair share for the new backend
+	if share := float64(moved) / float64(len(remotes)); share < 0.1 || share > 0.35 {
+		t.Fatalf("%d of %d clients moved, want about a fifth", moved, len(remotes))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// backendMaxConns caps the connections opened to each backend, requests
+// wait for one to free up past it, 0 leaves them unlimited
+var backendMaxConns = envInt("BACKEND_MAX_CONNS", 0)
+
+// backendMaxStreams caps the requests multiplexed on each HTTP/2 connection
+// to a backend, on top of what the backend advertises. It needs a connection
+// cap, requests wait past connections times streams, 0 leaves them unlimited.
+var backendMaxStreams = envInt("BACKEND_MAX_STREAMS_PER_CONN", 0)
+
+// newTransport creates the transport a backend is proxied through
+func newTransport(b *Backend) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ExpectContinueTimeout = expectContinueTimeout
+	if b.tlsConfig != nil {
+		t.TLSClientConfig = b.tlsConfig
+	}
+	if b.proxy != nil {
+		t.DialContext = b.dialContext
+	}
+	if b.warmConns > t.MaxIdleConnsPerHost {
+		t.MaxIdleConnsPerHost = b.warmConns
+	}
+	t.MaxConnsPerHost = b.maxConns
+	// Go's HTTP/2 client only honors the stream limit the backend sends, so
+	// a smaller one is enforced on the requests in flight over all connections
+	// buildBackend rejects streams without connections
+	if b.maxStreams > 0 {
+		return &streamLimit{next: t, slots: make(chan struct{}, b.maxConns*b.maxStreams)}
+	}
+	return t
+}
+
+// streamLimit lets at most cap(slots) requests through at once, the others
+// wait for a slot or their context to be done
+type streamLimit struct {
+	next  http.RoundTripper
+	slots chan struct{}
+}
+
+func (l *streamLimit) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	// the stream stays open until the body is read to the end or closed
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { <-l.slots }}
+	return resp, nil
+}
+
+// releaseOnClose calls release once the body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackendConnLimits(t *testing.T) {
+	defer func(conns, streams int) {
+		backendMaxConns, backendMaxStreams = conns, streams
+	}(backendMaxConns, backendMaxStreams)
+	tests := []struct {
+		spec     string
+		conns    int // BACKEND_MAX_CONNS
+		streams  int // BACKEND_MAX_STREAMS_PER_CONN
+		maxConns int
+		slots    int // requests let through at once, 0 without a stream limit
+		err      bool
+	}{
+		{"localhost:9101", 0, 0, 0, 0, false},
+		{"localhost:9101", 4, 0, 4, 0, false},
+		{"localhost:9101", 4, 10, 4, 40, false},
+		{"localhost:9101?max_conns=2&max_streams=3", 4, 10, 2, 6, false},
+		{"localhost:9101?max_streams=3", 0, 0, 0, 0, true},
+		{"localhost:9101", 0, 10, 0, 0, true},
+		{"localhost:9101?max_conns=0", 4, 10, 0, 0, true},
+		{"localhost:9101?max_conns=0&max_streams=0", 4, 10, 0, 0, false},
+		{"localhost:9101?max_conns=-1", 0, 0, 0, 0, true},
+		{"localhost:9101?max_streams=many", 0, 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		backendMaxConns, backendMaxStreams = tt.conns, tt.streams
+		b, err := buildBackend(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("buildBackend(%q) error = %v, want error %v", tt.spec, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		transport := b.transport
+		slots := 0
+		if limit, ok := transport.(*streamLimit); ok {
+			transport, slots = limit.next, cap(limit.slots)
+		}
+		if got := transport.(*http.Transport).MaxConnsPerHost; got != tt.maxConns || slots != tt.slots {
+			t.Errorf("%s with %d conns and %d streams: %d conns and %d slots, want %d and %d",
+				tt.spec, tt.conns, tt.streams, got, slots, tt.maxConns, tt.slots)
+		}
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	arrived, release := make(chan struct{}, 4), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+	limit := &streamLimit{next: http.DefaultTransport, slots: make(chan struct{}, 1)}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		through bool
+	}{
+		{"first", time.Second, true},
+		{"over the limit", 50 * time.Millisecond, false},
+	}
+	var first *http.Response
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+		req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+		done := make(chan error, 1)
+		go func() {
+			resp, err := limit.RoundTrip(req.WithContext(ctx))
+			if err == nil && first == nil {
+				first = resp
+			}
+			done <- err
+		}()
+		if tt.through {
+			<-arrived
+			release <- struct{}{}
+		}
+		err := <-done
+		cancel()
+		if (err == nil) != tt.through {
+			t.Fatalf("%s request: error = %v, want through %v", tt.name, err, tt.through)
+		}
+		if !tt.through && err != context.DeadlineExceeded {
+			t.Fatalf("%s request failed with %v, want it waiting for a slot", tt.name, err)
+		}
+	}
+	select {
+	case <-arrived:
+		t.Fatal("a request over the limit reached the backend")
+	default:
+	}
+	// closing the body frees the slot
+	first.Body.Close()
+	req, _ := http.NewRequest(http.MethodGet, backend.URL, nil)
+	go func() { <-arrived; release <- struct{}{} }()
+	resp, err := limit.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(limit.slots) != 0 {
+		t.Fatalf("%d slots still taken once every body is closed", len(limit.slots))
+	}
+}
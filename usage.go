@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// usageFile is where the per backend usage is periodically written, empty disables it
+var usageFile = os.Getenv("USAGE_FILE")
+
+// usageFlushInterval is how often usageFile is rewritten
+var usageFlushInterval = envDuration("USAGE_FLUSH_INTERVAL", time.Minute)
+
+// backendUsage accumulates what was proxied to a backend since startup, in
+// is from the client to the backend and out the way back
+type backendUsage struct {
+	Requests          int64 `json:"requests"`
+	BytesIn           int64 `json:"bytes_in"`
+	BytesOut          int64 `json:"bytes_out"`
+	WebsocketBytesIn  int64 `json:"websocket_bytes_in"`
+	WebsocketBytesOut int64 `json:"websocket_bytes_out"`
+}
+
+// snapshot returns a consistent copy of each counter
+func (u *backendUsage) snapshot() backendUsage {
+	return backendUsage{
+		Requests:          atomic.LoadInt64(&u.Requests),
+		BytesIn:           atomic.LoadInt64(&u.BytesIn),
+		BytesOut:          atomic.LoadInt64(&u.BytesOut),
+		WebsocketBytesIn:  atomic.LoadInt64(&u.WebsocketBytesIn),
+		WebsocketBytesOut: atomic.LoadInt64(&u.WebsocketBytesOut),
+	}
+}
+
+// countingReader adds the bytes read through it to a counter as they go, so
+// streamed bodies and websockets are counted without being buffered
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+// countBytes wraps body so its bytes are added to count
+func countBytes(body io.ReadCloser, count *int64) io.ReadCloser {
+	if body == nil || body == http.NoBody {
+		return body
+	}
+	return &countingReader{ReadCloser: body, count: count}
+}
+
+// publishUsage hands the usage counters of b to the metrics sink
+func (b *Backend) publishUsage() {
+	if !collectingMetrics() {
+		return
+	}
+	u := b.usage.snapshot()
+	metrics.SetGauge(fmt.Sprintf("lb_backend_requests_total{backend=%q}", b.ID), float64(u.Requests))
+	metrics.SetGauge(fmt.Sprintf("lb_backend_bytes_total{backend=%q,direction=\"in\",traffic=\"http\"}", b.ID), float64(u.BytesIn))
+	metrics.SetGauge(fmt.Sprintf("lb_backend_bytes_total{backend=%q,direction=\"out\",traffic=\"http\"}", b.ID), float64(u.BytesOut))
+	metrics.SetGauge(fmt.Sprintf("lb_backend_bytes_total{backend=%q,direction=\"in\",traffic=\"websocket\"}", b.ID), float64(u.WebsocketBytesIn))
+	metrics.SetGauge(fmt.Sprintf("lb_backend_bytes_total{backend=%q,direction=\"out\",traffic=\"websocket\"}", b.ID), float64(u.WebsocketBytesOut))
+}
+
+// writeUsage replaces usageFile with the current usage of every backend
+func writeUsage() error {
+	backends := serverPool.Backends()
+	usage := make(map[string]backendUsage, len(backends))
+	for _, b := range backends {
+		usage[b.ID] = b.usage.snapshot()
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"time":     time.Now().UTC(),
+		"backends": usage,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(usageFile, data)
+}
+
+// flushUsage runs a routine writing the usage to usageFile
+func flushUsage() {
+	if usageFile == "" {
+		return
+	}
+	t := time.NewTicker(usageFlushInterval)
+	for {
+		select {
+		case <-t.C:
+			if err := writeUsage(); err != nil {
+				log.Println("Failed to write usage: ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageCountsHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		body     int
+		response int
+		streamed bool
+	}{
+		{"empty", http.MethodPost, 0, 0, false},
+		{"request body", http.MethodPost, 1000, 0, false},
+		{"response body", http.MethodPost, 0, 2500, false},
+		{"both", http.MethodPost, 300, 700, false},
+		{"streamed response", http.MethodPost, 10, 64 << 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(ioutil.Discard, r.Body)
+				if !tt.streamed {
+					_, _ = w.Write([]byte(strings.Repeat("o", tt.response)))
+					return
+				}
+				for sent := 0; sent < tt.response; sent += 4 << 10 {
+					_, _ = w.Write([]byte(strings.Repeat("o", 4<<10)))
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer backend.Close()
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://"))()
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(tt.method, "/room", strings.NewReader(strings.Repeat("i", tt.body))))
+			if w.Code != http.StatusOK || w.Body.Len() != tt.response {
+				t.Fatalf("status %d with %d bytes, want %d with %d", w.Code, w.Body.Len(), http.StatusOK, tt.response)
+			}
+			want := backendUsage{Requests: 1, BytesIn: int64(tt.body), BytesOut: int64(tt.response)}
+			if u := serverPool.Backends()[0].usage.snapshot(); u != want {
+				t.Fatalf("usage %+v, want %+v", u, want)
+			}
+		})
+	}
+}
+
+func TestUsageCountsWebsockets(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String())()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	defer waitWebsockets(t, 0)
+	conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// a masked "hi" from the client, the backend sends its 7 byte frame
+	if _, err := conn.Write([]byte("\x81\x82\x00\x00\x00\x00hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(br, make([]byte, 7)); err != nil {
+		t.Fatal(err)
+	}
+	b := serverPool.Backends()[0]
+	want := backendUsage{Requests: 1, WebsocketBytesIn: 8, WebsocketBytesOut: 7}
+	deadline := time.Now().Add(2 * time.Second)
+	for b.usage.snapshot() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("usage %+v, want %+v", b.usage.snapshot(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteUsage(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b")()
+	dir, err := ioutil.TempDir("", "balancer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { usageFile = file }(usageFile)
+	usageFile = filepath.Join(dir, "usage.json")
+	a := serverPool.GetBackend("a")
+	a.usage = backendUsage{Requests: 3, BytesIn: 10, BytesOut: 20, WebsocketBytesIn: 30, WebsocketBytesOut: 40}
+	if err := writeUsage(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(usageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Backends map[string]backendUsage `json:"backends"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Backends["a"] != a.usage || got.Backends["b"] != (backendUsage{}) {
+		t.Fatalf("wrote %s", data)
+	}
+}
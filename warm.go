@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// warmConns is how many idle connections are opened ahead of traffic to each backend
+var warmConns = envInt("WARM_CONNS", 0)
+
+// warm opens idle keep-alive connections to the backend so the first rooms
+// don't pay for the handshakes. The backend only takes new rooms as a last
+// resort until it's done.
+func (b *Backend) warm() {
+	// a backend discovered at startup or flapping could be warmed twice at once
+	if b.warmConns <= 0 || !b.startWarming() {
+		return
+	}
+	defer b.setWarming(false)
+	// concurrent requests can't share a connection, so each one opens its own
+	var wg sync.WaitGroup
+	for i := 0; i < b.warmConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodHead, b.URL.String()+b.httpProbe.path, nil)
+			if err != nil {
+				return
+			}
+			resp, err := b.transport.RoundTrip(req)
+			if err != nil {
+				log.Printf("[%s] Warming up failed: %s\n", b.ID, err.Error())
+				return
+			}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	log.Printf("[%s] Warmed up %d connections\n", b.ID, b.warmConns)
+}
+
+// startWarming flags the backend as warming, false when it already was
+func (b *Backend) startWarming() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.warming {
+		return false
+	}
+	b.warming = true
+	return true
+}
+
+func (b *Backend) setWarming(warming bool) {
+	b.mux.Lock()
+	b.warming = warming
+	b.mux.Unlock()
+}
+
+// IsWarming returns true while the backend's connections are being opened
+func (b *Backend) IsWarming() (warming bool) {
+	b.mux.RLock()
+	warming = b.warming
+	b.mux.RUnlock()
+	return
+}
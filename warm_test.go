@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingServer counts the connections opened to it
+func countingServer(conns *int64) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(conns, 1)
+		}
+	}
+	s.Start()
+	return s
+}
+
+func TestWarmOpensConnections(t *testing.T) {
+	tests := []struct {
+		name  string
+		warm  int
+		conns int64 // connections open after warming and serving a request
+	}{
+		{"disabled", 0, 1},
+		{"one", 1, 1},
+		{"several", 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns int64
+			backend := countingServer(&conns)
+			defer backend.Close()
+			defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?warm="+strconv.Itoa(tt.warm))()
+			b := serverPool.Backends()[0]
+			b.warm()
+			if n := atomic.LoadInt64(&conns); n != int64(tt.warm) {
+				t.Fatalf("warming opened %d connections, want %d", n, tt.warm)
+			}
+			if b.IsWarming() {
+				t.Fatal("still warming once done")
+			}
+			// the first room rides on a warm connection
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+			}
+			if n := atomic.LoadInt64(&conns); n != tt.conns {
+				t.Fatalf("%d connections after the first room, want %d", n, tt.conns)
+			}
+		})
+	}
+}
+
+func TestWarmOnRecovery(t *testing.T) {
+	var conns int64
+	backend := countingServer(&conns)
+	defer backend.Close()
+	defer setPool(t, strings.TrimPrefix(backend.URL, "http://")+"?check=tcp&warm=3")()
+	b := serverPool.Backends()[0]
+	b.SetAlive(false)
+	for i := 0; i < healthyThreshold; i++ {
+		serverPool.HealthCheck()
+	}
+	if !b.IsAlive() {
+		t.Fatal("backend didn't come back")
+	}
+	// each tcp check opens one of its own
+	want := int64(healthyThreshold + 3)
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&conns) < want || b.IsWarming() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections opened after recovering, want %d", atomic.LoadInt64(&conns), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWarmingTakesRoomsLast(t *testing.T) {
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b")()
+	a := serverPool.GetBackend("a")
+	a.setWarming(true)
+	for i := 0; i < 4; i++ {
+		if peer := serverPool.GetNextPeer(); peer != serverPool.GetBackend("b") {
+			t.Fatalf("new room went to %q while a warms up, want b", idOf(peer))
+		}
+	}
+	// nobody else can take it
+	serverPool.GetBackend("b").SetAlive(false)
+	if peer := serverPool.GetNextPeer(); peer != a {
+		t.Fatalf("new room went to %q, want the warming a", idOf(peer))
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServeWS proxies a websocket upgrade over a raw connection to the backend,
+// piping bytes both ways until either side closes
+func (b *Backend) ServeWS(w http.ResponseWriter, r *http.Request) {
+	// each websocket holds a client and a backend descriptor until it closes
+	if !acquireSlot(&websockets, maxWebsockets) {
+		log.Printf("%s(%s) Too many websockets open\n", r.RemoteAddr, r.URL.Path)
+		shed(w)
+		return
+	}
+	metrics.SetGauge("lb_websockets_active", float64(atomic.LoadInt64(&websockets)))
+	defer func() {
+		releaseSlot(&websockets)
+		metrics.SetGauge("lb_websockets_active", float64(atomic.LoadInt64(&websockets)))
+	}()
+	if class := GetRouteFromContext(r); maxConnsPerRoom > 0 && (class == RouteConnect || class == RouteAction) {
+		roomId := requestRoomId(r, class)
+		if !roomConns.Acquire(roomId, maxConnsPerRoom) {
+			log.Printf("%s(%s) Room %s is full\n", r.RemoteAddr, r.URL.Path, roomId)
+			writeError(w, errRoomFull)
+			return
+		}
+		defer roomConns.Release(roomId)
+	}
+	backendConn, err := b.dialWSRetrying(r)
+	if err != nil {
+		log.Printf("[%s] %s\n", b.URL.Host, err.Error())
+		// after the retries, mark this backend as down like the http proxy does
+		if r.Context().Err() == nil {
+			ejectBackend(b)
+		}
+		writeError(w, errUpstream)
+		return
+	}
+
+	// forward the handshake and wait for the backend to accept it
+	outreq := r.Clone(r.Context())
+	b.rewritePath(outreq.URL)
+	b.setHost(outreq)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outreq.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+	filterRequestHeaders(outreq.Header)
+	backendBuf := bufio.NewReader(backendConn)
+	var resp *http.Response
+	if wsHandshakeTimeout > 0 {
+		_ = backendConn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
+	}
+	if err = outreq.Write(backendConn); err == nil {
+		resp, err = http.ReadResponse(backendBuf, outreq)
+	}
+	// the websocket lives as long as its peers want it to
+	if err == nil {
+		err = backendConn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = backendConn.Close()
+		log.Printf("[%s] %s\n", b.URL.Host, err.Error())
+		writeError(w, errUpstream)
+		return
+	}
+	if trace := getTrace(r); trace != nil {
+		trace.served = true
+	}
+	filterResponseHeaders(resp.Header)
+	// clients offering only the routing hint need it echoed to accept the upgrade
+	if proto := routingSubprotocol(r); proto != "" && resp.Header.Get("Sec-WebSocket-Protocol") == "" {
+		resp.Header.Set("Sec-WebSocket-Protocol", proto)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the backend refused the upgrade, relay its answer as is
+		defer backendConn.Close()
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		_ = backendConn.Close()
+		writeError(w, errNoWebsockets)
+		return
+	}
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		_ = backendConn.Close()
+		log.Printf("%s(%s) Hijack failed: %s\n", r.RemoteAddr, r.URL.Path, err.Error())
+		return
+	}
+	atomic.AddInt64(&b.activeConns, 1)
+	defer atomic.AddInt64(&b.activeConns, -1)
+
+	if err := writeSwitchingProtocols(clientConn, resp); err != nil {
+		_ = clientConn.Close()
+		_ = backendConn.Close()
+		log.Printf("%s(%s) Handshake failed: %s\n", r.RemoteAddr, r.URL.Path, err.Error())
+		return
+	}
+	roomId := requestRoomId(r, GetRouteFromContext(r))
+	opened := time.Now()
+	debugf("%s(%s) Websocket to %s opened: room=%s client=%s backend=%s\n",
+		r.RemoteAddr, r.URL.Path, b.URL.Host, roomId, clientIP(r), b.ID)
+
+	// whichever side stops first closes both, then the other copy is joined
+	client := &wsPeer{name: "client", conn: clientConn}
+	backend := &wsPeer{name: "backend", conn: backendConn, masked: true}
+	done := make(chan string, 2)
+	go func() {
+		done <- closeReason("client", pipeWS(backend, clientBuf.Reader, client, &b.usage.WebsocketBytesIn))
+	}()
+	go func() {
+		done <- closeReason("backend", pipeWS(client, backendBuf, backend, &b.usage.WebsocketBytesOut))
+	}()
+	stop := make(chan struct{})
+	// why the balancer closed the websocket itself, if it did
+	var forced atomic.Value
+	for _, peer := range []*wsPeer{client, backend} {
+		if pingsPeer(peer.name) {
+			go peer.keepAlive(stop, func(p *wsPeer) {
+				forced.Store(p.name + " missed its pong")
+				_ = clientConn.Close()
+				_ = backendConn.Close()
+			})
+		}
+	}
+	if wsDrainCloseAfter > 0 {
+		go b.closeOnDrain(client, stop, func() {
+			forced.Store("client asked to reconnect, backend draining")
+			_ = backendConn.Close()
+		})
+	}
+	reason := <-done
+	close(stop)
+	_ = clientConn.Close()
+	_ = backendConn.Close()
+	<-done
+	if f, ok := forced.Load().(string); ok {
+		reason = f
+	}
+	log.Printf("%s(%s) Websocket to %s closed: %s, room=%s client=%s backend=%s duration=%s bytes_in=%d bytes_out=%d\n",
+		r.RemoteAddr, r.URL.Path, b.URL.Host, reason, roomId, clientIP(r), b.ID, time.Since(opened).Round(time.Millisecond),
+		atomic.LoadInt64(&client.sent), atomic.LoadInt64(&backend.sent))
+}
+
+// wsSubprotocolRouting lets clients pick the room of a connection with a subprotocol
+var wsSubprotocolRouting = envBool("WS_SUBPROTOCOL_ROUTING", false)
+
+// wsSubprotocolPrefix marks the subprotocol carrying the room id, e.g. room.42
+var wsSubprotocolPrefix = envString("WS_SUBPROTOCOL_PREFIX", "room.")
+
+// routingSubprotocol returns the requested subprotocol carrying a room id, if any
+func routingSubprotocol(r *http.Request) string {
+	if !wsSubprotocolRouting {
+		return ""
+	}
+	for _, value := range r.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+		for _, proto := range strings.Split(value, ",") {
+			proto = strings.TrimSpace(proto)
+			if strings.HasPrefix(proto, wsSubprotocolPrefix) && len(proto) > len(wsSubprotocolPrefix) {
+				return proto
+			}
+		}
+	}
+	return ""
+}
+
+// wsDialRetries is how many times a failed websocket dial is retried
+var wsDialRetries = envInt("WS_DIAL_RETRIES", 3)
+
+// wsDialBackoff is the wait before the first dial retry, doubling on each one
+var wsDialBackoff = envDuration("WS_DIAL_BACKOFF", 10*time.Millisecond)
+
+// wsConnectTimeout bounds opening a websocket's connection to the backend,
+// TLS included, so a dead backend fails fast
+var wsConnectTimeout = envDuration("WS_CONNECT_TIMEOUT", 5*time.Second)
+
+// wsHandshakeTimeout bounds forwarding the upgrade and reading the backend's
+// answer, 0 leaves it unbounded. Established websockets have no deadline.
+var wsHandshakeTimeout = envDuration("WS_HANDSHAKE_TIMEOUT", 10*time.Second)
+
+// dialWSRetrying dials the backend retrying with backoff, which is only
+// safe before the handshake is forwarded
+func (b *Backend) dialWSRetrying(r *http.Request) (net.Conn, error) {
+	backoff := wsDialBackoff
+	conn, err := b.dialWS(r)
+	for retry := 0; err != nil && retry < wsDialRetries; retry++ {
+		log.Printf("[%s] %s, retrying websocket dial\n", b.URL.Host, err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		backoff *= 2
+		conn, err = b.dialWS(r)
+	}
+	return conn, err
+}
+
+// dialWS opens a raw connection to the backend
+func (b *Backend) dialWS(r *http.Request) (net.Conn, error) {
+	if err := b.injectDialFault(r); err != nil {
+		return nil, err
+	}
+	return b.dial(wsConnectTimeout)
+}
+
+// dial opens a connection to the backend, over TLS when it's secure
+func (b *Backend) dial(timeout time.Duration) (net.Conn, error) {
+	conn, err := b.dialTimeout("tcp", b.URL.Host, timeout)
+	if err != nil || b.URL.Scheme != "https" {
+		return conn, err
+	}
+	// tls goes on top so it also works through a proxy's tunnel
+	tlsConn := tls.Client(conn, b.clientTLSConfig())
+	_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// writeSwitchingProtocols relays the backend's handshake response to the client
+func writeSwitchingProtocols(conn net.Conn, resp *http.Response) error {
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(conn); err != nil {
+		return err
+	}
+	_, err := io.WriteString(conn, "\r\n")
+	return err
+}
+
+// copyConn pipes src into dst until either fails, counting the bytes copied
+func copyConn(dst io.Writer, src io.Reader, count *int64) error {
+	_, err := io.Copy(dst, countBytes(ioutil.NopCloser(src), count))
+	return err
+}
+
+// closeReason describes why one direction of a websocket stopped
+func closeReason(side string, err error) string {
+	if err == nil {
+		return side + " closed"
+	}
+	return side + " error: " + err.Error()
+}
+
+// ActiveConns returns the number of websockets currently open to this backend
+func (b *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&b.activeConns)
+}
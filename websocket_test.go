@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wsBackend accepts websocket upgrades, sends a text frame and then either
+// drops the connection or waits for the client to go away
+func wsBackend(t *testing.T, drop func(conn *net.TCPConn)) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				_, _ = conn.Write([]byte("\x81\x05hello"))
+				if drop != nil {
+					drop(conn.(*net.TCPConn))
+					return
+				}
+				_, _ = io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// openWS sends a websocket upgrade for path to the balancer at url with the
+// extra header lines, returning the connection and the balancer's answer
+func openWS(t *testing.T, url, path, header string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: lb\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+header+"\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// waitWebsockets waits for the websockets open to come down to n, their
+// handlers are done with once they're not counted anymore
+func waitWebsockets(t *testing.T, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&websockets) > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d websockets open, want %d", atomic.LoadInt64(&websockets), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebsocketCloseReleasesEverything(t *testing.T) {
+	tests := []struct {
+		name       string
+		drop       func(conn *net.TCPConn)
+		clientDrop bool
+	}{
+		{"backend closes", func(conn *net.TCPConn) {}, false},
+		{"backend resets", func(conn *net.TCPConn) { _ = conn.SetLinger(0) }, false},
+		{"client drops", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := wsBackend(t, tt.drop)
+			defer backend.Close()
+			defer setPool(t, backend.Addr().String())()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			front := httptest.NewServer(http.HandlerFunc(lb))
+			defer front.Close()
+			b := serverPool.Backends()[0]
+			open := atomic.LoadInt64(&websockets)
+			goroutines := runtime.NumGoroutine()
+
+			conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			frame := make([]byte, 7)
+			if _, err := io.ReadFull(br, frame); err != nil || string(frame[2:]) != "hello" {
+				t.Fatalf("read %q (%v), want the backend's frame", frame, err)
+			}
+			if tt.clientDrop {
+				conn.Close()
+			} else {
+				// the balancer closes the client once the backend is gone
+				_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				if _, err := io.Copy(ioutil.Discard, br); err != nil {
+					t.Fatalf("client wasn't closed after the backend: %v", err)
+				}
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for b.ActiveConns() != 0 || atomic.LoadInt64(&websockets) != open || runtime.NumGoroutine() > goroutines {
+				if time.Now().After(deadline) {
+					t.Fatalf("after closing: %d active connections, %d websockets (want %d), %d goroutines (want %d)",
+						b.ActiveConns(), atomic.LoadInt64(&websockets), open, runtime.NumGoroutine(), goroutines)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestWebsocketDialRetries(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer func(retries int, backoff time.Duration) { wsDialRetries, wsDialBackoff = retries, backoff }(wsDialRetries, wsDialBackoff)
+	wsDialRetries, wsDialBackoff = 3, time.Millisecond
+	tests := []struct {
+		name    string
+		refused int64 // dials the backend refuses before accepting
+		code    int
+		alive   bool
+	}{
+		{"first dial", 0, http.StatusSwitchingProtocols, true},
+		{"after a refusal", 1, http.StatusSwitchingProtocols, true},
+		{"on the last retry", 3, http.StatusSwitchingProtocols, true},
+		{"retries exhausted", 4, statusUpstreamError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a proxy in front of the backend refuses the first dials
+			proxy := newConnectProxy(t)
+			defer proxy.listener.Close()
+			proxy.refuse = tt.refused
+			defer setPool(t, backend.Addr().String()+"?proxy="+proxy.URL())()
+			defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+			front := httptest.NewServer(http.HandlerFunc(lb))
+			defer front.Close()
+
+			conn, _, resp := openWS(t, front.URL, "/ws/1", "")
+			defer conn.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+			if alive := serverPool.Backends()[0].IsAlive(); alive != tt.alive {
+				t.Fatalf("backend alive = %v, want %v", alive, tt.alive)
+			}
+			// once the handshake is forwarded nothing is dialed again
+			if n := atomic.LoadInt64(&proxy.tunnels); tt.alive && n != 1 {
+				t.Fatalf("%d dials got through, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRoutingSubprotocol(t *testing.T) {
+	defer func(enabled bool) { wsSubprotocolRouting = enabled }(wsSubprotocolRouting)
+	tests := []struct {
+		name    string
+		enabled bool
+		offered []string // Sec-WebSocket-Protocol values
+		proto   string
+	}{
+		{"disabled", false, []string{"room.42"}, ""},
+		{"none offered", true, nil, ""},
+		{"only the hint", true, []string{"room.42"}, "room.42"},
+		{"among others", true, []string{"chat, room.42 , binary"}, "room.42"},
+		{"in a later header", true, []string{"chat", "room.7"}, "room.7"},
+		{"bare prefix", true, []string{"room."}, ""},
+		{"other protocols", true, []string{"chat, binary"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsSubprotocolRouting = tt.enabled
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			for _, v := range tt.offered {
+				r.Header.Add("Sec-WebSocket-Protocol", v)
+			}
+			if proto := routingSubprotocol(r); proto != tt.proto {
+				t.Fatalf("routingSubprotocol = %q, want %q", proto, tt.proto)
+			}
+		})
+	}
+}
+
+func TestSubprotocolRouting(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer func(enabled bool) { wsSubprotocolRouting = enabled }(wsSubprotocolRouting)
+	wsSubprotocolRouting = true
+	// room 30001 maps to the fourth backend, the only one that answers
+	defer setPool(t, "localhost:9101?name=a", "localhost:9102?name=b", "localhost:9103?name=c", backend.Addr().String()+"?name=d")()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	tests := []struct {
+		name    string
+		path    string
+		offered string
+		backend string
+	}{
+		{"hint alone", "/ws", "room.30001", "d"},
+		{"hint beside the game's protocol", "/ws", "game.v2, room.30001", "d"},
+		{"hint over the path", "/ws/1", "room.30001", "d"},
+		{"path without a hint", "/ws/1", "game.v2", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set("Sec-WebSocket-Protocol", tt.offered)
+			d, err := route(withDryRun(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idOf(d.Backend) != tt.backend {
+				t.Fatalf("routed to %q, want %q", idOf(d.Backend), tt.backend)
+			}
+		})
+	}
+
+	// the hint is echoed when the backend doesn't pick a subprotocol itself
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	conn, _, resp := openWS(t, front.URL, "/ws", "Sec-WebSocket-Protocol: room.30001\r\n")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if proto := resp.Header.Get("Sec-WebSocket-Protocol"); proto != "room.30001" {
+		t.Fatalf("negotiated %q, want room.30001", proto)
+	}
+}
+
+func TestWebsocketCap(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String())()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(max int) { maxWebsockets = max }(maxWebsockets)
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name     string
+		max      int
+		upgrades int
+		accepted int
+	}{
+		{"unlimited", 0, 5, 5},
+		{"under the cap", 5, 4, 4},
+		{"at the cap", 3, 3, 3},
+		{"over the cap", 3, 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the next case changes the cap the handlers read
+			defer waitWebsockets(t, 0)
+			maxWebsockets = tt.max
+			var open []net.Conn
+			defer func() {
+				for _, conn := range open {
+					conn.Close()
+				}
+			}()
+			accepted := 0
+			for i := 0; i < tt.upgrades; i++ {
+				conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+				if resp.StatusCode != http.StatusSwitchingProtocols {
+					conn.Close()
+					if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+						t.Fatalf("upgrade %d: status %d with Retry-After %q, want %d with one",
+							i, resp.StatusCode, resp.Header.Get("Retry-After"), http.StatusServiceUnavailable)
+					}
+					continue
+				}
+				open = append(open, conn)
+				accepted++
+				frame := make([]byte, 7)
+				if _, err := io.ReadFull(br, frame); err != nil {
+					t.Fatalf("upgrade %d: %v", i, err)
+				}
+			}
+			if accepted != tt.accepted {
+				t.Fatalf("%d upgrades accepted, want %d", accepted, tt.accepted)
+			}
+			if n := atomic.LoadInt64(&websockets); n != int64(accepted) {
+				t.Fatalf("%d websockets counted, want %d", n, accepted)
+			}
+			// the websockets already open carry on past the cap
+			for i, conn := range open {
+				_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+				if _, err := conn.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+					t.Fatalf("websocket %d closed: %v", i, err)
+				}
+			}
+			if tt.accepted == tt.upgrades {
+				return
+			}
+			// a closed websocket makes room for the next
+			open[0].Close()
+			open = open[1:]
+			waitWebsockets(t, int64(tt.max)-1)
+			conn, _, resp := openWS(t, front.URL, "/ws/1", "")
+			open = append(open, conn)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d after a websocket closed, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+		})
+	}
+}
+
+func TestRoomConnCap(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String())()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(max int) { maxConnsPerRoom = max }(maxConnsPerRoom)
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name     string
+		max      int
+		rooms    string // room of each upgrade
+		accepted string // + for an accepted upgrade, - for a full room
+	}{
+		{"unlimited", 0, "11111", "+++++"},
+		{"one room over", 2, "1111", "++--"},
+		{"rooms apart", 2, "121212", "++++--"},
+		{"a full room leaves others", 1, "1123", "+-++"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the next case changes the cap the handlers read
+			defer waitWebsockets(t, 0)
+			maxConnsPerRoom = tt.max
+			open := make(map[byte][]net.Conn)
+			defer func() {
+				for _, conns := range open {
+					for _, conn := range conns {
+						conn.Close()
+					}
+				}
+			}()
+			var accepted []byte
+			for i := 0; i < len(tt.rooms); i++ {
+				room := tt.rooms[i]
+				conn, br, resp := openWS(t, front.URL, "/ws/"+string(room), "")
+				if resp.StatusCode != http.StatusSwitchingProtocols {
+					conn.Close()
+					if resp.StatusCode != errRoomFull.Status {
+						t.Fatalf("upgrade %d: status %d, want %d", i, resp.StatusCode, errRoomFull.Status)
+					}
+					accepted = append(accepted, '-')
+					continue
+				}
+				open[room] = append(open[room], conn)
+				accepted = append(accepted, '+')
+				if _, err := io.ReadFull(br, make([]byte, 7)); err != nil {
+					t.Fatalf("upgrade %d: %v", i, err)
+				}
+			}
+			if string(accepted) != tt.accepted {
+				t.Fatalf("upgrades %s, want %s", accepted, tt.accepted)
+			}
+			if tt.max == 0 {
+				return
+			}
+			// a closed websocket makes room in its room only
+			room := tt.rooms[0]
+			open[room][0].Close()
+			open[room] = open[room][1:]
+			waitWebsockets(t, int64(strings.Count(string(accepted), "+"))-1)
+			conn, _, resp := openWS(t, front.URL, "/ws/"+string(room), "")
+			open[room] = append(open[room], conn)
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d after a websocket of the room closed, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+		})
+	}
+	roomConns.mux.Lock()
+	defer roomConns.mux.Unlock()
+	if len(roomConns.counts) != 0 {
+		t.Fatalf("rooms still counted after every websocket closed: %v", roomConns.counts)
+	}
+}
+
+func TestWebsocketLifecycleLog(t *testing.T) {
+	backend := wsBackend(t, nil)
+	defer backend.Close()
+	defer setPool(t, backend.Addr().String()+"?name=game-1")()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(level string, drainClose time.Duration) {
+		logLevel, wsDrainCloseAfter = level, drainClose
+	}(logLevel, wsDrainCloseAfter)
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	// a masked text frame of 5 bytes, 11 bytes in all
+	frame := []byte("\x81\x85\x00\x00\x00\x00howdy")
+	tests := []struct {
+		name   string
+		level  string
+		framed bool // relayed frame by frame
+		frames int  // sent by the client
+		opened bool // whether the open is logged
+	}{
+		{"info", "info", false, 2, false},
+		{"debug", "debug", false, 2, true},
+		{"nothing sent", "debug", false, 0, true},
+		{"framed", "debug", true, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out syncBuffer
+			log.SetOutput(&out)
+			defer log.SetOutput(os.Stderr)
+			logLevel = tt.level
+			wsDrainCloseAfter = 0
+			if tt.framed {
+				// never reached, but it has frames relayed one by one
+				wsDrainCloseAfter = time.Hour
+			}
+			conn, br, resp := openWS(t, front.URL, "/ws/7", "")
+			// the next case changes the settings the handler reads
+			defer waitWebsockets(t, 0)
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			if _, err := io.ReadFull(br, make([]byte, 7)); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.frames; i++ {
+				if _, err := conn.Write(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// let the backend read them before the client goes away
+			time.Sleep(20 * time.Millisecond)
+			conn.Close()
+			waitWebsockets(t, 0)
+			logged := out.String()
+			opened := regexp.MustCompile(`\(/ws/7\) Websocket to \S+ opened: room=7 client=127\.0\.0\.1 backend=game-1\n`)
+			if opened.MatchString(logged) != tt.opened {
+				t.Fatalf("open logged = %v, want %v:\n%s", !tt.opened, tt.opened, logged)
+			}
+			closed := regexp.MustCompile(`\(/ws/7\) Websocket to \S+ closed: .+, room=7 client=127\.0\.0\.1 backend=game-1 ` +
+				`duration=\d+ms bytes_in=(\d+) bytes_out=(\d+)\n`).FindStringSubmatch(logged)
+			if closed == nil {
+				t.Fatalf("no close logged:\n%s", logged)
+			}
+			// the backend sent a 7 byte hello
+			if in, out := closed[1], closed[2]; in != strconv.Itoa(tt.frames*len(frame)) || out != "7" {
+				t.Fatalf("logged %s bytes in and %s out, want %d and 7", in, out, tt.frames*len(frame))
+			}
+		})
+	}
+}
+
+func TestWebsocketTimeouts(t *testing.T) {
+	defer func(connect, handshake time.Duration, retries int) {
+		wsConnectTimeout, wsHandshakeTimeout, wsDialRetries = connect, handshake, retries
+	}(wsConnectTimeout, wsHandshakeTimeout, wsDialRetries)
+	wsDialRetries = 0
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name      string
+		stalls    bool // whether the backend never answers
+		secure    bool // whether the connection includes a TLS handshake
+		connect   time.Duration
+		handshake time.Duration
+		code      int
+	}{
+		{"tls never done", true, true, 50 * time.Millisecond, 0, statusUpstreamError},
+		{"upgrade never answered", true, false, time.Second, 50 * time.Millisecond, statusUpstreamError},
+		{"established outlives both", false, false, 30 * time.Millisecond, 30 * time.Millisecond, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsConnectTimeout, wsHandshakeTimeout = tt.connect, tt.handshake
+			if tt.secure {
+				defer setEnv("SECURE_LAYER", "1")()
+			}
+			backend := wsBackend(t, nil)
+			if tt.stalls {
+				backend.Close()
+				backend = stallingListener(t)
+			}
+			defer backend.Close()
+			defer setPool(t, backend.Addr().String())()
+			started := time.Now()
+			conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+			// the next case changes the timeouts the handler reads
+			defer waitWebsockets(t, 0)
+			defer conn.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.code)
+			}
+			if tt.stalls {
+				timeout := tt.connect
+				if !tt.secure {
+					timeout = tt.handshake
+				}
+				if took := time.Since(started); took < timeout || took > timeout+time.Second/2 {
+					t.Fatalf("gave up after %s, want about %s", took, timeout)
+				}
+				return
+			}
+			if _, err := io.ReadFull(br, make([]byte, 7)); err != nil {
+				t.Fatal(err)
+			}
+			// well past both timeouts the websocket is still open both ways
+			time.Sleep(5 * tt.handshake)
+			if _, err := conn.Write([]byte("\x81\x85\x00\x00\x00\x00howdy")); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+			if _, err := br.ReadByte(); err == nil || !err.(net.Error).Timeout() {
+				t.Fatalf("websocket closed: %v", err)
+			}
+		})
+	}
+}
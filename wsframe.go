@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// wsPingInterval is how often websocket peers are pinged to keep idle
+// connections open through intermediaries, 0 disables it
+var wsPingInterval = envDuration("WS_PING_INTERVAL", 0)
+
+// wsPongTimeout is how long a pinged peer has to answer before the
+// websocket is closed
+var wsPongTimeout = envDuration("WS_PONG_TIMEOUT", 10*time.Second)
+
+// wsPingPeers are the sides of a websocket that get pinged, client and/or backend
+var wsPingPeers = envList("WS_PING_PEERS")
+
+// Websocket opcodes the balancer looks at
+const (
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// wsPingPayload tells the pongs answering the balancer's pings apart from
+// the ones the other side is waiting for
+var wsPingPayload = []byte("lb-keepalive")
+
+// wsPeer is one side of a proxied websocket
+type wsPeer struct {
+	name   string // client or backend
+	conn   net.Conn
+	masked bool       // frames sent by the balancer must be masked, towards the backend
+	mux    sync.Mutex // frames written to conn don't interleave
+	pinged int64      // unix nanoseconds of the unanswered ping, 0 when none
+	sent   int64      // bytes it sent through the balancer
+}
+
+// pingsPeer returns true when the named side of websockets gets pinged
+func pingsPeer(name string) bool {
+	if wsPingInterval <= 0 {
+		return false
+	}
+	if len(wsPingPeers) == 0 {
+		return name == "client"
+	}
+	for _, peer := range wsPingPeers {
+		if peer == name {
+			return true
+		}
+	}
+	return false
+}
+
+// wsFramed returns true when the balancer may send frames of its own, then
+// websockets are relayed frame by frame so they can be slipped in between
+func wsFramed() bool {
+	return wsPingInterval > 0 || wsDrainCloseAfter > 0
+}
+
+// pipeWS relays what from sends to dst until either fails, counting the
+// bytes. With keepalives or drain closes on it goes frame by frame, so
+// frames can be slipped in between and pongs caught.
+func pipeWS(dst *wsPeer, src io.Reader, from *wsPeer, count *int64) error {
+	src = countBytes(ioutil.NopCloser(src), &from.sent)
+	if !wsFramed() {
+		return copyConn(dst.conn, src, count)
+	}
+	src = countBytes(ioutil.NopCloser(src), count)
+	for {
+		header, opcode, length, mask, err := readWSFrameHeader(src)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if opcode == wsOpPong && length <= 125 {
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(src, payload); err != nil {
+				return err
+			}
+			atomic.StoreInt64(&from.pinged, 0)
+			if bytes.Equal(unmaskWS(payload, mask), wsPingPayload) {
+				continue
+			}
+			// a pong for the other side's own ping, the masked payload goes as it came
+			if err := dst.write(append(header, payload...)); err != nil {
+				return err
+			}
+			continue
+		}
+		dst.mux.Lock()
+		_, err = dst.conn.Write(header)
+		if err == nil {
+			_, err = io.CopyN(dst.conn, src, length)
+		}
+		dst.mux.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readWSFrameHeader reads the header of the next frame, returning it as it
+// came along with the opcode, payload length and masking key
+func readWSFrameHeader(r io.Reader) (header []byte, opcode byte, length int64, mask []byte, err error) {
+	header = make([]byte, 2, 14)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0F
+	length = int64(header[1] & 0x7F)
+	extra := 0
+	switch length {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	masked := header[1]&0x80 != 0
+	if masked {
+		extra += 4
+	}
+	header = header[:2+extra]
+	if _, err = io.ReadFull(r, header[2:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(header[2:10]))
+	}
+	if masked {
+		mask = header[len(header)-4:]
+	}
+	return
+}
+
+// unmaskWS returns a copy of payload unmasked with mask
+func unmaskWS(payload, mask []byte) []byte {
+	unmasked := make([]byte, len(payload))
+	for i := range payload {
+		unmasked[i] = payload[i]
+		if mask != nil {
+			unmasked[i] ^= mask[i%4]
+		}
+	}
+	return unmasked
+}
+
+// write sends a whole frame to the peer
+func (p *wsPeer) write(frame []byte) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	_, err := p.conn.Write(frame)
+	return err
+}
+
+// ping sends the peer a keepalive ping, masked when it goes to the backend
+func (p *wsPeer) ping() error {
+	frame := []byte{0x80 | wsOpPing, byte(len(wsPingPayload))}
+	payload := wsPingPayload
+	if p.masked {
+		mask := make([]byte, 4)
+		binary.BigEndian.PutUint32(mask, rand.Uint32())
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		payload = unmaskWS(payload, mask)
+	}
+	return p.write(append(frame, payload...))
+}
+
+// close sends the peer a close frame with a code and reason
+func (p *wsPeer) close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	frame := []byte{0x80 | wsOpClose, byte(len(payload))}
+	if p.masked {
+		mask := make([]byte, 4)
+		binary.BigEndian.PutUint32(mask, rand.Uint32())
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		payload = unmaskWS(payload, mask)
+	}
+	return p.write(append(frame, payload...))
+}
+
+// keepAlive pings the peer every wsPingInterval until stop is closed, and
+// calls missed when a ping goes unanswered for wsPongTimeout
+func (p *wsPeer) keepAlive(stop <-chan struct{}, missed func(p *wsPeer)) {
+	t := time.NewTicker(wsPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		// a ping still waiting for its pong has its own deadline running
+		if atomic.LoadInt64(&p.pinged) != 0 {
+			continue
+		}
+		sent := time.Now().UnixNano()
+		atomic.StoreInt64(&p.pinged, sent)
+		if err := p.ping(); err != nil {
+			return
+		}
+		time.AfterFunc(wsPongTimeout, func() {
+			select {
+			case <-stop:
+			default:
+				if atomic.LoadInt64(&p.pinged) == sent {
+					missed(p)
+				}
+			}
+		})
+	}
+}
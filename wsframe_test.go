@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadWSFrameHeader(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name   string
+		frame  []byte
+		header int // bytes of it
+		opcode byte
+		length int64
+		mask   []byte
+		err    error
+	}{
+		{"text", []byte{0x81, 5, 'h', 'e', 'l', 'l', 'o'}, 2, 0x1, 5, nil, nil},
+		{"masked ping", append([]byte{0x89, 0x80 | 4}, mask...), 6, wsOpPing, 4, mask, nil},
+		{"16 bit length", []byte{0x82, 126, 0x01, 0x00}, 4, 0x2, 256, nil, nil},
+		{"64 bit length", []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}, 10, 0x2, 65536, nil, nil},
+		{"masked 16 bit length", append([]byte{0x82, 0x80 | 126, 0x01, 0x00}, mask...), 8, 0x2, 256, mask, nil},
+		{"nothing", nil, 0, 0, 0, nil, io.EOF},
+		{"cut short", []byte{0x81}, 0, 0, 0, nil, io.ErrUnexpectedEOF},
+		{"length cut short", []byte{0x82, 126, 0x01}, 0, 0, 0, nil, io.ErrUnexpectedEOF},
+		{"mask cut short", []byte{0x89, 0x80 | 4, 1, 2}, 0, 0, 0, nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, opcode, length, gotMask, err := readWSFrameHeader(bytes.NewReader(tt.frame))
+			if err != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(header, tt.frame[:tt.header]) {
+				t.Fatalf("header %v, want %v", header, tt.frame[:tt.header])
+			}
+			if opcode != tt.opcode || length != tt.length || !bytes.Equal(gotMask, tt.mask) {
+				t.Fatalf("opcode %x length %d mask %v, want %x %d %v", opcode, length, gotMask, tt.opcode, tt.length, tt.mask)
+			}
+		})
+	}
+}
+
+func TestPingsPeer(t *testing.T) {
+	defer func(interval time.Duration, peers []string) { wsPingInterval, wsPingPeers = interval, peers }(wsPingInterval, wsPingPeers)
+	tests := []struct {
+		interval        time.Duration
+		peers           []string
+		client, backend bool
+	}{
+		{0, nil, false, false},
+		{0, []string{"client", "backend"}, false, false},
+		{time.Second, nil, true, false},
+		{time.Second, []string{"backend"}, false, true},
+		{time.Second, []string{"client", "backend"}, true, true},
+	}
+	for _, tt := range tests {
+		wsPingInterval, wsPingPeers = tt.interval, tt.peers
+		if client, backend := pingsPeer("client"), pingsPeer("backend"); client != tt.client || backend != tt.backend {
+			t.Errorf("interval %s peers %v: pings client %v backend %v, want %v %v", tt.interval, tt.peers, client, backend, tt.client, tt.backend)
+		}
+	}
+}
+
+// readWSFrame reads the next frame off r, unmasking its payload
+func readWSFrame(r io.Reader) (opcode byte, masked bool, payload []byte, err error) {
+	_, opcode, length, mask, err := readWSFrameHeader(r)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, false, nil, err
+	}
+	return opcode, mask != nil, unmaskWS(payload, mask), nil
+}
+
+// pong returns a pong frame for payload, masked like the frames of clients
+func pong(payload []byte, masked bool) []byte {
+	if !masked {
+		return append([]byte{0x80 | wsOpPong, byte(len(payload))}, payload...)
+	}
+	mask := []byte{7, 1, 9, 3}
+	frame := append([]byte{0x80 | wsOpPong, 0x80 | byte(len(payload))}, mask...)
+	return append(frame, unmaskWS(payload, mask)...)
+}
+
+// pongBackend accepts websocket upgrades and reports the pings it gets,
+// answering them when answer is set
+func pongBackend(t *testing.T, answer bool, pings chan<- bool) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				for {
+					opcode, masked, payload, err := readWSFrame(br)
+					if err != nil {
+						return
+					}
+					if opcode != wsOpPing {
+						continue
+					}
+					pings <- masked
+					if answer {
+						_, _ = conn.Write(pong(payload, false))
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestWebsocketKeepalive(t *testing.T) {
+	defer func(interval, timeout time.Duration, peers []string) {
+		wsPingInterval, wsPongTimeout, wsPingPeers = interval, timeout, peers
+	}(wsPingInterval, wsPongTimeout, wsPingPeers)
+	wsPingInterval, wsPongTimeout = 20*time.Millisecond, 60*time.Millisecond
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	front := httptest.NewServer(http.HandlerFunc(lb))
+	defer front.Close()
+	tests := []struct {
+		name   string
+		peer   string // pinged
+		answer bool
+		open   bool // still open after many pong timeouts
+	}{
+		{"client answers", "client", true, true},
+		{"client stays silent", "client", false, false},
+		{"backend answers", "backend", true, true},
+		{"backend stays silent", "backend", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wsPingPeers = []string{tt.peer}
+			pings := make(chan bool, 100)
+			backend := pongBackend(t, tt.answer, pings)
+			defer backend.Close()
+			defer setPool(t, backend.Addr().String())()
+			conn, br, resp := openWS(t, front.URL, "/ws/1", "")
+			// the next case changes the settings the handler reads
+			defer waitWebsockets(t, 0)
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+			clientPings := 0
+			deadline := time.Now().Add(10 * wsPongTimeout)
+			_ = conn.SetReadDeadline(deadline)
+			var closed error
+			for closed == nil {
+				var opcode byte
+				var payload []byte
+				var masked bool
+				opcode, masked, payload, closed = readWSFrame(br)
+				if closed != nil {
+					break
+				}
+				if opcode != wsOpPing || masked || !bytes.Equal(payload, wsPingPayload) {
+					t.Fatalf("client got opcode %x masked %v payload %q, want the balancer's ping", opcode, masked, payload)
+				}
+				clientPings++
+				if tt.answer {
+					if _, err := conn.Write(pong(payload, true)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			timedOut := false
+			if err, ok := closed.(net.Error); ok && err.Timeout() {
+				timedOut = true
+			}
+			if timedOut != tt.open {
+				t.Fatalf("open after %s: %v (%v), want %v", 10*wsPongTimeout, timedOut, closed, tt.open)
+			}
+			backendPings := len(pings)
+			for i := 0; i < backendPings; i++ {
+				if masked := <-pings; !masked {
+					t.Fatal("ping to the backend wasn't masked")
+				}
+			}
+			pinged := clientPings
+			if tt.peer == "backend" {
+				pinged = backendPings
+				if clientPings != 0 {
+					t.Fatalf("client pinged %d times, want only the backend", clientPings)
+				}
+			} else if backendPings != 0 {
+				t.Fatalf("backend pinged %d times, want only the client", backendPings)
+			}
+			// answered pings keep coming, a missed one is the last
+			if tt.answer && pinged < 5 || !tt.answer && pinged != 1 {
+				t.Fatalf("%s pinged %d times", tt.peer, pinged)
+			}
+		})
+	}
+}
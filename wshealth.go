@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// wsHealthCheckPath is upgraded to a websocket by the websocket check, which
+// runs along the regular one when set. A backend can answer http and still
+// fail websockets.
+var wsHealthCheckPath = envString("WS_HEALTH_CHECK_PATH", "")
+
+// createRequiresWS keeps backends failing the websocket check from taking
+// new rooms, their clients couldn't connect to them
+var createRequiresWS = envBool("CREATE_REQUIRES_WS", true)
+
+// IsWSAlive returns false when the backend failed its last websocket check
+func (b *Backend) IsWSAlive() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return !b.wsDown
+}
+
+// probeWS runs the websocket check of the backend, if it has one, and
+// records the result
+func (b *Backend) probeWS() {
+	if b.wsProbePath == "" {
+		return
+	}
+	err := b.upgradeWS(b.wsProbePath)
+	b.mux.Lock()
+	wasDown := b.wsDown
+	b.wsDown = err != nil
+	b.mux.Unlock()
+	if err != nil && !wasDown {
+		log.Printf("[%s] websocket check failed, %s\n", b.ID, err.Error())
+	} else if err == nil && wasDown {
+		log.Printf("[%s] websocket check passed again\n", b.ID)
+	}
+}
+
+// upgradeWS opens a websocket on path and closes it right away
+func (b *Backend) upgradeWS(path string) error {
+	conn, err := b.dial(healthCheckConnectTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(healthCheckTimeout))
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, b.URL.String()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("upgrade answered with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsHealthBackend answers http with its name and accepts websocket upgrades
+// only when upgrades is set
+func wsHealthBackend(name string, upgrades bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocket(r) {
+			io.WriteString(w, name)
+			return
+		}
+		if !upgrades {
+			http.Error(w, "websockets are broken", http.StatusBadRequest)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	}))
+}
+
+func TestCreateSkipsWebsocketDown(t *testing.T) {
+	wsDown := wsHealthBackend("a", false)
+	defer wsDown.Close()
+	healthy := wsHealthBackend("b", true)
+	defer healthy.Close()
+	defer setRoomRoutes(t, "", RoomIdInt, defaultRoomIdSource)()
+	defer func(requires bool) { createRequiresWS = requires }(createRequiresWS)
+	tests := []struct {
+		name     string
+		requires bool
+		created  string // backends new rooms land on
+	}{
+		{"guarded", true, "b"},
+		{"unguarded", false, "a,b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			createRequiresWS = tt.requires
+			defer setPool(t, strings.TrimPrefix(wsDown.URL, "http://")+"?name=a&ws_probe_path=/ws",
+				strings.TrimPrefix(healthy.URL, "http://")+"?name=b&ws_probe_path=/ws")()
+			serverPool.HealthCheck()
+			a, b := serverPool.GetBackend("a"), serverPool.GetBackend("b")
+			if !a.IsAlive() || a.IsWSAlive() || !b.IsAlive() || !b.IsWSAlive() {
+				t.Fatalf("a alive %v ws %v, b alive %v ws %v, want a http only and b both",
+					a.IsAlive(), a.IsWSAlive(), b.IsAlive(), b.IsWSAlive())
+			}
+			created := make(map[string]bool)
+			for i := 0; i < 6; i++ {
+				w := httptest.NewRecorder()
+				lb(w, httptest.NewRequest(http.MethodPost, "/room", nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+				}
+				created[w.Body.String()] = true
+			}
+			var got []string
+			for _, name := range []string{"a", "b"} {
+				if created[name] {
+					got = append(got, name)
+				}
+			}
+			if strings.Join(got, ",") != tt.created {
+				t.Fatalf("new rooms landed on %v, want %s", got, tt.created)
+			}
+			// the rooms it already has are still served
+			w := httptest.NewRecorder()
+			lb(w, httptest.NewRequest(http.MethodGet, "/room/1/state", nil))
+			if w.Code != http.StatusOK || w.Body.String() != "a" {
+				t.Fatalf("room of a got %d from %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+// Policies for when no backend of the balancer's zone can take a new room
+const (
+	ZoneSpillover = "spillover"
+	ZoneStrict    = "strict"
+)
+
+// localZone is the zone the balancer runs in, new rooms prefer backends of
+// the same zone. Empty disables zone awareness.
+var localZone = envString("LB_ZONE", "")
+
+// zonePolicy is whether new rooms spill over to other zones or stay local
+var zonePolicy = envString("ZONE_POLICY", ZoneSpillover)
+
+// isValidZonePolicy returns true for the supported ZONE_POLICY values
+func isValidZonePolicy(policy string) bool {
+	return policy == ZoneSpillover || policy == ZoneStrict
+}
+
+// localPool returns the backends of the balancer's zone as a pool of their
+// own, nil when there's none
+func localPool(backends []*Backend) *ServerPool {
+	if localZone == "" {
+		return nil
+	}
+	var local []*Backend
+	for _, b := range backends {
+		if b.GetZone() == localZone {
+			local = append(local, b)
+		}
+	}
+	if len(local) == 0 {
+		return nil
+	}
+	return newSubPool(local)
+}
+
+// preferLocal runs pick on the backends of the balancer's zone first, and on
+// every backend when none of them can take the room and spilling over is allowed
+func (s *ServerPool) preferLocal(pick func(*ServerPool) *Backend) *Backend {
+	if localZone == "" {
+		return pick(s)
+	}
+	if local := s.Local(); local != nil {
+		if peer := pick(local); peer != nil {
+			return peer
+		}
+	}
+	if zonePolicy == ZoneStrict {
+		return nil
+	}
+	return pick(s)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPreferLocalZone(t *testing.T) {
+	defer func(zone, policy, strategy string) { localZone, zonePolicy, lbStrategy = zone, policy, strategy }(localZone, zonePolicy, lbStrategy)
+	specs := []string{
+		"localhost:9101?name=a1&zone=a", "localhost:9102?name=a2&zone=a",
+		"localhost:9103?name=b1&zone=b", "localhost:9104?name=b2&zone=b",
+	}
+	tests := []struct {
+		name     string
+		zone     string
+		policy   string
+		strategy string
+		down     []string // backends unable to take rooms
+		full     []string // backends at capacity
+		want     string   // backends the new rooms land on
+	}{
+		{"zone unaware", "", ZoneSpillover, StrategyRoundRobin, nil, nil, "a1,a2,b1,b2"},
+		{"same zone", "a", ZoneSpillover, StrategyRoundRobin, nil, nil, "a1,a2"},
+		{"other zone", "b", ZoneSpillover, StrategyRoundRobin, nil, nil, "b1,b2"},
+		{"same zone least load", "a", ZoneSpillover, StrategyLeastLoad, nil, nil, "a1,a2"},
+		{"one local down", "a", ZoneSpillover, StrategyRoundRobin, []string{"a1"}, nil, "a2"},
+		{"local down spills over", "a", ZoneSpillover, StrategyRoundRobin, []string{"a1", "a2"}, nil, "b1,b2"},
+		{"local full spills over", "a", ZoneSpillover, StrategyRoundRobin, nil, []string{"a1", "a2"}, "b1,b2"},
+		{"local down spills over least load", "a", ZoneSpillover, StrategyLeastLoad, []string{"a1", "a2"}, nil, "b1,b2"},
+		{"local down stays strict", "a", ZoneStrict, StrategyRoundRobin, []string{"a1", "a2"}, nil, ""},
+		{"local full stays strict", "a", ZoneStrict, StrategyRoundRobin, nil, []string{"a1", "a2"}, ""},
+		{"strict with local room", "a", ZoneStrict, StrategyRoundRobin, []string{"a1"}, nil, "a2"},
+		{"zone without backends spills over", "c", ZoneSpillover, StrategyRoundRobin, nil, nil, "a1,a2,b1,b2"},
+		{"zone without backends stays strict", "c", ZoneStrict, StrategyRoundRobin, nil, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the local zone is picked out when the pool is set
+			localZone, zonePolicy, lbStrategy = tt.zone, tt.policy, tt.strategy
+			defer setPool(t, specs...)()
+			for _, id := range tt.down {
+				serverPool.GetBackend(id).SetAlive(false)
+			}
+			for _, id := range tt.full {
+				b := serverPool.GetBackend(id)
+				b.setCapacity(1)
+				b.roomLoad.Add(1)
+			}
+			picked := make(map[string]bool)
+			for i := 0; i < 8; i++ {
+				peer := pickRoomPeer(httptest.NewRequest(http.MethodPost, "/room", nil))
+				if peer == nil {
+					continue
+				}
+				picked[peer.ID] = true
+				// least load spreads only once rooms add load
+				peer.roomLoad.Add(1)
+			}
+			var ids []string
+			for id := range picked {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			if got := strings.Join(ids, ","); got != tt.want {
+				t.Fatalf("new rooms landed on %q, want %q", got, tt.want)
+			}
+		})
+	}
+}